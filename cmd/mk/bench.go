@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/daicang/mk/pkg/bench"
+)
+
+// runBench loads records into the DB file and runs a workload on it,
+// records overwrite keys of earlier runs.
+func runBench(w io.Writer, args []string) error {
+	cfg := bench.DefaultConfig("A")
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	fs.StringVar(&cfg.Workload, "workload", cfg.Workload, "YCSB workload A-F, seqwrite, randwrite, read, scan or mixed")
+	fs.IntVar(&cfg.RecordCount, "records", cfg.RecordCount, "keys loaded before running")
+	fs.IntVar(&cfg.OperationCount, "ops", cfg.OperationCount, "operations to run")
+	fs.IntVar(&cfg.Concurrency, "concurrency", cfg.Concurrency, "concurrent workers")
+	fs.IntVar(&cfg.KeySize, "key-size", cfg.KeySize, "key length in bytes, keys are padded to it")
+	fs.IntVar(&cfg.ValueSize, "value-size", cfg.ValueSize, "value length in bytes")
+	fs.IntVar(&cfg.BatchSize, "batch", cfg.BatchSize, "writes per transaction")
+	fs.IntVar(&cfg.LoadBatchSize, "load-batch", cfg.LoadBatchSize, "pairs per transaction while loading")
+	fs.IntVar(&cfg.ScanLength, "scan-length", cfg.ScanLength, "keys per scan")
+	fs.BoolVar(&cfg.Zipfian, "zipfian", cfg.Zipfian, "choose keys with zipfian distribution")
+	fs.Int64Var(&cfg.Seed, "seed", cfg.Seed, "random seed")
+	asJSON := fs.Bool("json", false, "print result in JSON")
+	err := fs.Parse(args)
+	if err != nil || fs.NArg() != 1 {
+		flags := strings.Builder{}
+		fs.SetOutput(&flags)
+		fs.PrintDefaults()
+		return fmt.Errorf("%w: mk bench [flags] <file>\n%s", errUsage, flags.String())
+	}
+	if _, ok := bench.Workloads[cfg.Workload]; !ok {
+		return fmt.Errorf("%w: %q", bench.ErrUnknownWorkload, cfg.Workload)
+	}
+
+	d, err := openOrCreate(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	err = bench.Load(d, cfg)
+	if err != nil {
+		return closeAfter(d, fmt.Errorf("load: %w", err))
+	}
+	res, err := bench.Run(d, cfg)
+	if err != nil {
+		return closeAfter(d, err)
+	}
+	if *asJSON {
+		err = res.WriteJSON(w)
+	} else {
+		err = res.WriteText(w)
+	}
+	return closeAfter(d, err)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/daicang/mk/pkg/bench"
+)
+
+func TestBench(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data")
+	out := mustRun(t, "bench", "-workload", "mixed", "-records", "200", "-ops", "100",
+		"-key-size", "24", "-value-size", "50", "-batch", "10", path)
+	for _, s := range []string{"Workload:    mixed", "ops/sec", "P99", "read"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("Bench output misses %q:\n%s", s, out)
+		}
+	}
+
+	out = mustRun(t, "bench", "-workload", "seqwrite", "-records", "10", "-ops", "20", "-json", path)
+	res := bench.Result{}
+	if err := json.Unmarshal([]byte(out), &res); err != nil || res.Ops[bench.OpInsert].Count != 20 {
+		t.Errorf("Bad JSON output: %v %s", err, out)
+	}
+	if out := mustRun(t, "get", path, "user0000000010"); out != strings.Repeat("\x00", 100)+"\n" {
+		t.Errorf("Expect inserted key, get %q", out)
+	}
+
+	if err := run([]string{"bench", "-workload", "Z", path}, &bytes.Buffer{}); !errors.Is(err, bench.ErrUnknownWorkload) {
+		t.Errorf("Expect ErrUnknownWorkload, get %v", err)
+	}
+	err := run([]string{"bench", "-ops"}, &bytes.Buffer{})
+	if !errors.Is(err, errUsage) || !strings.Contains(err.Error(), "-batch") {
+		t.Errorf("Expect usage with flags, get %v", err)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/daicang/mk/pkg/db"
+	"github.com/daicang/mk/pkg/kv"
+)
+
+var (
+	// errKeyNotFound is returned by get and del for missing key.
+	errKeyNotFound = errors.New("key not found")
+)
+
+func runGet(w io.Writer, args []string) error {
+	return view(args[0], func(tx *db.Tx) error {
+		v := tx.Get(kv.Key(args[1]))
+		if v == nil {
+			return fmt.Errorf("%w: %q", errKeyNotFound, args[1])
+		}
+		fmt.Fprintf(w, "%s\n", v)
+		return nil
+	})
+}
+
+func runSet(w io.Writer, args []string) error {
+	return update(args[0], true, func(tx *db.Tx) error {
+		_, err := tx.Set(kv.Key(args[1]), kv.Value(args[2]))
+		return err
+	})
+}
+
+func runDel(w io.Writer, args []string) error {
+	return update(args[0], false, func(tx *db.Tx) error {
+		old, err := tx.Remove(kv.Key(args[1]))
+		if err != nil {
+			return err
+		}
+		if old == nil {
+			return fmt.Errorf("%w: %q", errKeyNotFound, args[1])
+		}
+		return nil
+	})
+}
+
+// runScan prints "key<tab>value" lines in key order. Files ordered by
+// Options.Compare fail to open, so keys with prefix are a range.
+func runScan(w io.Writer, args []string) error {
+	fs := flag.NewFlagSet("scan", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	prefix := fs.String("prefix", "", "only print keys with this prefix")
+	err := fs.Parse(args)
+	if err != nil || fs.NArg() != 1 {
+		return fmt.Errorf("%w: mk scan [--prefix p] <file>", errUsage)
+	}
+	r := kv.PrefixRange(kv.Key(*prefix))
+	return view(fs.Arg(0), func(tx *db.Tx) error {
+		return tx.Scan(r.Start, r.End, func(k kv.Key, v kv.Value) error {
+			_, err := fmt.Fprintf(w, "%s\t%s\n", k, v)
+			return err
+		})
+	})
+}
+
+// runWarm reads pages of keys with prefix into OS page cache, e.g.
+// before starting a server on the file, prints the page count.
+func runWarm(w io.Writer, args []string) error {
+	fs := flag.NewFlagSet("warm", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	prefix := fs.String("prefix", "", "only warm pages of keys with this prefix")
+	err := fs.Parse(args)
+	if err != nil || fs.NArg() != 1 {
+		return fmt.Errorf("%w: mk warm [--prefix p] <file>", errUsage)
+	}
+	d, err := openDB(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%d pages\n", d.Warm(kv.Key(*prefix)))
+	return d.Close()
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/daicang/mk/pkg/db"
+)
+
+func TestData(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data")
+	if err := run([]string{"del", path, "a"}, &bytes.Buffer{}); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expect ErrNotExist for del on missing file, get %v", err)
+	}
+
+	// set creates the file
+	mustRun(t, "set", path, "fruit/apple", "red")
+	mustRun(t, "set", path, "fruit/banana", "yellow")
+	mustRun(t, "set", path, "veg/carrot", "orange")
+	mustRun(t, "set", path, "fruit/apple", "green")
+
+	if out := mustRun(t, "get", path, "fruit/apple"); out != "green\n" {
+		t.Errorf("Expect green, get %q", out)
+	}
+	if err := run([]string{"get", path, "fruit/cherry"}, &bytes.Buffer{}); !errors.Is(err, errKeyNotFound) {
+		t.Errorf("Expect errKeyNotFound, get %v", err)
+	}
+
+	out := mustRun(t, "scan", path)
+	expect := "fruit/apple\tgreen\nfruit/banana\tyellow\nveg/carrot\torange\n"
+	if out != expect {
+		t.Errorf("Expect scan output %q, get %q", expect, out)
+	}
+	out = mustRun(t, "scan", "--prefix", "fruit/", path)
+	expect = "fruit/apple\tgreen\nfruit/banana\tyellow\n"
+	if out != expect {
+		t.Errorf("Expect prefix scan output %q, get %q", expect, out)
+	}
+	if err := run([]string{"scan", "--limit", "1", path}, &bytes.Buffer{}); !errors.Is(err, errUsage) {
+		t.Errorf("Expect errUsage for unknown flag, get %v", err)
+	}
+	if err := run([]string{"scan"}, &bytes.Buffer{}); !errors.Is(err, errUsage) {
+		t.Errorf("Expect errUsage without file, get %v", err)
+	}
+
+	var all, veg int
+	if _, err := fmt.Sscanf(mustRun(t, "warm", path), "%d pages", &all); err != nil || all == 0 {
+		t.Errorf("Expect pages warmed, get %d: %v", all, err)
+	}
+	if _, err := fmt.Sscanf(mustRun(t, "warm", "--prefix", "veg/", path), "%d pages", &veg); err != nil || veg == 0 || veg > all {
+		t.Errorf("Expect pages of prefix warmed, get %d of %d: %v", veg, all, err)
+	}
+	if err := run([]string{"warm", "--prefix"}, &bytes.Buffer{}); !errors.Is(err, errUsage) {
+		t.Errorf("Expect errUsage for warm without file, get %v", err)
+	}
+
+	mustRun(t, "del", path, "fruit/apple")
+	if err := run([]string{"del", path, "fruit/apple"}, &bytes.Buffer{}); !errors.Is(err, errKeyNotFound) {
+		t.Errorf("Expect errKeyNotFound for removed key, get %v", err)
+	}
+	if out := mustRun(t, "scan", "--prefix", "fruit/", path); out != "fruit/banana\tyellow\n" {
+		t.Errorf("Bad scan after del: %q", out)
+	}
+
+	// Files in another key order are refused
+	reverse := filepath.Join(t.TempDir(), "reverse")
+	d, err := db.Open(db.Options{
+		Path:        reverse,
+		Compare:     func(a, b []byte) int { return bytes.Compare(b, a) },
+		CompareName: "reverse",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	err = run([]string{"scan", "--prefix", "fruit/", reverse}, &bytes.Buffer{})
+	if !errors.Is(err, db.ErrComparatorMismatch) {
+		t.Errorf("Expect ErrComparatorMismatch for file in reverse order, get %v", err)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/daicang/mk/pkg/common"
+	"github.com/daicang/mk/pkg/db"
+	"github.com/daicang/mk/pkg/freelist"
+	"github.com/daicang/mk/pkg/page"
+)
+
+// maxDumpValue is the longest value printed by dump, longer ones
+// are cut.
+const maxDumpValue = 64
+
+func runInfo(w io.Writer, args []string) error {
+	return view(args[0], func(tx *db.Tx) error {
+		info := tx.Info()
+		fmt.Fprintf(w, "Format:        %d\n", info.FormatVersion)
+		fmt.Fprintf(w, "Page size:     %d\n", info.PageSize)
+		fmt.Fprintf(w, "Meta pages:    %d\n", info.MetaPages)
+		fmt.Fprintf(w, "Total pages:   %d\n", info.TotalPages)
+		fmt.Fprintf(w, "Free pages:    %d\n", info.FreePages)
+		fmt.Fprintf(w, "Freelist page: %d\n", info.FreelistPage)
+		fmt.Fprintf(w, "Root page:     %d\n", info.RootPage)
+		fmt.Fprintf(w, "Txid:          %d\n", info.TxID)
+		fmt.Fprintf(w, "Sequence:      %d\n", info.Sequence)
+		fmt.Fprintf(w, "Keys:          %d\n", tx.Count())
+		return nil
+	})
+}
+
+func runPages(w io.Writer, args []string) error {
+	return view(args[0], func(tx *db.Tx) error {
+		fmt.Fprintf(w, "%-8s %-10s %8s %8s\n", "ID", "TYPE", "COUNT", "OVERFLOW")
+		for _, p := range tx.Pages() {
+			fmt.Fprintf(w, "%-8d %-10s %8d %8d\n", p.ID, p.Type, p.Count, p.Overflow)
+		}
+		return nil
+	})
+}
+
+// runDump reads the page from file directly, so it works on files
+// which fail to open.
+func runDump(w io.Writer, args []string) error {
+	id, err := strconv.ParseUint(args[1], 10, 32)
+	if err != nil {
+		return fmt.Errorf("%w: bad pgid %q", errUsage, args[1])
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	buf, err := readPage(f, common.Pgid(id))
+	if err != nil {
+		return err
+	}
+	p := page.FromBuffer(buf, 0)
+	fmt.Fprintf(w, "Page %d: type=%s count=%d overflow=%d\n", p.Index(), p.Type(), p.Count(), p.Overflow())
+	fmt.Fprint(w, hex.Dump(buf))
+	return decodePage(w, p, len(buf))
+}
+
+// readPage reads page id and the pages it covers from f.
+func readPage(f *os.File, id common.Pgid) ([]byte, error) {
+	buf := make([]byte, page.PageSize)
+	offset := int64(id) * int64(page.PageSize)
+	_, err := f.ReadAt(buf, offset)
+	if err != nil {
+		return nil, fmt.Errorf("read page %d: %w", id, err)
+	}
+	overflow := page.FromBuffer(buf, 0).Overflow()
+	if overflow <= 0 {
+		return buf, nil
+	}
+	// Overflow of a corrupted page may be anything, ReadAt returns
+	// EOF when it goes beyond the file.
+	buf = make([]byte, (overflow+1)*page.PageSize)
+	_, err = f.ReadAt(buf, offset)
+	if err != nil {
+		return nil, fmt.Errorf("read page %d with %d overflow: %w", id, overflow, err)
+	}
+	return buf, nil
+}
+
+// decodePage prints content of page p held by size bytes.
+func decodePage(w io.Writer, p *page.Page, size int) error {
+	switch p.Type() {
+	case "meta":
+		m, err := db.ReadMeta(p)
+		fmt.Fprintf(w, "%v\n", m)
+		return err
+	case "freelist":
+		if page.HeaderSize+p.Count()*8 > size {
+			return fmt.Errorf("%w: %d free slots beyond page", db.ErrInvalidDB, p.Count())
+		}
+		f := freelist.NewFreelist()
+		f.ReadPage(p)
+		fmt.Fprintf(w, "free: %v\n", f.IDs())
+	case "internal":
+		for i := 0; i < p.Count(); i++ {
+			fmt.Fprintf(w, "%d: %q -> %d\n", i, p.GetKeyAt(i), p.GetChildPgid(i))
+		}
+	case "leaf":
+		for i := 0; i < p.Count(); i++ {
+			if head := p.GetOverflowAt(i); head != 0 {
+				fmt.Fprintf(w, "%d: %q = <%d bytes in overflow page %d>\n",
+					i, p.GetKeyAt(i), p.GetValueSizeAt(i), head)
+				continue
+			}
+			v := p.GetValueAt(i)
+			if len(v) > maxDumpValue {
+				fmt.Fprintf(w, "%d: %q = %q... (%d bytes)\n", i, p.GetKeyAt(i), v[:maxDumpValue], len(v))
+				continue
+			}
+			fmt.Fprintf(w, "%d: %q = %q\n", i, p.GetKeyAt(i), v)
+		}
+	case "overflow":
+		fmt.Fprintf(w, "next: %d\n", p.GetOverflowNext())
+	}
+	return nil
+}
+
+func runCheck(w io.Writer, args []string) error {
+	return view(args[0], func(tx *db.Tx) error {
+		count := 0
+		for err := range tx.Check() {
+			fmt.Fprintln(w, err)
+			count++
+		}
+		if count > 0 {
+			return fmt.Errorf("%w: %d problems found", db.ErrInvalidDB, count)
+		}
+		fmt.Fprintln(w, "OK")
+		return nil
+	})
+}
+
+func runAnalyze(w io.Writer, args []string) error {
+	return view(args[0], func(tx *db.Tx) error {
+		fmt.Fprint(w, tx.Analyze().String())
+		return nil
+	})
+}
+
+func runFrag(w io.Writer, args []string) error {
+	d, err := openDB(args[0])
+	if err != nil {
+		return err
+	}
+	r, err := d.FragmentationReport()
+	if err == nil {
+		fmt.Fprint(w, r.String())
+	}
+	return closeAfter(d, err)
+}
+
+func runCompact(w io.Writer, args []string) error {
+	src, dst := args[0], args[1]
+	d, err := openDB(src)
+	if err != nil {
+		return err
+	}
+	err = d.Compact(dst)
+	cerr := d.Close()
+	if err != nil {
+		return err
+	}
+	if cerr != nil {
+		return cerr
+	}
+	before, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	after, err := os.Stat(dst)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%d -> %d bytes\n", before.Size(), after.Size())
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/daicang/mk/pkg/db"
+	"github.com/daicang/mk/pkg/page"
+)
+
+// createDB creates a DB file with some pairs, returns its path.
+func createDB(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "data")
+	d, err := db.Open(db.Options{Path: path})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	err = d.Update(func(tx *db.Tx) error {
+		for i := 0; i < 1000; i++ {
+			_, err := tx.Set([]byte(fmt.Sprintf("key-%04d", i)), []byte("value"))
+			if err != nil {
+				return err
+			}
+		}
+		_, err := tx.Set([]byte("large"), bytes.Repeat([]byte("x"), page.PageSize))
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Failed to update: %v", err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	return path
+}
+
+// mustRun runs command line, returns output.
+func mustRun(t *testing.T, args ...string) string {
+	t.Helper()
+	buf := bytes.Buffer{}
+	if err := run(args, &buf); err != nil {
+		t.Fatalf("%v: %v", args, err)
+	}
+	return buf.String()
+}
+
+func TestInspect(t *testing.T) {
+	path := createDB(t)
+
+	out := mustRun(t, "info", path)
+	if !strings.Contains(out, "Keys:          1001") {
+		t.Errorf("Bad info:\n%s", out)
+	}
+	out = mustRun(t, "pages", path)
+	for _, typ := range []string{"meta", "freelist", "internal", "leaf", "overflow"} {
+		if !strings.Contains(out, typ) {
+			t.Errorf("Pages misses %s:\n%s", typ, out)
+		}
+	}
+	out = mustRun(t, "dump", path, "0")
+	if !strings.Contains(out, "type=meta") || !strings.Contains(out, "txid=") {
+		t.Errorf("Bad meta dump:\n%s", out)
+	}
+	if out := mustRun(t, "check", path); out != "OK\n" {
+		t.Errorf("Bad check output:\n%s", out)
+	}
+	out = mustRun(t, "analyze", path)
+	if !strings.Contains(out, "leaf pairs") {
+		t.Errorf("Bad analyze output:\n%s", out)
+	}
+	out = mustRun(t, "frag", path)
+	if !strings.Contains(out, "overflow ratio") || !strings.Contains(out, "wasted bytes") {
+		t.Errorf("Bad frag output:\n%s", out)
+	}
+
+	if err := run([]string{"dump", path, "x"}, &bytes.Buffer{}); !errors.Is(err, errUsage) {
+		t.Errorf("Expect errUsage for bad pgid, get %v", err)
+	}
+	if err := run([]string{"dump", path, "100000"}, &bytes.Buffer{}); err == nil {
+		t.Error("Expect error for page beyond file")
+	}
+}
+
+func TestDumpLeaf(t *testing.T) {
+	path := createDB(t)
+	leaf := ""
+	out := mustRun(t, "pages", path)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 1 && fields[1] == "leaf" {
+			leaf = fields[0]
+			break
+		}
+	}
+	out = mustRun(t, "dump", path, leaf)
+	if !strings.Contains(out, "type=leaf") || !strings.Contains(out, `"key-`) {
+		t.Errorf("Bad leaf dump:\n%s", out)
+	}
+}
+
+func TestCheckCorrupted(t *testing.T) {
+	path := createDB(t)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	// An extra zero free slot makes meta page 0 also free
+	d, err := db.Open(db.Options{Path: path})
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	err = d.View(func(tx *db.Tx) error {
+		p := page.FromBuffer(data, tx.Info().FreelistPage)
+		p.SetCount(p.Count() + 1)
+		return nil
+	})
+	if err != nil || d.Close() != nil {
+		t.Fatalf("Failed to read info: %v", err)
+	}
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	buf := bytes.Buffer{}
+	err = run([]string{"check", path}, &buf)
+	if !errors.Is(err, db.ErrInvalidDB) || buf.Len() == 0 {
+		t.Errorf("Expect ErrInvalidDB with problems printed, get %v:\n%s", err, buf.String())
+	}
+}
+
+func TestCompact(t *testing.T) {
+	path := createDB(t)
+	dst := filepath.Join(t.TempDir(), "compacted")
+	out := mustRun(t, "compact", path, dst)
+	if !strings.Contains(out, "bytes") {
+		t.Errorf("Bad compact output: %s", out)
+	}
+	out = mustRun(t, "info", dst)
+	if !strings.Contains(out, "Keys:          1001") {
+		t.Errorf("Bad info of compacted file:\n%s", out)
+	}
+	if err := run([]string{"compact", path, dst}, &bytes.Buffer{}); err == nil {
+		t.Error("Expect error when target exists")
+	}
+}
@@ -0,0 +1,141 @@
+// Command mk inspects and maintains mk DB files.
+//
+// Usage:
+//
+//	mk <command> [arguments]
+//
+// Run mk without arguments to list commands.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/daicang/mk/pkg/db"
+	"github.com/daicang/mk/pkg/log"
+)
+
+var (
+	// errUsage is returned for bad command line.
+	errUsage = errors.New("usage")
+)
+
+// openTimeout is how long to wait for a DB locked by another process.
+const openTimeout = time.Second
+
+// command is one subcommand.
+type command struct {
+	name string
+	// args describes arguments in usage
+	args string
+	help string
+	// nargs is the number of arguments, -1 when command parses flags
+	// and checks arguments itself
+	nargs int
+	run   func(w io.Writer, args []string) error
+}
+
+var commands = []command{
+	{"info", "<file>", "print meta and page counts", 1, runInfo},
+	{"pages", "<file>", "list pages with type and count", 1, runPages},
+	{"dump", "<file> <pgid>", "print page in hex and decoded", 2, runDump},
+	{"check", "<file>", "check consistency of pages and tree", 1, runCheck},
+	{"analyze", "<file>", "print key, value and leaf size histograms", 1, runAnalyze},
+	{"frag", "<file>", "print free spans, overflow ratio and wasted bytes", 1, runFrag},
+	{"compact", "<src> <dst>", "copy live pairs into a new file", 2, runCompact},
+	{"get", "<file> <key>", "print value of key", 2, runGet},
+	{"set", "<file> <key> <value>", "set key to value, file is created if missing", 3, runSet},
+	{"del", "<file> <key>", "remove key", 2, runDel},
+	{"scan", "[--prefix p] <file>", "print pairs in key order, one per line", -1, runScan},
+	{"warm", "[--prefix p] <file>", "read pages of keys into OS page cache", -1, runWarm},
+	{"bench", "[flags] <file>", "load and run a workload, print ops/sec and latency", -1, runBench},
+}
+
+func main() {
+	err := run(os.Args[1:], os.Stdout)
+	if err != nil {
+		if errors.Is(err, errUsage) {
+			usage(os.Stderr)
+		}
+		fmt.Fprintf(os.Stderr, "mk: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// run runs command line args, writes output to w.
+func run(args []string, w io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%w: no command", errUsage)
+	}
+	for _, c := range commands {
+		if c.name != args[0] {
+			continue
+		}
+		if c.nargs >= 0 && len(args)-1 != c.nargs {
+			return fmt.Errorf("%w: mk %s %s", errUsage, c.name, c.args)
+		}
+		return c.run(w, args[1:])
+	}
+	return fmt.Errorf("%w: unknown command %q", errUsage, args[0])
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: mk <command> [arguments]\n\nCommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-8s %-22s %s\n", c.name, c.args, c.help)
+	}
+	fmt.Fprintln(w)
+}
+
+// openDB opens an existing DB file. Open creates missing files, so
+// check first to not leave an empty DB for a mistyped path.
+func openDB(path string) (*db.DB, error) {
+	_, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return openOrCreate(path)
+}
+
+// openOrCreate opens DB file, a new file is created if not exist.
+func openOrCreate(path string) (*db.DB, error) {
+	d, err := db.Open(db.Options{Path: path, Timeout: openTimeout, Logger: log.Global().Logr()})
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	return d, nil
+}
+
+// view runs fn in a read-only tx of DB at path.
+func view(path string, fn func(tx *db.Tx) error) error {
+	d, err := openDB(path)
+	if err != nil {
+		return err
+	}
+	return closeAfter(d, d.View(fn))
+}
+
+// update runs fn in a writable tx of DB at path.
+func update(path string, create bool, fn func(tx *db.Tx) error) error {
+	open := openDB
+	if create {
+		open = openOrCreate
+	}
+	d, err := open(path)
+	if err != nil {
+		return err
+	}
+	return closeAfter(d, d.Update(fn))
+}
+
+// closeAfter closes d, returns err, or close error if err is nil.
+func closeAfter(d *db.DB, err error) error {
+	cerr := d.Close()
+	if err == nil {
+		err = cerr
+	}
+	return err
+}
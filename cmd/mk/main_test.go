@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	bad := [][]string{
+		{},
+		{"unknown"},
+		{"info"},
+		{"dump", "file"},
+		{"compact", "a", "b", "c"},
+	}
+	for _, args := range bad {
+		if err := run(args, &bytes.Buffer{}); !errors.Is(err, errUsage) {
+			t.Errorf("%v: expect errUsage, get %v", args, err)
+		}
+	}
+
+	buf := bytes.Buffer{}
+	usage(&buf)
+	for _, c := range commands {
+		if !bytes.Contains(buf.Bytes(), []byte(c.name)) {
+			t.Errorf("Usage misses %s", c.name)
+		}
+	}
+}
+
+func TestOpenDB(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing")
+	if _, err := openDB(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expect ErrNotExist, get %v", err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Missing file should not be created, get %v", err)
+	}
+}
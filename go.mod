@@ -2,4 +2,7 @@ module github.com/daicang/mk
 
 go 1.15
 
-require github.com/google/gofuzz v1.2.0
+require (
+	github.com/go-logr/logr v1.2.3
+	github.com/google/gofuzz v1.2.0
+)
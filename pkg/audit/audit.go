@@ -0,0 +1,228 @@
+// Package audit writes and reads the append-only mutation audit stream.
+// The stream is split into segments named audit-NNNNNN.log, each holding
+// one JSON record per line. A new segment starts when the current one
+// exceeds the size limit.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	// OpSet records key set.
+	OpSet = "set"
+	// OpRemove records key removal.
+	OpRemove = "remove"
+	// OpMerge records merge operand of key, see db.Tx.Merge.
+	OpMerge = "merge"
+	// OpOption records runtime option change, key is option name.
+	OpOption = "option"
+
+	segmentPattern = "audit-*.log"
+	segmentFormat  = "audit-%06d.log"
+)
+
+// Record is one committed mutation.
+type Record struct {
+	TxID uint64    `json:"txid"`
+	Time time.Time `json:"ts"`
+	Op   string    `json:"op"`
+	Key  []byte    `json:"key"`
+	// ValueHash is sha256 of the new value or merge operand, empty
+	// for removal.
+	ValueHash []byte `json:"value_sha256,omitempty"`
+	// Detail describes non-mutation records, e.g. option change.
+	Detail string `json:"detail,omitempty"`
+}
+
+// NewRecord returns record of one mutation, value is nil for removal
+// and the operand for merge.
+func NewRecord(txid uint64, op string, key, value []byte) Record {
+	r := Record{
+		TxID: txid,
+		Op:   op,
+		Key:  append([]byte{}, key...),
+	}
+	if op == OpSet || op == OpMerge {
+		h := sha256.Sum256(value)
+		r.ValueHash = h[:]
+	}
+	return r
+}
+
+// NewOptionRecord returns record of one option change.
+func NewOptionRecord(txid uint64, name string, from, to interface{}) Record {
+	return Record{
+		TxID:   txid,
+		Op:     OpOption,
+		Key:    []byte(name),
+		Detail: fmt.Sprintf("%v -> %v", from, to),
+	}
+}
+
+// Writer appends records to segments in a directory.
+type Writer struct {
+	dir string
+	// Segment size limit in bytes
+	maxSize int64
+	// Current segment sequence number
+	seq  int
+	f    *os.File
+	size int64
+}
+
+// segments returns sorted segment paths in dir.
+func segments(dir string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, segmentPattern))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// OpenWriter opens writer appending to the last segment in dir.
+// maxSize <= 0 disables rotation.
+func OpenWriter(dir string, maxSize int64) (*Writer, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	paths, err := segments(dir)
+	if err != nil {
+		return nil, err
+	}
+	w := &Writer{
+		dir:     dir,
+		maxSize: maxSize,
+		seq:     1,
+	}
+	if len(paths) > 0 {
+		_, err = fmt.Sscanf(filepath.Base(paths[len(paths)-1]), segmentFormat, &w.seq)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = w.openSegment()
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Writer) openSegment() error {
+	path := filepath.Join(w.dir, fmt.Sprintf(segmentFormat, w.seq))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	w.f = f
+	w.size = info.Size()
+	return nil
+}
+
+// rotate closes current segment and starts next one.
+func (w *Writer) rotate() error {
+	err := w.f.Close()
+	if err != nil {
+		return err
+	}
+	w.seq++
+	return w.openSegment()
+}
+
+// Append writes records of one transaction and syncs.
+// Records without time are stamped with current time.
+// Records of one transaction never span segments.
+func (w *Writer) Append(records []Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+	now := time.Now()
+	if w.maxSize > 0 && w.size >= w.maxSize {
+		err := w.rotate()
+		if err != nil {
+			return err
+		}
+	}
+	buf := []byte{}
+	for _, r := range records {
+		if r.Time.IsZero() {
+			r.Time = now
+		}
+		line, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, line...)
+		buf = append(buf, '\n')
+	}
+	n, err := w.f.Write(buf)
+	w.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return w.f.Sync()
+}
+
+// SetMaxSize changes segment size limit, it applies from the next append.
+func (w *Writer) SetMaxSize(maxSize int64) {
+	w.maxSize = maxSize
+}
+
+// Close closes current segment.
+func (w *Writer) Close() error {
+	return w.f.Close()
+}
+
+// Read calls fn for every record in dir in append order,
+// stops at the first error returned by fn.
+func Read(dir string, fn func(Record) error) error {
+	paths, err := segments(dir)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		err = readSegment(path, fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readSegment(path string, fn func(Record) error) error {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	// A line is never longer than the segment
+	scanner.Buffer(make([]byte, 0, 64*1024), len(buf)+1)
+	for scanner.Scan() {
+		r := Record{}
+		err = json.Unmarshal(scanner.Bytes(), &r)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		err = fn(r)
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
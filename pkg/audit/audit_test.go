@@ -0,0 +1,78 @@
+package audit
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteRead(t *testing.T) {
+	dir := t.TempDir()
+	w, err := OpenWriter(dir, 512)
+	if err != nil {
+		t.Fatalf("Failed to open writer: %v", err)
+	}
+
+	txs := 20
+	for txid := 1; txid <= txs; txid++ {
+		records := []Record{
+			NewRecord(uint64(txid), OpSet, []byte(fmt.Sprintf("key-%d", txid)), []byte("value")),
+			NewRecord(uint64(txid), OpRemove, []byte("old"), nil),
+		}
+		err = w.Append(records)
+		if err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+
+	paths, _ := filepath.Glob(filepath.Join(dir, segmentPattern))
+	if len(paths) < 2 {
+		t.Errorf("Expect rotated segments, get %v", paths)
+	}
+
+	// Reopen continues the last segment
+	w, err = OpenWriter(dir, 512)
+	if err != nil {
+		t.Fatalf("Failed to reopen writer: %v", err)
+	}
+	err = w.Append([]Record{NewRecord(uint64(txs+1), OpSet, []byte("last"), nil)})
+	if err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+	w.Close()
+
+	records := []Record{}
+	err = Read(dir, func(r Record) error {
+		records = append(records, r)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if len(records) != 2*txs+1 {
+		t.Fatalf("Expect %d records, get %d", 2*txs+1, len(records))
+	}
+	hash := sha256.Sum256([]byte("value"))
+	for i, r := range records[:2*txs] {
+		txid := uint64(i/2 + 1)
+		if r.TxID != txid || r.Time.IsZero() {
+			t.Errorf("Record %d: bad txid or time: %+v", i, r)
+		}
+		if i%2 == 0 {
+			if r.Op != OpSet || !bytes.Equal(r.ValueHash, hash[:]) {
+				t.Errorf("Record %d: bad set record %+v", i, r)
+			}
+		} else if r.Op != OpRemove || r.ValueHash != nil {
+			t.Errorf("Record %d: bad remove record %+v", i, r)
+		}
+	}
+	if string(records[2*txs].Key) != "last" {
+		t.Errorf("Records out of order, last is %+v", records[2*txs])
+	}
+}
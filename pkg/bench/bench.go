@@ -0,0 +1,473 @@
+// Package bench runs YCSB-like workloads against DB, and single
+// operation ones which time writes, point reads and scans alone.
+package bench
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/daicang/mk/pkg/db"
+)
+
+// ErrUnknownWorkload is returned for workload not in Workloads.
+var ErrUnknownWorkload = errors.New("unknown workload")
+
+// Op is operation type.
+type Op string
+
+const (
+	// OpRead reads one key.
+	OpRead Op = "read"
+	// OpUpdate overwrites one existing key.
+	OpUpdate Op = "update"
+	// OpInsert inserts one new key.
+	OpInsert Op = "insert"
+	// OpScan reads a short run of consecutive keys.
+	OpScan Op = "scan"
+	// OpReadModifyWrite reads then updates one key.
+	OpReadModifyWrite Op = "rmw"
+)
+
+// Workload holds operation proportions, which sum to 1.
+type Workload struct {
+	Read            float64
+	Update          float64
+	Insert          float64
+	Scan            float64
+	ReadModifyWrite float64
+	// Latest makes reads prefer recently inserted keys.
+	Latest bool
+	// Hashed inserts records in hashed key order, like YCSB
+	// insertorder=hashed, instead of in key order.
+	Hashed bool
+}
+
+var (
+	// Workloads are the YCSB core workloads.
+	Workloads = map[string]Workload{
+		// Update heavy
+		"A": {Read: 0.5, Update: 0.5},
+		// Read mostly
+		"B": {Read: 0.95, Update: 0.05},
+		// Read only
+		"C": {Read: 1},
+		// Read latest
+		"D": {Read: 0.95, Insert: 0.05, Latest: true},
+		// Short ranges
+		"E": {Scan: 0.95, Insert: 0.05},
+		// Read-modify-write
+		"F": {Read: 0.5, ReadModifyWrite: 0.5},
+		// Sequential writes, appending to the last leaf
+		"seqwrite": {Insert: 1},
+		// Random writes, splitting leaves all over the tree
+		"randwrite": {Insert: 1, Hashed: true},
+		// Point reads
+		"read": {Read: 1},
+		// Scans only
+		"scan": {Scan: 1},
+		// Reads, writes and scans of random keys
+		"mixed": {Read: 0.4, Update: 0.3, Insert: 0.1, Scan: 0.2, Hashed: true},
+	}
+)
+
+// Config holds benchmark parameters.
+type Config struct {
+	// Workload name, one of Workloads
+	Workload string
+	// Keys loaded before running
+	RecordCount int
+	// Operations to run, shared by all workers
+	OperationCount int
+	// Concurrent workers
+	Concurrency int
+	// Key length in bytes, generated keys are padded to it
+	KeySize int
+	// Value length in bytes
+	ValueSize int
+	// Keys per scan
+	ScanLength int
+	// Pairs written per transaction in load phase
+	LoadBatchSize int
+	// Write operations per transaction in run phase, the operation
+	// filling a transaction is timed with its commit
+	BatchSize int
+	// Zipfian key choice instead of uniform
+	Zipfian bool
+	// Random seed
+	Seed int64
+}
+
+// DefaultConfig returns config for a small run of given workload.
+func DefaultConfig(workload string) Config {
+	return Config{
+		Workload:       workload,
+		RecordCount:    10000,
+		OperationCount: 10000,
+		Concurrency:    1,
+		ValueSize:      100,
+		ScanLength:     10,
+		LoadBatchSize:  1000,
+		BatchSize:      1,
+		Seed:           1,
+	}
+}
+
+// OpResult holds latency summary of one operation type.
+type OpResult struct {
+	Count int           `json:"count"`
+	Mean  time.Duration `json:"mean_ns"`
+	P50   time.Duration `json:"p50_ns"`
+	P99   time.Duration `json:"p99_ns"`
+	Max   time.Duration `json:"max_ns"`
+}
+
+// Result is machine-readable benchmark output.
+type Result struct {
+	Workload    string           `json:"workload"`
+	Concurrency int              `json:"concurrency"`
+	Operations  int              `json:"operations"`
+	Duration    time.Duration    `json:"duration_ns"`
+	OpsPerSec   float64          `json:"ops_per_sec"`
+	P99         time.Duration    `json:"p99_ns"`
+	Ops         map[Op]*OpResult `json:"ops"`
+	Config      Config           `json:"config"`
+	latencies   map[Op][]time.Duration
+}
+
+// WriteJSON writes result as one JSON document.
+func (r *Result) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// WriteText writes result as a table of operation latencies.
+func (r *Result) WriteText(w io.Writer) error {
+	fmt.Fprintf(w, "Workload:    %s\n", r.Workload)
+	fmt.Fprintf(w, "Operations:  %d in %v\n", r.Operations, r.Duration)
+	fmt.Fprintf(w, "Throughput:  %.0f ops/sec\n", r.OpsPerSec)
+	fmt.Fprintf(w, "P99 latency: %v\n\n", r.P99)
+	ops := make([]string, 0, len(r.Ops))
+	for op := range r.Ops {
+		ops = append(ops, string(op))
+	}
+	sort.Strings(ops)
+	fmt.Fprintf(w, "%-8s %8s %12s %12s %12s %12s\n", "OP", "COUNT", "MEAN", "P50", "P99", "MAX")
+	for _, op := range ops {
+		o := r.Ops[Op(op)]
+		_, err := fmt.Fprintf(w, "%-8s %8d %12v %12v %12v %12v\n", op, o.Count, o.Mean, o.P50, o.P99, o.Max)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runner holds state shared by workers.
+type runner struct {
+	db  *db.DB
+	cfg Config
+	wl  Workload
+	// mu protects keyCount and the batched write tx, reads run in
+	// concurrent read-only transactions without it.
+	mu sync.Mutex
+	// keys inserted so far
+	keyCount int
+	value    []byte
+	// tx is the open tx of batched writes, nil when there's none
+	tx *db.Tx
+	// batched is the number of writes in tx
+	batched int
+}
+
+// Key returns the i-th benchmark key.
+func Key(i int) []byte {
+	return []byte(fmt.Sprintf("user%010d", i))
+}
+
+// recordKey returns key of the i-th record padded to size. Hashed keys
+// mix i with the splitmix64 finalizer, which is a bijection, so keys of
+// different records never collide.
+func recordKey(i int, hashed bool, size int) []byte {
+	key := Key(i)
+	if hashed {
+		x := uint64(i)
+		x = (x ^ x>>30) * 0xbf58476d1ce4e5b9
+		x = (x ^ x>>27) * 0x94d049bb133111eb
+		x ^= x >> 31
+		key = []byte(fmt.Sprintf("user%020d", x))
+	}
+	if len(key) < size {
+		key = append(key, bytes.Repeat([]byte{'x'}, size-len(key))...)
+	}
+	return key
+}
+
+// Load inserts cfg.RecordCount keys.
+func Load(d *db.DB, cfg Config) error {
+	wl := Workloads[cfg.Workload]
+	value := make([]byte, cfg.ValueSize)
+	batch := cfg.LoadBatchSize
+	if batch <= 0 {
+		batch = 1
+	}
+	for start := 0; start < cfg.RecordCount; start += batch {
+		tx, err := db.NewWritableTx(d)
+		if err != nil {
+			return err
+		}
+		for i := start; i < start+batch && i < cfg.RecordCount; i++ {
+			_, err = tx.Set(recordKey(i, wl.Hashed, cfg.KeySize), value)
+			if err != nil {
+				_ = tx.Rollback()
+				return err
+			}
+		}
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run runs workload on a loaded DB.
+func Run(d *db.DB, cfg Config) (*Result, error) {
+	wl, exist := Workloads[cfg.Workload]
+	if !exist {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownWorkload, cfg.Workload)
+	}
+	workers := cfg.Concurrency
+	if workers <= 0 {
+		workers = 1
+	}
+	r := runner{
+		db:       d,
+		cfg:      cfg,
+		wl:       wl,
+		keyCount: cfg.RecordCount,
+		value:    make([]byte, cfg.ValueSize),
+	}
+	res := Result{
+		Workload:    cfg.Workload,
+		Concurrency: workers,
+		Operations:  cfg.OperationCount,
+		Ops:         map[Op]*OpResult{},
+		Config:      cfg,
+		latencies:   map[Op][]time.Duration{},
+	}
+
+	wg := sync.WaitGroup{}
+	resMu := sync.Mutex{}
+	errs := make(chan error, workers)
+	start := time.Now()
+
+	for w := 0; w < workers; w++ {
+		ops := cfg.OperationCount / workers
+		if w < cfg.OperationCount%workers {
+			ops++
+		}
+		rnd := rand.New(rand.NewSource(cfg.Seed + int64(w)))
+		wg.Add(1)
+		go func(ops int, rnd *rand.Rand) {
+			defer wg.Done()
+			lat, err := r.work(ops, rnd)
+			if err != nil {
+				errs <- err
+				return
+			}
+			resMu.Lock()
+			for op, ds := range lat {
+				res.latencies[op] = append(res.latencies[op], ds...)
+			}
+			resMu.Unlock()
+		}(ops, rnd)
+	}
+	wg.Wait()
+	cerr := r.commit()
+	res.Duration = time.Since(start)
+	close(errs)
+	// Closed channel yields nil when no worker failed
+	err := <-errs
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if res.Duration > 0 {
+		res.OpsPerSec = float64(cfg.OperationCount) / res.Duration.Seconds()
+	}
+	all := []time.Duration{}
+	for op, ds := range res.latencies {
+		res.Ops[op] = summarize(ds)
+		all = append(all, ds...)
+	}
+	if len(all) > 0 {
+		res.P99 = summarize(all).P99
+	}
+
+	return &res, nil
+}
+
+// summarize computes latency summary.
+func summarize(ds []time.Duration) *OpResult {
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	total := time.Duration(0)
+	for _, d := range ds {
+		total += d
+	}
+	n := len(ds)
+	return &OpResult{
+		Count: n,
+		Mean:  total / time.Duration(n),
+		P50:   ds[n*50/100],
+		P99:   ds[n*99/100],
+		Max:   ds[n-1],
+	}
+}
+
+// work runs ops operations, returns latencies by op type.
+func (r *runner) work(ops int, rnd *rand.Rand) (map[Op][]time.Duration, error) {
+	lat := map[Op][]time.Duration{}
+	var zipf *rand.Zipf
+	if r.cfg.Zipfian && r.cfg.RecordCount > 1 {
+		zipf = rand.NewZipf(rnd, 1.1, 1, uint64(r.cfg.RecordCount-1))
+	}
+
+	for i := 0; i < ops; i++ {
+		op := r.chooseOp(rnd.Float64())
+		start := time.Now()
+		err := r.do(op, r.chooseKey(rnd, zipf))
+		if err != nil {
+			return nil, err
+		}
+		lat[op] = append(lat[op], time.Since(start))
+	}
+	return lat, nil
+}
+
+// chooseOp maps p in [0, 1) to an operation.
+func (r *runner) chooseOp(p float64) Op {
+	wl := r.wl
+	choices := []struct {
+		op Op
+		p  float64
+	}{
+		{OpRead, wl.Read},
+		{OpUpdate, wl.Update},
+		{OpInsert, wl.Insert},
+		{OpScan, wl.Scan},
+		{OpReadModifyWrite, wl.ReadModifyWrite},
+	}
+	last := OpRead
+	for _, c := range choices {
+		if c.p == 0 {
+			continue
+		}
+		if p < c.p {
+			return c.op
+		}
+		p -= c.p
+		last = c.op
+	}
+	return last
+}
+
+// chooseKey returns index of an existing key.
+func (r *runner) chooseKey(rnd *rand.Rand, zipf *rand.Zipf) int {
+	r.mu.Lock()
+	count := r.keyCount
+	r.mu.Unlock()
+	if count == 0 {
+		return 0
+	}
+	switch {
+	case r.wl.Latest:
+		// Skew towards the newest keys
+		return count - 1 - rnd.Intn(count)*rnd.Intn(count)/count
+	case zipf != nil:
+		return int(zipf.Uint64()) % count
+	}
+	return rnd.Intn(count)
+}
+
+// key returns key of the i-th record.
+func (r *runner) key(i int) []byte {
+	return recordKey(i, r.wl.Hashed, r.cfg.KeySize)
+}
+
+// do runs one operation. Reads run in their own transaction, writes
+// are batched in r.tx, which commits once it holds cfg.BatchSize writes.
+// Only writes wait for r.mu, so its wait is part of write latency.
+func (r *runner) do(op Op, i int) error {
+	switch op {
+	case OpRead:
+		return r.db.View(func(tx *db.Tx) error {
+			tx.Get(r.key(i))
+			return nil
+		})
+	case OpScan:
+		return r.db.View(func(tx *db.Tx) error {
+			c := tx.Cursor()
+			k, _ := c.Seek(r.key(i))
+			for j := 1; j < r.cfg.ScanLength && k != nil; j++ {
+				k, _ = c.Next()
+			}
+			return nil
+		})
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.tx == nil {
+		tx, err := db.NewWritableTx(r.db)
+		if err != nil {
+			return err
+		}
+		r.tx = tx
+	}
+	tx := r.tx
+	var err error
+	switch op {
+	case OpUpdate:
+		_, err = tx.Set(r.key(i), r.value)
+	case OpInsert:
+		_, err = tx.Set(r.key(r.keyCount), r.value)
+		r.keyCount++
+	case OpReadModifyWrite:
+		nv := append([]byte{}, tx.Get(r.key(i))...)
+		if len(nv) > 0 {
+			nv[0]++
+		}
+		_, err = tx.Set(r.key(i), nv)
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		r.tx, r.batched = nil, 0
+		return err
+	}
+	r.batched++
+	if r.batched < r.cfg.BatchSize {
+		return nil
+	}
+	return r.commit()
+}
+
+// commit commits batched writes.
+func (r *runner) commit() error {
+	if r.tx == nil {
+		return nil
+	}
+	tx := r.tx
+	r.tx, r.batched = nil, 0
+	return tx.Commit()
+}
@@ -0,0 +1,182 @@
+package bench
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/daicang/mk/pkg/db"
+	"github.com/daicang/mk/pkg/kv"
+)
+
+func TestWorkloads(t *testing.T) {
+	for name := range Workloads {
+		d, err := db.Open(db.Options{
+			Path: filepath.Join(t.TempDir(), "data"),
+		})
+		if err != nil {
+			t.Fatalf("Failed to open DB: %v", err)
+		}
+
+		cfg := DefaultConfig(name)
+		cfg.RecordCount = 500
+		cfg.OperationCount = 200
+		cfg.Concurrency = 4
+		cfg.Zipfian = name == "B"
+
+		err = Load(d, cfg)
+		if err != nil {
+			t.Fatalf("Failed to load: %v", err)
+		}
+		res, err := Run(d, cfg)
+		if err != nil {
+			t.Fatalf("Failed to run workload %s: %v", name, err)
+		}
+
+		total := 0
+		for _, r := range res.Ops {
+			total += r.Count
+			if r.P50 > r.P99 || r.P99 > r.Max {
+				t.Errorf("Workload %s: unordered percentiles %+v", name, r)
+			}
+		}
+		if res.P99 <= 0 {
+			t.Errorf("Workload %s: expect p99 latency, get %v", name, res.P99)
+		}
+		if total != cfg.OperationCount {
+			t.Errorf("Workload %s: expect %d ops, get %d", name, cfg.OperationCount, total)
+		}
+
+		buf := bytes.Buffer{}
+		err = res.WriteJSON(&buf)
+		if err != nil {
+			t.Fatalf("Failed to write JSON: %v", err)
+		}
+		decoded := Result{}
+		err = json.Unmarshal(buf.Bytes(), &decoded)
+		if err != nil || decoded.Workload != name {
+			t.Errorf("Bad JSON output: %v %s", err, buf.String())
+		}
+		buf.Reset()
+		if err := res.WriteText(&buf); err != nil || !strings.Contains(buf.String(), "ops/sec") {
+			t.Errorf("Bad text output: %v %s", err, buf.String())
+		}
+		_ = d.Close()
+	}
+}
+
+func TestBatch(t *testing.T) {
+	d, err := db.Open(db.Options{Path: filepath.Join(t.TempDir(), "data")})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer func() { _ = d.Close() }()
+	cfg := DefaultConfig("randwrite")
+	cfg.RecordCount = 100
+	cfg.OperationCount = 95
+	cfg.KeySize = 32
+	cfg.BatchSize = 10
+	cfg.Concurrency = 2
+	err = Load(d, cfg)
+	if err != nil {
+		t.Fatalf("Failed to load: %v", err)
+	}
+	// The last partial batch is committed too
+	if _, err := Run(d, cfg); err != nil {
+		t.Fatalf("Failed to run: %v", err)
+	}
+	err = d.View(func(tx *db.Tx) error {
+		if n := tx.Count(); n != 195 {
+			t.Errorf("Expect 195 keys, get %d", n)
+		}
+		return tx.Scan(nil, nil, func(k kv.Key, v kv.Value) error {
+			if len(k) != cfg.KeySize {
+				t.Errorf("Expect %d byte key, get %q", cfg.KeySize, k)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	// Hashed keys are not in record order
+	keys := [][]byte{}
+	for i := 0; i < 10; i++ {
+		keys = append(keys, recordKey(i, true, 0))
+	}
+	if sort.SliceIsSorted(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 }) {
+		t.Errorf("Expect hashed keys out of order: %q", keys)
+	}
+}
+
+func TestLoadError(t *testing.T) {
+	d, err := db.Open(db.Options{Path: filepath.Join(t.TempDir(), "data")})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	cfg := DefaultConfig("C")
+	cfg.KeySize = db.MaxKeySize + 1
+	if err := Load(d, cfg); !errors.Is(err, db.ErrKeyTooLarge) {
+		t.Errorf("Expect ErrKeyTooLarge, get %v", err)
+	}
+	// Failed load leaves no writable tx to block Close
+	if err := d.Close(); err != nil {
+		t.Errorf("Failed to close: %v", err)
+	}
+}
+
+func TestUnknownWorkload(t *testing.T) {
+	_, err := Run(nil, DefaultConfig("Z"))
+	if !errors.Is(err, ErrUnknownWorkload) {
+		t.Errorf("Expect ErrUnknownWorkload, get %v", err)
+	}
+}
+
+// BenchmarkWorkloads runs b.N operations of each workload on a loaded
+// DB, and reports throughput and p99 latency of all operations.
+func BenchmarkWorkloads(b *testing.B) {
+	for _, c := range []struct {
+		workload  string
+		valueSize int
+		batch     int
+	}{
+		{"seqwrite", 100, 1},
+		{"seqwrite", 100, 100},
+		{"randwrite", 100, 1},
+		{"randwrite", 100, 100},
+		{"randwrite", 4096, 100},
+		{"read", 100, 1},
+		{"scan", 100, 1},
+		{"mixed", 100, 1},
+		{"mixed", 100, 100},
+	} {
+		name := fmt.Sprintf("%s-value%d-batch%d", c.workload, c.valueSize, c.batch)
+		b.Run(name, func(b *testing.B) {
+			d, err := db.Open(db.Options{Path: filepath.Join(b.TempDir(), "data")})
+			if err != nil {
+				b.Fatalf("Failed to open DB: %v", err)
+			}
+			defer func() { _ = d.Close() }()
+			cfg := DefaultConfig(c.workload)
+			cfg.OperationCount = b.N
+			cfg.ValueSize = c.valueSize
+			cfg.BatchSize = c.batch
+			err = Load(d, cfg)
+			if err != nil {
+				b.Fatalf("Failed to load: %v", err)
+			}
+			b.ResetTimer()
+			res, err := Run(d, cfg)
+			if err != nil {
+				b.Fatalf("Failed to run: %v", err)
+			}
+			b.ReportMetric(res.OpsPerSec, "ops/s")
+			b.ReportMetric(float64(res.P99.Nanoseconds()), "p99-ns")
+		})
+	}
+}
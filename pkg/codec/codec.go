@@ -0,0 +1,100 @@
+// Package codec compresses values stored in DB file. Encoded values
+// start with their codec, so values written with different codecs can
+// be read from one file.
+package codec
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// Codec is a compression algorithm.
+type Codec byte
+
+const (
+	// None stores value as is.
+	None Codec = iota
+	// Flate is DEFLATE at best speed, from compress/flate.
+	Flate
+)
+
+// ErrCorrupt is returned when decoding bytes not made by Encode.
+var ErrCorrupt = errors.New("corrupt compressed value")
+
+// flateWriters pools flate writers, which are costly to create.
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+// String returns codec name for print.
+func (c Codec) String() string {
+	switch c {
+	case None:
+		return "none"
+	case Flate:
+		return "flate"
+	}
+	return fmt.Sprintf("Codec(%d)", int(c))
+}
+
+// Encode returns v compressed with c, prefixed by c.
+func Encode(c Codec, v []byte) []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, len(v)/2+1))
+	buf.WriteByte(byte(c))
+	switch c {
+	case Flate:
+		w := flateWriters.Get().(*flate.Writer)
+		w.Reset(buf)
+		// Writes to bytes.Buffer never fail
+		_, _ = w.Write(v)
+		_ = w.Close()
+		flateWriters.Put(w)
+	default:
+		buf.Write(v)
+	}
+	return buf.Bytes()
+}
+
+// Decode returns value encoded in b by Encode.
+func Decode(b []byte) ([]byte, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("%w: empty", ErrCorrupt)
+	}
+	switch Codec(b[0]) {
+	case None:
+		return append([]byte{}, b[1:]...), nil
+	case Flate:
+		r := flate.NewReader(bytes.NewReader(b[1:]))
+		v, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+		}
+		return v, nil
+	}
+	return nil, fmt.Errorf("%w: unknown codec %d", ErrCorrupt, b[0])
+}
+
+// NewReader returns a reader decoding value encoded by Encode from r,
+// so large values are decoded without reading them whole.
+func NewReader(r io.Reader) (io.Reader, error) {
+	var c [1]byte
+	_, err := io.ReadFull(r, c[:])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	switch Codec(c[0]) {
+	case None:
+		return r, nil
+	case Flate:
+		return flate.NewReader(r), nil
+	}
+	return nil, fmt.Errorf("%w: unknown codec %d", ErrCorrupt, c[0])
+}
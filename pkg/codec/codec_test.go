@@ -0,0 +1,53 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+func TestCodec(t *testing.T) {
+	value := bytes.Repeat([]byte(`{"name":"mk","tags":["kv","btree"]}`), 100)
+	for _, c := range []Codec{None, Flate} {
+		b := Encode(c, value)
+		if Codec(b[0]) != c {
+			t.Errorf("%s: encoded value starts with %d", c, b[0])
+		}
+		v, err := Decode(b)
+		if err != nil || !bytes.Equal(v, value) {
+			t.Errorf("%s: failed to decode: %v", c, err)
+		}
+	}
+	if b := Encode(Flate, value); len(b) > len(value)/10 {
+		t.Errorf("Expect repetitive value compressed, get %d of %d bytes", len(b), len(value))
+	}
+	if v, err := Decode(Encode(Flate, nil)); err != nil || len(v) != 0 {
+		t.Errorf("Failed to decode empty value: %q %v", v, err)
+	}
+
+	for _, bad := range [][]byte{nil, {9, 1, 2}, {byte(Flate), 0xff, 0xff}} {
+		if _, err := Decode(bad); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("Expect ErrCorrupt for %x, get %v", bad, err)
+		}
+	}
+}
+
+func TestNewReader(t *testing.T) {
+	value := bytes.Repeat([]byte("streamed value "), 1000)
+	for _, c := range []Codec{None, Flate} {
+		r, err := NewReader(bytes.NewReader(Encode(c, value)))
+		if err != nil {
+			t.Fatalf("%s: failed to create reader: %v", c, err)
+		}
+		v, err := ioutil.ReadAll(r)
+		if err != nil || !bytes.Equal(v, value) {
+			t.Errorf("%s: failed to read: %v", c, err)
+		}
+	}
+	for _, bad := range [][]byte{nil, {9, 1, 2}} {
+		if _, err := NewReader(bytes.NewReader(bad)); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("Expect ErrCorrupt for %x, get %v", bad, err)
+		}
+	}
+}
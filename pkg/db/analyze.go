@@ -0,0 +1,339 @@
+package db
+
+import (
+	"fmt"
+	"math/bits"
+	"strings"
+
+	"github.com/daicang/mk/pkg/common"
+	"github.com/daicang/mk/pkg/page"
+	"github.com/daicang/mk/pkg/tree"
+)
+
+// Histogram counts samples in power-of-two buckets.
+// Bucket 0 holds zeros, bucket i holds samples in [2^(i-1), 2^i).
+type Histogram struct {
+	Count   int
+	Sum     int
+	Min     int
+	Max     int
+	Buckets []int
+}
+
+// Add records one sample.
+func (h *Histogram) Add(v int) {
+	if h.Count == 0 || v < h.Min {
+		h.Min = v
+	}
+	if v > h.Max {
+		h.Max = v
+	}
+	h.Count++
+	h.Sum += v
+
+	i := bits.Len(uint(v))
+	for len(h.Buckets) <= i {
+		h.Buckets = append(h.Buckets, 0)
+	}
+	h.Buckets[i]++
+}
+
+// Mean returns average of all samples.
+func (h *Histogram) Mean() float64 {
+	if h.Count == 0 {
+		return 0
+	}
+	return float64(h.Sum) / float64(h.Count)
+}
+
+// bucketRange returns [low, high) of bucket i.
+func bucketRange(i int) (int, int) {
+	if i == 0 {
+		return 0, 1
+	}
+	return 1 << (i - 1), 1 << i
+}
+
+// String returns one line per non-empty bucket.
+func (h *Histogram) String() string {
+	sb := strings.Builder{}
+	fmt.Fprintf(&sb, "count=%d min=%d max=%d mean=%.1f\n", h.Count, h.Min, h.Max, h.Mean())
+	for i, c := range h.Buckets {
+		if c == 0 {
+			continue
+		}
+		low, high := bucketRange(i)
+		fmt.Fprintf(&sb, "  [%d, %d) %d\n", low, high, c)
+	}
+	return sb.String()
+}
+
+// Analysis holds size distributions of the b+tree.
+// These numbers help tuning page size, fill percent and overflow threshold.
+type Analysis struct {
+	// KeySize is histogram of key lengths.
+	KeySize Histogram
+	// ValueSize is histogram of value lengths as stored, a compressed
+	// value counts its compressed length.
+	ValueSize Histogram
+	// LeafPairs is histogram of key/value pair count per leaf.
+	LeafPairs Histogram
+}
+
+// String returns analysis report for print.
+func (a *Analysis) String() string {
+	return fmt.Sprintf(
+		"key size: %svalue size: %sleaf pairs: %s",
+		a.KeySize.String(),
+		a.ValueSize.String(),
+		a.LeafPairs.String(),
+	)
+}
+
+// Analyze walks the whole tree and computes size histograms. Values in
+// overflow pages are not read, their size is in the leaf.
+func (tx *Tx) Analyze() *Analysis {
+	a := Analysis{}
+	tx.forEachNode(func(n *tree.Node, depth int) {
+		if !n.IsLeaf {
+			return
+		}
+		a.LeafPairs.Add(n.KeyCount())
+		for i := 0; i < n.KeyCount(); i++ {
+			a.KeySize.Add(len(n.GetKeyAt(i)))
+			if ov := n.OverflowAt(i); ov.Head != 0 {
+				a.ValueSize.Add(ov.Size)
+			} else {
+				a.ValueSize.Add(len(tx.valueAt(n, i)))
+			}
+		}
+	})
+	return &a
+}
+
+// forEachNode visits all nodes depth-first, root has depth 0.
+// Nodes not yet accessed by tx are not added to it, so walking a
+// writable tx won't make its nodes dirty.
+func (tx *Tx) forEachNode(fn func(n *tree.Node, depth int)) {
+	tx.walkNode(tx.root, 0, fn)
+}
+
+func (tx *Tx) walkNode(n *tree.Node, depth int, fn func(n *tree.Node, depth int)) {
+	fn(n, depth)
+	if n.IsLeaf {
+		return
+	}
+	for i := 0; i < n.KeyCount(); i++ {
+		tx.walkNode(tx.peekNode(n.GetChildID(i), n), depth+1, fn)
+	}
+}
+
+// Depth returns level count of the tree, a single root leaf has
+// depth 1. It only reads the leftmost path.
+func (tx *Tx) Depth() int {
+	depth := 1
+	for n := tx.root; !n.IsLeaf; n = tx.peekNode(n.GetChildID(0), n) {
+		depth++
+	}
+	return depth
+}
+
+// peekNode returns node from pgid without adding it to tx. It's not
+// modified, so read-only tx reads it like getNode, from DB node cache
+// when enabled, and writable tx reads it lazily.
+func (tx *Tx) peekNode(id common.Pgid, parent *tree.Node) *tree.Node {
+	n, exist := tx.nodes[id]
+	if exist {
+		return n
+	}
+	if !tx.writable {
+		return tx.readNode(id, parent)
+	}
+	n = &tree.Node{
+		Parent: parent,
+	}
+	n.ReadPageLazy(tx.getPage(id), tx.getPage)
+
+	return n
+}
+
+// LevelProfile describes one level of the b+tree.
+type LevelProfile struct {
+	// Pages is the number of nodes at this level.
+	Pages int
+	// Keys is the total key count at this level.
+	Keys int
+}
+
+// Fanout returns average key count per node,
+// which is average children count for internal levels.
+func (l LevelProfile) Fanout() float64 {
+	if l.Pages == 0 {
+		return 0
+	}
+	return float64(l.Keys) / float64(l.Pages)
+}
+
+// TreeProfile describes b+tree shape.
+type TreeProfile struct {
+	// Depth is level count, a single root leaf has depth 1.
+	Depth int
+	// Levels from root to leaves.
+	Levels []LevelProfile
+}
+
+// String returns one line per level.
+func (p *TreeProfile) String() string {
+	sb := strings.Builder{}
+	fmt.Fprintf(&sb, "depth=%d\n", p.Depth)
+	for i, l := range p.Levels {
+		fmt.Fprintf(&sb, "  level %d: pages=%d keys=%d fanout=%.1f\n", i, l.Pages, l.Keys, l.Fanout())
+	}
+	return sb.String()
+}
+
+// TreeStats summarizes b+tree size and how full its pages are.
+type TreeStats struct {
+	// Keys is the total key count.
+	Keys int
+	// Depth is level count, a single root leaf has depth 1.
+	Depth int
+	// LeafPages is pages of leaf nodes, multi-page nodes included.
+	LeafPages int
+	// InternalPages is pages of internal nodes.
+	InternalPages int
+	// OverflowPages is pages holding large values, see page.MaxInlineValue.
+	OverflowPages int
+	// FillPercent is node bytes in percent of leaf and internal pages.
+	FillPercent float64
+}
+
+// TreeStats walks the whole tree and returns its statistics.
+func (tx *Tx) TreeStats() TreeStats {
+	s := TreeStats{}
+	used := 0
+	tx.forEachNode(func(n *tree.Node, depth int) {
+		if depth+1 > s.Depth {
+			s.Depth = depth + 1
+		}
+		size := n.Size()
+		used += size
+		pages := (size + page.PageSize - 1) / page.PageSize
+		if n.IsLeaf {
+			s.Keys += n.KeyCount()
+			s.LeafPages += pages
+			s.OverflowPages += n.OverflowPages()
+		} else {
+			s.InternalPages += pages
+		}
+	})
+	total := (s.LeafPages + s.InternalPages) * page.PageSize
+	if total > 0 {
+		s.FillPercent = 100 * float64(used) / float64(total)
+	}
+	return s
+}
+
+// TreeProfile returns depth, pages per level and fanout per level.
+func (tx *Tx) TreeProfile() *TreeProfile {
+	p := TreeProfile{}
+	tx.forEachNode(func(n *tree.Node, depth int) {
+		if depth >= len(p.Levels) {
+			p.Levels = append(p.Levels, LevelProfile{})
+		}
+		p.Levels[depth].Pages++
+		p.Levels[depth].Keys += n.KeyCount()
+	})
+	p.Depth = len(p.Levels)
+
+	return &p
+}
+
+// FragmentationReport describes how pages of the file are used, large
+// free pages or wasted bytes tell when to compact.
+type FragmentationReport struct {
+	// TotalPages is pages of the file, free pages included.
+	TotalPages int
+	// FreePages is pages in freelist of the last commit.
+	FreePages int
+	// FreeSpans is runs of contiguous free pages.
+	FreeSpans int
+	// LargestFreeSpan is pages of the largest free run, the longest
+	// overflow chain stored without growing file.
+	LargestFreeSpan int
+	// SpanHistogram counts free spans by size, item i counts spans of
+	// [2^i, 2^(i+1)) pages.
+	SpanHistogram []int
+	// TreePages is pages of leaf and internal nodes.
+	TreePages int
+	// OverflowPages is pages holding large values.
+	OverflowPages int
+	// OverflowRatio is overflow pages in pages in use.
+	OverflowRatio float64
+	// WastedBytes is unused bytes of tree and overflow pages.
+	WastedBytes int
+	// WastedBytesPerPage is WastedBytes per tree and overflow page.
+	WastedBytesPerPage float64
+}
+
+// String returns report for print.
+func (r *FragmentationReport) String() string {
+	sb := strings.Builder{}
+	free := 0.0
+	if r.TotalPages > 0 {
+		free = 100 * float64(r.FreePages) / float64(r.TotalPages)
+	}
+	fmt.Fprintf(&sb, "pages=%d free=%d (%.1f%%) tree=%d overflow=%d\n", r.TotalPages, r.FreePages, free, r.TreePages, r.OverflowPages)
+	fmt.Fprintf(&sb, "free spans=%d largest=%d\n", r.FreeSpans, r.LargestFreeSpan)
+	for i, c := range r.SpanHistogram {
+		if c > 0 {
+			fmt.Fprintf(&sb, "  [%d, %d) %d\n", 1<<i, 1<<(i+1), c)
+		}
+	}
+	fmt.Fprintf(&sb, "overflow ratio=%.3f\n", r.OverflowRatio)
+	fmt.Fprintf(&sb, "wasted bytes=%d per page=%.1f\n", r.WastedBytes, r.WastedBytesPerPage)
+	return sb.String()
+}
+
+// FragmentationReport walks the tree and freelist of the last commit
+// and reports free spans, overflow pages and unused bytes of pages.
+func (db *DB) FragmentationReport() (*FragmentationReport, error) {
+	r := FragmentationReport{}
+	err := db.View(func(tx *Tx) error {
+		fs := tx.readFreelist().Stats()
+		r.TotalPages = int(tx.meta.totalPages)
+		r.FreePages = fs.FreePages
+		r.FreeSpans = fs.Spans
+		r.LargestFreeSpan = fs.LargestSpan
+		r.SpanHistogram = fs.SpanHistogram
+		tx.forEachNode(func(n *tree.Node, depth int) {
+			size := n.Size()
+			pages := (size + page.PageSize - 1) / page.PageSize
+			r.TreePages += pages
+			r.WastedBytes += pages*page.PageSize - size
+			if !n.IsLeaf {
+				return
+			}
+			for i := 0; i < n.KeyCount(); i++ {
+				ov := n.OverflowAt(i)
+				if ov.Head == 0 {
+					continue
+				}
+				pages := page.OverflowPages(ov.Size)
+				r.OverflowPages += pages
+				r.WastedBytes += pages*page.OverflowCapacity - ov.Size
+			}
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if used := r.TotalPages - r.FreePages; used > 0 {
+		r.OverflowRatio = float64(r.OverflowPages) / float64(used)
+	}
+	if pages := r.TreePages + r.OverflowPages; pages > 0 {
+		r.WastedBytesPerPage = float64(r.WastedBytes) / float64(pages)
+	}
+	return &r, nil
+}
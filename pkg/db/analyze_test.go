@@ -0,0 +1,205 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/daicang/mk/pkg/page"
+)
+
+func TestHistogram(t *testing.T) {
+	h := Histogram{}
+	for _, v := range []int{0, 1, 2, 3, 4, 7, 8, 100} {
+		h.Add(v)
+	}
+
+	if h.Count != 8 || h.Min != 0 || h.Max != 100 || h.Sum != 125 {
+		t.Errorf("Incorrect summary: %+v", h)
+	}
+	expect := []int{1, 1, 2, 2, 1, 0, 0, 1}
+	if fmt.Sprint(h.Buckets) != fmt.Sprint(expect) {
+		t.Errorf("Incorrect buckets: expect %v, get %v", expect, h.Buckets)
+	}
+	if !strings.Contains(h.String(), "[64, 128) 1") {
+		t.Errorf("Missing bucket in output: %s", h.String())
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	db := openDB(t)
+	size := 2000
+	kvs := map[string]string{}
+	for i := 0; i < size; i++ {
+		kvs[fmt.Sprintf("key-%06d", i)] = strings.Repeat("v", i%100)
+	}
+	fillDB(t, db, kvs)
+
+	tx, err := NewReadOnlyTx(db)
+	if err != nil {
+		t.Fatalf("Failed to create tx: %v", err)
+	}
+	a := tx.Analyze()
+
+	if a.KeySize.Count != size || a.KeySize.Min != 10 || a.KeySize.Max != 10 {
+		t.Errorf("Incorrect key size: %+v", a.KeySize)
+	}
+	if a.ValueSize.Count != size || a.ValueSize.Min != 0 || a.ValueSize.Max != 99 {
+		t.Errorf("Incorrect value size: %+v", a.ValueSize)
+	}
+	if a.LeafPairs.Sum != size {
+		t.Errorf("Leaf pairs should sum to %d, get %d", size, a.LeafPairs.Sum)
+	}
+	if a.LeafPairs.Count < 2 {
+		t.Errorf("Expect multiple leaves, get %d", a.LeafPairs.Count)
+	}
+}
+
+func TestAnalyzeStoredSize(t *testing.T) {
+	db, err := Open(Options{Path: dataPath(t), Compression: CompressionFlate})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+	large := strings.Repeat("v", 10*page.PageSize)
+	fillDB(t, db, map[string]string{"large": large})
+
+	tx, _ := NewReadOnlyTx(db)
+	defer func() { _ = tx.Rollback() }()
+	a := tx.Analyze()
+	if a.ValueSize.Count != 1 || a.ValueSize.Max >= len(large) {
+		t.Errorf("Expect compressed size of %d bytes, get %+v", len(large), a.ValueSize)
+	}
+	if len(tx.readPages) != 1 {
+		t.Errorf("Expect only root page read, get %d pages", len(tx.readPages))
+	}
+}
+
+func TestTreeProfile(t *testing.T) {
+	db := openDB(t)
+
+	tx, _ := NewReadOnlyTx(db)
+	p := tx.TreeProfile()
+	if p.Depth != 1 || tx.Depth() != 1 || p.Levels[0].Pages != 1 || p.Levels[0].Keys != 0 {
+		t.Errorf("Incorrect profile for empty DB: %s", p)
+	}
+
+	size := 20000
+	kvs := map[string]string{}
+	for i := 0; i < size; i++ {
+		kvs[fmt.Sprintf("key-%06d", i)] = "value"
+	}
+	fillDB(t, db, kvs)
+
+	tx, _ = NewReadOnlyTx(db)
+	p = tx.TreeProfile()
+	if p.Depth < 3 {
+		t.Fatalf("Expect at least 3 levels, get %s", p)
+	}
+	if tx.Depth() != p.Depth {
+		t.Errorf("Depth %d differs from profile %s", tx.Depth(), p)
+	}
+	if p.Levels[0].Pages != 1 {
+		t.Errorf("Root level should have 1 page, get %d", p.Levels[0].Pages)
+	}
+	for i := 0; i < p.Depth-1; i++ {
+		// Keys at internal level are children at next level
+		if p.Levels[i].Keys != p.Levels[i+1].Pages {
+			t.Errorf("Level %d has %d children, level %d has %d pages",
+				i, p.Levels[i].Keys, i+1, p.Levels[i+1].Pages)
+		}
+	}
+	if p.Levels[p.Depth-1].Keys != size {
+		t.Errorf("Leaf level should have %d keys, get %d", size, p.Levels[p.Depth-1].Keys)
+	}
+}
+
+func TestTreeStats(t *testing.T) {
+	db := openDB(t)
+	tx, _ := NewReadOnlyTx(db)
+	s := tx.TreeStats()
+	if s.Keys != 0 || s.Depth != 1 || s.LeafPages != 1 || tx.Count() != 0 {
+		t.Errorf("Incorrect stats for empty DB: %+v", s)
+	}
+
+	size := 20000
+	kvs := map[string]string{"large": strings.Repeat("L", 3*page.PageSize)}
+	for i := 0; i < size; i++ {
+		kvs[fmt.Sprintf("key-%06d", i)] = "value"
+	}
+	fillDB(t, db, kvs)
+
+	tx, _ = NewReadOnlyTx(db)
+	s = tx.TreeStats()
+	p := tx.TreeProfile()
+	if s.Keys != len(kvs) || tx.Count() != len(kvs) {
+		t.Errorf("Expect %d keys, get %d and count %d", len(kvs), s.Keys, tx.Count())
+	}
+	if s.Depth != p.Depth || s.LeafPages != p.Levels[p.Depth-1].Pages {
+		t.Errorf("Stats %+v don't match profile %s", s, p)
+	}
+	if s.InternalPages == 0 || s.OverflowPages != page.OverflowPages(3*page.PageSize) {
+		t.Errorf("Incorrect page counts: %+v", s)
+	}
+	// Split leaves are at least half full
+	if s.FillPercent < 40 || s.FillPercent > 100 {
+		t.Errorf("Unexpected fill percent %.1f", s.FillPercent)
+	}
+}
+
+func TestFragmentationReport(t *testing.T) {
+	db := openDB(t)
+	r, err := db.FragmentationReport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.TotalPages != 4 || r.FreePages != 0 || r.TreePages != 1 || r.OverflowRatio != 0 {
+		t.Errorf("Incorrect report for empty DB: %+v", r)
+	}
+
+	kvs := map[string]string{}
+	for i := 0; i < 2000; i++ {
+		kvs[fmt.Sprintf("key-%04d", i)] = "value"
+	}
+	for i := 0; i < 4; i++ {
+		kvs[fmt.Sprintf("large-%d", i)] = strings.Repeat("L", 3*page.PageSize)
+	}
+	fillDB(t, db, kvs)
+	// Removed chains leave free spans between live pages
+	tx, _ := NewWritableTx(db)
+	mustRemove(t, tx, []byte("large-1"))
+	mustRemove(t, tx, []byte("large-2"))
+	mustCommit(t, tx)
+
+	r, err = db.FragmentationReport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, _ = NewReadOnlyTx(db)
+	s := tx.TreeStats()
+	_ = tx.Rollback()
+	chain := page.OverflowPages(3 * page.PageSize)
+	if r.OverflowPages != 2*chain || r.TreePages != s.LeafPages+s.InternalPages {
+		t.Errorf("Incorrect page counts %+v, tree stats %+v", r, s)
+	}
+	if r.FreePages < 2*chain || r.LargestFreeSpan < 2*chain || r.FreeSpans == 0 {
+		t.Errorf("Expect free spans of removed chains, get %+v", r)
+	}
+	spans := 0
+	for _, c := range r.SpanHistogram {
+		spans += c
+	}
+	if spans != r.FreeSpans {
+		t.Errorf("Histogram %v doesn't sum to %d spans", r.SpanHistogram, r.FreeSpans)
+	}
+	used := float64(r.TotalPages - r.FreePages)
+	if r.OverflowRatio != float64(r.OverflowPages)/used {
+		t.Errorf("Incorrect overflow ratio %f", r.OverflowRatio)
+	}
+	if r.WastedBytesPerPage <= 0 || r.WastedBytesPerPage >= float64(page.PageSize) {
+		t.Errorf("Unexpected wasted bytes per page %.1f", r.WastedBytesPerPage)
+	}
+	if out := r.String(); !strings.Contains(out, "free spans=") {
+		t.Errorf("Bad report:\n%s", out)
+	}
+}
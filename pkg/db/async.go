@@ -0,0 +1,56 @@
+package db
+
+// CommitAsync commits without waiting for sync, so it returns after
+// pages and meta are written to OS cache. New transactions see the
+// changes at once, and a background flusher syncs them to disk.
+//
+// The returned channel receives nil when the commit is durable, or the
+// commit or sync error, then it's closed. Until then a crash of OS may
+// lose the commit, like DurabilityNone. Concurrent async commits share
+// one sync, and Close waits for pending syncs.
+func (tx *Tx) CommitAsync() <-chan error {
+	errc := make(chan error, 1)
+	db := tx.db
+	// Count before commit, so Close which waits for the tx also waits
+	// for its sync
+	db.flushWait.Add(1)
+	err := tx.CommitWith(DurabilityNone)
+	if err != nil {
+		db.flushWait.Done()
+		errc <- err
+		close(errc)
+		return errc
+	}
+
+	db.flushlock.Lock()
+	db.flushWaiters = append(db.flushWaiters, errc)
+	if !db.flushing {
+		db.flushing = true
+		go db.flush()
+	}
+	db.flushlock.Unlock()
+	return errc
+}
+
+// flush syncs DB for waiting async commits, until there's none.
+// Commits made during a sync wait for the next one.
+func (db *DB) flush() {
+	for {
+		db.flushlock.Lock()
+		waiters := db.flushWaiters
+		db.flushWaiters = nil
+		if len(waiters) == 0 {
+			db.flushing = false
+			db.flushlock.Unlock()
+			return
+		}
+		db.flushlock.Unlock()
+
+		err := db.sync()
+		for _, errc := range waiters {
+			errc <- err
+			close(errc)
+			db.flushWait.Done()
+		}
+	}
+}
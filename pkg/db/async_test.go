@@ -0,0 +1,71 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestCommitAsync(t *testing.T) {
+	path := dataPath(t)
+	db, err := Open(Options{Path: path})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	kvs := map[string]string{}
+	pending := []<-chan error{}
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key-%02d", i)
+		kvs[key] = "value"
+		tx, err := NewWritableTx(db)
+		if err != nil {
+			t.Fatalf("Failed to create tx: %v", err)
+		}
+		mustSet(t, tx, []byte(key), []byte("value"))
+		pending = append(pending, tx.CommitAsync())
+
+		// Commit is visible before it's synced
+		rtx, _ := NewReadOnlyTx(db)
+		if got := rtx.Get([]byte(key)); string(got) != "value" {
+			t.Errorf("Expect %s visible after async commit, get %q", key, got)
+		}
+		if err := rtx.Rollback(); err != nil {
+			t.Fatalf("Failed to rollback: %v", err)
+		}
+	}
+	for i, errc := range pending[:10] {
+		if err := <-errc; err != nil {
+			t.Errorf("Commit %d: %v", i, err)
+		}
+		if _, ok := <-errc; ok {
+			t.Errorf("Commit %d: expect channel closed", i)
+		}
+	}
+	if db.DurableTxID() < 10 {
+		t.Errorf("Expect first 10 commits durable, durable id %d", db.DurableTxID())
+	}
+
+	rtx, _ := NewReadOnlyTx(db)
+	if err := <-rtx.CommitAsync(); !errors.Is(err, ErrTxReadOnly) {
+		t.Errorf("Expect ErrTxReadOnly, get %v", err)
+	}
+	if err := rtx.Rollback(); err != nil {
+		t.Fatalf("Failed to rollback: %v", err)
+	}
+
+	// Close waits for pending syncs
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	for i, errc := range pending[10:] {
+		select {
+		case err := <-errc:
+			if err != nil {
+				t.Errorf("Commit %d: %v", i+10, err)
+			}
+		default:
+			t.Errorf("Commit %d: expect synced on close", i+10)
+		}
+	}
+	checkBackup(t, path, kvs)
+}
@@ -0,0 +1,77 @@
+package db
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/daicang/mk/pkg/common"
+	"github.com/daicang/mk/pkg/page"
+)
+
+// WriteTo writes a DB file holding the snapshot of this read-only tx to
+// w, returns bytes written. Pages of the snapshot are not reused while
+// tx is open, so writes can go on during the copy.
+func (tx *Tx) WriteTo(w io.Writer) (int64, error) {
+	if tx.writable {
+		return 0, ErrTxWritable
+	}
+	if tx.closed() {
+		return 0, ErrTxClosed
+	}
+	// Meta pages on file may be newer, write them from tx meta
+	metaPages := tx.db.metaPages
+	buf := make([]byte, metaPages*page.PageSize)
+	for i := 0; i < metaPages; i++ {
+		p := page.FromBuffer(buf, common.Pgid(i))
+		p.SetIndex(common.Pgid(i))
+		p.SetFlag(page.FlagMeta)
+		m := tx.meta.copy()
+		m.checksum = m.sum()
+		m.write(p)
+	}
+	// Then the rest of pages up to the end of snapshot
+	var src io.ReaderAt = tx.db.file
+	start := int64(metaPages * page.PageSize)
+	end := int64(tx.meta.totalPages) * int64(page.PageSize)
+	if f, ok := tx.db.file.(*cryptFile); ok {
+		// Pages are copied encrypted, the file opens with the same key
+		var err error
+		buf, err = f.seal(buf, 0)
+		if err != nil {
+			return 0, fmt.Errorf("write meta: %w", err)
+		}
+		src, start, end = f.dbFile, physicalOffset(start), physicalOffset(end)
+	}
+	n, err := w.Write(buf)
+	written := int64(n)
+	if err != nil {
+		return written, fmt.Errorf("write meta: %w", err)
+	}
+	copied, err := io.Copy(w, io.NewSectionReader(src, start, end-start))
+	written += copied
+	if err != nil {
+		return written, fmt.Errorf("copy pages: %w", err)
+	}
+	return written, nil
+}
+
+// Backup writes the last committed state to a new DB file at path,
+// an existing file is overwritten. It doesn't block writes.
+func (db *DB) Backup(path string) error {
+	return db.View(func(tx *Tx) error {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		_, err = tx.WriteTo(f)
+		if err == nil {
+			err = f.Sync()
+		}
+		cerr := f.Close()
+		if err != nil {
+			return err
+		}
+		return cerr
+	})
+}
@@ -0,0 +1,116 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/daicang/mk/pkg/kv"
+)
+
+func TestWriteTo(t *testing.T) {
+	for _, mmap := range []bool{false, true} {
+		db, err := Open(Options{Path: dataPath(t), WritableMmap: mmap})
+		if err != nil {
+			t.Fatalf("Failed to open DB: %v", err)
+		}
+		kvs := map[string]string{}
+		for i := 0; i < 3000; i++ {
+			kvs[fmt.Sprintf("key-%04d", i)] = "v0"
+		}
+		fillDB(t, db, kvs)
+
+		// Commits after the snapshot are not in the copy
+		rtx, _ := NewReadOnlyTx(db)
+		for round := 1; round <= 3; round++ {
+			update := map[string]string{}
+			for k := range kvs {
+				update[k] = fmt.Sprintf("v%d", round)
+			}
+			update[fmt.Sprintf("new-%d", round)] = "new"
+			fillDB(t, db, update)
+		}
+		buf := bytes.Buffer{}
+		n, err := rtx.WriteTo(&buf)
+		if err != nil || n != int64(buf.Len()) {
+			t.Fatalf("WriteTo returns %d, %v, wrote %d bytes", n, err, buf.Len())
+		}
+		err = rtx.Rollback()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = rtx.WriteTo(&buf); !errors.Is(err, ErrTxClosed) {
+			t.Errorf("Expect ErrTxClosed, get %v", err)
+		}
+		wtx, _ := NewWritableTx(db)
+		if _, err = wtx.WriteTo(&buf); !errors.Is(err, ErrTxWritable) {
+			t.Errorf("Expect ErrTxWritable, get %v", err)
+		}
+		mustCommit(t, wtx)
+
+		path := filepath.Join(t.TempDir(), "copy")
+		err = ioutil.WriteFile(path, buf.Bytes(), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkBackup(t, path, kvs)
+		err = db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBackup(t *testing.T) {
+	db := openDB(t)
+	kvs := map[string]string{"a": "1", "b": "2"}
+	fillDB(t, db, kvs)
+	path := filepath.Join(t.TempDir(), "backup")
+	err := db.Backup(path)
+	if err != nil {
+		t.Fatalf("Failed to backup: %v", err)
+	}
+	checkBackup(t, path, kvs)
+	// Backup of a closed DB fails
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Backup(path); !errors.Is(err, ErrDBClosed) {
+		t.Errorf("Expect ErrDBClosed, get %v", err)
+	}
+}
+
+// checkBackup opens DB file at path and checks it holds exactly kvs.
+func checkBackup(t *testing.T, path string, kvs map[string]string) {
+	db, err := Open(Options{Path: path})
+	if err != nil {
+		t.Fatalf("Failed to open backup: %v", err)
+	}
+	err = db.View(func(tx *Tx) error {
+		count := 0
+		err := tx.ForEach(func(k kv.Key, v kv.Value) error {
+			if kvs[string(k)] != string(v) {
+				return fmt.Errorf("key %s is %s in backup, expect %s", k, v, kvs[string(k)])
+			}
+			count++
+			return nil
+		})
+		if err == nil && count != len(kvs) {
+			err = fmt.Errorf("backup has %d keys, expect %d", count, len(kvs))
+		}
+		return err
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	// Backup takes writes
+	fillDB(t, db, map[string]string{"after": "backup"})
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
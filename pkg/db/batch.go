@@ -0,0 +1,145 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxBatchSize is default Options.MaxBatchSize.
+	DefaultMaxBatchSize = 1000
+	// DefaultMaxBatchDelay is default Options.MaxBatchDelay.
+	DefaultMaxBatchDelay = 10 * time.Millisecond
+)
+
+// errTrySolo tells Batch caller to run its function alone.
+var errTrySolo = errors.New("batch function failed, run it alone")
+
+// call is one Batch function waiting for its result.
+type call struct {
+	fn  func(*Tx) error
+	err chan<- error
+}
+
+// batch is calls which run in one writable transaction.
+type batch struct {
+	db    *DB
+	timer *time.Timer
+	start sync.Once
+	calls []call
+}
+
+// Batch runs fn in a writable transaction shared with other concurrent
+// Batch calls, so they pay for one commit and one sync. A batch runs
+// when it has Options.MaxBatchSize calls, or Options.MaxBatchDelay
+// after its first call.
+//
+// When fn returns an error, it's removed from the batch and called
+// again in its own transaction, whose error is returned. So fn may be
+// called more than once, and must only change the tx. Unlike Update,
+// Batch waits for the open writable transaction, so it must not be
+// called from a goroutine holding one.
+func (db *DB) Batch(fn func(*Tx) error) error {
+	errc := make(chan error, 1)
+
+	db.batchlock.Lock()
+	if db.batch == nil || len(db.batch.calls) >= db.maxBatchSize {
+		db.batch = &batch{db: db}
+		db.batch.timer = time.AfterFunc(db.maxBatchDelay, db.batch.trigger)
+	}
+	db.batch.calls = append(db.batch.calls, call{fn: fn, err: errc})
+	if len(db.batch.calls) >= db.maxBatchSize {
+		// Wake up batch, it's ready to run
+		go db.batch.trigger()
+	}
+	db.batchlock.Unlock()
+
+	err := <-errc
+	if errors.Is(err, errTrySolo) {
+		err = db.updateWait(fn)
+	}
+	return err
+}
+
+// trigger runs batch once.
+func (b *batch) trigger() {
+	b.start.Do(b.run)
+}
+
+// run runs calls in one transaction and sends each call its result.
+// A failed call is removed and told to run alone, then the rest retry.
+func (b *batch) run() {
+	b.db.batchlock.Lock()
+	b.timer.Stop()
+	// New calls go to a new batch
+	if b.db.batch == b {
+		b.db.batch = nil
+	}
+	b.db.batchlock.Unlock()
+
+	for len(b.calls) > 0 {
+		failed := -1
+		err := b.db.updateWait(func(tx *Tx) error {
+			for i, c := range b.calls {
+				err := safelyCall(c.fn, tx)
+				if err != nil {
+					failed = i
+					return err
+				}
+			}
+			return nil
+		})
+		if failed < 0 {
+			for _, c := range b.calls {
+				c.err <- err
+			}
+			return
+		}
+		c := b.calls[failed]
+		b.calls[failed] = b.calls[len(b.calls)-1]
+		b.calls = b.calls[:len(b.calls)-1]
+		c.err <- errTrySolo
+	}
+}
+
+// updateWait is Update which waits for the open writable transaction
+// instead of returning ErrTxExists.
+func (db *DB) updateWait(fn func(*Tx) error) error {
+	for {
+		tx, err := NewWritableTx(db)
+		if err == nil {
+			return tx.run(fn)
+		}
+		if !errors.Is(err, ErrTxExists) {
+			return err
+		}
+		// Writable tx holds rwlock until it's closed
+		db.rwlock.Lock()
+		db.rwlock.Unlock() // nolint: staticcheck
+	}
+}
+
+// panicked is error of batch function which panics, it's run again
+// alone so the panic reaches its caller.
+type panicked struct {
+	reason interface{}
+}
+
+func (p panicked) Error() string {
+	if err, ok := p.reason.(error); ok {
+		return err.Error()
+	}
+	return fmt.Sprint(p.reason)
+}
+
+// safelyCall calls fn and turns panic into error.
+func safelyCall(fn func(*Tx) error, tx *Tx) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = panicked{p}
+		}
+	}()
+	return fn(tx)
+}
@@ -0,0 +1,123 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBatch(t *testing.T) {
+	db, err := Open(Options{Path: dataPath(t), MaxBatchDelay: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	start := db.meta.txid
+
+	// Calls from concurrent goroutines share commits
+	const calls = 100
+	errBad := errors.New("bad call")
+	errs := make([]error, calls)
+	wg := sync.WaitGroup{}
+	for i := 0; i < calls; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = db.Batch(func(tx *Tx) error {
+				_, err := tx.Set([]byte(fmt.Sprintf("key-%03d", i)), []byte("value"))
+				if err != nil {
+					return err
+				}
+				if i%10 == 0 {
+					return errBad
+				}
+				return nil
+			})
+		}(i)
+	}
+	wg.Wait()
+	if db.meta.txid-start >= calls {
+		t.Errorf("Expect calls batched, get %d commits for %d calls", db.meta.txid-start, calls)
+	}
+
+	// Failed calls get their own error and commit nothing
+	err = db.View(func(tx *Tx) error {
+		for i := 0; i < calls; i++ {
+			value := tx.Get([]byte(fmt.Sprintf("key-%03d", i)))
+			if i%10 == 0 {
+				if !errors.Is(errs[i], errBad) || value != nil {
+					t.Errorf("Call %d: expect error and no change, get %v, %q", i, errs[i], value)
+				}
+				continue
+			}
+			if errs[i] != nil || value == nil {
+				t.Errorf("Call %d: expect committed, get %v, %q", i, errs[i], value)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Panic reaches the caller
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Expect panic from Batch")
+			}
+		}()
+		_ = db.Batch(func(tx *Tx) error {
+			panic("boom")
+		})
+	}()
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Batch(func(*Tx) error { return nil }); !errors.Is(err, ErrDBClosed) {
+		t.Errorf("Expect ErrDBClosed after Close, get %v", err)
+	}
+}
+
+func TestBatchSize(t *testing.T) {
+	// Full batch runs without waiting for the delay
+	db, err := Open(Options{Path: dataPath(t), MaxBatchSize: 1, MaxBatchDelay: time.Hour})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	// Batch waits for the open writable tx
+	tx, _ := NewWritableTx(db)
+	done := make(chan error)
+	go func() {
+		done <- db.Batch(func(tx *Tx) error {
+			_, err := tx.Set([]byte("a"), []byte("1"))
+			return err
+		})
+	}()
+	mustSet(t, tx, []byte("b"), []byte("2"))
+	mustCommit(t, tx)
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatalf("Batch failed: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Batch not run")
+	}
+	err = db.View(func(tx *Tx) error {
+		if tx.Get([]byte("a")) == nil || tx.Get([]byte("b")) == nil {
+			t.Error("Expect both keys committed")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,309 @@
+package db
+
+import (
+	"encoding/binary"
+	"fmt"
+	"unsafe"
+
+	"github.com/daicang/mk/pkg/audit"
+	"github.com/daicang/mk/pkg/common"
+	"github.com/daicang/mk/pkg/kv"
+	"github.com/daicang/mk/pkg/page"
+)
+
+// Changefeed keeps changes of recent commits in the DB file, so
+// consumers can read changes since a txid even after restart, e.g. for
+// incremental backup or replication, see Options.ChangefeedPages.
+//
+// Changes of a commit are appended to the last segment, a run of
+// changefeed pages copied to new pages on every append like nodes are.
+// A new segment starts when the last one is full, and the oldest
+// segments are dropped when the feed outgrows its page limit.
+// The directory page referenced by meta lists segments:
+// page header | start txid | segment info | segment info | ..
+// All commits after start txid are in the feed. A segment page holds
+// one record per commit:
+// page header | txid | op count | length | ops | txid | ..
+// op: kind | key length uvarint | key | value length uvarint | value
+
+const (
+	// change kinds
+	changeSet    byte = 1
+	changeRemove byte = 2
+	changeMerge  byte = 3
+
+	// changeHeaderSize is size of commit record header:
+	// txid uint64 | op count uint32 | length uint32
+	changeHeaderSize = 16
+	// segmentInfoSize is size of segment info in directory:
+	// page id uint32 | size uint32 | record count uint32 | pad | first txid | last txid
+	segmentInfoSize = 32
+)
+
+// Change is one change of a commit in the changefeed.
+type Change struct {
+	TxID uint64
+	// Op is audit.OpSet, audit.OpRemove or audit.OpMerge
+	Op  string
+	Key kv.Key
+	// Value is nil for removal, the operand for merge
+	Value kv.Value
+}
+
+// segmentInfo describes one changefeed segment.
+type segmentInfo struct {
+	id common.Pgid
+	// size is bytes of commit records
+	size int
+	// count is number of commit records
+	count int
+	// first and last are txids of the first and last record
+	first uint64
+	last  uint64
+}
+
+// pagesFor returns number of pages holding size bytes of page data.
+func pagesFor(size int) int {
+	return (page.HeaderSize + size + page.PageSize - 1) / page.PageSize
+}
+
+// pageData returns data bytes of page p and its overflow pages.
+func pageData(p *page.Page) []byte {
+	size := (p.Overflow()+1)*page.PageSize - page.HeaderSize
+	return (*[common.MmapMaxSize]byte)(unsafe.Pointer(&p.Data))[:size:size]
+}
+
+// appendBytes appends length of b as uvarint and b to buf.
+func appendBytes(buf, b []byte) []byte {
+	var n [binary.MaxVarintLen64]byte
+	buf = append(buf, n[:binary.PutUvarint(n[:], uint64(len(b)))]...)
+	return append(buf, b...)
+}
+
+// recordChange encodes a change of tx for the changefeed.
+func (tx *Tx) recordChange(op string, key kv.Key, value kv.Value) {
+	if tx.db.changefeedPages == 0 {
+		return
+	}
+	kind := changeSet
+	switch op {
+	case audit.OpRemove:
+		kind = changeRemove
+	case audit.OpMerge:
+		kind = changeMerge
+	}
+	tx.changes = append(tx.changes, kind)
+	tx.changes = appendBytes(tx.changes, key)
+	if kind != changeRemove {
+		tx.changes = appendBytes(tx.changes, value)
+	}
+	tx.changeCount++
+}
+
+// readChangefeed returns start txid and segments of changefeed in tx
+// meta.
+func (tx *Tx) readChangefeed() (uint64, []segmentInfo) {
+	p := tx.getPage(tx.meta.changefeedPage)
+	data := pageData(p)
+	start := binary.LittleEndian.Uint64(data)
+	segments := make([]segmentInfo, p.Count())
+	for i := range segments {
+		b := data[8+i*segmentInfoSize:]
+		segments[i] = segmentInfo{
+			id:    common.Pgid(binary.LittleEndian.Uint32(b)),
+			size:  int(binary.LittleEndian.Uint32(b[4:])),
+			count: int(binary.LittleEndian.Uint32(b[8:])),
+			first: binary.LittleEndian.Uint64(b[16:]),
+			last:  binary.LittleEndian.Uint64(b[24:]),
+		}
+	}
+	return start, segments
+}
+
+// dropChangefeed frees changefeed pages of tx meta.
+func (tx *Tx) dropChangefeed() {
+	_, segments := tx.readChangefeed()
+	for _, s := range segments {
+		tx.freePage(s.id)
+	}
+	tx.freePage(tx.meta.changefeedPage)
+	tx.meta.changefeedPage = 0
+}
+
+// writeChangefeed appends changes of tx to the changefeed, and drops
+// the feed when it's disabled.
+func (tx *Tx) writeChangefeed() error {
+	limit := tx.db.changefeedPages
+	if limit == 0 {
+		if tx.meta.changefeedPage != 0 {
+			tx.dropChangefeed()
+		}
+		return nil
+	}
+	// A new feed holds commits after the last one
+	start, segments := tx.id-1, []segmentInfo{}
+	if tx.meta.changefeedPage != 0 {
+		if tx.changeCount == 0 {
+			return nil
+		}
+		start, segments = tx.readChangefeed()
+		tx.freePage(tx.meta.changefeedPage)
+	}
+
+	if tx.changeCount > 0 {
+		record := make([]byte, changeHeaderSize, changeHeaderSize+len(tx.changes))
+		binary.LittleEndian.PutUint64(record, tx.id)
+		binary.LittleEndian.PutUint32(record[8:], uint32(tx.changeCount))
+		binary.LittleEndian.PutUint32(record[12:], uint32(len(tx.changes)))
+		record = append(record, tx.changes...)
+
+		// Append to the last segment when it stays in one page
+		seg := segmentInfo{first: tx.id}
+		var data []byte
+		n := len(segments)
+		if n > 0 && segments[n-1].size+len(record) <= page.PageSize-page.HeaderSize {
+			seg = segments[n-1]
+			data = append(data, pageData(tx.getPage(seg.id))[:seg.size]...)
+			tx.freePage(seg.id)
+			segments = segments[:n-1]
+		}
+		data = append(data, record...)
+		p, err := tx.allocate(pagesFor(len(data)))
+		if err != nil {
+			return err
+		}
+		p.SetFlags(page.FlagChangefeed)
+		p.SetCount(seg.count + 1)
+		copy(pageData(p), data)
+		seg.id = p.Index()
+		seg.size = len(data)
+		seg.count++
+		seg.last = tx.id
+		segments = append(segments, seg)
+	}
+
+	// Drop the oldest segments beyond limit, the last one is kept
+	total := pagesFor(8 + len(segments)*segmentInfoSize)
+	for _, s := range segments {
+		total += pagesFor(s.size)
+	}
+	for len(segments) > 1 && total > limit {
+		total -= pagesFor(segments[0].size)
+		tx.freePage(segments[0].id)
+		start = segments[0].last
+		segments = segments[1:]
+	}
+
+	p, err := tx.allocate(pagesFor(8 + len(segments)*segmentInfoSize))
+	if err != nil {
+		return err
+	}
+	p.SetFlags(page.FlagChangefeed)
+	p.SetCount(len(segments))
+	data := pageData(p)
+	binary.LittleEndian.PutUint64(data, start)
+	for i, s := range segments {
+		b := data[8+i*segmentInfoSize:]
+		binary.LittleEndian.PutUint32(b, uint32(s.id))
+		binary.LittleEndian.PutUint32(b[4:], uint32(s.size))
+		binary.LittleEndian.PutUint32(b[8:], uint32(s.count))
+		binary.LittleEndian.PutUint64(b[16:], s.first)
+		binary.LittleEndian.PutUint64(b[24:], s.last)
+	}
+	tx.meta.changefeedPage = p.Index()
+	return nil
+}
+
+// Changes calls fn for changes of commits after txid since in commit
+// order, up to the snapshot of tx. It stops at the first error from fn
+// and returns it. Key and value are only valid in fn.
+// It returns ErrChangefeedDisabled when the file has no changefeed, and
+// ErrChangesTruncated when some commits after since are dropped from
+// the feed, or made before it's enabled.
+func (tx *Tx) Changes(since uint64, fn func(c Change) error) error {
+	if tx.closed() {
+		return ErrTxClosed
+	}
+	if tx.meta.changefeedPage == 0 {
+		return ErrChangefeedDisabled
+	}
+	start, segments := tx.readChangefeed()
+	if since < start {
+		return fmt.Errorf("%w: feed starts after txid %d", ErrChangesTruncated, start)
+	}
+	for _, s := range segments {
+		if s.last <= since {
+			continue
+		}
+		p := tx.getPage(s.id)
+		data := pageData(p)
+		if !p.IsChangefeed() || s.size > len(data) {
+			return fmt.Errorf("%w: bad changefeed segment in page %d", ErrInvalidDB, s.id)
+		}
+		data = data[:s.size]
+		for len(data) > 0 {
+			if len(data) < changeHeaderSize {
+				return fmt.Errorf("%w: torn changefeed record in page %d", ErrInvalidDB, s.id)
+			}
+			txid := binary.LittleEndian.Uint64(data)
+			count := int(binary.LittleEndian.Uint32(data[8:]))
+			length := int(binary.LittleEndian.Uint32(data[12:]))
+			data = data[changeHeaderSize:]
+			if length > len(data) {
+				return fmt.Errorf("%w: changefeed record of tx %d beyond page %d", ErrInvalidDB, txid, s.id)
+			}
+			if txid > since {
+				err := decodeChanges(txid, count, data[:length], fn)
+				if err != nil {
+					return err
+				}
+			}
+			data = data[length:]
+		}
+	}
+	return nil
+}
+
+// decodeChanges calls fn for count changes of tx txid in ops.
+func decodeChanges(txid uint64, count int, ops []byte, fn func(c Change) error) error {
+	// readBytes reads uvarint length and the following bytes
+	readBytes := func() ([]byte, bool) {
+		n, size := binary.Uvarint(ops)
+		if size <= 0 || n > uint64(len(ops)-size) {
+			return nil, false
+		}
+		b := ops[size : size+int(n)]
+		ops = ops[size+int(n):]
+		return b, true
+	}
+	for i := 0; i < count; i++ {
+		if len(ops) == 0 {
+			return fmt.Errorf("%w: changefeed record of tx %d has %d of %d changes", ErrInvalidDB, txid, i, count)
+		}
+		c := Change{TxID: txid, Op: audit.OpSet}
+		kind := ops[0]
+		ops = ops[1:]
+		key, ok := readBytes()
+		c.Key = key
+		switch {
+		case !ok:
+		case kind == changeSet:
+			c.Value, ok = readBytes()
+		case kind == changeRemove:
+			c.Op = audit.OpRemove
+		case kind == changeMerge:
+			c.Op = audit.OpMerge
+			c.Value, ok = readBytes()
+		default:
+			ok = false
+		}
+		if !ok {
+			return fmt.Errorf("%w: bad change %d of tx %d in changefeed", ErrInvalidDB, i, txid)
+		}
+		err := fn(c)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/daicang/mk/pkg/audit"
+)
+
+// changes returns changes after since as "txid op key=value" strings.
+func changes(t *testing.T, db *DB, since uint64) ([]string, error) {
+	t.Helper()
+	tx, err := NewReadOnlyTx(db)
+	if err != nil {
+		t.Fatalf("Failed to begin tx: %v", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	list := []string{}
+	err = tx.Changes(since, func(c Change) error {
+		list = append(list, fmt.Sprintf("%d %s %s=%s", c.TxID, c.Op, c.Key, c.Value))
+		return nil
+	})
+	return list, err
+}
+
+func TestChangefeed(t *testing.T) {
+	db := openDB(t)
+	fillDB(t, db, map[string]string{"before": "feed"})
+	path := db.path
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	db, err := Open(Options{Path: path, ChangefeedPages: 8, StrictMode: true})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	start := db.meta.txid
+	tx, _ := NewWritableTx(db)
+	mustSet(t, tx, []byte("a"), []byte("1"))
+	mustSet(t, tx, []byte("b"), []byte{})
+	mustCommit(t, tx)
+	first := tx.ID()
+	tx, _ = NewWritableTx(db)
+	mustRemove(t, tx, []byte("a"))
+	sp, _ := tx.Savepoint()
+	mustSet(t, tx, []byte("c"), []byte("3"))
+	if err := tx.RollbackTo(sp); err != nil {
+		t.Fatalf("Failed to rollback to savepoint: %v", err)
+	}
+	mustCommit(t, tx)
+	second := tx.ID()
+	// Commit without changes
+	tx, _ = NewWritableTx(db)
+	mustCommit(t, tx)
+
+	all := []string{
+		fmt.Sprintf("%d %s a=1", first, audit.OpSet),
+		fmt.Sprintf("%d %s b=", first, audit.OpSet),
+		fmt.Sprintf("%d %s a=", second, audit.OpRemove),
+	}
+	if list, err := changes(t, db, start); err != nil || !reflect.DeepEqual(list, all) {
+		t.Errorf("Expect changes %q, get %q, %v", all, list, err)
+	}
+	if list, err := changes(t, db, first); err != nil || !reflect.DeepEqual(list, all[2:]) {
+		t.Errorf("Expect changes %q, get %q, %v", all[2:], list, err)
+	}
+	if _, err := changes(t, db, start-1); !errors.Is(err, ErrChangesTruncated) {
+		t.Errorf("Expect changes before feed truncated, get %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+
+	// Changes survive reopen, and are dropped with changefeed disabled
+	db, err = Open(Options{Path: path, StrictMode: true})
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+	if list, err := changes(t, db, start); err != nil || !reflect.DeepEqual(list, all) {
+		t.Errorf("Expect changes %q after reopen, get %q, %v", all, list, err)
+	}
+	fillDB(t, db, map[string]string{"d": "4"})
+	if _, err := changes(t, db, start); !errors.Is(err, ErrChangefeedDisabled) {
+		t.Errorf("Expect changefeed disabled, get %v", err)
+	}
+	if errs := checkErrors(t, db); len(errs) != 0 {
+		t.Errorf("Check after dropping changefeed: %v", errs)
+	}
+}
+
+func TestChangefeedRing(t *testing.T) {
+	limit := 6
+	db, err := Open(Options{Path: dataPath(t), ChangefeedPages: limit, StrictMode: true})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+	start := db.meta.txid
+	value := strings.Repeat("v", 1000)
+	for i := 0; i < 50; i++ {
+		fillDB(t, db, map[string]string{fmt.Sprintf("key-%02d", i): value})
+	}
+	tx, _ := NewWritableTx(db)
+	mustSet(t, tx, []byte("large"), []byte(strings.Repeat("L", 3*limit*1000)))
+	mustCommit(t, tx)
+	last := tx.ID()
+
+	rtx, _ := NewReadOnlyTx(db)
+	pages := 0
+	for _, p := range rtx.Pages() {
+		if p.Type == "changefeed" {
+			pages += p.Overflow + 1
+		}
+	}
+	_ = rtx.Rollback()
+	// The last commit is kept even if it's beyond limit
+	if pages > limit+pagesFor(3*limit*1000) {
+		t.Errorf("Changefeed takes %d pages over limit %d", pages, limit)
+	}
+
+	if _, err := changes(t, db, start); !errors.Is(err, ErrChangesTruncated) {
+		t.Errorf("Expect old changes truncated, get %v", err)
+	}
+	list, err := changes(t, db, last-1)
+	if err != nil || len(list) != 1 || !strings.HasPrefix(list[0], fmt.Sprintf("%d %s large=LLL", last, audit.OpSet)) {
+		t.Errorf("Expect the last change, get %d changes, %v", len(list), err)
+	}
+}
@@ -0,0 +1,235 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/daicang/mk/pkg/codec"
+	"github.com/daicang/mk/pkg/common"
+	"github.com/daicang/mk/pkg/freelist"
+	"github.com/daicang/mk/pkg/kv"
+	"github.com/daicang/mk/pkg/page"
+)
+
+// Check verifies pages of this read-only tx in background, sends each
+// problem found to the returned channel, and closes it when done.
+// Problems wrap ErrInvalidDB. Check verifies that:
+//   - every page is used exactly once, as meta, freelist, free page,
+//     tree node, overflow or changefeed page
+//   - page types match their use
+//   - keys are sorted in each node and within range of parent index,
+//     parent index is the first key of child
+//   - all leaves are at the same depth
+//
+// tx must not be used until the channel is closed.
+func (tx *Tx) Check() <-chan error {
+	ch := make(chan error)
+	go func() {
+		defer close(ch)
+		if tx.writable {
+			ch <- ErrTxWritable
+			return
+		}
+		if tx.closed() {
+			ch <- ErrTxClosed
+			return
+		}
+		c := checker{
+			tx:        tx,
+			ch:        ch,
+			owners:    map[common.Pgid]string{},
+			leafDepth: -1,
+		}
+		c.check()
+	}()
+	return ch
+}
+
+// strictCheck checks read-only tx and closes it, panics on any problem.
+// See Options.StrictMode.
+func strictCheck(tx *Tx) {
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	msgs := []string{}
+	for err := range tx.Check() {
+		msgs = append(msgs, err.Error())
+	}
+	if len(msgs) != 0 {
+		panic(fmt.Sprintf("strict mode: check after commit %d: %s", tx.id, strings.Join(msgs, "; ")))
+	}
+}
+
+// checker holds state of Tx.Check.
+type checker struct {
+	tx *Tx
+	ch chan<- error
+	// owners maps used pages to their use
+	owners map[common.Pgid]string
+	// leafDepth is depth of the first leaf, -1 before any leaf
+	leafDepth int
+}
+
+func (c *checker) errorf(format string, args ...interface{}) {
+	c.ch <- fmt.Errorf("%w: %s", ErrInvalidDB, fmt.Sprintf(format, args...))
+}
+
+func (c *checker) check() {
+	m := c.tx.meta
+	for i := 0; i < c.tx.db.metaPages; i++ {
+		c.use(common.Pgid(i), 1, "meta")
+	}
+	if c.valid(m.freelistPage, "freelist") {
+		p := c.tx.getPage(m.freelistPage)
+		if !p.IsFreelist() {
+			c.errorf("freelist page %d has type %s", p.Index(), p.Type())
+		} else if c.use(p.Index(), p.Overflow()+1, "freelist") {
+			f := freelist.NewFreelist()
+			f.ReadPage(p)
+			for _, id := range f.IDs() {
+				if c.valid(id, "free") {
+					c.use(id, 1, "free")
+				}
+			}
+		}
+	}
+	if c.valid(m.rootPage, "root") {
+		c.checkNode(m.rootPage, nil, nil, 0)
+	}
+	if m.changefeedPage != 0 && c.checkChangefeedPage(m.changefeedPage) {
+		_, segments := c.tx.readChangefeed()
+		for _, s := range segments {
+			c.checkChangefeedPage(s.id)
+		}
+	}
+	for id := common.Pgid(0); id < m.totalPages; id++ {
+		if _, ok := c.owners[id]; !ok {
+			c.errorf("page %d is not used", id)
+		}
+	}
+}
+
+// valid returns whether page id is inside the file.
+func (c *checker) valid(id common.Pgid, use string) bool {
+	if id >= c.tx.meta.totalPages {
+		c.errorf("%s page %d is beyond %d pages", use, id, c.tx.meta.totalPages)
+		return false
+	}
+	return true
+}
+
+// use marks count pages from id with given use, returns false when
+// any of them is already used.
+func (c *checker) use(id common.Pgid, count int, use string) bool {
+	ok := true
+	for i := id; i < id+common.Pgid(count); i++ {
+		if owner, exist := c.owners[i]; exist {
+			c.errorf("page %d is used as both %s and %s", i, owner, use)
+			ok = false
+			continue
+		}
+		c.owners[i] = use
+	}
+	return ok
+}
+
+// checkChangefeedPage checks type of changefeed page and marks it
+// used, returns whether it's valid.
+func (c *checker) checkChangefeedPage(id common.Pgid) bool {
+	if !c.valid(id, "changefeed") {
+		return false
+	}
+	p := c.tx.getPage(id)
+	if !p.IsChangefeed() {
+		c.errorf("changefeed page %d has type %s", id, p.Type())
+		return false
+	}
+	return c.use(id, p.Overflow()+1, "changefeed")
+}
+
+// checkNode checks node at page id and its subtree. Keys of node must
+// be in [lower, upper), nil bound means unbounded.
+func (c *checker) checkNode(id common.Pgid, lower, upper kv.Key, depth int) {
+	p := c.tx.getPage(id)
+	if !p.IsLeaf() && !p.IsInternal() {
+		c.errorf("node page %d has type %s", id, p.Type())
+		return
+	}
+	// Reused page may lead to a cycle, don't go into it
+	if !c.use(id, p.Overflow()+1, "node") {
+		return
+	}
+	if p.Count() == 0 && depth > 0 {
+		c.errorf("node page %d is empty", id)
+		return
+	}
+	for i := 0; i < p.Count(); i++ {
+		key := p.GetKeyAt(i)
+		if i > 0 && c.tx.db.compare(p.GetKeyAt(i-1), key) >= 0 {
+			c.errorf("node page %d: key %d %q not after %q", id, i, key, p.GetKeyAt(i-1))
+		}
+		if (lower != nil && c.tx.db.compare(key, lower) < 0) || (upper != nil && c.tx.db.compare(key, upper) >= 0) {
+			c.errorf("node page %d: key %q out of parent range [%q, %q)", id, key, lower, upper)
+		}
+	}
+
+	if p.IsLeaf() {
+		if c.leafDepth < 0 {
+			c.leafDepth = depth
+		} else if depth != c.leafDepth {
+			c.errorf("leaf page %d at depth %d, expect %d", id, depth, c.leafDepth)
+		}
+		for i := 0; i < p.Count(); i++ {
+			if p.GetOverflowAt(i) != 0 {
+				c.checkOverflow(p, i)
+			}
+		}
+		return
+	}
+	for i := 0; i < p.Count(); i++ {
+		cid := p.GetChildPgid(i)
+		if !c.valid(cid, "child") {
+			continue
+		}
+		child := c.tx.getPage(cid)
+		if child.Count() > 0 && (child.IsLeaf() || child.IsInternal()) && !bytes.Equal(child.GetKeyAt(0), p.GetKeyAt(i)) {
+			c.errorf("node page %d indexes child %d by %q, child starts at %q", id, cid, p.GetKeyAt(i), child.GetKeyAt(0))
+		}
+		end := upper
+		if i+1 < p.Count() {
+			end = p.GetKeyAt(i + 1)
+		}
+		c.checkNode(cid, p.GetKeyAt(i), end, depth+1)
+	}
+}
+
+// checkOverflow checks overflow chain of value i in leaf page p.
+func (c *checker) checkOverflow(p *page.Page, i int) {
+	size := 0
+	for id := p.GetOverflowAt(i); id != 0; {
+		if !c.valid(id, "overflow") {
+			return
+		}
+		op := c.tx.getPage(id)
+		if !op.IsOverflow() {
+			c.errorf("overflow page %d has type %s", id, op.Type())
+			return
+		}
+		if !c.use(id, 1, "overflow") {
+			return
+		}
+		size += op.Count()
+		id = op.GetOverflowNext()
+	}
+	if size != p.GetValueSizeAt(i) {
+		c.errorf("leaf page %d: value %d has %d bytes in overflow pages, expect %d", p.Index(), i, size, p.GetValueSizeAt(i))
+		return
+	}
+	if p.IsCompressedAt(i) {
+		_, err := codec.Decode(page.ReadOverflow(c.tx.getPage, p.GetOverflowAt(i), size))
+		if err != nil {
+			c.errorf("leaf page %d: value %d: %v", p.Index(), i, err)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/daicang/mk/pkg/page"
+)
+
+// checkErrors runs Check in a new read-only tx, returns all errors.
+func checkErrors(t *testing.T, db *DB) []error {
+	t.Helper()
+	tx, err := NewReadOnlyTx(db)
+	if err != nil {
+		t.Fatalf("Failed to create tx: %v", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	errs := []error{}
+	for err := range tx.Check() {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+func TestCheck(t *testing.T) {
+	db := openDB(t)
+	if errs := checkErrors(t, db); len(errs) != 0 {
+		t.Errorf("Empty DB: %v", errs)
+	}
+
+	kvs := map[string]string{}
+	for i := 0; i < 3000; i++ {
+		kvs[fmt.Sprintf("key-%04d", i)] = fmt.Sprintf("value-%d", i)
+	}
+	for i := 0; i < 10; i++ {
+		kvs[fmt.Sprintf("large-%d", i)] = strings.Repeat("x", page.PageSize*(i+1))
+	}
+	fillDB(t, db, kvs)
+	tx, _ := NewWritableTx(db)
+	for i := 0; i < 3000; i += 3 {
+		mustRemove(t, tx, []byte(fmt.Sprintf("key-%04d", i)))
+	}
+	mustRemove(t, tx, []byte("large-3"))
+	mustCommit(t, tx)
+	if errs := checkErrors(t, db); len(errs) != 0 {
+		t.Errorf("Check after commits: %v", errs)
+	}
+
+	tx, _ = NewWritableTx(db)
+	if err := <-tx.Check(); !errors.Is(err, ErrTxWritable) {
+		t.Errorf("Expect ErrTxWritable, get %v", err)
+	}
+	mustCommit(t, tx)
+}
+
+func TestCheckCorrupted(t *testing.T) {
+	db := openDB(t)
+	kvs := map[string]string{}
+	for i := 0; i < 3000; i++ {
+		kvs[fmt.Sprintf("key-%04d", i)] = "value"
+	}
+	fillDB(t, db, kvs)
+	tx, _ := NewWritableTx(db)
+	for i := 0; i < 1000; i++ {
+		mustRemove(t, tx, []byte(fmt.Sprintf("key-%04d", i)))
+	}
+	mustCommit(t, tx)
+
+	rtx, _ := NewReadOnlyTx(db)
+	buf := bytes.Buffer{}
+	if _, err := rtx.WriteTo(&buf); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	meta := *rtx.meta
+	if err := rtx.Rollback(); err != nil {
+		t.Fatalf("Failed to rollback: %v", err)
+	}
+
+	corrupts := map[string]func(data []byte){
+		"leaked page": func(data []byte) {
+			p := page.FromBuffer(data, meta.freelistPage)
+			p.SetCount(p.Count() - 1)
+		},
+		"extra free page": func(data []byte) {
+			p := page.FromBuffer(data, meta.freelistPage)
+			p.SetCount(p.Count() + 1)
+		},
+		"unsorted key": func(data []byte) {
+			p := page.FromBuffer(data, meta.rootPage)
+			for p.IsInternal() {
+				p = page.FromBuffer(data, p.GetChildPgid(p.Count()-1))
+			}
+			p.GetKeyAt(0)[0] = 0xff
+		},
+	}
+	for name, corrupt := range corrupts {
+		data := append([]byte{}, buf.Bytes()...)
+		corrupt(data)
+		path := dataPath(t)
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+		cdb, err := Open(Options{Path: path})
+		if err != nil {
+			t.Fatalf("%s: failed to open: %v", name, err)
+		}
+		errs := checkErrors(t, cdb)
+		if len(errs) == 0 {
+			t.Errorf("%s: expect errors", name)
+		}
+		for _, err := range errs {
+			if !errors.Is(err, ErrInvalidDB) {
+				t.Errorf("%s: expect ErrInvalidDB, get %v", name, err)
+			}
+		}
+		if err := cdb.Close(); err != nil {
+			t.Errorf("Failed to close: %v", err)
+		}
+	}
+}
+
+func TestStrictMode(t *testing.T) {
+	db, err := Open(Options{Path: dataPath(t), StrictMode: true})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+	kvs := map[string]string{}
+	for i := 0; i < 3000; i++ {
+		kvs[fmt.Sprintf("key-%04d", i)] = fmt.Sprintf("value-%d", i)
+	}
+	fillDB(t, db, kvs)
+	tx, _ := NewWritableTx(db)
+	for i := 0; i < 3000; i += 2 {
+		mustRemove(t, tx, []byte(fmt.Sprintf("key-%04d", i)))
+	}
+	mustCommit(t, tx)
+
+	// A page allocated and never used leaks
+	tx, _ = NewWritableTx(db)
+	mustSet(t, tx, []byte("key"), []byte("value"))
+	if _, err := tx.allocate(1); err != nil {
+		t.Fatalf("Failed to allocate: %v", err)
+	}
+	defer func() {
+		r := recover()
+		if r == nil || !strings.Contains(fmt.Sprint(r), "strict mode") {
+			t.Errorf("Expect strict mode panic, get %v", r)
+		}
+	}()
+	_ = tx.Commit()
+}
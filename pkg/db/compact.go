@@ -0,0 +1,100 @@
+package db
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/daicang/mk/pkg/kv"
+	"github.com/daicang/mk/pkg/mmap"
+	"github.com/daicang/mk/pkg/page"
+)
+
+// compactTxSize is bytes of pairs copied by one transaction of Compact.
+var compactTxSize = 4 << 20
+
+// Compact writes the last committed state to a new DB file at dstPath,
+// with pairs rewritten densely in key order. The new file holds no free
+// pages, so it's at most the live size of DB. Writes go on during
+// Compact but are not copied. dstPath must not exist.
+// Pages read by the copy are dropped from the memory map afterwards,
+// so one pass over a large DB doesn't stay in process memory.
+// The new file is encrypted with the key of DB, if any.
+func (db *DB) Compact(dstPath string) error {
+	return db.CompactWithKey(dstPath, db.encryptionKey)
+}
+
+// CompactWithKey is Compact to a file encrypted with key, which rotates
+// the encryption key: the new file replaces DB and is opened with key.
+// Nil key writes a file without encryption.
+func (db *DB) CompactWithKey(dstPath string, key []byte) error {
+	_, err := os.Stat(dstPath)
+	if err == nil {
+		return fmt.Errorf("compact to %s: %w", dstPath, os.ErrExist)
+	}
+	// Copy without sync, the file is synced once at the end
+	opts := Options{Path: dstPath, Durability: DurabilityNone, EncryptionKey: key}
+	if db.compareName != "" {
+		opts.Compare, opts.CompareName = db.compare, db.compareName
+	}
+	dst, err := Open(opts)
+	if err != nil {
+		return err
+	}
+	err = db.View(func(tx *Tx) error {
+		err := tx.copyTo(dst)
+		if err != nil {
+			return err
+		}
+		return tx.dropMmap()
+	})
+	if err == nil {
+		err = dst.Sync()
+	}
+	cerr := dst.Close()
+	if err != nil {
+		return err
+	}
+	return cerr
+}
+
+// dropMmap drops pages of tx snapshot from memory map, later reads
+// load them again from the file. Locked pages are kept.
+func (tx *Tx) dropMmap() error {
+	if tx.db.noMmap || tx.db.mlock {
+		return nil
+	}
+	size := int(tx.meta.totalPages) * page.PageSize
+	return mmap.Advise(tx.db.mmData()[:size], mmap.DontNeed)
+}
+
+// copyTo copies all pairs and the sequence of tx to dst, committing
+// every compactTxSize bytes.
+func (tx *Tx) copyTo(dst *DB) error {
+	dtx, err := NewWritableTx(dst)
+	if err != nil {
+		return err
+	}
+	size := 0
+	err = tx.ForEach(func(k kv.Key, v kv.Value) error {
+		if size >= compactTxSize {
+			err := dtx.Commit()
+			if err != nil {
+				return err
+			}
+			dtx, err = NewWritableTx(dst)
+			if err != nil {
+				return err
+			}
+			size = 0
+		}
+		size += len(k) + len(v)
+		_, err := dtx.Set(k, v)
+		return err
+	})
+	if err != nil {
+		_ = dtx.Rollback()
+		return err
+	}
+	dtx.meta.sequence = tx.meta.sequence
+	return dtx.Commit()
+}
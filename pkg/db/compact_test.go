@@ -0,0 +1,84 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompact(t *testing.T) {
+	db := openDB(t)
+	kvs := map[string]string{}
+	for round := 0; round < 5; round++ {
+		batch := map[string]string{}
+		for i := 0; i < 4000; i++ {
+			batch[fmt.Sprintf("key-%d-%04d", round, i)] = fmt.Sprintf("value-%d", i)
+		}
+		fillDB(t, db, batch)
+		for k, v := range batch {
+			kvs[k] = v
+		}
+	}
+	// Remove most keys, so the file is mostly free pages
+	tx, _ := NewWritableTx(db)
+	for k := range kvs {
+		if k[len(k)-1] != '0' {
+			mustRemove(t, tx, []byte(k))
+			delete(kvs, k)
+		}
+	}
+	_, err := tx.NextSequence()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustCommit(t, tx)
+
+	// Small transactions exercise commits during copy
+	defer func(size int) { compactTxSize = size }(compactTxSize)
+	compactTxSize = 16 << 10
+	path := filepath.Join(t.TempDir(), "compact")
+	err = db.Compact(path)
+	if err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	srcInfo, _ := db.file.Stat()
+	dstInfo, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dstInfo.Size()*2 > srcInfo.Size() {
+		t.Errorf("Expect compacted file much smaller, get %d bytes from %d", dstInfo.Size(), srcInfo.Size())
+	}
+	checkBackup(t, path, kvs)
+	dst, err := Open(Options{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dst.meta.sequence != 1 {
+		t.Errorf("Expect sequence copied, get %d", dst.meta.sequence)
+	}
+	err = dst.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Compact(path); !errors.Is(err, os.ErrExist) {
+		t.Errorf("Expect ErrExist compacting to existing file, get %v", err)
+	}
+	// Source pages dropped from the map are read again from file
+	rtx, _ := NewReadOnlyTx(db)
+	for k, v := range kvs {
+		if got := rtx.Get([]byte(k)); string(got) != v {
+			t.Fatalf("Key %s: expect %s after compact, get %q", k, v, got)
+		}
+	}
+	if err := rtx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,52 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/daicang/mk/pkg/codec"
+	"github.com/daicang/mk/pkg/kv"
+)
+
+// Compression is how values are compressed, see Options.Compression.
+type Compression int
+
+const (
+	// CompressionNone stores values as is.
+	CompressionNone Compression = iota
+	// CompressionFlate compresses with DEFLATE at best speed.
+	CompressionFlate
+)
+
+// String returns compression name for print.
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionFlate:
+		return "flate"
+	}
+	return fmt.Sprintf("Compression(%d)", int(c))
+}
+
+// codec returns codec of compression.
+func (c Compression) codec() codec.Codec {
+	if c == CompressionFlate {
+		return codec.Flate
+	}
+	return codec.None
+}
+
+// compress returns value compressed with Options.Compression, and
+// whether it's compressed. Values below Options.CompressionThreshold,
+// or not smaller after compression, are returned as is.
+func (tx *Tx) compress(value kv.Value) (kv.Value, bool) {
+	if tx.db.compression == CompressionNone || len(value) < tx.db.compressionThreshold {
+		return value, false
+	}
+	encoded := codec.Encode(tx.db.compression.codec(), value)
+	if len(encoded) >= len(value) {
+		return value, false
+	}
+	tx.stats.BytesCompressed += len(value) - len(encoded)
+	return encoded, true
+}
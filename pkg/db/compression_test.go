@@ -0,0 +1,127 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/daicang/mk/pkg/codec"
+	"github.com/daicang/mk/pkg/page"
+)
+
+func TestCompression(t *testing.T) {
+	path := dataPath(t)
+	db, err := Open(Options{Path: path, Compression: CompressionFlate})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	blob := []byte(strings.Repeat(`{"id":1,"tags":["a","b"]},`, 10*page.PageSize/26))
+	small := []byte("small")
+	tx, err := NewWritableTx(db)
+	if err != nil {
+		t.Fatalf("Failed to create tx: %v", err)
+	}
+	mustSet(t, tx, []byte("blob"), blob)
+	mustSet(t, tx, []byte("small"), small)
+	mustCommit(t, tx)
+	stats := db.Stats()
+	if stats.TxStats.BytesCompressed < len(blob)/2 {
+		t.Errorf("Expect blob compressed, %d bytes saved", stats.TxStats.BytesCompressed)
+	}
+	// The blob takes one overflow page instead of ten
+	if stats.TxStats.PagesAllocated > 4 {
+		t.Errorf("Expect compressed blob in few pages, get %d pages", stats.TxStats.PagesAllocated)
+	}
+	if errs := checkErrors(t, db); len(errs) > 0 {
+		t.Errorf("Check fails with compressed value: %v", errs)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close DB: %v", err)
+	}
+
+	// Compressed values are read without Options.Compression
+	db, err = Open(Options{Path: path})
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+	_ = db.View(func(tx *Tx) error {
+		if !bytes.Equal(tx.Get([]byte("blob")), blob) || !bytes.Equal(tx.Get([]byte("small")), small) {
+			t.Error("Values mismatch after reopen")
+		}
+		return nil
+	})
+}
+
+func TestCompressionThreshold(t *testing.T) {
+	db, err := Open(Options{Path: dataPath(t), Compression: CompressionFlate, CompressionThreshold: 1 << 20})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+	tx, err := NewWritableTx(db)
+	if err != nil {
+		t.Fatalf("Failed to create tx: %v", err)
+	}
+	mustSet(t, tx, []byte("blob"), bytes.Repeat([]byte("a"), 2*page.PageSize))
+	mustCommit(t, tx)
+	if n := db.Stats().TxStats.BytesCompressed; n != 0 {
+		t.Errorf("Expect value below threshold not compressed, %d bytes saved", n)
+	}
+}
+
+func TestCompressionCorrupt(t *testing.T) {
+	path := dataPath(t)
+	db, err := Open(Options{Path: path, Compression: CompressionFlate})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	blob := strings.Repeat("blob ", 2*page.PageSize)
+	fillDB(t, db, map[string]string{"blob": blob, "small": "small"})
+	root := db.meta.rootPage
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close DB: %v", err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := page.FromBuffer(data, root)
+	if !leaf.IsCompressedAt(0) {
+		t.Fatal("Expect compressed blob")
+	}
+	// Unknown codec
+	page.FromBuffer(data, leaf.GetOverflowAt(0)).OverflowData()[0] = 0xff
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, noMmap := range []bool{false, true} {
+		db, err := Open(Options{Path: path, NoMmap: noMmap})
+		if err != nil {
+			t.Fatalf("Failed to open DB: %v", err)
+		}
+		err = db.View(func(tx *Tx) error {
+			if v := tx.Get([]byte("blob")); v != nil {
+				t.Errorf("Expect nil for corrupt value, get %d bytes", len(v))
+			}
+			_, err := tx.GetRef([]byte("blob"))
+			return err
+		})
+		if !errors.Is(err, ErrInvalidDB) || !strings.Contains(err.Error(), codec.ErrCorrupt.Error()) {
+			t.Errorf("NoMmap %v: expect ErrInvalidDB of corrupt value, get %v", noMmap, err)
+		}
+		err = db.Update(func(tx *Tx) error {
+			_, err := tx.Set([]byte("blob"), []byte("new"))
+			return err
+		})
+		if !errors.Is(err, ErrInvalidDB) {
+			t.Errorf("NoMmap %v: expect ErrInvalidDB writing to leaf of corrupt value, get %v", noMmap, err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatalf("Failed to close DB: %v", err)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package db
+
+import (
+	"github.com/daicang/mk/pkg/audit"
+	"github.com/daicang/mk/pkg/kv"
+	"github.com/daicang/mk/pkg/tree"
+)
+
+// Cursor iterates pairs in key order.
+// Cursor reads nodes of its transaction, so in a writable tx it
+// observes uncommitted changes of the same tx.
+//
+// Cursor stays valid when the tx is modified during iteration:
+// Next always returns the smallest key larger than the key cursor is at,
+// and Prev the largest key smaller than it. So removed keys are skipped,
+// keys inserted ahead of the cursor position are visited, and keys
+// inserted behind it are not. Removing the current key doesn't change
+// where Next or Prev goes. A cursor past either end stays there.
+type Cursor struct {
+	tx *Tx
+	// stack is the path from root to current leaf.
+	stack []elemRef
+	// key is a copy of current key, nil when cursor is not at a pair.
+	key kv.Key
+	// version is tx version when stack was built.
+	version uint64
+	// moves counts Next and Prev calls, to check tx context periodically.
+	moves int
+	// err is the tx context error which stopped cursor.
+	err error
+}
+
+// ctxCheckInterval is how many moves cursor makes between checks of
+// tx context.
+const ctxCheckInterval = 256
+
+// elemRef is one position on the cursor path.
+type elemRef struct {
+	node  *tree.Node
+	index int
+}
+
+// Cursor returns cursor of this transaction.
+func (tx *Tx) Cursor() *Cursor {
+	return &Cursor{
+		tx: tx,
+	}
+}
+
+// First moves cursor to the first pair, returns nil key when tree is empty.
+func (c *Cursor) First() (kv.Key, kv.Value) {
+	c.stack = append(c.stack[:0], elemRef{node: c.tx.root})
+	c.goFirst()
+	if !c.valid() {
+		c.next()
+	}
+	return c.moved()
+}
+
+// Last moves cursor to the last pair, returns nil key when tree is empty.
+func (c *Cursor) Last() (kv.Key, kv.Value) {
+	root := c.tx.root
+	c.stack = append(c.stack[:0], elemRef{node: root, index: root.KeyCount() - 1})
+	c.goLast()
+	if !c.valid() {
+		c.prev()
+	}
+	return c.moved()
+}
+
+// Prev moves cursor to the previous pair, returns nil key at the start.
+func (c *Cursor) Prev() (kv.Key, kv.Value) {
+	if c.key == nil || c.stopped() {
+		return nil, nil
+	}
+	if c.version != c.tx.version || !c.at(c.key) {
+		// Stack is stale, or Delete left cursor between pairs.
+		// Go to the first pair not before the last key, then step back.
+		c.seek(c.key)
+	}
+	c.prev()
+	return c.moved()
+}
+
+// Next moves cursor to the next pair, returns nil key at the end.
+func (c *Cursor) Next() (kv.Key, kv.Value) {
+	if c.key == nil || c.stopped() {
+		return nil, nil
+	}
+	if c.version != c.tx.version {
+		// Tx changed since last move, stack may be stale.
+		// Find position again from the last key.
+		k, _ := c.seek(c.key)
+		if k != nil && c.tx.db.compare(k, c.key) != 0 {
+			return c.moved()
+		}
+	}
+	c.next()
+	return c.moved()
+}
+
+// Err returns the context error which stopped Next and Prev, for tx
+// from DB.BeginTx, or the error reading a page from file. Stopped cursor
+// returns nil key like at the end.
+func (c *Cursor) Err() error {
+	if c.err != nil {
+		return c.err
+	}
+	return c.tx.readErr
+}
+
+// stopped checks tx context every ctxCheckInterval moves, returns
+// whether it's done.
+func (c *Cursor) stopped() bool {
+	if c.err != nil || c.tx.readErr != nil {
+		return true
+	}
+	if c.tx.ctx == nil {
+		return false
+	}
+	c.moves++
+	if c.moves%ctxCheckInterval == 0 {
+		c.err = c.tx.ctx.Err()
+	}
+	return c.err != nil
+}
+
+// Seek moves cursor to the first pair with key equal or larger than given key,
+// returns nil key when there's no such pair.
+func (c *Cursor) Seek(key kv.Key) (kv.Key, kv.Value) {
+	c.seek(key)
+	return c.moved()
+}
+
+// seekFrom seeks lower bound start of a range, nil start moves to the
+// first pair. Empty key is not the smallest in every order, see
+// Options.Compare.
+func (c *Cursor) seekFrom(start kv.Key) (kv.Key, kv.Value) {
+	if start == nil {
+		return c.First()
+	}
+	return c.Seek(start)
+}
+
+// Delete removes pair at cursor.
+// Cursor keeps its position, so Next returns the pair after the removed one.
+// It returns ErrNotAtPair when cursor doesn't point to a pair.
+func (c *Cursor) Delete() error {
+	err := c.tx.checkWritable()
+	if err != nil {
+		return err
+	}
+	if c.key == nil {
+		return ErrNotAtPair
+	}
+	top := &c.stack[len(c.stack)-1]
+	leaf := top.node
+	// When the leaf is owned by tx and stack is fresh, remove in place
+	// and step back, so next() lands on the following pair.
+	if c.version == c.tx.version && c.valid() && c.tx.nodes[leaf.Index] == leaf {
+		value := c.tx.valueAt(leaf, top.index)
+		key, _ := leaf.RemoveKeyValueAt(top.index)
+		leaf.Balanced = false
+		c.tx.audit(audit.OpRemove, key, nil)
+		c.tx.recordUndo(key, value)
+		c.tx.version++
+		c.version = c.tx.version
+		top.index--
+		return nil
+	}
+	old, err := c.tx.Remove(c.key)
+	if err != nil {
+		return err
+	}
+	if old == nil {
+		return ErrNotAtPair
+	}
+	return nil
+}
+
+// moved records position after cursor moves, returns current pair.
+func (c *Cursor) moved() (kv.Key, kv.Value) {
+	c.version = c.tx.version
+	k, v := c.current()
+	if k == nil || c.tx.readErr != nil {
+		c.key = nil
+		return nil, nil
+	}
+	if c.key == nil {
+		// Keep empty key distinguishable from no key
+		c.key = kv.Key{}
+	}
+	c.key = append(c.key[:0], k...)
+	return k, v
+}
+
+// seek builds stack for given key, returns pair at new position.
+func (c *Cursor) seek(key kv.Key) (kv.Key, kv.Value) {
+	c.stack = c.stack[:0]
+	n := c.tx.root
+	for {
+		if n.IsLeaf {
+			_, i := n.SearchFunc(key, c.tx.db.compare)
+			c.stack = append(c.stack, elemRef{node: n, index: i})
+			break
+		}
+		i := n.ChildIndexFunc(key, c.tx.db.compare)
+		c.stack = append(c.stack, elemRef{node: n, index: i})
+		n = c.tx.peekNode(n.GetChildID(i), n)
+	}
+	if !c.valid() {
+		return c.next()
+	}
+	return c.current()
+}
+
+// goFirst descends to the first leaf under current stack top.
+func (c *Cursor) goFirst() {
+	for {
+		top := c.stack[len(c.stack)-1]
+		if top.node.IsLeaf {
+			return
+		}
+		child := c.tx.peekNode(top.node.GetChildID(top.index), top.node)
+		c.stack = append(c.stack, elemRef{node: child, index: 0})
+	}
+}
+
+// goLast descends to the last leaf under current stack top.
+func (c *Cursor) goLast() {
+	for {
+		top := c.stack[len(c.stack)-1]
+		if top.node.IsLeaf {
+			return
+		}
+		child := c.tx.peekNode(top.node.GetChildID(top.index), top.node)
+		c.stack = append(c.stack, elemRef{node: child, index: child.KeyCount() - 1})
+	}
+}
+
+// prev moves to the previous pair, skipping leaves emptied in this tx.
+func (c *Cursor) prev() (kv.Key, kv.Value) {
+	for {
+		// Find the deepest level which can move left
+		i := len(c.stack) - 1
+		for ; i >= 0; i-- {
+			e := &c.stack[i]
+			if e.index > 0 {
+				e.index--
+				break
+			}
+		}
+		if i < 0 {
+			// Keep stack top before the start, so Prev keeps returning nil
+			c.stack[len(c.stack)-1].index = -1
+			return nil, nil
+		}
+		c.stack = c.stack[:i+1]
+		c.goLast()
+		if c.valid() {
+			return c.current()
+		}
+	}
+}
+
+// next moves to the next pair, skipping leaves emptied in this tx.
+func (c *Cursor) next() (kv.Key, kv.Value) {
+	for {
+		// Find the deepest level which can move right
+		i := len(c.stack) - 1
+		for ; i >= 0; i-- {
+			e := &c.stack[i]
+			if e.index < e.node.KeyCount()-1 {
+				e.index++
+				break
+			}
+		}
+		if i < 0 {
+			// Keep stack top at the end, so Next keeps returning nil
+			top := &c.stack[len(c.stack)-1]
+			top.index = top.node.KeyCount()
+			return nil, nil
+		}
+		c.stack = c.stack[:i+1]
+		c.goFirst()
+		if c.valid() {
+			return c.current()
+		}
+	}
+}
+
+// at returns whether cursor points to given key.
+func (c *Cursor) at(key kv.Key) bool {
+	k, _ := c.current()
+	return k != nil && c.tx.db.compare(k, key) == 0
+}
+
+// valid returns whether cursor points to a pair.
+func (c *Cursor) valid() bool {
+	if len(c.stack) == 0 {
+		return false
+	}
+	top := c.stack[len(c.stack)-1]
+	return top.node.IsLeaf && top.index >= 0 && top.index < top.node.KeyCount()
+}
+
+// current returns pair at cursor.
+func (c *Cursor) current() (kv.Key, kv.Value) {
+	if !c.valid() {
+		return nil, nil
+	}
+	top := c.stack[len(c.stack)-1]
+	return top.node.GetKeyAt(top.index), c.tx.valueAt(top.node, top.index)
+}
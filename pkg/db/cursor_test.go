@@ -0,0 +1,436 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/daicang/mk/pkg/kv"
+)
+
+// scanAll returns all pairs from cursor in order.
+func scanAll(c *Cursor) ([]string, map[string]string) {
+	keys := []string{}
+	kvs := map[string]string{}
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		keys = append(keys, string(k))
+		kvs[string(k)] = string(v)
+	}
+	return keys, kvs
+}
+
+// checkScan checks cursor returns exactly the model in order.
+func checkScan(t *testing.T, c *Cursor, model map[string]string) {
+	t.Helper()
+	keys, kvs := scanAll(c)
+	if !sort.StringsAreSorted(keys) {
+		t.Errorf("Keys not sorted")
+	}
+	if len(keys) != len(model) || len(kvs) != len(model) {
+		t.Fatalf("Expect %d keys, get %d", len(model), len(keys))
+	}
+	for k, v := range model {
+		if kvs[k] != v {
+			t.Errorf("Key %s: expect %q, get %q", k, v, kvs[k])
+		}
+	}
+}
+
+func TestCursor(t *testing.T) {
+	db := openDB(t)
+
+	tx, _ := NewReadOnlyTx(db)
+	k, _ := tx.Cursor().First()
+	if k != nil {
+		t.Errorf("Empty DB should have no first key, get %s", k)
+	}
+
+	model := map[string]string{}
+	for i := 0; i < 5000; i += 2 {
+		model[fmt.Sprintf("key-%05d", i)] = fmt.Sprintf("value-%d", i)
+	}
+	fillDB(t, db, model)
+
+	tx, _ = NewReadOnlyTx(db)
+	checkScan(t, tx.Cursor(), model)
+
+	c := tx.Cursor()
+	seeks := map[string]string{
+		"":          "key-00000",
+		"key-00100": "key-00100",
+		"key-00101": "key-00102",
+		"key-04998": "key-04998",
+		"key-04999": "",
+	}
+	for seek, expect := range seeks {
+		k, v := c.Seek([]byte(seek))
+		if string(k) != expect {
+			t.Errorf("Seek %q: expect %q, get %q", seek, expect, k)
+		}
+		if k != nil && string(v) != model[expect] {
+			t.Errorf("Seek %q: expect value %q, get %q", seek, model[expect], v)
+		}
+	}
+
+	k, _ = c.Seek([]byte("key-04996"))
+	k2, _ := c.Next()
+	k3, _ := c.Next()
+	if string(k) != "key-04996" || string(k2) != "key-04998" || k3 != nil {
+		t.Errorf("Bad iteration at end: %s %s %s", k, k2, k3)
+	}
+	if k, _ = c.Next(); k != nil {
+		t.Errorf("Next after end should return nil, get %s", k)
+	}
+}
+
+func TestCursorReadYourWrites(t *testing.T) {
+	db := openDB(t)
+	model := map[string]string{}
+	for i := 0; i < 3000; i++ {
+		model[fmt.Sprintf("key-%05d", i)] = "committed"
+	}
+	fillDB(t, db, model)
+
+	tx, _ := NewWritableTx(db)
+	// Interleave writes with full scans
+	for round := 0; round < 3; round++ {
+		for i := round; i < 3000; i += 7 {
+			key := fmt.Sprintf("key-%05d", i)
+			mustRemove(t, tx, []byte(key))
+			delete(model, key)
+		}
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("new-%d-%03d", round, i)
+			value := fmt.Sprintf("uncommitted-%d", round)
+			mustSet(t, tx, []byte(key), []byte(value))
+			model[key] = value
+		}
+		key := fmt.Sprintf("key-%05d", 1000+round)
+		mustSet(t, tx, []byte(key), []byte("overwritten"))
+		model[key] = "overwritten"
+
+		checkScan(t, tx.Cursor(), model)
+	}
+
+	// Empty a whole range, cursor should skip emptied leaves
+	for i := 100; i < 2000; i++ {
+		key := fmt.Sprintf("key-%05d", i)
+		mustRemove(t, tx, []byte(key))
+		delete(model, key)
+	}
+	checkScan(t, tx.Cursor(), model)
+	k, _ := tx.Cursor().Seek([]byte("key-00100"))
+	if string(k) != "key-02000" {
+		t.Errorf("Seek into emptied range: expect key-02000, get %s", k)
+	}
+
+	mustCommit(t, tx)
+	rtx, _ := NewReadOnlyTx(db)
+	checkScan(t, rtx.Cursor(), model)
+}
+
+func TestCursorStableUnderMutation(t *testing.T) {
+	db := openDB(t)
+	model := map[string]string{}
+	for i := 0; i < 2000; i += 10 {
+		model[fmt.Sprintf("key-%05d", i)] = "v"
+	}
+	fillDB(t, db, model)
+
+	tx, _ := NewWritableTx(db)
+	c := tx.Cursor()
+	k, _ := c.Seek([]byte("key-00500"))
+	if string(k) != "key-00500" {
+		t.Fatalf("Bad seek: %s", k)
+	}
+
+	// Insert right after cursor is visited, insert before cursor is not
+	mustSet(t, tx, []byte("key-00505"), []byte("after"))
+	mustSet(t, tx, []byte("key-00495"), []byte("before"))
+	k, v := c.Next()
+	if string(k) != "key-00505" || string(v) != "after" {
+		t.Errorf("Expect inserted key-00505, get %s=%s", k, v)
+	}
+
+	// Remove the current key, Next goes to its successor
+	mustRemove(t, tx, []byte("key-00505"))
+	k, _ = c.Next()
+	if string(k) != "key-00510" {
+		t.Errorf("Expect key-00510 after removing current, get %s", k)
+	}
+
+	// Remove the next keys, they are skipped
+	mustRemove(t, tx, []byte("key-00520"))
+	mustRemove(t, tx, []byte("key-00530"))
+	k, _ = c.Next()
+	if string(k) != "key-00540" {
+		t.Errorf("Expect key-00540 after removing next keys, get %s", k)
+	}
+
+	// Overwrite current key and remove a long run of following keys
+	mustSet(t, tx, []byte("key-00540"), []byte("updated"))
+	for i := 550; i < 1500; i += 10 {
+		mustRemove(t, tx, []byte(fmt.Sprintf("key-%05d", i)))
+	}
+	k, _ = c.Next()
+	if string(k) != "key-01500" {
+		t.Errorf("Expect key-01500 after removing a range, get %s", k)
+	}
+
+	// Cursor at the end stays at the end
+	k, _ = c.Seek([]byte("key-01990"))
+	if string(k) != "key-01990" {
+		t.Fatalf("Bad seek: %s", k)
+	}
+	k, _ = c.Next()
+	if k != nil {
+		t.Fatalf("Expect end, get %s", k)
+	}
+	mustSet(t, tx, []byte("key-99999"), []byte("v"))
+	k, _ = c.Next()
+	if k != nil {
+		t.Errorf("Cursor past end should stay there, get %s", k)
+	}
+
+	// Delete every visited key while iterating
+	count := 0
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		mustRemove(t, tx, k)
+		count++
+	}
+	if k, _ := tx.Cursor().First(); k != nil {
+		t.Errorf("All keys should be removed, get %s", k)
+	}
+	if count == 0 {
+		t.Error("Expect keys to be visited")
+	}
+	mustCommit(t, tx)
+}
+
+func TestCursorDelete(t *testing.T) {
+	db := openDB(t)
+	model := map[string]string{}
+	for i := 0; i < 5000; i++ {
+		model[fmt.Sprintf("key-%05d", i)] = fmt.Sprint(i % 3)
+	}
+	fillDB(t, db, model)
+
+	tx, _ := NewWritableTx(db)
+	c := tx.Cursor()
+	if err := c.Delete(); !errors.Is(err, ErrNotAtPair) {
+		t.Errorf("Expect ErrNotAtPair on unpositioned cursor, get %v", err)
+	}
+
+	// Purge pairs with value "0" while iterating
+	visited := 0
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		visited++
+		if string(v) == "0" {
+			key := string(k)
+			if err := c.Delete(); err != nil {
+				t.Fatalf("Failed to delete %s: %v", key, err)
+			}
+			delete(model, key)
+		}
+	}
+	if visited != 5000 {
+		t.Errorf("Expect to visit 5000 keys, get %d", visited)
+	}
+	checkScan(t, tx.Cursor(), model)
+
+	// Delete on a cursor from a stale position falls back to tx.Remove
+	k, _ := c.Seek([]byte("key-00001"))
+	mustSet(t, tx, []byte("key-00000"), []byte("0"))
+	if err := c.Delete(); err != nil {
+		t.Fatalf("Failed to delete %s: %v", k, err)
+	}
+	delete(model, "key-00001")
+	model["key-00000"] = "0"
+	k, _ = c.Next()
+	if string(k) != "key-00002" {
+		t.Errorf("Expect key-00002 after delete, get %s", k)
+	}
+
+	// Delete everything from the first key
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		if err := c.Delete(); err != nil {
+			t.Fatalf("Failed to delete %s: %v", k, err)
+		}
+	}
+	if k, _ := tx.Cursor().First(); k != nil {
+		t.Errorf("Expect empty tree, get %s", k)
+	}
+	mustCommit(t, tx)
+	rtx, _ := NewReadOnlyTx(db)
+	checkScan(t, rtx.Cursor(), map[string]string{})
+}
+
+// scanReverse returns all keys from cursor in reverse order.
+func scanReverse(c *Cursor) []string {
+	keys := []string{}
+	for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
+		keys = append(keys, string(k))
+	}
+	return keys
+}
+
+func TestCursorReverse(t *testing.T) {
+	db := openDB(t)
+	tx, _ := NewReadOnlyTx(db)
+	if k, _ := tx.Cursor().Last(); k != nil {
+		t.Errorf("Empty DB should have no last key, get %s", k)
+	}
+
+	model := map[string]string{}
+	for i := 0; i < 5000; i += 2 {
+		model[fmt.Sprintf("key-%05d", i)] = fmt.Sprintf("value-%d", i)
+	}
+	fillDB(t, db, model)
+
+	tx, _ = NewReadOnlyTx(db)
+	keys, _ := scanAll(tx.Cursor())
+	reverse := scanReverse(tx.Cursor())
+	if len(reverse) != len(keys) {
+		t.Fatalf("Expect %d keys, get %d", len(keys), len(reverse))
+	}
+	for i, k := range reverse {
+		if k != keys[len(keys)-1-i] {
+			t.Fatalf("Reverse scan %d: expect %s, get %s", i, keys[len(keys)-1-i], k)
+		}
+	}
+
+	// Change direction in the middle
+	c := tx.Cursor()
+	k, _ := c.Seek([]byte("key-01001"))
+	k2, _ := c.Prev()
+	k3, _ := c.Prev()
+	k4, _ := c.Next()
+	if string(k) != "key-01002" || string(k2) != "key-01000" || string(k3) != "key-00998" || string(k4) != "key-01000" {
+		t.Errorf("Bad direction change: %s %s %s %s", k, k2, k3, k4)
+	}
+
+	// Cursor before the start stays there
+	c.First()
+	if k, _ = c.Prev(); k != nil {
+		t.Errorf("Prev at first key should return nil, get %s", k)
+	}
+	if k, _ = c.Prev(); k != nil {
+		t.Errorf("Cursor before start should stay there, get %s", k)
+	}
+	if k, _ = c.Next(); k != nil {
+		t.Errorf("Cursor before start should stay there, get %s", k)
+	}
+
+	// Prev from the end
+	c.Seek([]byte("key-99999"))
+	if k, _ = c.Prev(); k != nil {
+		t.Errorf("Cursor past end should stay there, get %s", k)
+	}
+}
+
+func TestCursorReverseUnderMutation(t *testing.T) {
+	db := openDB(t)
+	model := map[string]string{}
+	for i := 0; i < 3000; i++ {
+		model[fmt.Sprintf("key-%05d", i)] = "v"
+	}
+	fillDB(t, db, model)
+
+	tx, _ := NewWritableTx(db)
+	c := tx.Cursor()
+	if k, _ := c.Seek([]byte("key-01500")); string(k) != "key-01500" {
+		t.Fatalf("Bad seek: %s", k)
+	}
+
+	// Insert right before cursor is visited, insert after cursor is not
+	mustSet(t, tx, []byte("key-01499x"), []byte("before"))
+	mustSet(t, tx, []byte("key-01500x"), []byte("after"))
+	k, _ := c.Prev()
+	if string(k) != "key-01499x" {
+		t.Errorf("Expect inserted key-01499x, get %s", k)
+	}
+
+	// Remove a long run of previous keys
+	for i := 100; i < 1500; i++ {
+		mustRemove(t, tx, []byte(fmt.Sprintf("key-%05d", i)))
+	}
+	k, _ = c.Prev()
+	if string(k) != "key-00099" {
+		t.Errorf("Expect key-00099 after removing a range, get %s", k)
+	}
+
+	// Delete while iterating backward
+	for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
+		if k[len(k)-1]%2 == 0 {
+			if err := c.Delete(); err != nil {
+				t.Fatalf("Failed to delete %s: %v", k, err)
+			}
+		}
+	}
+	keys, _ := scanAll(tx.Cursor())
+	expect := 0
+	for _, k := range keys {
+		if k[len(k)-1]%2 == 0 {
+			t.Fatalf("Key %s should be deleted", k)
+		}
+		expect++
+	}
+	reverse := scanReverse(tx.Cursor())
+	if len(reverse) != expect {
+		t.Errorf("Expect %d keys backward, get %d", expect, len(reverse))
+	}
+	mustCommit(t, tx)
+	rtx, _ := NewReadOnlyTx(db)
+	if len(scanReverse(rtx.Cursor())) != expect {
+		t.Error("Bad reverse scan after commit")
+	}
+}
+
+func TestCursorContext(t *testing.T) {
+	db := openDB(t)
+	defer func() {
+		_ = db.Close()
+	}()
+	kvs := map[string]string{}
+	for i := 0; i < 10*ctxCheckInterval; i++ {
+		kvs[fmt.Sprintf("key-%05d", i)] = "value"
+	}
+	fillDB(t, db, kvs)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tx, err := db.BeginTx(ctx, false)
+	if err != nil {
+		t.Fatalf("Failed to begin tx: %v", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	count := 0
+	err = tx.ForEach(func(k kv.Key, v kv.Value) error {
+		count++
+		if count == ctxCheckInterval {
+			cancel()
+		}
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) || count > 2*ctxCheckInterval {
+		t.Errorf("Expect scan cancelled soon, get %v after %d pairs", err, count)
+	}
+
+	c := tx.Cursor()
+	if k, _ := c.First(); k == nil || c.Err() != nil {
+		t.Fatalf("Expect first pair before any move")
+	}
+	k, _ := c.Next()
+	for k != nil {
+		k, _ = c.Next()
+	}
+	if !errors.Is(c.Err(), context.Canceled) {
+		t.Errorf("Expect cursor stopped by context, get %v", c.Err())
+	}
+	if k, _ := c.Prev(); k != nil {
+		t.Errorf("Expect stopped cursor stays stopped, get %q", k)
+	}
+}
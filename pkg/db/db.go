@@ -1,20 +1,38 @@
 package db
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"math/bits"
 	"os"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 	"unsafe"
 
+	"github.com/go-logr/logr"
+
+	"github.com/daicang/mk/pkg/audit"
 	"github.com/daicang/mk/pkg/common"
 	"github.com/daicang/mk/pkg/freelist"
+	"github.com/daicang/mk/pkg/kv"
+	"github.com/daicang/mk/pkg/mmap"
 	"github.com/daicang/mk/pkg/page"
+	"github.com/daicang/mk/pkg/wal"
 )
 
 const (
 	// Magic indentifies DB file
 	Magic = 0xDCDB2020
+	// FormatVersion is the on-disk format written by this code. Open
+	// refuses files of newer versions, metas written before version 8
+	// hold 0. Since version 9 headers are little-endian on every
+	// architecture, before it they were in host byte order.
+	FormatVersion = 9
 )
 
 const (
@@ -22,37 +40,362 @@ const (
 	MmapStep = 1 << 30
 )
 
+// Durability is how commit waits for changes to reach disk.
+type Durability int
+
+const (
+	// DurabilityDefault uses Options.Durability, which defaults to sync.
+	DurabilityDefault Durability = iota
+	// DurabilitySync syncs pages and meta before commit returns.
+	DurabilitySync
+	// DurabilityNone leaves changes in OS cache, they survive process crash
+	// but may be lost or torn by OS crash or power loss.
+	DurabilityNone
+)
+
+// String returns durability name for print.
+func (d Durability) String() string {
+	switch d {
+	case DurabilityDefault:
+		return "default"
+	case DurabilitySync:
+		return "sync"
+	case DurabilityNone:
+		return "none"
+	}
+	return fmt.Sprintf("Durability(%d)", int(d))
+}
+
+// Advice is memory map access pattern told to OS, see Options.MmapAdvise.
+type Advice int
+
+const (
+	// AdviceNormal gives no hint, OS reads ahead moderately.
+	AdviceNormal Advice = iota
+	// AdviceRandom expects random reads, OS doesn't read ahead, so
+	// point reads on large DB don't fill page cache with unused pages.
+	AdviceRandom
+	// AdviceSequential expects scans, OS reads ahead aggressively.
+	AdviceSequential
+)
+
+// String returns advice name for print.
+func (a Advice) String() string {
+	switch a {
+	case AdviceNormal:
+		return "normal"
+	case AdviceRandom:
+		return "random"
+	case AdviceSequential:
+		return "sequential"
+	}
+	return fmt.Sprintf("Advice(%d)", int(a))
+}
+
+// mmapAdvice returns advice for mmap.Advise.
+func (a Advice) mmapAdvice() mmap.Advice {
+	switch a {
+	case AdviceRandom:
+		return mmap.Random
+	case AdviceSequential:
+		return mmap.Sequential
+	}
+	return mmap.Normal
+}
+
 // Options holds info to start DB.
 type Options struct {
-	// DB mmap file path
+	// DB mmap file path, or MemoryPath for in-memory DB
 	Path string
+	// AuditDir enables mutation audit log in given directory
+	AuditDir string
+	// AuditSegmentSize is audit segment size limit in bytes, 0 disables rotation
+	AuditSegmentSize int64
+	// WritableMmap maps file writable, so transactions build dirty pages
+	// in the memory map and commit with msync instead of WriteAt.
+	WritableMmap bool
+	// Durability of commits, can be overridden by Tx.CommitWith
+	Durability Durability
+	// NoSync sets Durability to DurabilityNone, for bulk loads which
+	// call DB.Sync at the end.
+	NoSync bool
+	// ExtentPages makes commits spilling at least this many pages
+	// allocate them as one contiguous extent, 0 disables extents.
+	ExtentPages int
+	// Timeout to wait for file lock held by another process,
+	// 0 waits forever.
+	Timeout time.Duration
+	// MaxBatchSize is the maximal number of calls in one batch,
+	// see DB.Batch.
+	MaxBatchSize int
+	// MaxBatchDelay is how long a batch waits for more calls before
+	// it runs, see DB.Batch.
+	MaxBatchDelay time.Duration
+	// InitialMmapSize is the memory map size in bytes on open.
+	// Growing the map keeps old maps while read transactions use them,
+	// so a map covering the expected DB size saves memory and remaps.
+	InitialMmapSize int
+	// MaxMmapSize limits memory map size in bytes, commits needing a
+	// larger map fail with ErrMmapTooLarge.
+	MaxMmapSize int
+	// GrowthStep rounds up file size when DB grows, so the file is
+	// extended less often. 0 grows file to exactly the pages in use.
+	GrowthStep int
+	// MmapAdvise tells OS how memory map is read, default normal.
+	MmapAdvise Advice
+	// NoMmap reads pages with pread into pooled buffers instead of
+	// mapping the file, for platforms or filesystems where mmap is
+	// missing or unreliable, and files larger than address space.
+	// Reads cost a syscall and a copy. A failed read panics, like a
+	// fault on a memory map does.
+	NoMmap bool
+	// Mlock locks mapped file in memory, so reads never wait for page
+	// faults. Locked size is limited by RLIMIT_MEMLOCK.
+	Mlock bool
+	// StrictMode runs Tx.Check on each commit and panics on any
+	// problem. It's slow, for tests and debugging.
+	StrictMode bool
+	// PoisonFreed fills freed pages with 0xDE when they become
+	// reusable, so reads of freed pages through stale pointers show up
+	// as garbage instead of silently returning old data. For debugging.
+	PoisonFreed bool
+	// WAL logs pages of each commit to Path+WALSuffix before writing
+	// them to DB file, and syncs the log instead of DB file. Commits
+	// torn while writing DB file are replayed from the log on open.
+	// Not supported for in-memory DB and WritableMmap.
+	WAL bool
+	// WALCheckpointSize is the log size in bytes which makes a commit
+	// checkpoint, see DB.Checkpoint.
+	WALCheckpointSize int64
+	// MaxTxDuration reports read-only tx open longer than this, since
+	// it keeps pages freed after its snapshot from reuse. 0 disables it.
+	MaxTxDuration time.Duration
+	// OnLongTx is called with tx id and how long it's open, when a
+	// read-only tx exceeds MaxTxDuration. Nil logs the tx instead.
+	OnLongTx func(txid uint64, d time.Duration)
+	// ChangefeedPages keeps changes of recent commits in a ring of at
+	// most this many pages in DB file, see Tx.Changes. 0 disables it
+	// and drops the changefeed in file on the next commit.
+	ChangefeedPages int
+	// Compare orders keys instead of bytes.Compare, e.g. for
+	// case-insensitive keys. The order is part of the file, so
+	// CompareName is required with it, is saved in meta on create and
+	// must match on later opens. Keys with a prefix are not together
+	// in every order, so prefix functions scan all keys then, see
+	// DB.Bytewise.
+	Compare kv.CompareFunc
+	// CompareName names Compare, at most ComparatorNameSize bytes.
+	CompareName string
+	// Compression compresses values stored in overflow pages, i.e.
+	// larger than page.MaxInlineValue, when it saves space. Each value
+	// records its codec, so it can change between opens. Smaller values
+	// stay in leaf pages uncompressed.
+	Compression Compression
+	// CompressionThreshold is the minimal size of compressed values in
+	// bytes, values in overflow pages smaller than it are not compressed.
+	CompressionThreshold int
+	// ODirect writes pages at commit through a descriptor opened with
+	// O_DIRECT from aligned buffers, so bulk imports don't fill OS page
+	// cache, which also holds the memory map. Meta, WAL and pages of
+	// Tx.SetReader are still written through page cache. It's supported
+	// on Linux and FreeBSD, not for in-memory DB, WritableMmap and
+	// EncryptionKey. Open fails on filesystems refusing O_DIRECT, e.g.
+	// tmpfs.
+	ODirect bool
+	// EncryptionKey encrypts pages except meta with AES-GCM, a key of
+	// 16, 24 or 32 bytes selects AES-128, AES-192 or AES-256. Pages are
+	// decrypted into buffers on read, so it implies NoMmap, and is not
+	// supported with WritableMmap, Mlock and WAL. Meta records a check
+	// of the key, opening with another key or none fails with
+	// ErrEncryptionKey. DB.CompactWithKey changes the key.
+	EncryptionKey []byte
+	// FreelistType is how free pages are indexed in memory, the file
+	// format is the same. freelist.TypeHashmap keeps allocation O(1)
+	// for large DB with many free pages.
+	FreelistType freelist.Type
+	// FillPercent is how full commit fills nodes it splits, in
+	// [tree.MinFillPercent, tree.MaxFillPercent]. A high fill packs
+	// pages of keys appended in order, a low one leaves room for
+	// random inserts so pages split less.
+	FillPercent float64
+	// NodeCacheSize is the byte budget of nodes cached for read-only
+	// transactions, least recently used nodes are evicted over it. Hot
+	// nodes, e.g. internal nodes near root, are then decoded once
+	// instead of in every tx. Cursors and scans read through it too, so
+	// a scan larger than the budget evicts hot nodes. 0 disables the
+	// cache.
+	NodeCacheSize int
+	// Merge combines values with operands of Tx.Merge when merge
+	// records are read, e.g. MergeAdd for counters. Files with merge
+	// records must be opened with the same function to read them,
+	// reads return ErrNoMergeFunc without it.
+	Merge MergeFunc
+	// Hooks are called on commit, node split and merge, map growth
+	// and allocation failure.
+	Hooks Hooks
+	// Tracer receives spans of commit, spill, write and mmap grow,
+	// nil disables tracing.
+	Tracer Tracer
+	// Logger receives diagnostic messages, the zero Logger discards
+	// them. Pass log.Global().Logr() to print them to stderr.
+	Logger logr.Logger
 }
 
 // DB represents one database.
 type DB struct {
 	// Path to memory mapping file
 	path string
-	// Meta block
+	// Meta of the last commit
 	meta *Meta
-	// Memory map file pointer
-	file *os.File
+	// metaPages is 2, or 1 for files of format version 1
+	metaPages int
+	// DB file, memFile for in-memory DB
+	file dbFile
 	// pointer to memory map array, without size limit
 	mmBuf *[]byte
-	// pointer to memory map array, with size limit
-	mmSizedBuf *[common.MmapMaxSize]byte
+	// pointer to memory map array with size limit, swapped atomically
+	// on remap since readers don't lock, see mmData
+	mmSizedBuf unsafe.Pointer
+	// metalock protects meta, txs, writableTx, state, failed and
+	// durableTxid
+	metalock sync.Mutex
+	// rwlock is held by the writable transaction until it's closed
+	rwlock sync.Mutex
 	// All current transaction
 	txs []*Tx
 	// There can only be one writable transaction
 	writableTx *Tx
 	// mmapSize is the mmaped file size
 	mmapSize int
-	// single page pool
-	singlePages sync.Pool
+	// maxMmapSize is Options.MaxMmapSize
+	maxMmapSize int
+	// staleMmaps are replaced maps which may be read by open
+	// transactions, each is unmapped when the last of them closes
+	staleMmaps []*staleMmap
+	// Memory map is writable, see Options.WritableMmap
+	writableMmap bool
+	// fileSize is the file size, maintained by grow
+	fileSize int
+	// growthStep is Options.GrowthStep
+	growthStep int
+	// mmapAdvise is Options.MmapAdvise
+	mmapAdvise Advice
+	// noMmap is Options.NoMmap
+	noMmap bool
+	// direct is DB file opened for Options.ODirect, nil without it
+	direct *os.File
+	// mlock is Options.Mlock
+	mlock bool
+	// lockedSize is bytes locked from the start of current map
+	lockedSize int
+	// strictMode is Options.StrictMode
+	strictMode bool
+	// poisonFreed is Options.PoisonFreed
+	poisonFreed bool
+	// wal is the write-ahead log, nil without Options.WAL
+	wal *wal.Log
+	// walSem is held while writing a commit or checkpointing
+	walSem chan struct{}
+	// walCheckpointSize is Options.WALCheckpointSize
+	walCheckpointSize int64
+	// maxTxDuration is Options.MaxTxDuration
+	maxTxDuration time.Duration
+	// onLongTx is Options.OnLongTx
+	onLongTx func(txid uint64, d time.Duration)
+	// changefeedPages is Options.ChangefeedPages
+	changefeedPages int
+	// compare is Options.Compare, bytes.Compare by default
+	compare kv.CompareFunc
+	// compareName is Options.CompareName
+	compareName string
+	// compression is Options.Compression
+	compression Compression
+	// compressionThreshold is Options.CompressionThreshold
+	compressionThreshold int
+	// encryptionKey is Options.EncryptionKey
+	encryptionKey []byte
+	// freelistType is Options.FreelistType
+	freelistType freelist.Type
+	// fillPercent is Options.FillPercent
+	fillPercent float64
+	// nodeCache holds nodes of read-only tx, nil without
+	// Options.NodeCacheSize
+	nodeCache *nodeCache
+	// merge is Options.Merge
+	merge MergeFunc
+	// tracer is Options.Tracer
+	tracer Tracer
+	// hooks is Options.Hooks
+	hooks Hooks
+	// logger is Options.Logger
+	logger logr.Logger
+	// page buffer pool
+	pagePool pagePool
+	// writeBuf is the buffer commit copies adjacent pages into, kept
+	// for the next commit, see Tx.writePages
+	writeBuf []byte
 	// mmap empty page slots
 	freelist *freelist.Freelist
+	// audit log writer, nil when disabled
+	audit *audit.Writer
+	// audit segment size limit
+	auditSegmentSize int64
+	// durability of commits without override
+	durability Durability
+	// durableTxid is the last transaction known to be synced
+	durableTxid uint64
+	// extentPages is minimal spill size to allocate an extent
+	extentPages int
+	// failed is the I/O error which stopped writes, see Health
+	failed error
+	// state is one of stateOpen, stateStopped and stateClosed
+	state int32
+	// txWait counts open transactions, Close waits for them
+	txWait sync.WaitGroup
+	// batchlock protects batch
+	batchlock sync.Mutex
+	// batch collecting calls of DB.Batch, nil when there's none
+	batch *batch
+	// maximal calls in one batch
+	maxBatchSize int
+	// maximal delay of a batch
+	maxBatchDelay time.Duration
+	// flushlock protects flushWaiters and flushing
+	flushlock sync.Mutex
+	// flushWaiters are async commits waiting for the next sync
+	flushWaiters []chan<- error
+	// flushing is set while flusher goroutine runs
+	flushing bool
+	// flushWait counts async commits not synced, Close waits for them
+	flushWait sync.WaitGroup
+	// stats are counters since open or ResetStats, protected by metalock
+	stats Stats
 }
 
-// Meta holds database metadata.
+const (
+	// stateOpen allows all transactions
+	stateOpen int32 = iota
+	// stateStopped allows only read-only tx, see HandleSignals
+	stateStopped
+	// stateClosed allows no tx, see Close
+	stateClosed
+)
+
+// Meta holds database metadata. It's stored in meta page data as
+// little-endian fields at the offsets 64-bit builds used when Meta was
+// cast from page:
+//
+//	0  magic          uint32
+//	4  totalPages     uint32
+//	8  freelistPage   uint32
+//	12 rootPage       uint32
+//	16 txid           uint64
+//	24 checksum       uint64
+//	32 sequence       uint64
+//	40 changefeedPage uint32
+//	44 comparator     [32]byte
+//	76 keyCheck       [16]byte
+//	92 version        uint32
 type Meta struct {
 	// magic should be mkMagic
 	magic uint32
@@ -62,191 +405,694 @@ type Meta struct {
 	freelistPage common.Pgid
 	// root page id
 	rootPage common.Pgid
+	// id of last committed transaction
+	txid uint64
+	// checksum of fields above and sequence, see sum
+	checksum uint64
+	// last value returned by Tx.NextSequence
+	sequence uint64
+	// changefeed directory page id, 0 without changefeed
+	changefeedPage common.Pgid
+	// comparator is Options.CompareName, zeros for bytewise order
+	comparator [ComparatorNameSize]byte
+	// keyCheck identifies Options.EncryptionKey, zeros without encryption
+	keyCheck [keyCheckSize]byte
+	// version is FormatVersion of the commit, 0 before version 8
+	version uint32
 }
 
+const (
+	// metaSize is the size of meta in page data.
+	metaSize = 96
+	// metaSumSize is the size of meta fields covered by checksum.
+	metaSumSize = 24
+)
+
 func (m *Meta) copy() *Meta {
 	return &Meta{
 		magic:        m.magic,
 		rootPage:     m.rootPage,
 		freelistPage: m.freelistPage,
 		totalPages:   m.totalPages,
+		txid:         m.txid,
+		checksum:     m.checksum,
+		sequence:     m.sequence,
+
+		changefeedPage: m.changefeedPage,
+		comparator:     m.comparator,
+		keyCheck:       m.keyCheck,
+		version:        m.version,
+	}
+}
+
+// sum returns FNV-1a checksum of meta fields.
+// Sequence, changefeed page, comparator, key check and version are added
+// after checksum, they're only summed when not 0, so metas written before
+// them have the same checksum.
+//
+// Sums are of the encoded bytes, which are what 64-bit little-endian
+// builds summed from memory, 8 bytes from changefeedPage included.
+func (m *Meta) sum() uint64 {
+	b := m.encode()
+	h := fnv.New64a()
+	_, _ = h.Write(b[:metaSumSize])
+	if m.sequence != 0 {
+		_, _ = h.Write(b[32:40])
+	}
+	if m.changefeedPage != 0 {
+		_, _ = h.Write(b[40:48])
+	}
+	if m.comparator != [ComparatorNameSize]byte{} {
+		_, _ = h.Write(m.comparator[:])
 	}
+	if m.keyCheck != [keyCheckSize]byte{} {
+		_, _ = h.Write(m.keyCheck[:])
+	}
+	if m.version != 0 {
+		_, _ = h.Write(b[92:96])
+	}
+	return h.Sum64()
+}
+
+// encode returns meta in its page layout.
+func (m *Meta) encode() [metaSize]byte {
+	var b [metaSize]byte
+	le := binary.LittleEndian
+	le.PutUint32(b[0:], m.magic)
+	le.PutUint32(b[4:], uint32(m.totalPages))
+	le.PutUint32(b[8:], uint32(m.freelistPage))
+	le.PutUint32(b[12:], uint32(m.rootPage))
+	le.PutUint64(b[16:], m.txid)
+	le.PutUint64(b[24:], m.checksum)
+	le.PutUint64(b[32:], m.sequence)
+	le.PutUint32(b[40:], uint32(m.changefeedPage))
+	copy(b[44:76], m.comparator[:])
+	copy(b[76:92], m.keyCheck[:])
+	le.PutUint32(b[92:], m.version)
+	return b
+}
+
+// write writes meta to data of meta page p.
+func (m *Meta) write(p *page.Page) {
+	b := m.encode()
+	copy(metaBytes(p), b[:])
+}
+
+// metaBytes returns meta bytes in page data.
+func metaBytes(p *page.Page) []byte {
+	return (*[metaSize]byte)(unsafe.Pointer(&p.Data))[:]
 }
 
-// pageMeta retrieves meta struct from page.
+// comparatorName returns name of key order, empty for bytewise order.
+func (m *Meta) comparatorName() string {
+	return string(bytes.TrimRight(m.comparator[:], "\x00"))
+}
+
+// validate checks magic and checksum of meta.
+func (m *Meta) validate() error {
+	if m.magic != Magic {
+		return fmt.Errorf("%w: magic not match", ErrInvalidDB)
+	}
+	if m.checksum != m.sum() {
+		return fmt.Errorf("%w: meta checksum not match", ErrInvalidDB)
+	}
+	return nil
+}
+
+// pageMeta decodes meta struct from page, changes of it are saved
+// with write.
 func pageMeta(p *page.Page) *Meta {
 	if !p.IsMeta() {
 		panic("not meta page")
 	}
-	return (*Meta)(unsafe.Pointer(&p.Data))
+	b := metaBytes(p)
+	le := binary.LittleEndian
+	m := &Meta{
+		magic:          le.Uint32(b[0:]),
+		totalPages:     common.Pgid(le.Uint32(b[4:])),
+		freelistPage:   common.Pgid(le.Uint32(b[8:])),
+		rootPage:       common.Pgid(le.Uint32(b[12:])),
+		txid:           le.Uint64(b[16:]),
+		checksum:       le.Uint64(b[24:]),
+		sequence:       le.Uint64(b[32:]),
+		changefeedPage: common.Pgid(le.Uint32(b[40:])),
+		version:        le.Uint32(b[92:]),
+	}
+	copy(m.comparator[:], b[44:76])
+	copy(m.keyCheck[:], b[76:92])
+	return m
 }
 
-// Open returns (DB, succeed)
-func Open(opts Options) (*DB, bool) {
+// pickMeta returns the valid meta with the highest txid from the first
+// two pages, and the number of meta pages. Metas are written to both
+// pages in turn, so a torn meta write leaves the other one valid.
+// Files of format version 1 have one meta page without checksum.
+// Big-endian builds wrote files in their byte order before version 9,
+// those files are reported instead of read.
+func pickMeta(p0, p1 *page.Page) (*Meta, int, error) {
+	if binary.LittleEndian.Uint32(metaBytes(p0)) == bits.ReverseBytes32(Magic) {
+		return nil, 0, fmt.Errorf("%w: file is big-endian, written by a big-endian build before format version 9", ErrInvalidDB)
+	}
+	if !p1.IsMeta() {
+		if !p0.IsMeta() || pageMeta(p0).magic != Magic {
+			return nil, 0, fmt.Errorf("%w: magic not match", ErrInvalidDB)
+		}
+		return pageMeta(p0), 1, nil
+	}
+	var picked *Meta
+	err := fmt.Errorf("%w: no meta page", ErrInvalidDB)
+	for _, p := range []*page.Page{p0, p1} {
+		if !p.IsMeta() {
+			continue
+		}
+		m := pageMeta(p)
+		verr := m.validate()
+		if verr != nil {
+			err = verr
+			continue
+		}
+		if picked == nil || m.txid > picked.txid {
+			picked = m
+		}
+	}
+	if picked == nil {
+		return nil, 0, err
+	}
+	return picked, 2, nil
+}
+
+// Open opens DB file at opts.Path, a new file is created if not exist.
+func Open(opts Options) (*DB, error) {
+	err := opts.Validate()
+	if err != nil {
+		return nil, err
+	}
 	db := &DB{
-		path: opts.Path,
+		path:         opts.Path,
+		writableMmap: opts.WritableMmap,
+		durability:   opts.Durability,
+		extentPages:  opts.ExtentPages,
+
+		auditSegmentSize: opts.AuditSegmentSize,
+		maxBatchSize:     opts.MaxBatchSize,
+		maxBatchDelay:    opts.MaxBatchDelay,
+		maxMmapSize:      opts.MaxMmapSize,
+		growthStep:       opts.GrowthStep,
+		mmapAdvise:       opts.MmapAdvise,
+		noMmap:           opts.NoMmap,
+		mlock:            opts.Mlock,
+		strictMode:       opts.StrictMode,
+		poisonFreed:      opts.PoisonFreed,
+
+		walCheckpointSize: opts.WALCheckpointSize,
+		maxTxDuration:     opts.MaxTxDuration,
+		onLongTx:          opts.OnLongTx,
+		logger:            opts.Logger,
+		hooks:             opts.Hooks,
+		tracer:            opts.Tracer,
+		changefeedPages:   opts.ChangefeedPages,
+		merge:             opts.Merge,
+		compression:       opts.Compression,
+		fillPercent:       opts.FillPercent,
+		freelistType:      opts.FreelistType,
+		compare:           opts.Compare,
+		compareName:       opts.CompareName,
+		encryptionKey:     opts.EncryptionKey,
+
+		compressionThreshold: opts.CompressionThreshold,
 	}
-	_, err := os.Stat(db.path)
-	// Create DB file if unexist
-	if os.IsNotExist(err) {
-		ok := db.initFile()
-		if !ok {
-			fmt.Println("Failed to create new DB")
-			return nil, false
+	if db.compare == nil {
+		db.compare = bytes.Compare
+	}
+	if opts.NodeCacheSize > 0 {
+		db.nodeCache = newNodeCache(opts.NodeCacheSize)
+	}
+	if db.path == MemoryPath {
+		db.file = &memFile{}
+	} else {
+		db.file, err = os.OpenFile(db.path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		// Lock before reading, so a new file is initiated only once
+		err = db.flock(opts.Timeout)
+	}
+	if err == nil && opts.ODirect {
+		db.direct, err = openDirect(db.path)
+	}
+	if err == nil {
+		err = db.load(opts)
+	}
+	if err != nil {
+		if db.wal != nil {
+			_ = db.wal.Close()
+		}
+		if db.direct != nil {
+			_ = db.direct.Close()
+		}
+		_ = db.file.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// load reads meta, maps file and opens audit log.
+// Empty file is initiated as new DB.
+func (db *DB) load(opts Options) error {
+	if len(db.encryptionKey) > 0 {
+		f, err := newCryptFile(db.file, db.encryptionKey)
+		if err != nil {
+			return err
+		}
+		db.file = f
+	}
+	fInfo, err := db.file.Stat()
+	if err != nil {
+		return err
+	}
+	if fInfo.Size() == 0 {
+		err = db.initFile()
+		if err != nil {
+			return fmt.Errorf("create DB: %w", err)
+		}
+	}
+	if opts.WAL {
+		err = db.openWAL()
+		if err != nil {
+			return err
 		}
 	}
-	// Open DB file
-	db.file, err = os.OpenFile(db.path, os.O_CREATE, 0644)
+	// Read both meta pages
+	buf := make([]byte, 2*page.PageSize)
+	_, err = db.file.ReadAt(buf, 0)
 	if err != nil {
-		fmt.Printf("Failed to open DB file: %v\n", err)
-		return nil, false
+		return fmt.Errorf("%w: read meta: %v", ErrInvalidDB, err)
 	}
-	// Read DB file
-	buf := make([]byte, page.PageSize)
-	_, err = db.file.Read(buf)
+	mt, count, err := pickMeta(page.FromBuffer(buf, 0), page.FromBuffer(buf, 1))
 	if err != nil {
-		fmt.Printf("Failed to read DB file: %v\n", err)
-		return nil, false
+		return err
+	}
+	if mt.version > FormatVersion {
+		return fmt.Errorf("%w: file format version is %d, newest supported is %d", ErrUnsupportedVersion, mt.version, FormatVersion)
 	}
-	// Load meta info
-	mt := pageMeta(page.FromBuffer(buf, 0))
-	if mt.magic != Magic {
-		fmt.Println("magic not match")
-		return nil, false
+	name := mt.comparatorName()
+	if name != db.compareName {
+		return fmt.Errorf("%w: file is ordered by %q, Options.CompareName is %q", ErrComparatorMismatch, name, db.compareName)
+	}
+	keyCheck := encryptionKeyCheck(db.encryptionKey)
+	switch {
+	case mt.keyCheck == keyCheck:
+	case mt.keyCheck == [keyCheckSize]byte{}:
+		return fmt.Errorf("%w: file is not encrypted", ErrEncryptionKey)
+	case len(db.encryptionKey) == 0:
+		return fmt.Errorf("%w: file is encrypted, Options.EncryptionKey is not set", ErrEncryptionKey)
+	default:
+		return fmt.Errorf("%w: file is encrypted with another key", ErrEncryptionKey)
 	}
 	db.meta = mt
-	// Start mmap
-	ok := db.mmap(common.MmapMinSize)
-	if !ok {
-		fmt.Println("failed to mmap")
-		return nil, false
+	db.metaPages = count
+	db.durableTxid = mt.txid
+	// Start mmap, which records file size too
+	if !db.noMmap {
+		err = db.mmap(opts.InitialMmapSize)
+		if err != nil {
+			return err
+		}
+	} else {
+		fInfo, err = db.file.Stat()
+		if err != nil {
+			return err
+		}
+		db.fileSize = int(fInfo.Size())
 	}
 	// Load freelist
-	db.freelist = freelist.NewFreelist()
-	pgFreelist := db.getPage(db.meta.freelistPage)
-	db.freelist.ReadPage(pgFreelist)
-	// Init single page pool
-	db.singlePages = sync.Pool{
-		New: func() interface{} { return make([]byte, page.PageSize) },
+	err = db.loadFreelist()
+	if err != nil {
+		return err
 	}
+	db.updateGauges()
+	// Open audit log
+	if opts.AuditDir != "" {
+		db.audit, err = audit.OpenWriter(opts.AuditDir, opts.AuditSegmentSize)
+		if err != nil {
+			return fmt.Errorf("open audit log: %w", err)
+		}
+	}
+	return nil
+}
 
-	return db, true
+// Bytewise returns whether keys are in bytes.Compare order, i.e.
+// Options.Compare is not set. Only this order keeps keys with a prefix
+// together, in kv.PrefixRange.
+func (db *DB) Bytewise() bool {
+	return db.compareName == ""
 }
 
-// initFile initiates new DB file.
-func (db *DB) initFile() bool {
-	var err error
-	db.file, err = os.Create(db.path)
+// DurableTxID returns id of the last transaction synced to disk.
+// It is behind the last committed id when commits skip sync.
+func (db *DB) DurableTxID() uint64 {
+	db.metalock.Lock()
+	defer db.metalock.Unlock()
+	return db.durableTxid
+}
+
+// Sync flushes commits made without sync to disk, and moves
+// DurableTxID to the last commit.
+func (db *DB) Sync() error {
+	db.metalock.Lock()
+	if db.state == stateClosed {
+		db.metalock.Unlock()
+		return ErrDBClosed
+	}
+	db.metalock.Unlock()
+	return db.sync()
+}
+
+// sync syncs DB file and moves DurableTxID to the last commit.
+func (db *DB) sync() error {
+	db.metalock.Lock()
+	txid := db.meta.txid
+	db.metalock.Unlock()
+	// Syncing the file also flushes pages dirtied in writable map
+	err := db.file.Sync()
 	if err != nil {
-		fmt.Printf("Failed to create new DB file: %v\n", err)
-		return false
+		return db.ioError(fmt.Errorf("sync: %w", err))
 	}
+	db.metalock.Lock()
+	if txid > db.durableTxid {
+		db.durableTxid = txid
+	}
+	db.metalock.Unlock()
+	return nil
+}
 
-	buf := make([]byte, 3*page.PageSize)
-	// First page is meta page
-	p0 := page.FromBuffer(buf, 0)
-	p0.Index = 0
-	p0.SetFlag(page.FlagMeta)
-	p0.Overflow = 0
+// Health returns the error which made DB stop taking writes,
+// nil when DB is healthy.
+// After ENOSPC or EIO in a commit, disk state of the failed commit is
+// unknown, so DB refuses writable transactions. Read transactions keep
+// working on the last committed state.
+func (db *DB) Health() error {
+	db.metalock.Lock()
+	defer db.metalock.Unlock()
+	return db.failed
+}
 
-	mt := pageMeta(p0)
-	mt.magic = Magic
-	mt.freelistPage = 1
-	mt.rootPage = 2
-	mt.totalPages = 3
+// ioError logs a write or sync error, and marks DB failed for writes
+// when disk is full or broken. It returns err.
+func (db *DB) ioError(err error) error {
+	db.logger.Error(err, "I/O failed")
+	db.metalock.Lock()
+	defer db.metalock.Unlock()
+	if db.failed == nil && (errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EIO)) {
+		db.failed = err
+		db.logger.Error(err, "DB stops taking writes")
+	}
+	return err
+}
 
-	// Second page is for freelist
-	p1 := page.FromBuffer(buf, 1)
-	p1.Index = 1
-	p1.SetFlag(page.FlagFreelist)
+// loadFreelist reads freelist from the page recorded in meta.
+func (db *DB) loadFreelist() error {
+	db.freelist = freelist.New(db.freelistType)
+	if db.noMmap {
+		p, err := db.readPage(db.meta.freelistPage)
+		if err != nil {
+			return err
+		}
+		db.freelist.ReadPage(p)
+		db.pagePool.put(p)
+		return nil
+	}
+	pgFreelist := db.getPage(db.meta.freelistPage)
+	db.freelist.ReadPage(pgFreelist)
+	return nil
+}
+
+// releasePending makes pages freed by committed transactions reusable,
+// except pages which open read-only transactions may still read.
+func (db *DB) releasePending() error {
+	oldest := db.meta.txid
+	for _, tx := range db.txs {
+		if !tx.writable && tx.id < oldest {
+			oldest = tx.id
+		}
+	}
+	ids := db.freelist.Release(oldest)
+	if db.poisonFreed {
+		return db.poison(ids)
+	}
+	return nil
+}
+
+// poisonByte fills released pages, see Options.PoisonFreed.
+const poisonByte = 0xde
 
-	// Third page is for root node
+// poison fills pages of sorted ids with poisonByte.
+func (db *DB) poison(ids []common.Pgid) error {
+	for i := 0; i < len(ids); {
+		// Write contiguous pages at once
+		j := i + 1
+		for j < len(ids) && ids[j] == ids[j-1]+1 {
+			j++
+		}
+		buf := bytes.Repeat([]byte{poisonByte}, (j-i)*page.PageSize)
+		start := int(ids[i]) * page.PageSize
+		_, err := db.file.WriteAt(buf, int64(start))
+		if err != nil {
+			return fmt.Errorf("poison freed pages: %w", err)
+		}
+		if !db.noMmap {
+			err = invalidateRange(db.mmData()[start:start+len(buf)], db.mlock)
+			if err != nil {
+				return fmt.Errorf("invalidate memory map: %w", err)
+			}
+		}
+		i = j
+	}
+	return nil
+}
+
+// initFile writes pages of an empty DB to opened file.
+func (db *DB) initFile() error {
+	buf := make([]byte, 4*page.PageSize)
+	// First two pages are meta pages
+	for i := 0; i < 2; i++ {
+		p := page.FromBuffer(buf, common.Pgid(i))
+		p.SetIndex(common.Pgid(i))
+		p.SetFlag(page.FlagMeta)
+		p.SetOverflow(0)
+
+		mt := &Meta{
+			magic:        Magic,
+			freelistPage: 2,
+			rootPage:     3,
+			totalPages:   4,
+			keyCheck:     encryptionKeyCheck(db.encryptionKey),
+			version:      FormatVersion,
+		}
+		copy(mt.comparator[:], db.compareName)
+		mt.checksum = mt.sum()
+		mt.write(p)
+	}
+
+	// Third page is for freelist
 	p2 := page.FromBuffer(buf, 2)
-	p2.Index = 2
-	p2.SetFlag(page.FlagLeaf)
+	p2.SetIndex(2)
+	p2.SetFlag(page.FlagFreelist)
+
+	// Fourth page is for root node
+	p3 := page.FromBuffer(buf, 3)
+	p3.SetIndex(3)
+	p3.SetFlag(page.FlagLeaf)
 
 	// Write and sync
-	_, err = db.file.WriteAt(buf, 0)
+	_, err := db.file.WriteAt(buf, 0)
 	if err != nil {
-		fmt.Printf("Failed to write new DB file: %v\n", err)
-		return false
+		return err
 	}
-	err = db.file.Sync()
-	if err != nil {
-		fmt.Printf("Failed to sync new DB file: %v\n", err)
-		return false
+	return db.file.Sync()
+}
+
+// allocate allocates contiguous pages.
+func (db *DB) allocate(count int) (*page.Page, error) {
+	// Check freelist for memory-map free slot
+	id, ok := db.freelist.Allocate(count)
+	if !ok {
+		// When no proper "hole", enlarge memory mapping
+		id = db.writableTx.meta.totalPages
+		db.writableTx.meta.totalPages += common.Pgid(count)
+		db.writableTx.stats.PagesGrown += count
+		mmapSize := int(db.writableTx.meta.totalPages * common.Pgid(page.PageSize))
+
+		// Extend file first, map beyond file end raises SIGBUS when read
+		err := db.grow(mmapSize)
+		if err != nil {
+			return nil, db.allocFailed(count, err)
+		}
+		// Enlarge mmap
+		if !db.noMmap && mmapSize > db.mmapSize {
+			oldSize := db.mmapSize
+			span := db.writableTx.startSpan("mmap grow")
+			err := db.mmap(mmapSize)
+			span.SetAttribute("old_size", oldSize)
+			span.SetAttribute("new_size", db.mmapSize)
+			span.End()
+			if err != nil {
+				return nil, db.allocFailed(count, err)
+			}
+			if db.hooks.OnGrow != nil {
+				db.hooks.OnGrow(oldSize, db.mmapSize)
+			}
+		}
 	}
 
-	return true
-}
+	if db.nodeCache != nil {
+		// Nodes cached from reused pages are gone
+		db.nodeCache.invalidate(id, count)
+	}
 
-// allocate allocates contiguous pages, returns (*page, succeed).
-func (db *DB) allocate(count int) (*page.Page, bool) {
-	// Allocate memory buffer to hold new page
-	var buf []byte
-	if count == 1 {
-		buf = db.singlePages.Get().([]byte)
+	var p *page.Page
+	if db.writableMmap {
+		var err error
+		p, err = db.mappedPage(id, count)
+		if err != nil {
+			return nil, db.allocFailed(count, err)
+		}
 	} else {
-		buf = make([]byte, count*page.PageSize)
+		// Allocate memory buffer to hold new page
+		p = page.FromBuffer(db.pagePool.get(count), 0)
 	}
-	// New page struct
-	p := page.FromBuffer(buf, 0)
-	p.Overflow = count - 1
+	p.SetIndex(id)
+	p.SetOverflow(count - 1)
 
-	// Check freelist for memory-map free slot
-	id, ok := db.freelist.Allocate(count)
-	if ok {
-		p.Index = id
-		return p, true
-	}
+	return p, nil
+}
 
-	// When no proper "hole", enlarge memory mapping
-	p.Index = db.writableTx.meta.totalPages
-	db.writableTx.meta.totalPages += common.Pgid(count)
-	mmapSize := int(db.writableTx.meta.totalPages * common.Pgid(page.PageSize))
+// grow extends DB file to at least size bytes, rounded up to
+// GrowthStep. It's called before pages beyond file end are mapped.
+func (db *DB) grow(size int) error {
+	if size <= db.fileSize {
+		return nil
+	}
+	if db.growthStep > 0 {
+		size += db.growthStep - 1
+		size -= size % db.growthStep
+	}
+	err := db.file.Truncate(int64(size))
+	if err != nil {
+		return db.ioError(fmt.Errorf("extend DB file: %w", err))
+	}
+	db.fileSize = size
+	if db.mlock && db.mmBuf != nil {
+		// Pages beyond current map are locked when it grows
+		return db.lockMmap(*db.mmBuf)
+	}
+	return nil
+}
 
-	// Enlarge mmap
-	if mmapSize > db.mmapSize {
-		ok := db.mmap(mmapSize)
-		if !ok {
-			return nil, false
+// shrink truncates file to pages of the last commit, rounded up to
+// GrowthStep, when commit txid dropped free pages at its end. Readers
+// opened before txid may read up to their own total pages, e.g. in
+// backup, and the last synced meta may still use the pages, so file is
+// kept until a later synced commit without such readers.
+func (db *DB) shrink(txid uint64) error {
+	db.metalock.Lock()
+	size := int(db.meta.totalPages) * page.PageSize
+	keep := db.durableTxid < txid
+	for _, tx := range db.txs {
+		if !tx.writable && tx.id < txid {
+			keep = true
+		}
+	}
+	db.metalock.Unlock()
+	if db.growthStep > 0 {
+		size += db.growthStep - 1
+		size -= size % db.growthStep
+	}
+	if keep || size >= db.fileSize || (!db.noMmap && !mmap.TruncateMapped) {
+		return nil
+	}
+	if db.mlock && db.lockedSize > size {
+		err := mmap.Unlock((*db.mmBuf)[size:db.lockedSize])
+		if err != nil {
+			return err
 		}
+		db.lockedSize = size
+	}
+	err := db.file.Truncate(int64(size))
+	if err != nil {
+		return fmt.Errorf("shrink DB file: %w", err)
 	}
+	db.logger.V(1).Info("DB file shrunk", "old_size", db.fileSize, "new_size", size)
+	db.fileSize = size
+	return nil
+}
 
-	return p, true
+// lockMmap locks the part of map buf inside file which is not locked.
+func (db *DB) lockMmap(buf []byte) error {
+	end := db.fileSize
+	if end > len(buf) {
+		end = len(buf)
+	}
+	if end <= db.lockedSize {
+		return nil
+	}
+	err := mmap.Lock(buf[db.lockedSize:end])
+	if err != nil {
+		return err
+	}
+	db.lockedSize = end
+	return nil
+}
+
+// unlockMmap unlocks current map.
+func (db *DB) unlockMmap() error {
+	if db.lockedSize == 0 {
+		return nil
+	}
+	err := mmap.Unlock((*db.mmBuf)[:db.lockedSize])
+	db.lockedSize = 0
+	return err
+}
+
+// mappedPage returns cleared pages in writable memory map,
+// which are inside the file since allocate grows it.
+func (db *DB) mappedPage(id common.Pgid, count int) (*page.Page, error) {
+	end := int(id)*page.PageSize + count*page.PageSize
+	offset := int(id) * page.PageSize
+	buf := db.mmData()[offset:end]
+	for i := range buf {
+		buf[i] = 0
+	}
+	return db.getPage(id), nil
 }
 
 // roundMmapSize doubles mmap size to 1GB,
-// then grows by 1GB up to maxMmapSize
-func roundMmapSize(size int) int {
+// then grows by 1GB up to maxSize
+func roundMmapSize(size, maxSize int) int {
 	if size < 1<<30 {
 		for i := 1; i <= 30; i++ {
-			if size < 1<<i {
+			if size <= 1<<i {
 				size = 1 << i
 				break
 			}
 		}
-		return size
+	} else {
+		// Align by step
+		size += MmapStep
+		size -= size % MmapStep
 	}
 
-	// Align by step
-	size += MmapStep
-	size -= size % MmapStep
-
-	if size > common.MmapMaxSize {
-		fmt.Println("Exceed max mmap size, round up")
-		size = common.MmapMaxSize
+	if size > maxSize {
+		size = maxSize
 	}
-
 	return size
 }
 
 // mmap create mmap for at least given size.
-func (db *DB) mmap(sz int) bool {
+func (db *DB) mmap(sz int) error {
 	fInfo, err := db.file.Stat()
 	if err != nil {
-		fmt.Printf("Failed to stat mmap file: %v\n", err)
-		return false
+		return err
 	}
 
 	mapFileSize := int(fInfo.Size())
@@ -254,33 +1100,233 @@ func (db *DB) mmap(sz int) bool {
 		sz = mapFileSize
 	}
 
-	sz = roundMmapSize(sz)
-
-	// TODO: dereference before unmapping
+	if sz > db.maxMmapSize {
+		return fmt.Errorf("%w: %d bytes needed", ErrMmapTooLarge, sz)
+	}
+	sz = roundMmapSize(sz, db.maxMmapSize)
 
-	buf, err := syscall.Mmap(
-		int(db.file.Fd()),
-		0,
-		sz,
-		syscall.PROT_READ,
-		syscall.MAP_SHARED,
-	)
+	buf, err := mmap.Map(db.osFile(), sz, db.writableMmap)
 	if err != nil {
-		fmt.Printf("mmap failed: %v\n", err)
-		return false
+		return err
+	}
+	if db.mmapAdvise != AdviceNormal {
+		err = mmap.Advise(buf, db.mmapAdvise.mmapAdvice())
+		if err != nil {
+			_ = mmap.Unmap(buf)
+			return err
+		}
+	}
+	// Map extends file on some platforms
+	fInfo, err = db.file.Stat()
+	if err != nil {
+		return err
 	}
 
-	db.mmBuf = &buf
-	db.mmSizedBuf = (*[common.MmapMaxSize]byte)(unsafe.Pointer(&buf))
+	if db.mmBuf != nil {
+		// Old map stays for readers, unlock it as pages are locked
+		// again through the new map
+		err = db.unlockMmap()
+		if err != nil {
+			_ = mmap.Unmap(buf)
+			return err
+		}
+		db.replaceMmap(buf)
+	} else {
+		db.mmBuf = &buf
+		atomic.StorePointer(&db.mmSizedBuf, unsafe.Pointer(&buf[0]))
+	}
 	db.mmapSize = sz
-	page0 := page.FromBuffer(*db.mmBuf, 0)
-	db.meta = pageMeta(page0)
+	db.fileSize = int(fInfo.Size())
+
+	if db.mlock {
+		return db.lockMmap(buf)
+	}
+	return nil
+}
+
+// staleMmap is a replaced memory map, with the number of open
+// transactions which may still read it.
+type staleMmap struct {
+	buf     []byte
+	readers int
+}
+
+// replaceMmap makes buf the current map. The old map is kept for
+// transactions open now, which may hold pointers into it, and is
+// unmapped when the last of them closes. Transactions created later
+// only read buf. Nodes cached from the old map are dropped, since
+// later transactions would read them after it's unmapped.
+func (db *DB) replaceMmap(buf []byte) {
+	db.metalock.Lock()
+	stale := &staleMmap{buf: *db.mmBuf, readers: len(db.txs)}
+	for _, tx := range db.txs {
+		tx.mmaps = append(tx.mmaps, stale)
+	}
+	db.staleMmaps = append(db.staleMmaps, stale)
+	db.mmBuf = &buf
+	atomic.StorePointer(&db.mmSizedBuf, unsafe.Pointer(&buf[0]))
+	if stale.readers == 0 {
+		db.unmapStale(stale)
+	}
+	db.metalock.Unlock()
+	if db.nodeCache != nil {
+		db.nodeCache.clear()
+	}
+}
+
+// releaseMmaps drops references of closed tx to replaced maps, caller
+// holds metalock.
+func (db *DB) releaseMmaps(tx *Tx) {
+	for _, m := range tx.mmaps {
+		m.readers--
+		if m.readers == 0 {
+			db.unmapStale(m)
+		}
+	}
+	tx.mmaps = nil
+}
 
-	return true
+// unmapStale unmaps replaced map m which no tx reads, caller holds
+// metalock.
+func (db *DB) unmapStale(m *staleMmap) {
+	for i, s := range db.staleMmaps {
+		if s == m {
+			db.staleMmaps = append(db.staleMmaps[:i], db.staleMmaps[i+1:]...)
+			break
+		}
+	}
+	err := mmap.Unmap(m.buf)
+	if err != nil {
+		db.logger.Error(err, "Failed to unmap replaced memory map", "size", len(m.buf))
+	}
+}
+
+// Close waits for open transactions to be committed or rolled back,
+// then syncs and closes DB file and unmaps it. Transactions and other
+// operations after Close return ErrDBClosed.
+func (db *DB) Close() error {
+	db.metalock.Lock()
+	prev := atomic.SwapInt32(&db.state, stateClosed)
+	db.metalock.Unlock()
+	if prev == stateClosed {
+		return ErrDBClosed
+	}
+	db.txWait.Wait()
+
+	var err error
+	if prev == stateOpen {
+		err = db.release()
+	} else if db.noMmap {
+		// Shutdown keeps the file open for read transactions
+		err = db.file.Close()
+	}
+	if db.noMmap {
+		return err
+	}
+	if uerr := db.unlockMmap(); err == nil {
+		err = uerr
+	}
+	// No tx reads memory maps now, and maps hold the file lock
+	for _, m := range db.staleMmaps {
+		uerr := mmap.Unmap(m.buf)
+		if err == nil {
+			err = uerr
+		}
+	}
+	if uerr := mmap.Unmap(*db.mmBuf); err == nil {
+		err = uerr
+	}
+	db.staleMmaps = nil
+	db.mmBuf = nil
+	atomic.StorePointer(&db.mmSizedBuf, nil)
+	db.mmapSize = 0
+	return err
+}
+
+// release syncs committed changes, closes audit log and DB file.
+func (db *DB) release() error {
+	err := db.closeLogs()
+	if err != nil {
+		return err
+	}
+	return db.file.Close()
+}
+
+// closeLogs syncs committed changes and closes audit log, write-ahead log
+// and direct I/O file, leaving DB file open.
+func (db *DB) closeLogs() error {
+	db.flushWait.Wait()
+	err := db.file.Sync()
+	if err != nil {
+		return db.ioError(fmt.Errorf("sync on close: %w", err))
+	}
+	db.metalock.Lock()
+	db.durableTxid = db.meta.txid
+	db.metalock.Unlock()
+	if db.audit != nil {
+		err = db.audit.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if db.wal != nil {
+		// DB file is synced, the log is not needed
+		err = db.closeWAL()
+		if err != nil {
+			return err
+		}
+	}
+	if db.direct != nil {
+		return db.direct.Close()
+	}
+	return nil
+}
+
+// osFile returns DB file for memory map and lock calls, in-memory DB
+// has no memory map.
+func (db *DB) osFile() *os.File {
+	if f, ok := db.file.(*cryptFile); ok {
+		return f.dbFile.(*os.File)
+	}
+	return db.file.(*os.File)
+}
+
+// mmData returns current memory map. Replaced maps stay mapped until
+// transactions open at the time are closed, see replaceMmap.
+func (db *DB) mmData() *[common.MmapMaxSize]byte {
+	return (*[common.MmapMaxSize]byte)(atomic.LoadPointer(&db.mmSizedBuf))
 }
 
 // getPage returns page from memory map
 func (db *DB) getPage(index common.Pgid) *page.Page {
 	offset := index * common.Pgid(page.PageSize)
-	return (*page.Page)(unsafe.Pointer(&db.mmSizedBuf[offset]))
+	return (*page.Page)(unsafe.Pointer(&db.mmData()[offset]))
+}
+
+// readPage reads page and its overflow pages from file into buffer
+// from page pool, for DB without memory map.
+func (db *DB) readPage(id common.Pgid) (*page.Page, error) {
+	offset := int64(id) * int64(page.PageSize)
+	buf := db.pagePool.get(1)
+	p := page.FromBuffer(buf, 0)
+	_, err := db.file.ReadAt(buf, offset)
+	if err != nil {
+		db.pagePool.put(p)
+		return nil, fmt.Errorf("read page %d: %w", id, err)
+	}
+	if p.Overflow() == 0 {
+		return p, nil
+	}
+	count := p.Overflow() + 1
+	// Buffer goes back to pool by its own size
+	p.SetOverflow(0)
+	db.pagePool.put(p)
+	buf = db.pagePool.get(count)
+	p = page.FromBuffer(buf, 0)
+	_, err = db.file.ReadAt(buf, offset)
+	if err != nil {
+		db.pagePool.put(p)
+		return nil, fmt.Errorf("read page %d with %d overflow: %w", id, count-1, err)
+	}
+	return p, nil
 }
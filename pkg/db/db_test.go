@@ -1,66 +1,135 @@
 package db
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/daicang/mk/pkg/audit"
 	"github.com/daicang/mk/pkg/common"
+	"github.com/daicang/mk/pkg/freelist"
+	"github.com/daicang/mk/pkg/kv"
 	"github.com/daicang/mk/pkg/page"
+	"github.com/daicang/mk/pkg/testutil"
+	"github.com/daicang/mk/pkg/tree"
 )
 
-var (
-	dataPath = "../testing_data/data"
-)
+// dataPath returns DB file path in a per-test temporary directory.
+func dataPath(t *testing.T) string {
+	return filepath.Join(t.TempDir(), "data")
+}
+
+// openDB opens a new DB, fails test on error.
+func openDB(t *testing.T) *DB {
+	db, err := Open(Options{
+		Path: dataPath(t),
+	})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	return db
+}
+
+// fillDB writes given pairs into DB with one transaction.
+func fillDB(t *testing.T, db *DB, kvs map[string]string) {
+	tx, err := NewWritableTx(db)
+	if err != nil {
+		t.Fatalf("Failed to create tx: %v", err)
+	}
+	for key, value := range kvs {
+		mustSet(t, tx, []byte(key), []byte(value))
+	}
+	mustCommit(t, tx)
+}
+
+// mustSet sets key in tx, fails test on error.
+func mustSet(tb testing.TB, tx *Tx, key kv.Key, value kv.Value) {
+	_, err := tx.Set(key, value)
+	if err != nil {
+		tb.Fatalf("Failed to set %q: %v", key, err)
+	}
+}
+
+// mustRemove removes key from tx, fails test on error.
+func mustRemove(tb testing.TB, tx *Tx, key kv.Key) {
+	_, err := tx.Remove(key)
+	if err != nil {
+		tb.Fatalf("Failed to remove %q: %v", key, err)
+	}
+}
+
+// mustCommit commits tx, fails test on error.
+func mustCommit(tb testing.TB, tx *Tx) {
+	err := tx.Commit()
+	if err != nil {
+		tb.Fatalf("Failed to commit: %v", err)
+	}
+}
 
 func TestCreateNew(t *testing.T) {
 	opt := Options{
-		Path: dataPath,
+		Path: dataPath(t),
 	}
-	os.Remove(dataPath)
 	db := DB{
 		path: opt.Path,
 	}
 
-	ok := db.initFile()
-	if !ok {
-		t.Error("Failed to create new DB")
+	var err error
+	db.file, err = os.OpenFile(db.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.initFile()
+	if err != nil {
+		t.Errorf("Failed to create new DB: %v", err)
 	}
 
-	_, err := os.Stat(db.path)
+	_, err = os.Stat(db.path)
 	if err != nil {
 		t.Errorf("Failed to check data file: %v", err)
 	}
 
-	buf := make([]byte, 3*page.PageSize)
+	buf := make([]byte, 4*page.PageSize)
 	fd, _ := os.OpenFile(db.path, os.O_CREATE, 0644)
 
 	fd.Read(buf)
 
-	for i := 0; i < 3; i++ {
+	for i := 0; i < 4; i++ {
 		p := page.FromBuffer(buf, common.Pgid(i))
-		if p.Index != common.Pgid(i) {
+		if p.Index() != common.Pgid(i) {
 			t.Errorf("Incorrect page id")
 		}
 
 		switch i {
-		case 0:
+		case 0, 1:
 			if !p.IsMeta() {
-				t.Error("First page should be meta page")
+				t.Fatal("First two pages should be meta pages")
 			}
 			mt := pageMeta(p)
-			if mt.magic != Magic {
-				t.Errorf("Meta page magic value error")
+			if mt.validate() != nil {
+				t.Errorf("Meta page %d is invalid: %v", i, mt.validate())
 			}
-			if mt.rootPage != 2 {
+			if mt.rootPage != 3 || mt.freelistPage != 2 {
 				t.Errorf("Meta page root pgid error")
 			}
 
-		case 1:
+		case 2:
 			if !p.IsFreelist() {
-				t.Errorf("Second page should be freelist page")
+				t.Errorf("Third page should be freelist page")
 			}
 
-		case 2:
+		case 3:
 			if !p.IsLeaf() {
 				t.Errorf("Root page should be leaf")
 			}
@@ -68,36 +137,2238 @@ func TestCreateNew(t *testing.T) {
 	}
 }
 
-// func TestDB(t *testing.T) {
-// 	opt := Options{
-// 		ReadOnly: false,
-// 		Path:     dataPath,
-// 	}
+func TestDB(t *testing.T) {
+	opt := Options{
+		Path: dataPath(t),
+	}
+
+	db, err := Open(opt)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+
+	tx, err := NewWritableTx(db)
+	if err != nil {
+		t.Fatalf("Failed to create tx: %v", err)
+	}
+
+	kvs := testutil.RandomKV(1000)
+
+	for key, value := range kvs {
+		old, err := tx.Set([]byte(key), []byte(value))
+		if err != nil {
+			t.Fatalf("Failed to set: %v", err)
+		}
+		if old != nil {
+			t.Errorf("Old value should be nil: old=%s", old)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		t.Errorf("Failed to commit: %v", err)
+	}
+
+	// Reopen and check all pairs
+	err = db.Close()
+	if err != nil {
+		t.Fatalf("Failed to close DB: %v", err)
+	}
+	db, err = Open(opt)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	rtx, err := NewReadOnlyTx(db)
+	if err != nil {
+		t.Fatalf("Failed to create read-only tx: %v", err)
+	}
+	for key, value := range kvs {
+		v := rtx.Get([]byte(key))
+		if v == nil {
+			t.Errorf("Key %q not found", key)
+			continue
+		}
+		if string(v) != value {
+			t.Errorf("Value mismatch for %q: expect %q, get %q", key, value, v)
+		}
+	}
+}
+
+func TestRemove(t *testing.T) {
+	db := openDB(t)
+	kvs := testutil.RandomKV(1000)
+	fillDB(t, db, kvs)
+
+	tx, err := NewWritableTx(db)
+	if err != nil {
+		t.Fatalf("Failed to create tx: %v", err)
+	}
+	removed := map[string]bool{}
+	for key, value := range kvs {
+		if len(removed) == 900 {
+			break
+		}
+		old, err := tx.Remove([]byte(key))
+		if err != nil {
+			t.Fatalf("Failed to remove: %v", err)
+		}
+		if string(old) != value {
+			t.Errorf("Key %q: expect old value %q, get %q", key, value, old)
+		}
+		removed[key] = true
+	}
+	old, err := tx.Remove([]byte("missing key"))
+	if old != nil || err != nil {
+		t.Errorf("Removing missing key returns (%q, %v)", old, err)
+	}
+	mustCommit(t, tx)
+
+	rtx, _ := NewReadOnlyTx(db)
+	for key, value := range kvs {
+		v := rtx.Get([]byte(key))
+		if removed[key] {
+			if v != nil {
+				t.Errorf("Removed key %q found", key)
+			}
+			continue
+		}
+		if v == nil || string(v) != value {
+			t.Errorf("Key %q: expect %q, get %q", key, value, v)
+		}
+	}
+}
+
+func TestLargeTree(t *testing.T) {
+	path := dataPath(t)
+	db, err := Open(Options{Path: path})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	rnd := rand.New(rand.NewSource(2))
+	kvs := map[string]string{}
+	// Each commit splits leaves many times over and grows the tree.
+	for _, count := range []int{20000, 20000, 20000, 20000, 20000} {
+		tx, _ := NewWritableTx(db)
+		for i := 0; i < count; i++ {
+			k := fmt.Sprintf("%016x", rnd.Uint64())
+			kvs[k] = fmt.Sprint(i)
+			mustSet(t, tx, []byte(k), []byte(kvs[k]))
+		}
+		mustCommit(t, tx)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(Options{Path: path})
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	err = db.View(func(tx *Tx) error {
+		profile := tx.TreeProfile()
+		if profile.Depth < 3 {
+			t.Errorf("Expect at least 3 levels, get %d", profile.Depth)
+		}
+		if profile.Levels[profile.Depth-1].Keys != len(kvs) {
+			t.Errorf("Expect %d keys, get %d", len(kvs), profile.Levels[profile.Depth-1].Keys)
+		}
+		for k, v := range kvs {
+			if string(tx.Get([]byte(k))) != v {
+				t.Fatalf("Key %s: expect %s, get %s", k, v, tx.Get([]byte(k)))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	db := openDB(t)
+	rnd := rand.New(rand.NewSource(1))
+	kvs := map[string]string{}
+	for i := 0; i < 3000; i++ {
+		kvs[fmt.Sprintf("key-%05d", rnd.Intn(100000))] = strings.Repeat("v", rnd.Intn(page.MaxInlineValue))
+	}
+	fillDB(t, db, kvs)
+
+	// Each round removes a random part of keys and adds a few
+	for round := 0; round < 20; round++ {
+		tx, _ := NewWritableTx(db)
+		for k := range kvs {
+			if rnd.Intn(4) == 0 {
+				mustRemove(t, tx, []byte(k))
+				delete(kvs, k)
+			}
+		}
+		for i := 0; i < 20; i++ {
+			k := fmt.Sprintf("key-%05d", rnd.Intn(100000))
+			kvs[k] = strings.Repeat("n", rnd.Intn(page.MaxInlineValue))
+			mustSet(t, tx, []byte(k), []byte(kvs[k]))
+		}
+		mustCommit(t, tx)
+
+		rtx, _ := NewReadOnlyTx(db)
+		rtx.forEachNode(func(n *tree.Node, depth int) {
+			if n.IsRoot() {
+				return
+			}
+			if n.KeyCount() == 0 {
+				t.Fatalf("Round %d: empty node %d", round, n.Index)
+			}
+			pos := childPosition(n)
+			if pos > 0 && !n.Parent.Keys[pos].EqualTo(n.Keys[0]) {
+				t.Errorf("Round %d: node %d indexed by %q, first key %q", round, n.Index, n.Parent.Keys[pos], n.Keys[0])
+			}
+		})
+		c := rtx.Cursor()
+		count := 0
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if kvs[string(k)] != string(v) {
+				t.Fatalf("Round %d: key %s mismatch", round, k)
+			}
+			count++
+		}
+		if count != len(kvs) {
+			t.Fatalf("Round %d: expect %d keys, get %d", round, len(kvs), count)
+		}
+		err := rtx.Rollback()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBorrow(t *testing.T) {
+	value := make([]byte, page.PageSize/10)
+	parent := &tree.Node{Keys: []kv.Key{[]byte("a"), []byte("k00")}, Cids: []common.Pgid{11, 12}}
+	left := &tree.Node{Index: 11, IsLeaf: true, Parent: parent}
+	left.InsertKeyValueAt(0, []byte("a"), value)
+	right := &tree.Node{Index: 12, IsLeaf: true, Parent: parent}
+	for i := 0; i < 12; i++ {
+		right.InsertKeyValueAt(i, []byte(fmt.Sprintf("k%02d", i)), value)
+	}
+	right.Key = right.Keys[0]
+
+	tx := &Tx{nodes: map[common.Pgid]*tree.Node{}}
+	if !tx.borrow(left, right) {
+		t.Fatal("Expect borrowing when merged node overfills")
+	}
+	if left.Underfill() || right.Underfill() {
+		t.Errorf("Expect both siblings filled, get %d and %d keys", left.KeyCount(), right.KeyCount())
+	}
+	if left.KeyCount()+right.KeyCount() != 13 {
+		t.Errorf("Expect 13 keys in siblings, get %d", left.KeyCount()+right.KeyCount())
+	}
+	if left.Keys[left.KeyCount()-1].GreaterEqual(right.Keys[0]) {
+		t.Errorf("Keys out of order: %q before %q", left.Keys[left.KeyCount()-1], right.Keys[0])
+	}
+	if !parent.Keys[1].EqualTo(right.Keys[0]) || !right.Key.EqualTo(right.Keys[0]) {
+		t.Errorf("Expect right node indexed by %q, get %q", right.Keys[0], parent.Keys[1])
+	}
+
+	// Small siblings are merged instead
+	small := &tree.Node{Index: 12, IsLeaf: true, Parent: parent}
+	small.InsertKeyValueAt(0, []byte("k00"), value)
+	if tx.borrow(left, small) {
+		t.Error("Expect no borrowing when siblings fit in one page")
+	}
+}
+
+func TestGetMany(t *testing.T) {
+	db := openDB(t)
+	kvs := map[string]string{}
+	for i := 0; i < 20000; i += 2 {
+		kvs[fmt.Sprintf("key-%05d", i)] = fmt.Sprint(i)
+	}
+	fillDB(t, db, kvs)
+
+	// Keys out of order, with missing and repeated keys
+	rnd := rand.New(rand.NewSource(3))
+	keys := []kv.Key{nil, []byte("zzz"), []byte("key-00000")}
+	for i := 0; i < 5000; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("key-%05d", rnd.Intn(20000))))
+	}
+	for _, writable := range []bool{false, true} {
+		var tx *Tx
+		if writable {
+			tx, _ = NewWritableTx(db)
+			mustSet(t, tx, []byte("key-00001"), []byte("new"))
+			kvs["key-00001"] = "new"
+			keys = append(keys, []byte("key-00001"))
+		} else {
+			tx, _ = NewReadOnlyTx(db)
+		}
+		values, err := tx.GetMany(keys)
+		if err != nil || len(values) != len(keys) {
+			t.Fatalf("Expect %d values, get %d, %v", len(keys), len(values), err)
+		}
+		for i, key := range keys {
+			expect, exist := kvs[string(key)]
+			if (values[i] != nil) != exist || string(values[i]) != expect {
+				t.Errorf("Key %q: expect %q, get %q", key, expect, values[i])
+			}
+		}
+		err = tx.Rollback()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = tx.GetMany(keys); !errors.Is(err, ErrTxClosed) {
+			t.Errorf("Expect ErrTxClosed, get %v", err)
+		}
+	}
+}
+
+func BenchmarkGetMany(b *testing.B) {
+	db, err := Open(Options{Path: filepath.Join(b.TempDir(), "data")})
+	if err != nil {
+		b.Fatal(err)
+	}
+	keys := []kv.Key{}
+	for i := 0; i < 100000; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("key-%06d", i)))
+	}
+	// Leaves split at commit, so load in small commits
+	for i := 0; i < len(keys); i += 10000 {
+		tx, _ := NewWritableTx(db)
+		for _, key := range keys[i : i+10000] {
+			mustSet(b, tx, key, []byte("value"))
+		}
+		mustCommit(b, tx)
+	}
+	rnd := rand.New(rand.NewSource(4))
+	rnd.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+	keys = keys[:10000]
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tx, _ := NewReadOnlyTx(db)
+		_, err := tx.GetMany(keys)
+		if err != nil {
+			b.Fatal(err)
+		}
+		_ = tx.Rollback()
+	}
+}
+
+func TestGetRef(t *testing.T) {
+	db := openDB(t)
+	defer func() { _ = db.Close() }()
+	fillDB(t, db, map[string]string{"a": "1", "empty": ""})
+	tx, err := NewReadOnlyTx(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := tx.GetRef(kv.Key("a"))
+	if err != nil || string(ref) != "1" {
+		t.Fatalf("Expect 1, get %q %v", ref, err)
+	}
+	// Refs point into the same page, Get returns a copy
+	again, _ := tx.GetRef(kv.Key("a"))
+	v := tx.Get(kv.Key("a"))
+	if &again[0] != &ref[0] || &v[0] == &ref[0] {
+		t.Error("Expect GetRef without copy and Get with copy")
+	}
+	if ref, err := tx.GetRef(kv.Key("empty")); err != nil || ref == nil || len(ref) != 0 {
+		t.Errorf("Expect empty value, get %q %v", ref, err)
+	}
+	if ref, err := tx.GetRef(kv.Key("missing")); err != nil || ref != nil {
+		t.Errorf("Expect nil for missing key, get %q %v", ref, err)
+	}
+	_ = tx.Rollback()
+	if _, err := tx.GetRef(kv.Key("a")); !errors.Is(err, ErrTxClosed) {
+		t.Errorf("Expect ErrTxClosed, get %v", err)
+	}
+}
+
+func TestLazyRead(t *testing.T) {
+	db := openDB(t)
+	defer func() { _ = db.Close() }()
+	blob := strings.Repeat("x", 10*page.PageSize)
+	fillDB(t, db, map[string]string{"a": "1", "blob": blob})
+	_ = db.View(func(tx *Tx) error {
+		// Overflow pages of blob are not read by Get of a
+		if string(tx.Get(kv.Key("a"))) != "1" || tx.Stats().PagesRead != 1 {
+			t.Errorf("Expect one page read, get %d", tx.Stats().PagesRead)
+		}
+		if string(tx.Get(kv.Key("blob"))) != blob || tx.Stats().PagesRead == 1 {
+			t.Error("Expect blob read from overflow pages")
+		}
+		return nil
+	})
+}
+
+func TestFillPercent(t *testing.T) {
+	kvs := map[string]string{}
+	for i := 0; i < 5000; i++ {
+		kvs[fmt.Sprintf("key-%06d", i)] = "value"
+	}
+	dirtied := map[float64]int{}
+	for _, fill := range []float64{0, tree.MaxFillPercent} {
+		db, err := Open(Options{Path: dataPath(t), FillPercent: fill})
+		if err != nil {
+			t.Fatalf("Failed to open DB: %v", err)
+		}
+		tx, _ := NewWritableTx(db)
+		for k, v := range kvs {
+			mustSet(t, tx, kv.Key(k), kv.Value(v))
+		}
+		mustCommit(t, tx)
+		dirtied[fill] = tx.Stats().PagesDirtied
+		checkPairs(t, db, kvs)
+		if errs := checkErrors(t, db); len(errs) > 0 {
+			t.Errorf("Check fails with fill %v: %v", fill, errs)
+		}
+		_ = db.Close()
+	}
+	// Full nodes take about half the pages of default
+	if dirtied[tree.MaxFillPercent]*3 > dirtied[0]*2 {
+		t.Errorf("Expect fewer pages with full nodes, get %v", dirtied)
+	}
+}
+
+func TestTxStats(t *testing.T) {
+	db := openDB(t)
+	kvs := map[string]string{}
+	for i := 0; i < 20000; i++ {
+		kvs[fmt.Sprintf("key-%06d", i)] = "value"
+	}
+	fillDB(t, db, kvs)
+
+	tx, _ := NewWritableTx(db)
+	depth := tx.TreeProfile().Depth
+	mustSet(t, tx, []byte("key-001000"), []byte("new value"))
+	mustCommit(t, tx)
+
+	stats := tx.Stats()
+	// Only nodes along the path are rewritten
+	if stats.PagesDirtied != depth {
+		t.Errorf("Expect %d dirtied pages, get %d", depth, stats.PagesDirtied)
+	}
+	if stats.PagesRead < depth {
+		t.Errorf("Expect at least %d read pages, get %d", depth, stats.PagesRead)
+	}
+	// Path nodes and freelist are moved to new pages
+	if stats.PagesAllocated < depth+1 || stats.PagesFreed < depth+1 {
+		t.Errorf("Incorrect page accounting: %+v", stats)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(Options{
+		Path:     filepath.Join(dir, "data"),
+		AuditDir: filepath.Join(dir, "audit"),
+	})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+
+	tx, _ := NewWritableTx(db)
+	mustSet(t, tx, []byte("a"), []byte("1"))
+	mustSet(t, tx, []byte("b"), []byte("2"))
+	mustCommit(t, tx)
+
+	tx, _ = NewWritableTx(db)
+	mustRemove(t, tx, []byte("a"))
+	// Removing missing key is not a mutation
+	mustRemove(t, tx, []byte("missing"))
+	mustCommit(t, tx)
+
+	// Uncommitted tx is not audited
+	tx, _ = NewWritableTx(db)
+	mustSet(t, tx, []byte("c"), []byte("3"))
+	tx.rollback()
+
+	records := []audit.Record{}
+	err = audit.Read(filepath.Join(dir, "audit"), func(r audit.Record) error {
+		records = append(records, r)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to read audit log: %v", err)
+	}
+
+	expect := []string{"1 set a", "1 set b", "2 remove a"}
+	if len(records) != len(expect) {
+		t.Fatalf("Expect %d records, get %+v", len(expect), records)
+	}
+	for i, r := range records {
+		get := fmt.Sprintf("%d %s %s", r.TxID, r.Op, r.Key)
+		if get != expect[i] {
+			t.Errorf("Record %d: expect %q, get %q", i, expect[i], get)
+		}
+	}
+}
+
+func TestTxClone(t *testing.T) {
+	db := openDB(t)
+	kvs := map[string]string{}
+	for i := 0; i < 5000; i++ {
+		kvs[fmt.Sprintf("key-%05d", i)] = fmt.Sprintf("value-%d", i)
+	}
+	fillDB(t, db, kvs)
+
+	tx, _ := NewReadOnlyTx(db)
+	// Each worker reads the whole snapshot with its own clone
+	errs := make(chan string, 100)
+	wg := sync.WaitGroup{}
+	for w := 0; w < 4; w++ {
+		clone, err := tx.Clone()
+		if err != nil {
+			t.Fatalf("Failed to clone: %v", err)
+		}
+		if clone.ID() != tx.ID() {
+			t.Errorf("Clone id %d, expect %d", clone.ID(), tx.ID())
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k, v := range kvs {
+				got := clone.Get([]byte(k))
+				if got == nil || string(got) != v {
+					errs <- fmt.Sprintf("Key %s: expect %s, get %q", k, v, got)
+					return
+				}
+			}
+			keys, _ := scanAll(clone.Cursor())
+			if len(keys) != len(kvs) {
+				errs <- fmt.Sprintf("Scan returns %d keys, expect %d", len(keys), len(kvs))
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	wtx, _ := NewWritableTx(db)
+	if _, err := wtx.Clone(); !errors.Is(err, ErrTxWritable) {
+		t.Errorf("Expect ErrTxWritable cloning writable tx, get %v", err)
+	}
+}
+
+func TestCommitDurability(t *testing.T) {
+	for _, mmap := range []bool{false, true} {
+		path := dataPath(t)
+		db, err := Open(Options{
+			Path:         path,
+			WritableMmap: mmap,
+			Durability:   DurabilityNone,
+		})
+		if err != nil {
+			t.Fatalf("Failed to open DB: %v", err)
+		}
+		durable := db.DurableTxID()
+
+		commit := func(key string, d Durability) uint64 {
+			tx, _ := NewWritableTx(db)
+			mustSet(t, tx, []byte(key), []byte("value"))
+			err := tx.CommitWith(d)
+			if err != nil {
+				t.Fatalf("Failed to commit: %v", err)
+			}
+			return tx.ID()
+		}
+		commit("a", DurabilityDefault)
+		commit("b", DurabilityNone)
+		if db.DurableTxID() != durable {
+			t.Errorf("Commits without sync moved durable id to %d", db.DurableTxID())
+		}
+		id := commit("c", DurabilitySync)
+		if db.DurableTxID() != id {
+			t.Errorf("Expect durable id %d, get %d", id, db.DurableTxID())
+		}
+		commit("d", DurabilityDefault)
+		if db.DurableTxID() != id {
+			t.Errorf("Expect durable id %d, get %d", id, db.DurableTxID())
+		}
+
+		// Unsynced commits are still visible after reopen, Close syncs
+		// but durable id comes from the file.
+		err = db.Close()
+		if err != nil {
+			t.Fatalf("Failed to close DB: %v", err)
+		}
+		db, err = Open(Options{Path: path})
+		if err != nil {
+			t.Fatalf("Failed to reopen DB: %v", err)
+		}
+		tx, _ := NewReadOnlyTx(db)
+		for _, key := range []string{"a", "b", "c", "d"} {
+			if tx.Get([]byte(key)) == nil {
+				t.Errorf("Key %s not found after reopen", key)
+			}
+		}
+		if db.DurableTxID() != tx.ID() {
+			t.Errorf("Expect durable id %d after open, get %d", tx.ID(), db.DurableTxID())
+		}
+	}
+}
+
+func TestSync(t *testing.T) {
+	for _, mmap := range []bool{false, true} {
+		db, err := Open(Options{Path: dataPath(t), WritableMmap: mmap, NoSync: true})
+		if err != nil {
+			t.Fatalf("Failed to open DB: %v", err)
+		}
+		durable := db.DurableTxID()
+		fillDB(t, db, map[string]string{"a": "1"})
+		fillDB(t, db, map[string]string{"b": "2"})
+		if db.DurableTxID() != durable {
+			t.Errorf("Commits with NoSync moved durable id to %d", db.DurableTxID())
+		}
+		err = db.Sync()
+		if err != nil {
+			t.Fatalf("Failed to sync: %v", err)
+		}
+		if db.DurableTxID() != durable+2 {
+			t.Errorf("Expect durable id %d after Sync, get %d", durable+2, db.DurableTxID())
+		}
+		err = db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = db.Sync(); !errors.Is(err, ErrDBClosed) {
+			t.Errorf("Expect ErrDBClosed syncing closed DB, get %v", err)
+		}
+	}
+}
+
+func TestOverflowValues(t *testing.T) {
+	for _, mmap := range []bool{false, true} {
+		path := dataPath(t)
+		db, err := Open(Options{Path: path, WritableMmap: mmap})
+		if err != nil {
+			t.Fatalf("Failed to open DB: %v", err)
+		}
+		kvs := map[string]string{"small": "value"}
+		for i, size := range []int{page.MaxInlineValue + 1, 1 << 20, 5 << 20} {
+			kvs[fmt.Sprintf("large-%d", i)] = string(testutil.RandomByteArray(size))
+		}
+		fillDB(t, db, kvs)
+		err = db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db, err = Open(Options{Path: path, WritableMmap: mmap})
+		if err != nil {
+			t.Fatalf("Failed to reopen DB: %v", err)
+		}
+		check := func() {
+			err := db.View(func(tx *Tx) error {
+				for k, v := range kvs {
+					if string(tx.Get([]byte(k))) != v {
+						t.Errorf("Value of %s mismatch, length %d", k, len(tx.Get([]byte(k))))
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		check()
+
+		// Rewriting values frees old chains, so file stops growing
+		// once pending pages are released, it may shrink.
+		var pages common.Pgid
+		for round := 0; round < 4; round++ {
+			kvs["large-1"] = string(testutil.RandomByteArray(1 << 20))
+			fillDB(t, db, map[string]string{"large-1": kvs["large-1"]})
+			if round == 1 {
+				pages = db.meta.totalPages
+			}
+		}
+		if db.meta.totalPages > pages {
+			t.Errorf("Expect at most %d pages after rewriting value, get %d", pages, db.meta.totalPages)
+		}
+		delete(kvs, "large-2")
+		tx, _ := NewWritableTx(db)
+		mustRemove(t, tx, []byte("large-2"))
+		mustCommit(t, tx)
+		if tx.Stats().PagesFreed < page.OverflowPages(5<<20) {
+			t.Errorf("Expect overflow pages freed, get %d", tx.Stats().PagesFreed)
+		}
+		check()
+		err = db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
 
-// 	os.Remove(dataPath)
+func TestWriteFailure(t *testing.T) {
+	// Writes to /dev/full fail with ENOSPC
+	full, err := os.OpenFile("/dev/full", os.O_WRONLY, 0)
+	if err != nil {
+		t.Skipf("No /dev/full: %v", err)
+	}
+	defer full.Close()
 
-// 	db, ok := Open(opt)
-// 	if !ok {
-// 		t.Fatal("Failed to open DB")
-// 	}
+	// File grown ahead leaves only the page writes to fail
+	db, err := Open(Options{Path: dataPath(t), GrowthStep: 1 << 20})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	kvs := map[string]string{}
+	for i := 0; i < 1000; i++ {
+		kvs[fmt.Sprintf("key-%04d", i)] = "value"
+	}
+	fillDB(t, db, kvs)
+	if db.Health() != nil {
+		t.Fatalf("Expect healthy DB, get %v", db.Health())
+	}
 
-// 	tx, ok := NewWritableTx(db)
-// 	if !ok {
-// 		t.Fatal("Failed to create tx")
-// 	}
+	file := db.file
+	db.file = full
+	tx, _ := NewWritableTx(db)
+	mustSet(t, tx, []byte("key-0001"), []byte("lost"))
+	mustSet(t, tx, []byte("new key"), []byte("lost"))
+	err = tx.Commit()
+	if !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("Expect ENOSPC from commit when disk is full, get %v", err)
+	}
+	db.file = file
 
-// 	kvs := randomKV(1000)
+	if !errors.Is(db.Health(), syscall.ENOSPC) {
+		t.Errorf("Expect ENOSPC from Health, get %v", db.Health())
+	}
+	if _, err := NewWritableTx(db); !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("Failed DB should refuse writable tx, get %v", err)
+	}
+	// Reads see the last commit
+	rtx, err := NewReadOnlyTx(db)
+	if err != nil {
+		t.Fatalf("Failed DB should allow read-only tx: %v", err)
+	}
+	for k, v := range kvs {
+		got := rtx.Get([]byte(k))
+		if got == nil || string(got) != v {
+			t.Errorf("Key %s: expect %s, get %q", k, v, got)
+		}
+	}
+	if rtx.Get([]byte("new key")) != nil {
+		t.Error("Failed commit should not be visible")
+	}
+}
 
-// 	for key, value := range kvs {
-// 		found, old := tx.Set([]byte(key), []byte(value))
-// 		if found {
-// 			t.Errorf("Found should be false: old=%s", old)
-// 		}
-// 	}
+// countingFile counts writes to DB file.
+type countingFile struct {
+	dbFile
+	writes int
+}
 
-// 	ok = tx.Commit()
-// 	if !ok {
-// 		t.Errorf("Failed to commit")
-// 	}
+// WriteAt counts and writes b.
+func (f *countingFile) WriteAt(b []byte, off int64) (int, error) {
+	f.writes++
+	return f.dbFile.WriteAt(b, off)
+}
 
-// }
+func TestWriteCoalescing(t *testing.T) {
+	for name, opts := range map[string]Options{
+		"mmap":      {Path: dataPath(t), InitialMmapSize: 1 << 26},
+		"no mmap":   {Path: dataPath(t), NoMmap: true},
+		"extent":    {Path: dataPath(t), NoMmap: true, ExtentPages: 16},
+		"memory":    {Path: MemoryPath},
+		"encrypted": {Path: dataPath(t), EncryptionKey: bytes.Repeat([]byte{1}, 16)},
+	} {
+		db, err := Open(opts)
+		if err != nil {
+			t.Fatalf("%s: failed to open DB: %v", name, err)
+		}
+		file := &countingFile{dbFile: db.file}
+		db.file = file
+		kvs := map[string]string{"large": strings.Repeat("L", maxWriteSize+page.PageSize)}
+		for i := 0; i < 20000; i++ {
+			kvs[fmt.Sprintf("key-%06d", i)] = "value"
+		}
+		tx, _ := NewWritableTx(db)
+		for k, v := range kvs {
+			mustSet(t, tx, []byte(k), []byte(v))
+		}
+		mustCommit(t, tx)
+		// Pages of a new DB are adjacent, meta takes one more write
+		pages := tx.Stats().PagesAllocated
+		if file.writes > 1+pages*page.PageSize/maxWriteSize+5 {
+			t.Errorf("%s: expect %d pages in few writes, get %d writes", name, pages, file.writes)
+		}
+		db.file = file.dbFile
+		checkPairs(t, db, kvs)
+		if errs := checkErrors(t, db); len(errs) > 0 {
+			t.Errorf("%s: check fails: %v", name, errs)
+		}
+		_ = db.Close()
+		if opts.Path == MemoryPath {
+			continue
+		}
+		db, err = Open(opts)
+		if err != nil {
+			t.Fatalf("%s: failed to reopen DB: %v", name, err)
+		}
+		checkPairs(t, db, kvs)
+		_ = db.Close()
+	}
+}
+
+func TestODirect(t *testing.T) {
+	for name, opts := range map[string]Options{
+		"mmap":    {Path: dataPath(t), ODirect: true},
+		"no mmap": {Path: dataPath(t), ODirect: true, NoMmap: true},
+		"extent":  {Path: dataPath(t), ODirect: true, ExtentPages: 16},
+		"wal":     {Path: dataPath(t), ODirect: true, WAL: true},
+	} {
+		db, err := Open(opts)
+		if errors.Is(err, syscall.EINVAL) || errors.Is(err, ErrInvalidOption) {
+			t.Skipf("No O_DIRECT: %v", err)
+		}
+		if err != nil {
+			t.Fatalf("%s: failed to open DB: %v", name, err)
+		}
+		kvs := map[string]string{"large": strings.Repeat("L", maxWriteSize+page.PageSize)}
+		for i := 0; i < 20000; i++ {
+			kvs[fmt.Sprintf("key-%06d", i)] = "value"
+		}
+		fillDB(t, db, kvs)
+		// Pages read through memory map or pread see direct writes
+		checkPairs(t, db, kvs)
+		tx, _ := NewWritableTx(db)
+		for i := 0; i < 20000; i += 7 {
+			k := fmt.Sprintf("key-%06d", i)
+			kvs[k] = "updated"
+			mustSet(t, tx, []byte(k), []byte("updated"))
+		}
+		mustCommit(t, tx)
+		checkPairs(t, db, kvs)
+		if errs := checkErrors(t, db); len(errs) > 0 {
+			t.Errorf("%s: check fails: %v", name, errs)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatalf("%s: failed to close: %v", name, err)
+		}
+		db, err = Open(opts)
+		if err != nil {
+			t.Fatalf("%s: failed to reopen DB: %v", name, err)
+		}
+		checkPairs(t, db, kvs)
+		_ = db.Close()
+	}
+}
+
+func TestErrors(t *testing.T) {
+	db := openDB(t)
+	fillDB(t, db, map[string]string{"a": "1"})
+
+	tx, _ := NewWritableTx(db)
+	if _, err := NewWritableTx(db); !errors.Is(err, ErrTxExists) {
+		t.Errorf("Expect ErrTxExists, get %v", err)
+	}
+	if _, err := tx.Set(make([]byte, MaxKeySize+1), nil); !errors.Is(err, ErrKeyTooLarge) {
+		t.Errorf("Expect ErrKeyTooLarge, get %v", err)
+	}
+	old, err := tx.Set([]byte("a"), []byte("2"))
+	if err != nil || string(old) != "1" {
+		t.Errorf("Expect old value 1, get (%q, %v)", old, err)
+	}
+	mustCommit(t, tx)
+	if _, err := tx.Set([]byte("b"), nil); !errors.Is(err, ErrTxClosed) {
+		t.Errorf("Expect ErrTxClosed after commit, get %v", err)
+	}
+	if err := tx.Commit(); !errors.Is(err, ErrTxClosed) {
+		t.Errorf("Expect ErrTxClosed committing twice, get %v", err)
+	}
+
+	rtx, _ := NewReadOnlyTx(db)
+	if _, err := rtx.Remove([]byte("a")); !errors.Is(err, ErrTxReadOnly) {
+		t.Errorf("Expect ErrTxReadOnly, get %v", err)
+	}
+	if err := rtx.Commit(); !errors.Is(err, ErrTxReadOnly) {
+		t.Errorf("Expect ErrTxReadOnly committing read-only tx, get %v", err)
+	}
+
+	// Opening a file which is not a DB
+	path := dataPath(t)
+	err = ioutil.WriteFile(path, make([]byte, page.PageSize), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(Options{Path: path}); !errors.Is(err, ErrInvalidDB) {
+		t.Errorf("Expect ErrInvalidDB, get %v", err)
+	}
+}
+
+func TestUpdateView(t *testing.T) {
+	db := openDB(t)
+	err := db.Update(func(tx *Tx) error {
+		_, err := tx.Set([]byte("a"), []byte("1"))
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+
+	// Error from fn rolls back
+	errStop := errors.New("stop")
+	err = db.Update(func(tx *Tx) error {
+		mustSet(t, tx, []byte("b"), []byte("2"))
+		return errStop
+	})
+	if err != errStop {
+		t.Errorf("Expect fn error from Update, get %v", err)
+	}
+	// Panic in fn rolls back and frees the writer slot
+	func() {
+		defer func() {
+			_ = recover()
+		}()
+		_ = db.Update(func(tx *Tx) error {
+			mustSet(t, tx, []byte("c"), []byte("3"))
+			panic("boom")
+		})
+	}()
+	err = db.Update(func(tx *Tx) error {
+		return tx.Commit()
+	})
+	if !errors.Is(err, ErrTxManaged) {
+		t.Errorf("Expect ErrTxManaged committing in Update, get %v", err)
+	}
+
+	err = db.View(func(tx *Tx) error {
+		if string(tx.Get([]byte("a"))) != "1" {
+			t.Error("Expect committed key a")
+		}
+		for _, k := range []string{"b", "c"} {
+			if tx.Get([]byte(k)) != nil {
+				t.Errorf("Rolled back key %s is visible", k)
+			}
+		}
+		if _, err := tx.Set([]byte("d"), nil); !errors.Is(err, ErrTxReadOnly) {
+			t.Errorf("Expect ErrTxReadOnly in View, get %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("View failed: %v", err)
+	}
+	if len(db.txs) != 0 || db.writableTx != nil {
+		t.Errorf("Expect all transactions closed, get %d", len(db.txs))
+	}
+}
+
+func TestClose(t *testing.T) {
+	path := dataPath(t)
+	db, err := Open(Options{Path: path, Durability: DurabilityNone})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	fillDB(t, db, map[string]string{"a": "1"})
+
+	// Close waits for the open read-only tx
+	rtx, _ := NewReadOnlyTx(db)
+	closed := make(chan error, 1)
+	go func() {
+		closed <- db.Close()
+	}()
+	select {
+	case err = <-closed:
+		t.Fatalf("Close returns with open tx: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if string(rtx.Get([]byte("a"))) != "1" {
+		t.Error("Open tx should read during Close")
+	}
+	err = rtx.Rollback()
+	if err != nil {
+		t.Errorf("Failed to rollback: %v", err)
+	}
+	select {
+	case err = <-closed:
+		if err != nil {
+			t.Fatalf("Failed to close: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for Close")
+	}
+
+	if _, err := NewReadOnlyTx(db); !errors.Is(err, ErrDBClosed) {
+		t.Errorf("Expect ErrDBClosed for read-only tx, get %v", err)
+	}
+	if _, err := NewWritableTx(db); !errors.Is(err, ErrDBClosed) {
+		t.Errorf("Expect ErrDBClosed for writable tx, get %v", err)
+	}
+	if err := db.Close(); !errors.Is(err, ErrDBClosed) {
+		t.Errorf("Expect ErrDBClosed closing twice, get %v", err)
+	}
+	if err := rtx.Rollback(); !errors.Is(err, ErrTxClosed) {
+		t.Errorf("Expect ErrTxClosed rolling back twice, get %v", err)
+	}
+
+	// Close syncs commits
+	db, err = Open(Options{Path: path})
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	err = db.View(func(tx *Tx) error {
+		if string(tx.Get([]byte("a"))) != "1" {
+			t.Error("Expect committed key after reopen")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Errorf("Failed to close: %v", err)
+	}
+}
+
+func TestNextSequence(t *testing.T) {
+	path := dataPath(t)
+	db, err := Open(Options{Path: path})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	next := func(tx *Tx, expect uint64) {
+		seq, err := tx.NextSequence()
+		if err != nil || seq != expect {
+			t.Errorf("Expect sequence %d, get %d, %v", expect, seq, err)
+		}
+	}
+	tx, _ := NewWritableTx(db)
+	next(tx, 1)
+	next(tx, 2)
+	mustCommit(t, tx)
+	// Rolled back values are returned again
+	tx, _ = NewWritableTx(db)
+	next(tx, 3)
+	err = tx.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(Options{Path: path})
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	err = db.Update(func(tx *Tx) error {
+		next(tx, 3)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.View(func(tx *Tx) error {
+		if _, err := tx.NextSequence(); !errors.Is(err, ErrTxReadOnly) {
+			t.Errorf("Expect ErrTxReadOnly, get %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Sequence is covered by meta checksum
+	m := db.meta.copy()
+	m.sequence++
+	if m.validate() == nil {
+		t.Error("Expect checksum mismatch after changing sequence")
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMetaRecovery(t *testing.T) {
+	path := dataPath(t)
+	db, err := Open(Options{Path: path})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	fillDB(t, db, map[string]string{"a": "1"})
+	fillDB(t, db, map[string]string{"b": "2"})
+	err = db.Close()
+	if err != nil {
+		t.Fatalf("Failed to close DB: %v", err)
+	}
+
+	// Tear meta of the last commit, which is on page 2%2
+	corrupt := func(id int) {
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		_, err = f.WriteAt([]byte{0xff, 0xff}, int64(id*page.PageSize+page.HeaderSize+8))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	corrupt(0)
+	db, err = Open(Options{Path: path})
+	if err != nil {
+		t.Fatalf("Failed to open DB with one valid meta: %v", err)
+	}
+	err = db.View(func(tx *Tx) error {
+		if tx.ID() != 1 {
+			t.Errorf("Expect txid 1 from the other meta, get %d", tx.ID())
+		}
+		if string(tx.Get([]byte("a"))) != "1" || tx.Get([]byte("b")) != nil {
+			t.Error("Expect state of the first commit")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Next commit overwrites the torn meta
+	fillDB(t, db, map[string]string{"c": "3"})
+	err = db.Close()
+	if err != nil {
+		t.Fatalf("Failed to close DB: %v", err)
+	}
+	db, err = Open(Options{Path: path})
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	err = db.View(func(tx *Tx) error {
+		if tx.ID() != 2 || string(tx.Get([]byte("c"))) != "3" {
+			t.Errorf("Expect commit 2 after recovery, get txid %d", tx.ID())
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatalf("Failed to close DB: %v", err)
+	}
+
+	corrupt(0)
+	corrupt(1)
+	if _, err := Open(Options{Path: path}); !errors.Is(err, ErrInvalidDB) {
+		t.Errorf("Expect ErrInvalidDB with both metas torn, get %v", err)
+	}
+}
+
+func TestFormatVersion(t *testing.T) {
+	path := dataPath(t)
+	db, err := Open(Options{Path: path})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	fillDB(t, db, map[string]string{"a": "1"})
+	_ = db.View(func(tx *Tx) error {
+		if v := tx.Info().FormatVersion; v != FormatVersion {
+			t.Errorf("Expect format version %d, get %d", FormatVersion, v)
+		}
+		return nil
+	})
+	err = db.Close()
+	if err != nil {
+		t.Fatalf("Failed to close DB: %v", err)
+	}
+
+	// Both metas claim a newer version, with valid checksum
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id := 0; id < 2; id++ {
+		m := pageMeta(page.FromBuffer(buf, common.Pgid(id)))
+		m.version = FormatVersion + 1
+		m.checksum = m.sum()
+		m.write(page.FromBuffer(buf, common.Pgid(id)))
+	}
+	err = ioutil.WriteFile(path, buf, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(Options{Path: path}); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("Expect ErrUnsupportedVersion, get %v", err)
+	}
+}
+
+func TestMetaEncoding(t *testing.T) {
+	m := &Meta{
+		magic:          Magic,
+		totalPages:     0x0102,
+		freelistPage:   3,
+		rootPage:       4,
+		txid:           0x05060708,
+		sequence:       9,
+		changefeedPage: 10,
+		version:        FormatVersion,
+	}
+	copy(m.comparator[:], "cmp")
+	m.keyCheck[0] = 0xee
+	m.checksum = m.sum()
+	buf := make([]byte, page.PageSize)
+	p := page.FromBuffer(buf, 0)
+	p.SetFlag(page.FlagMeta)
+	m.write(p)
+	if got := pageMeta(p); *got != *m || got.validate() != nil {
+		t.Errorf("Meta read back wrong: %s", got)
+	}
+	// Fields are little-endian at fixed offsets
+	data := buf[page.HeaderSize:]
+	if !bytes.Equal(data[:8], []byte{0x20, 0x20, 0xdb, 0xdc, 0x02, 0x01, 0, 0}) ||
+		!bytes.Equal(data[16:20], []byte{0x08, 0x07, 0x06, 0x05}) ||
+		string(data[44:47]) != "cmp" || data[76] != 0xee || data[92] != FormatVersion {
+		t.Errorf("Unexpected meta layout: %x", data[:metaSize])
+	}
+
+	// Files of big-endian builds before version 9 are reported
+	binary.BigEndian.PutUint32(data, Magic)
+	path := dataPath(t)
+	err := ioutil.WriteFile(path, append(buf, buf...), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Open(Options{Path: path})
+	if !errors.Is(err, ErrInvalidDB) || !strings.Contains(err.Error(), "big-endian") {
+		t.Errorf("Expect ErrInvalidDB for big-endian file, get %v", err)
+	}
+}
+
+func TestPendingPages(t *testing.T) {
+	db := openDB(t)
+	kvs := map[string]string{}
+	for i := 0; i < 2000; i++ {
+		kvs[fmt.Sprintf("key-%04d", i)] = "old"
+	}
+	fillDB(t, db, kvs)
+
+	// Pages freed while a reader is open are not reused,
+	// so the reader keeps its snapshot.
+	rtx, _ := NewReadOnlyTx(db)
+	for round := 0; round < 5; round++ {
+		tx, _ := NewWritableTx(db)
+		for k := range kvs {
+			mustSet(t, tx, []byte(k), []byte(fmt.Sprintf("new-%d", round)))
+		}
+		mustCommit(t, tx)
+	}
+	for k := range kvs {
+		if v := rtx.Get([]byte(k)); string(v) != "old" {
+			t.Fatalf("Reader sees %q for %s", v, k)
+		}
+	}
+	if db.freelist.PendingCount() == 0 {
+		t.Error("Expect pending pages with open reader")
+	}
+	total := db.meta.totalPages
+
+	// Without reader, pending pages are reused
+	err := rtx.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for round := 0; round < 5; round++ {
+		tx, _ := NewWritableTx(db)
+		for k := range kvs {
+			mustSet(t, tx, []byte(k), []byte("newer"))
+		}
+		mustCommit(t, tx)
+	}
+	if db.meta.totalPages > total {
+		t.Errorf("Expect freed pages reused, file grows from %d to %d pages", total, db.meta.totalPages)
+	}
+
+	// Freelist survives reopen, pending pages are free after it
+	path := db.path
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(Options{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillDB(t, db, map[string]string{"key-0000": "reopened"})
+	if db.meta.totalPages > total {
+		t.Errorf("Expect free pages reused after reopen, file grows from %d to %d pages", total, db.meta.totalPages)
+	}
+}
+
+func TestFreelistType(t *testing.T) {
+	path := dataPath(t)
+	db, err := Open(Options{Path: path, FreelistType: freelist.TypeHashmap})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	kvs := map[string]string{}
+	for i := 0; i < 2000; i++ {
+		kvs[fmt.Sprintf("key-%04d", i)] = strings.Repeat("v", i%300)
+	}
+	fillDB(t, db, kvs)
+	total := db.meta.totalPages
+	for round := 0; round < 5; round++ {
+		for k := range kvs {
+			kvs[k] = fmt.Sprintf("value-%d", round)
+		}
+		kvs["blob"] = strings.Repeat("b", (round+1)*page.PageSize)
+		fillDB(t, db, kvs)
+	}
+	if db.meta.totalPages > 2*total {
+		t.Errorf("Expect freed pages reused, file grows from %d to %d pages", total, db.meta.totalPages)
+	}
+	if errs := checkErrors(t, db); len(errs) > 0 {
+		t.Errorf("Check fails with hashmap freelist: %v", errs)
+	}
+	free := db.freelist.IDs()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// File is the same for both types
+	db, err = Open(Options{Path: path})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+	checkPairs(t, db, kvs)
+	if len(db.freelist.IDs()) < len(free) {
+		t.Errorf("Expect at least %d free pages after reopen, get %d", len(free), len(db.freelist.IDs()))
+	}
+}
+
+func TestPendingByReader(t *testing.T) {
+	db := openDB(t)
+	kvs := map[string]string{}
+	for i := 0; i < 2000; i++ {
+		kvs[fmt.Sprintf("key-%04d", i)] = "v0"
+	}
+	fillDB(t, db, kvs)
+	update := func(value string) {
+		tx, _ := NewWritableTx(db)
+		for k := range kvs {
+			mustSet(t, tx, []byte(k), []byte(value))
+		}
+		mustCommit(t, tx)
+	}
+
+	old, _ := NewReadOnlyTx(db)
+	update("v1")
+	newer, _ := NewReadOnlyTx(db)
+	update("v2")
+	update("v3")
+	all := db.freelist.PendingCount()
+
+	// Closing the oldest reader releases pages only it could see
+	err := old.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, _ := NewWritableTx(db)
+	after := db.freelist.PendingCount()
+	if after == 0 || after >= all {
+		t.Errorf("Expect part of %d pending pages released, get %d", all, after)
+	}
+	err = tx.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	update("v4")
+	for k := range kvs {
+		if v := newer.Get([]byte(k)); string(v) != "v1" {
+			t.Fatalf("Reader sees %q for %s", v, k)
+		}
+	}
+
+	err = newer.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, _ = NewWritableTx(db)
+	if n := db.freelist.PendingCount(); n != 0 {
+		t.Errorf("Expect no pending pages without reader, get %d", n)
+	}
+	err = tx.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSnapshotIsolation(t *testing.T) {
+	for _, mmap := range []bool{false, true} {
+		db, err := Open(Options{Path: dataPath(t), WritableMmap: mmap})
+		if err != nil {
+			t.Fatalf("Failed to open DB: %v", err)
+		}
+		kvs := map[string]string{}
+		for i := 0; i < 3000; i++ {
+			kvs[fmt.Sprintf("key-%04d", i)] = "v0"
+		}
+		fillDB(t, db, kvs)
+
+		// Each snapshot expects values of one version
+		snapshots := map[*Tx]string{}
+		before, _ := NewReadOnlyTx(db)
+		snapshots[before] = "v0"
+		for round := 1; round <= 3; round++ {
+			value := fmt.Sprintf("v%d", round)
+			tx, _ := NewWritableTx(db)
+			for k := range kvs {
+				mustSet(t, tx, []byte(k), []byte(value))
+			}
+			mustSet(t, tx, []byte(value), []byte("new key"))
+			// Reader created during the writer sees the last commit
+			during, _ := NewReadOnlyTx(db)
+			snapshots[during] = fmt.Sprintf("v%d", round-1)
+			mustCommit(t, tx)
+		}
+
+		for rtx, expect := range snapshots {
+			c := rtx.Cursor()
+			count := 0
+			for k, v := c.First(); k != nil; k, v = c.Next() {
+				if string(v) != expect && string(v) != "new key" {
+					t.Fatalf("Snapshot %d: key %s is %s, expect %s", rtx.ID(), k, v, expect)
+				}
+				count++
+			}
+			if count != len(kvs)+int(rtx.ID())-1 {
+				t.Errorf("Snapshot %d: expect %d keys, get %d", rtx.ID(), len(kvs)+int(rtx.ID())-1, count)
+			}
+			err = rtx.Rollback()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestConcurrentTx(t *testing.T) {
+	db := openDB(t)
+	fillDB(t, db, map[string]string{"count": "0"})
+
+	// Writers race for the writable tx, each commit adds one key and
+	// bumps count, so a reader sees exactly count keys besides count.
+	const writers, commits = 4, 50
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < commits; {
+				err := db.Update(func(tx *Tx) error {
+					count := 0
+					_, err := fmt.Sscan(string(tx.Get([]byte("count"))), &count)
+					if err != nil {
+						return err
+					}
+					_, err = tx.Set([]byte(fmt.Sprintf("key-%d-%d", w, i)), []byte("v"))
+					if err != nil {
+						return err
+					}
+					_, err = tx.Set([]byte("count"), []byte(fmt.Sprint(count+1)))
+					return err
+				})
+				if errors.Is(err, ErrTxExists) {
+					time.Sleep(time.Millisecond)
+					continue
+				}
+				if err != nil {
+					t.Errorf("Update failed: %v", err)
+					return
+				}
+				i++
+			}
+		}(w)
+	}
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				err := db.View(func(tx *Tx) error {
+					count := 0
+					_, err := fmt.Sscan(string(tx.Get([]byte("count"))), &count)
+					if err != nil {
+						return err
+					}
+					keys := 0
+					c := tx.Cursor()
+					for k, _ := c.First(); k != nil; k, _ = c.Next() {
+						keys++
+					}
+					if keys != count+1 {
+						t.Errorf("Snapshot %d: count is %d, get %d keys", tx.ID(), count, keys)
+					}
+					return nil
+				})
+				if err != nil {
+					t.Errorf("View failed: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	readers.Wait()
+
+	err := db.View(func(tx *Tx) error {
+		if string(tx.Get([]byte("count"))) != fmt.Sprint(writers*commits) {
+			t.Errorf("Expect count %d, get %s", writers*commits, tx.Get([]byte("count")))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMmapSize(t *testing.T) {
+	path := dataPath(t)
+	db, err := Open(Options{Path: path, InitialMmapSize: 1 << 20, MaxMmapSize: 1 << 21})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	if db.mmapSize != 1<<20 {
+		t.Errorf("Expect initial mmap size 1MB, get %d", db.mmapSize)
+	}
+
+	// Grow until the map reaches its limit
+	value := strings.Repeat("x", 1000)
+	var last int
+	for i := 0; ; i++ {
+		err = db.Update(func(tx *Tx) error {
+			_, err := tx.Set([]byte(fmt.Sprintf("key-%05d", i)), []byte(value))
+			return err
+		})
+		if err != nil {
+			last = i
+			break
+		}
+		if db.mmapSize > 1<<21 {
+			t.Fatalf("Map size %d exceeds limit", db.mmapSize)
+		}
+	}
+	if !errors.Is(err, ErrMmapTooLarge) {
+		t.Fatalf("Expect ErrMmapTooLarge, get %v", err)
+	}
+	err = db.View(func(tx *Tx) error {
+		if count := tx.Count(); count != last {
+			t.Errorf("Expect %d keys after failed commit, get %d", last, count)
+		}
+		return nil
+	})
+	if err != nil || db.Close() != nil {
+		t.Fatalf("Failed to read and close: %v", err)
+	}
+
+	// File larger than the limit can't be mapped
+	if _, err := Open(Options{Path: path, MaxMmapSize: 1 << 20}); !errors.Is(err, ErrMmapTooLarge) {
+		t.Errorf("Expect ErrMmapTooLarge on open, get %v", err)
+	}
+	db, err = Open(Options{Path: path})
+	if err != nil {
+		t.Fatalf("Failed to reopen: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Errorf("Failed to close: %v", err)
+	}
+}
+
+func TestStaleMmap(t *testing.T) {
+	db, err := Open(Options{Path: dataPath(t), InitialMmapSize: 1 << 17, NodeCacheSize: 64 << 10})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	fillDB(t, db, map[string]string{"old": "value"})
+	rtx, err := NewReadOnlyTx(db)
+	if err != nil {
+		t.Fatalf("Failed to create read-only tx: %v", err)
+	}
+	old, _ := rtx.GetRef([]byte("old"))
+
+	// Grow file and remap while rtx reads the old map
+	kvs := map[string]string{}
+	for i := 0; i < 2000; i++ {
+		kvs[fmt.Sprintf("key-%04d", i)] = strings.Repeat("v", 200)
+	}
+	fillDB(t, db, kvs)
+	if len(db.staleMmaps) == 0 || db.staleMmaps[0].readers != 1 {
+		t.Fatalf("Expect old map kept for reader, get %d maps", len(db.staleMmaps))
+	}
+	if string(old) != "value" {
+		t.Errorf("Expect value from old map, get %q", old)
+	}
+	if err := rtx.Rollback(); err != nil {
+		t.Fatalf("Failed to roll back: %v", err)
+	}
+	if len(db.staleMmaps) != 0 {
+		t.Errorf("Expect old maps unmapped after last reader, get %d", len(db.staleMmaps))
+	}
+	kvs["old"] = "value"
+	checkPairs(t, db, kvs)
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+}
+
+func TestGrowthStep(t *testing.T) {
+	for _, mmap := range []bool{false, true} {
+		path := dataPath(t)
+		db, err := Open(Options{Path: path, GrowthStep: 1 << 20, WritableMmap: mmap})
+		if err != nil {
+			t.Fatalf("Failed to open DB: %v", err)
+		}
+		kvs := map[string]string{}
+		for round := 0; round < 3; round++ {
+			for i := 0; i < 1000; i++ {
+				kvs[fmt.Sprintf("key-%d-%04d", round, i)] = strings.Repeat("v", 500)
+			}
+			fillDB(t, db, kvs)
+			fi, err := os.Stat(path)
+			if err != nil {
+				t.Fatalf("Failed to stat: %v", err)
+			}
+			used := int64(db.meta.totalPages) * int64(page.PageSize)
+			if fi.Size()%(1<<20) != 0 || fi.Size() < used {
+				t.Errorf("File size %d is not 1MB aligned or below %d used", fi.Size(), used)
+			}
+		}
+		if errs := checkErrors(t, db); len(errs) != 0 {
+			t.Errorf("Check: %v", errs)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatalf("Failed to close: %v", err)
+		}
+		checkBackup(t, path, kvs)
+	}
+}
+
+func TestShrink(t *testing.T) {
+	for name, opts := range map[string]Options{
+		"mmap":     {Path: dataPath(t)},
+		"writable": {Path: dataPath(t), WritableMmap: true},
+		"no mmap":  {Path: dataPath(t), NoMmap: true},
+		"wal":      {Path: dataPath(t), WAL: true},
+	} {
+		db, err := Open(opts)
+		if err != nil {
+			t.Fatalf("%s: failed to open DB: %v", name, err)
+		}
+		kvs := map[string]string{"small": "value"}
+		fillDB(t, db, map[string]string{"small": "value", "large": strings.Repeat("l", 1<<20)})
+		fileSize := func() int64 {
+			fi, err := os.Stat(opts.Path)
+			if err != nil {
+				t.Fatalf("Failed to stat: %v", err)
+			}
+			return fi.Size()
+		}
+		size := fileSize()
+
+		// Pages freed while a reader is open keep file size
+		rtx, _ := NewReadOnlyTx(db)
+		tx, _ := NewWritableTx(db)
+		mustRemove(t, tx, []byte("large"))
+		mustCommit(t, tx)
+		fillDB(t, db, map[string]string{"a": "1"})
+		if fileSize() < size {
+			t.Errorf("%s: expect file of %d bytes with open reader, get %d", name, size, fileSize())
+		}
+		_ = rtx.Rollback()
+		size = fileSize()
+
+		// Commits move pages at the end into freed pages, then drop
+		// free pages at the end. Without sync, file is kept until the
+		// next synced commit.
+		for i := 0; i < 3; i++ {
+			tx, _ = NewWritableTx(db)
+			mustSet(t, tx, []byte("b"), []byte("2"))
+			if err := tx.CommitWith(DurabilityNone); err != nil {
+				t.Fatal(err)
+			}
+		}
+		used := int64(db.meta.totalPages) * int64(page.PageSize)
+		if used >= size || fileSize() != size {
+			t.Errorf("%s: expect %d pages used in file of %d bytes, get %d bytes", name, db.meta.totalPages, size, fileSize())
+		}
+		fillDB(t, db, map[string]string{"c": "3"})
+		used = int64(db.meta.totalPages) * int64(page.PageSize)
+		if fileSize() != used {
+			t.Errorf("%s: expect file shrunk to %d bytes, get %d", name, used, fileSize())
+		}
+
+		if errs := checkErrors(t, db); len(errs) != 0 {
+			t.Errorf("%s: check fails after shrink: %v", name, errs)
+		}
+		kvs["a"], kvs["b"], kvs["c"] = "1", "2", "3"
+		checkPairs(t, db, kvs)
+		// File grows again
+		fillDB(t, db, map[string]string{"large": strings.Repeat("l", 1<<20)})
+		if err := db.Close(); err != nil {
+			t.Fatalf("%s: failed to close: %v", name, err)
+		}
+		db, err = Open(opts)
+		if err != nil {
+			t.Fatalf("%s: failed to reopen DB: %v", name, err)
+		}
+		kvs["large"] = strings.Repeat("l", 1<<20)
+		checkPairs(t, db, kvs)
+		_ = db.Close()
+	}
+}
+
+func TestMmapAdvise(t *testing.T) {
+	for _, advice := range []Advice{AdviceNormal, AdviceRandom, AdviceSequential} {
+		path := dataPath(t)
+		db, err := Open(Options{Path: path, MmapAdvise: advice, InitialMmapSize: 1 << 17})
+		if err != nil {
+			t.Fatalf("%s: failed to open DB: %v", advice, err)
+		}
+		// Enough pages to remap with the advice
+		kvs := map[string]string{}
+		for i := 0; i < 2000; i++ {
+			kvs[fmt.Sprintf("key-%04d", i)] = strings.Repeat("v", 200)
+		}
+		fillDB(t, db, kvs)
+		if db.mmapSize <= 1<<17 {
+			t.Errorf("%s: expect remap, map size %d", advice, db.mmapSize)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatalf("%s: failed to close: %v", advice, err)
+		}
+		checkBackup(t, path, kvs)
+	}
+	if s := Advice(5).String(); s != "Advice(5)" {
+		t.Errorf("Bad name of unknown advice: %s", s)
+	}
+}
+
+func TestMlock(t *testing.T) {
+	path := dataPath(t)
+	db, err := Open(Options{Path: path, Mlock: true, InitialMmapSize: 1 << 17})
+	if err != nil {
+		t.Skipf("Mlock is not permitted: %v", err)
+	}
+	if db.lockedSize != db.fileSize {
+		t.Errorf("Locked %d bytes of %d", db.lockedSize, db.fileSize)
+	}
+	// Enough pages to grow file and remap
+	kvs := map[string]string{}
+	for i := 0; i < 2000; i++ {
+		kvs[fmt.Sprintf("key-%04d", i)] = strings.Repeat("v", 200)
+	}
+	mapSize := db.mmapSize
+	tx, err := NewWritableTx(db)
+	if err != nil {
+		t.Fatalf("Failed to create tx: %v", err)
+	}
+	for k, v := range kvs {
+		mustSet(t, tx, []byte(k), []byte(v))
+	}
+	err = tx.Commit()
+	if errors.Is(err, syscall.ENOMEM) || errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EAGAIN) {
+		t.Skipf("Mlock limit reached: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	if db.mmapSize == mapSize {
+		t.Error("Expect DB to remap")
+	}
+	if db.lockedSize != db.fileSize {
+		t.Errorf("Locked %d bytes of %d after remap", db.lockedSize, db.fileSize)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	if db.lockedSize != 0 {
+		t.Errorf("Expect unlock on close, %d bytes locked", db.lockedSize)
+	}
+	checkBackup(t, path, kvs)
+}
+
+func TestNoMmap(t *testing.T) {
+	path := dataPath(t)
+	db, err := Open(Options{Path: path, NoMmap: true})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	if db.mmBuf != nil {
+		t.Error("Expect no memory map")
+	}
+	kvs := map[string]string{}
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 2000; i++ {
+			kvs[fmt.Sprintf("key-%04d", i)] = fmt.Sprintf("value-%d-%d", round, i)
+		}
+		kvs[fmt.Sprintf("large-%d", round)] = strings.Repeat("x", page.PageSize*3)
+		fillDB(t, db, kvs)
+	}
+
+	// Snapshot stays readable while pages are rewritten
+	rtx, _ := NewReadOnlyTx(db)
+	update := map[string]string{}
+	for k := range kvs {
+		update[k] = "updated"
+	}
+	fillDB(t, db, update)
+	for k, v := range kvs {
+		if got := rtx.Get([]byte(k)); string(got) != v {
+			t.Fatalf("Key %s: expect %s in snapshot, get %q", k, v, got)
+		}
+	}
+	if err := rtx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	before := db.PoolStats()
+	if errs := checkErrors(t, db); len(errs) != 0 {
+		t.Errorf("Check: %v", errs)
+	}
+	if db.PoolStats().Hits == before.Hits {
+		t.Error("Expect page reads to reuse pooled buffers")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+
+	// File is the same as with memory map
+	checkBackup(t, path, update)
+}
+
+// failingFile fails reads when fail is set.
+type failingFile struct {
+	dbFile
+	fail bool
+}
+
+var errRead = errors.New("read failed")
+
+func (f *failingFile) ReadAt(b []byte, off int64) (int, error) {
+	if f.fail {
+		return 0, errRead
+	}
+	return f.dbFile.ReadAt(b, off)
+}
+
+func TestNoMmapReadError(t *testing.T) {
+	path := dataPath(t)
+	db, err := Open(Options{Path: path, NoMmap: true})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	kvs := map[string]string{}
+	for i := 0; i < 2000; i++ {
+		kvs[fmt.Sprintf("key-%04d", i)] = fmt.Sprintf("value-%d", i)
+	}
+	kvs["large"] = strings.Repeat("x", page.PageSize*3)
+	fillDB(t, db, kvs)
+	f := &failingFile{dbFile: db.file}
+	db.file = f
+
+	// Transactions read only root before reads fail
+	rtx, _ := NewReadOnlyTx(db)
+	wtx, _ := NewWritableTx(db)
+	f.fail = true
+	if _, err := NewReadOnlyTx(db); !errors.Is(err, errRead) {
+		t.Errorf("Expect read error opening tx, get %v", err)
+	}
+	if v := rtx.Get([]byte("key-1000")); v != nil {
+		t.Errorf("Expect nil value on read error, get %q", v)
+	}
+	if _, err := rtx.GetRef([]byte("key-1000")); !errors.Is(err, errRead) {
+		t.Errorf("Expect read error from GetRef, get %v", err)
+	}
+	if _, err := rtx.GetReader([]byte("large")); !errors.Is(err, errRead) {
+		t.Errorf("Expect read error from GetReader, get %v", err)
+	}
+	c := rtx.Cursor()
+	if k, _ := c.First(); k != nil {
+		t.Errorf("Expect cursor stopped on read error, get key %q", k)
+	}
+	if !errors.Is(c.Err(), errRead) {
+		t.Errorf("Expect read error from cursor, get %v", c.Err())
+	}
+	err = rtx.Scan(nil, nil, func(kv.Key, kv.Value) error { return nil })
+	if !errors.Is(err, errRead) {
+		t.Errorf("Expect read error from Scan, get %v", err)
+	}
+	if err := rtx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := wtx.Set([]byte("key-1000"), []byte("new")); !errors.Is(err, errRead) {
+		t.Errorf("Expect read error from Set, get %v", err)
+	}
+	if err := wtx.Commit(); !errors.Is(err, errRead) {
+		t.Errorf("Expect read error from commit, get %v", err)
+	}
+	if err := db.Health(); err != nil {
+		t.Errorf("Expect DB not failed by read error, get %v", err)
+	}
+
+	f.fail = false
+	db.file = f.dbFile
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	checkBackup(t, path, kvs)
+}
+
+func TestMemoryDB(t *testing.T) {
+	db, err := Open(Options{Path: MemoryPath})
+	if err != nil {
+		t.Fatalf("Failed to open in-memory DB: %v", err)
+	}
+	// In-memory DBs are independent and take no file lock
+	other, err := Open(Options{Path: MemoryPath})
+	if err != nil {
+		t.Fatalf("Failed to open second in-memory DB: %v", err)
+	}
+	fillDB(t, other, map[string]string{"other": "db"})
+
+	kvs := map[string]string{}
+	for i := 0; i < 3000; i++ {
+		kvs[fmt.Sprintf("key-%04d", i)] = fmt.Sprintf("value-%d", i)
+	}
+	kvs["large"] = strings.Repeat("x", page.PageSize*2)
+	fillDB(t, db, kvs)
+	tx, _ := NewWritableTx(db)
+	for i := 0; i < 3000; i += 2 {
+		key := fmt.Sprintf("key-%04d", i)
+		mustRemove(t, tx, []byte(key))
+		delete(kvs, key)
+	}
+	mustCommit(t, tx)
+	if _, err := os.Stat(MemoryPath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("In-memory DB should not create file, get %v", err)
+	}
+	if errs := checkErrors(t, db); len(errs) != 0 {
+		t.Errorf("Check: %v", errs)
+	}
+
+	// Backup writes in-memory DB to a file
+	path := dataPath(t)
+	if err := db.Backup(path); err != nil {
+		t.Fatalf("Failed to backup: %v", err)
+	}
+	checkBackup(t, path, kvs)
+	for _, d := range []*DB{db, other} {
+		if err := d.Close(); err != nil {
+			t.Errorf("Failed to close: %v", err)
+		}
+	}
+
+	if _, err := Open(Options{Path: MemoryPath, WritableMmap: true}); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("Expect ErrInvalidOption for writable mmap, get %v", err)
+	}
+	if _, err := Open(Options{Path: MemoryPath, Mlock: true}); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("Expect ErrInvalidOption for mlock, get %v", err)
+	}
+	if _, err := Open(Options{Path: MemoryPath, WAL: true}); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("Expect ErrInvalidOption for WAL, get %v", err)
+	}
+}
+
+func TestPoisonFreed(t *testing.T) {
+	for name, opts := range map[string]Options{
+		"mmap":          {Path: dataPath(t)},
+		"writable mmap": {Path: dataPath(t), WritableMmap: true},
+		"no mmap":       {Path: dataPath(t), NoMmap: true},
+		"memory":        {Path: MemoryPath},
+	} {
+		opts.PoisonFreed = true
+		db, err := Open(opts)
+		if err != nil {
+			t.Fatalf("%s: failed to open DB: %v", name, err)
+		}
+		kvs := map[string]string{}
+		for i := 0; i < 2000; i++ {
+			kvs[fmt.Sprintf("key-%04d", i)] = fmt.Sprintf("value-%d", i)
+		}
+		kvs["large"] = strings.Repeat("x", page.PageSize*2)
+		fillDB(t, db, kvs)
+		tx, _ := NewWritableTx(db)
+		for i := 0; i < 2000; i += 2 {
+			key := fmt.Sprintf("key-%04d", i)
+			mustRemove(t, tx, []byte(key))
+			delete(kvs, key)
+		}
+		mustRemove(t, tx, []byte("large"))
+		delete(kvs, "large")
+		mustCommit(t, tx)
+
+		// Pages freed by the last commit are released by next writer
+		tx, _ = NewWritableTx(db)
+		ids := db.freelist.IDs()
+		if len(ids) == 0 {
+			t.Fatalf("%s: expect free pages", name)
+		}
+		buf := make([]byte, page.PageSize)
+		for _, id := range ids {
+			if _, err := db.file.ReadAt(buf, int64(id)*int64(page.PageSize)); err != nil {
+				t.Fatalf("%s: failed to read page %d: %v", name, id, err)
+			}
+			if !bytes.Equal(buf, bytes.Repeat([]byte{poisonByte}, page.PageSize)) {
+				t.Errorf("%s: free page %d is not poisoned", name, id)
+				break
+			}
+		}
+		for k, v := range kvs {
+			if got := tx.Get([]byte(k)); string(got) != v {
+				t.Errorf("%s: get %s returns %q, expect %q", name, k, got, v)
+			}
+		}
+		mustCommit(t, tx)
+		if errs := checkErrors(t, db); len(errs) != 0 {
+			t.Errorf("%s: check: %v", name, errs)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatalf("%s: failed to close: %v", name, err)
+		}
+	}
+}
+
+func TestMmapCoherent(t *testing.T) {
+	db := openDB(t)
+	kvs := map[string]string{}
+	for i := 0; i < 500; i++ {
+		kvs[fmt.Sprintf("key-%03d", i)] = "value"
+	}
+	fillDB(t, db, kvs)
+
+	// Pages committed with WriteAt read the same through memory map
+	size := int(db.meta.totalPages) * page.PageSize
+	buf := make([]byte, size)
+	_, err := db.file.ReadAt(buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id := common.Pgid(db.metaPages); id < db.meta.totalPages; id++ {
+		start := int(id) * page.PageSize
+		if string(db.mmData()[start:start+page.PageSize]) != string(buf[start:start+page.PageSize]) {
+			t.Fatalf("Page %d in memory map differs from file", id)
+		}
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDirtyRanges(t *testing.T) {
+	pages := page.Pages{}
+	// (index, overflow) of sorted dirty pages
+	for _, p := range [][2]int{{3, 0}, {4, 1}, {6, 0}, {9, 0}, {11, 2}, {14, 0}, {20, 0}} {
+		buf := make([]byte, page.PageSize)
+		pg := page.FromBuffer(buf, 0)
+		pg.SetIndex(common.Pgid(p[0]))
+		pg.SetOverflow(p[1])
+		pages = append(pages, pg)
+	}
+	get := fmt.Sprint(dirtyRanges(pages))
+	expect := "[{3 7} {9 10} {11 15} {20 21}]"
+	if get != expect {
+		t.Errorf("Expect ranges %s, get %s", expect, get)
+	}
+	if len(dirtyRanges(nil)) != 0 {
+		t.Error("Expect no range without pages")
+	}
+}
+
+func BenchmarkCommit(b *testing.B) {
+	for _, mode := range []struct {
+		name   string
+		mmap   bool
+		extent int
+		wal    bool
+	}{{"pwrite", false, 0, false}, {"mmap", true, 0, false}, {"extent", false, 16, false}, {"wal", false, 0, true}} {
+		b.Run(mode.name, func(b *testing.B) {
+			db, err := Open(Options{
+				Path:         filepath.Join(b.TempDir(), "data"),
+				WritableMmap: mode.mmap,
+				ExtentPages:  mode.extent,
+				WAL:          mode.wal,
+			})
+			if err != nil {
+				b.Fatalf("Failed to open DB: %v", err)
+			}
+			value := make([]byte, 100)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				tx, _ := NewWritableTx(db)
+				for j := 0; j < 100; j++ {
+					mustSet(b, tx, []byte(fmt.Sprintf("key-%08d", (i*7919+j*104729)%1000000)), value)
+				}
+				mustCommit(b, tx)
+			}
+		})
+	}
+}
+
+func TestBeginTx(t *testing.T) {
+	db := openDB(t)
+	defer func() {
+		_ = db.Close()
+	}()
+	fillDB(t, db, map[string]string{"a": "1"})
+
+	// Writer waits for the open writable tx until context is done
+	writer, _ := NewWritableTx(db)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := db.BeginTx(ctx, true); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expect deadline exceeded, get %v", err)
+	}
+	done := make(chan *Tx)
+	go func() {
+		tx, err := db.BeginTx(context.Background(), true)
+		if err != nil {
+			t.Errorf("Failed to begin tx: %v", err)
+		}
+		done <- tx
+	}()
+	time.Sleep(10 * time.Millisecond)
+	mustCommit(t, writer)
+	tx := <-done
+	if tx == nil {
+		t.FailNow()
+	}
+
+	// Commit fails after context is cancelled
+	ctx, cancel = context.WithCancel(context.Background())
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Failed to rollback: %v", err)
+	}
+	tx, err := db.BeginTx(ctx, true)
+	if err != nil {
+		t.Fatalf("Failed to begin tx: %v", err)
+	}
+	mustSet(t, tx, []byte("b"), []byte("2"))
+	cancel()
+	if err := tx.Commit(); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expect canceled commit, get %v", err)
+	}
+	if !tx.closed() {
+		t.Error("Expect cancelled tx rolled back")
+	}
+	rtx, err := db.BeginTx(context.Background(), false)
+	if err != nil {
+		t.Fatalf("Failed to begin read-only tx: %v", err)
+	}
+	if rtx.Get([]byte("b")) != nil || rtx.Get([]byte("a")) == nil {
+		t.Error("Unexpected pairs after cancelled commit")
+	}
+	if err := rtx.Rollback(); err != nil {
+		t.Fatalf("Failed to rollback: %v", err)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	reverse := func(a, b []byte) int {
+		return bytes.Compare(b, a)
+	}
+	path := dataPath(t)
+	opts := Options{Path: path, Compare: reverse, CompareName: "reverse"}
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	kvs := map[string]string{}
+	for i := 0; i < 2000; i++ {
+		kvs[fmt.Sprintf("key%04d", i)] = "value"
+	}
+	fillDB(t, db, kvs)
+	if errs := checkErrors(t, db); len(errs) > 0 {
+		t.Fatalf("Check fails in reverse order: %v", errs)
+	}
+
+	// checkOrder checks db iterates keys in reverse order.
+	checkOrder := func(db *DB) {
+		t.Helper()
+		_ = db.View(func(tx *Tx) error {
+			keys, _ := scanAll(tx.Cursor())
+			if len(keys) != len(kvs) || keys[0] != "key1999" || keys[len(keys)-1] != "key0000" {
+				t.Fatalf("Unexpected keys in reverse order: %d keys", len(keys))
+			}
+			for i := 1; i < len(keys); i++ {
+				if keys[i-1] <= keys[i] {
+					t.Fatalf("Key %s before %s", keys[i-1], keys[i])
+				}
+			}
+			if tx.Get([]byte("key1234")) == nil {
+				t.Error("Failed to get key in reverse order")
+			}
+			if n := tx.CountRange([]byte("key1500"), []byte("key1000")); n != 500 {
+				t.Errorf("Expect 500 keys in range, get %d", n)
+			}
+			// Prefix functions don't take prefix as a range
+			if k, _ := tx.MinKey([]byte("key1")); string(k) != "key1999" {
+				t.Errorf("Expect min key key1999 with prefix in reverse order, get %q", k)
+			}
+			if k, _ := tx.MaxKey([]byte("key1")); string(k) != "key1000" {
+				t.Errorf("Expect max key key1000 with prefix in reverse order, get %q", k)
+			}
+			if k, _ := tx.MinKey([]byte("none")); k != nil {
+				t.Errorf("Expect no key with prefix, get %q", k)
+			}
+			return nil
+		})
+		if db.Bytewise() || db.Warm([]byte("key1")) == 0 {
+			t.Error("Expect prefix warm without bytewise order")
+		}
+	}
+	checkOrder(db)
+	compacted := filepath.Join(t.TempDir(), "compacted")
+	if err := db.Compact(compacted); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close DB: %v", err)
+	}
+
+	// Order is saved in file
+	for _, bad := range []Options{
+		{Path: path},
+		{Path: path, Compare: reverse, CompareName: "other"},
+		{Path: compacted},
+	} {
+		if _, err := Open(bad); !errors.Is(err, ErrComparatorMismatch) {
+			t.Errorf("Expect ErrComparatorMismatch opening with %q, get %v", bad.CompareName, err)
+		}
+	}
+	for _, p := range []string{path, compacted} {
+		opts.Path = p
+		db, err = Open(opts)
+		if err != nil {
+			t.Fatalf("Failed to reopen %s: %v", p, err)
+		}
+		checkOrder(db)
+		_ = db.Close()
+	}
+}
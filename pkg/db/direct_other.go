@@ -0,0 +1,14 @@
+//go:build !freebsd && !linux
+// +build !freebsd,!linux
+
+package db
+
+import (
+	"fmt"
+	"os"
+)
+
+// openDirect fails without O_DIRECT support.
+func openDirect(path string) (*os.File, error) {
+	return nil, fmt.Errorf("%w: ODirect is not supported on this platform", ErrInvalidOption)
+}
@@ -0,0 +1,19 @@
+//go:build freebsd || linux
+// +build freebsd linux
+
+package db
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// openDirect opens file at path for writes bypassing OS page cache.
+func openDirect(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|syscall.O_DIRECT, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open with O_DIRECT: %w", err)
+	}
+	return f, nil
+}
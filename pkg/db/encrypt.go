@@ -0,0 +1,257 @@
+package db
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/daicang/mk/pkg/page"
+)
+
+// Encrypted file stores each page in a slot of page ciphertext, GCM tag
+// and nonce. Meta pages stay plaintext with zero padding, so a file
+// opened with a wrong key or without key is detected from meta.
+// Page id is authenticated with the page, so pages can't be swapped.
+const (
+	// nonceSize is the size of random GCM nonce of each page write
+	nonceSize = 12
+	// tagSize is the size of GCM tag
+	tagSize = 16
+	// plainPages are meta pages which are not encrypted
+	plainPages = 2
+
+	// keyCheckSize is the size of key check in meta
+	keyCheckSize = 16
+	// fillPages is the count of zero pages sealed per write when file
+	// grows
+	fillPages = 256
+)
+
+// slotSize is the size of a page on disk.
+var slotSize = page.PageSize + tagSize + nonceSize
+
+// keyCheckLabel is the message authenticated by key check.
+const keyCheckLabel = "mk encryption key check"
+
+// encryptionKeyCheck returns check identifying key in meta, zeros
+// without key. It's a MAC by key, so it doesn't tell the key.
+func encryptionKeyCheck(key []byte) [keyCheckSize]byte {
+	check := [keyCheckSize]byte{}
+	if len(key) == 0 {
+		return check
+	}
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(keyCheckLabel))
+	copy(check[:], mac.Sum(nil))
+	return check
+}
+
+// cryptFile encrypts pages written to file with AES-GCM and decrypts
+// pages read. Offsets and sizes of reads and writes are in plaintext
+// pages, and must be page aligned. Every slot in file is sealed, pages
+// grown ahead of writes are sealed zeros, so every page read is
+// authenticated.
+type cryptFile struct {
+	dbFile
+	aead cipher.AEAD
+	// mu protects size
+	mu sync.Mutex
+	// size is the plaintext size of file
+	size int64
+}
+
+// newCryptFile returns file encrypting pages with key.
+func newCryptFile(f dbFile, key []byte) (*cryptFile, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &cryptFile{dbFile: f, aead: aead, size: plainSize(fi.Size())}, nil
+}
+
+// plainSize returns plaintext size of encrypted file size.
+func plainSize(size int64) int64 {
+	slots, rest := size/int64(slotSize), size%int64(slotSize)
+	if rest > int64(page.PageSize) {
+		rest = int64(page.PageSize)
+	}
+	return slots*int64(page.PageSize) + rest
+}
+
+// physicalOffset returns offset in encrypted file of plaintext offset.
+func physicalOffset(off int64) int64 {
+	size := int64(page.PageSize)
+	return off/size*int64(slotSize) + off%size
+}
+
+// checkAligned returns error when b at off is not whole pages.
+func checkAligned(b []byte, off int64) error {
+	if off%int64(page.PageSize) != 0 || len(b)%page.PageSize != 0 {
+		return fmt.Errorf("unaligned access of %d bytes at %d to encrypted file", len(b), off)
+	}
+	return nil
+}
+
+// additionalData returns page id authenticated with page.
+func additionalData(id int64) []byte {
+	ad := make([]byte, 8)
+	binary.LittleEndian.PutUint64(ad, uint64(id))
+	return ad
+}
+
+// ReadAt implements io.ReaderAt, reads and decrypts pages at off.
+func (f *cryptFile) ReadAt(b []byte, off int64) (int, error) {
+	err := checkAligned(b, off)
+	if err != nil {
+		return 0, err
+	}
+	count := len(b) / page.PageSize
+	raw := make([]byte, count*slotSize)
+	_, err = f.dbFile.ReadAt(raw, physicalOffset(off))
+	if err != nil {
+		return 0, err
+	}
+	first := off / int64(page.PageSize)
+	for i := 0; i < count; i++ {
+		id := first + int64(i)
+		slot := raw[i*slotSize : (i+1)*slotSize]
+		dst := b[i*page.PageSize : (i+1)*page.PageSize]
+		if id < plainPages {
+			copy(dst, slot)
+			continue
+		}
+		nonce := slot[page.PageSize+tagSize:]
+		_, err = f.aead.Open(dst[:0], nonce, slot[:page.PageSize+tagSize], additionalData(id))
+		if err != nil {
+			return 0, fmt.Errorf("%w: decrypt page %d: %v", ErrInvalidDB, id, err)
+		}
+	}
+	return len(b), nil
+}
+
+// WriteAt implements io.WriterAt, encrypts and writes pages at off.
+// Pages between file end and off are filled with sealed zeros.
+func (f *cryptFile) WriteAt(b []byte, off int64) (int, error) {
+	raw, err := f.seal(b, off)
+	if err != nil {
+		return 0, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err = f.fill(off)
+	if err != nil {
+		return 0, err
+	}
+	_, err = f.dbFile.WriteAt(raw, physicalOffset(off))
+	if err != nil {
+		return 0, err
+	}
+	if end := off + int64(len(b)); end > f.size {
+		f.size = end
+	}
+	return len(b), nil
+}
+
+// fill writes sealed zero pages from file end up to plaintext offset
+// end, f.mu is held.
+func (f *cryptFile) fill(end int64) error {
+	if f.size >= end {
+		return nil
+	}
+	size := end - f.size
+	if size > fillPages*int64(page.PageSize) {
+		size = fillPages * int64(page.PageSize)
+	}
+	zeros := make([]byte, size)
+	for f.size < end {
+		n := end - f.size
+		if n > int64(len(zeros)) {
+			n = int64(len(zeros))
+		}
+		raw, err := f.seal(zeros[:n], f.size)
+		if err != nil {
+			return err
+		}
+		_, err = f.dbFile.WriteAt(raw, physicalOffset(f.size))
+		if err != nil {
+			return err
+		}
+		f.size += n
+	}
+	return nil
+}
+
+// seal returns slots on disk of pages b at off.
+func (f *cryptFile) seal(b []byte, off int64) ([]byte, error) {
+	err := checkAligned(b, off)
+	if err != nil {
+		return nil, err
+	}
+	count := len(b) / page.PageSize
+	raw := make([]byte, count*slotSize)
+	first := off / int64(page.PageSize)
+	for i := 0; i < count; i++ {
+		id := first + int64(i)
+		slot := raw[i*slotSize : (i+1)*slotSize]
+		src := b[i*page.PageSize : (i+1)*page.PageSize]
+		if id < plainPages {
+			copy(slot, src)
+			continue
+		}
+		nonce := slot[page.PageSize+tagSize:]
+		_, err = io.ReadFull(rand.Reader, nonce)
+		if err != nil {
+			return nil, fmt.Errorf("generate nonce: %w", err)
+		}
+		f.aead.Seal(slot[:0], nonce, src, additionalData(id))
+	}
+	return raw, nil
+}
+
+// Truncate changes file size in plaintext bytes, pages it grows are
+// sealed zeros.
+func (f *cryptFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if size > f.size {
+		return f.fill(size)
+	}
+	err := f.dbFile.Truncate(physicalOffset(size))
+	if err != nil {
+		return err
+	}
+	f.size = size
+	return nil
+}
+
+// Stat returns file info with size in plaintext bytes.
+func (f *cryptFile) Stat() (os.FileInfo, error) {
+	fi, err := f.dbFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return cryptFileInfo{FileInfo: fi, size: plainSize(fi.Size())}, nil
+}
+
+// cryptFileInfo is file info of cryptFile.
+type cryptFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (fi cryptFileInfo) Size() int64 { return fi.size }
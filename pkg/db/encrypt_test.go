@@ -0,0 +1,245 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/daicang/mk/pkg/kv"
+	"github.com/daicang/mk/pkg/page"
+)
+
+// checkPairs checks DB holds exactly kvs.
+func checkPairs(t *testing.T, db *DB, kvs map[string]string) {
+	t.Helper()
+	err := db.View(func(tx *Tx) error {
+		count := 0
+		err := tx.ForEach(func(k kv.Key, v kv.Value) error {
+			if kvs[string(k)] != string(v) {
+				return fmt.Errorf("key %s is %.20s, expect %.20s", k, v, kvs[string(k)])
+			}
+			count++
+			return nil
+		})
+		if err == nil && count != len(kvs) {
+			err = fmt.Errorf("DB has %d keys, expect %d", count, len(kvs))
+		}
+		return err
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	path := dataPath(t)
+	db, err := Open(Options{Path: path, EncryptionKey: key})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	kvs := map[string]string{"blob": strings.Repeat("secret blob ", page.PageSize)}
+	for i := 0; i < 2000; i++ {
+		kvs[fmt.Sprintf("key-%04d", i)] = fmt.Sprintf("secret-%d", i)
+	}
+	fillDB(t, db, kvs)
+	if errs := checkErrors(t, db); len(errs) > 0 {
+		t.Errorf("Check fails with encryption: %v", errs)
+	}
+	backup := filepath.Join(t.TempDir(), "backup")
+	if err := db.Backup(backup); err != nil {
+		t.Fatalf("Failed to backup: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close DB: %v", err)
+	}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte("secret")) || bytes.Contains(raw, []byte("key-0")) {
+		t.Error("Expect no plaintext in encrypted file")
+	}
+
+	// Opening needs the same key
+	for _, k := range [][]byte{nil, bytes.Repeat([]byte{2}, 32)} {
+		if _, err := Open(Options{Path: path, EncryptionKey: k}); !errors.Is(err, ErrEncryptionKey) {
+			t.Errorf("Expect ErrEncryptionKey for key %x, get %v", k, err)
+		}
+	}
+	// Backup is encrypted with the same key
+	db, err = Open(Options{Path: backup, EncryptionKey: key})
+	if err != nil {
+		t.Fatalf("Failed to open backup with key: %v", err)
+	}
+	checkPairs(t, db, kvs)
+	_ = db.Close()
+	db, err = Open(Options{Path: path, EncryptionKey: key})
+	if err != nil {
+		t.Fatalf("Failed to open DB with key: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+	checkPairs(t, db, kvs)
+
+	// Compaction rotates key or drops encryption
+	rotated := filepath.Join(t.TempDir(), "rotated")
+	newKey := bytes.Repeat([]byte{3}, 16)
+	if err := db.CompactWithKey(rotated, newKey); err != nil {
+		t.Fatalf("Failed to compact with new key: %v", err)
+	}
+	if _, err := Open(Options{Path: rotated, EncryptionKey: key}); !errors.Is(err, ErrEncryptionKey) {
+		t.Errorf("Expect ErrEncryptionKey with old key, get %v", err)
+	}
+	plain := filepath.Join(t.TempDir(), "plain")
+	if err := db.CompactWithKey(plain, nil); err != nil {
+		t.Fatalf("Failed to compact without key: %v", err)
+	}
+	for p, k := range map[string][]byte{rotated: newKey, plain: nil} {
+		dst, err := Open(Options{Path: p, EncryptionKey: k})
+		if err != nil {
+			t.Fatalf("Failed to open compacted %s: %v", p, err)
+		}
+		checkPairs(t, dst, kvs)
+		_ = dst.Close()
+	}
+	if _, err := Open(Options{Path: plain, EncryptionKey: key}); !errors.Is(err, ErrEncryptionKey) {
+		t.Errorf("Expect ErrEncryptionKey for plain file, get %v", err)
+	}
+}
+
+func TestCryptFile(t *testing.T) {
+	f, err := newCryptFile(&memFile{}, bytes.Repeat([]byte{1}, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pages := bytes.Repeat([]byte("p"), 4*page.PageSize)
+	if _, err := f.WriteAt(pages, 0); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	fi, _ := f.Stat()
+	if fi.Size() != int64(len(pages)) {
+		t.Errorf("Expect size %d, get %d", len(pages), fi.Size())
+	}
+	buf := make([]byte, 2*page.PageSize)
+	if _, err := f.ReadAt(buf, int64(2*page.PageSize)); err != nil || !bytes.Equal(buf, pages[:len(buf)]) {
+		t.Errorf("Pages mismatch after read: %v", err)
+	}
+	if _, err := f.ReadAt(buf[:100], 0); err == nil {
+		t.Error("Expect error for unaligned read")
+	}
+
+	// Grown and skipped pages are sealed zeros, tampered, moved or
+	// zeroed pages fail
+	if err := f.Truncate(int64(6 * page.PageSize)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.ReadAt(buf, int64(4*page.PageSize)); err != nil || !bytes.Equal(buf, make([]byte, len(buf))) {
+		t.Errorf("Expect zeros in grown pages: %v", err)
+	}
+	if _, err := f.WriteAt(pages[:page.PageSize], int64(8*page.PageSize)); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	if _, err := f.ReadAt(buf, int64(6*page.PageSize)); err != nil || !bytes.Equal(buf, make([]byte, len(buf))) {
+		t.Errorf("Expect zeros in skipped pages: %v", err)
+	}
+	mem := f.dbFile.(*memFile)
+	copy(mem.buf[7*slotSize:8*slotSize], make([]byte, slotSize))
+	if _, err := f.ReadAt(buf[:page.PageSize], int64(7*page.PageSize)); !errors.Is(err, ErrInvalidDB) {
+		t.Errorf("Expect ErrInvalidDB for zeroed page, get %v", err)
+	}
+	copy(mem.buf[4*slotSize:5*slotSize], mem.buf[2*slotSize:3*slotSize])
+	if _, err := f.ReadAt(buf[:page.PageSize], int64(4*page.PageSize)); !errors.Is(err, ErrInvalidDB) {
+		t.Errorf("Expect ErrInvalidDB for moved page, get %v", err)
+	}
+	mem.buf[3*slotSize] ^= 1
+	if _, err := f.ReadAt(buf[:page.PageSize], int64(3*page.PageSize)); !errors.Is(err, ErrInvalidDB) {
+		t.Errorf("Expect ErrInvalidDB for tampered page, get %v", err)
+	}
+}
+
+func TestEncryptionTampered(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	path := dataPath(t)
+	db, err := Open(Options{Path: path, EncryptionKey: key})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	kvs := map[string]string{}
+	for i := 0; i < 2000; i++ {
+		kvs[fmt.Sprintf("key-%04d", i)] = fmt.Sprintf("secret-%d", i)
+	}
+	fillDB(t, db, kvs)
+	key1000 := kv.Key("key-1000")
+	tx, _ := NewReadOnlyTx(db)
+	c := tx.Cursor()
+	c.Seek(key1000)
+	leaf := c.stack[len(c.stack)-1].node.Index
+	_ = tx.Rollback()
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close DB: %v", err)
+	}
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[int(leaf)*slotSize] ^= 1
+	if err := ioutil.WriteFile(path, raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(Options{Path: path, EncryptionKey: key})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	// Tampered leaf fails reads and writes under it, not others
+	err = db.View(func(tx *Tx) error {
+		if v := tx.Get(key1000); v != nil {
+			t.Errorf("Expect nil value from tampered page, get %q", v)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.View(func(tx *Tx) error {
+		_, err := tx.GetRef(key1000)
+		return err
+	})
+	if !errors.Is(err, ErrInvalidDB) {
+		t.Errorf("Expect ErrInvalidDB from GetRef, get %v", err)
+	}
+	err = db.View(func(tx *Tx) error {
+		return tx.ForEach(func(kv.Key, kv.Value) error { return nil })
+	})
+	if !errors.Is(err, ErrInvalidDB) {
+		t.Errorf("Expect ErrInvalidDB from ForEach, get %v", err)
+	}
+	err = db.Update(func(tx *Tx) error {
+		_, err := tx.Set(key1000, kv.Value("new"))
+		return err
+	})
+	if !errors.Is(err, ErrInvalidDB) {
+		t.Errorf("Expect ErrInvalidDB from Set, get %v", err)
+	}
+	wtx, _ := NewWritableTx(db)
+	mustRemove(t, wtx, kv.Key("key-0001"))
+	wtx.Get(key1000)
+	if err := wtx.Commit(); !errors.Is(err, ErrInvalidDB) {
+		t.Errorf("Expect ErrInvalidDB from commit after failed read, get %v", err)
+	}
+	err = db.View(func(tx *Tx) error {
+		if v := tx.Get(kv.Key("key-0000")); string(v) != kvs["key-0000"] {
+			return fmt.Errorf("key-0000 is %q", v)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Expect pages not tampered readable: %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package db
+
+import "errors"
+
+var (
+	// ErrInvalidDB is returned when file is not a DB or is corrupted.
+	ErrInvalidDB = errors.New("invalid database file")
+	// ErrDBClosed is returned for writes after DB is shut down.
+	ErrDBClosed = errors.New("database is closed")
+	// ErrTimeout is returned when DB file stays locked longer than
+	// Options.Timeout.
+	ErrTimeout = errors.New("timeout waiting for file lock")
+	// ErrTxExists is returned when another writable tx is open.
+	ErrTxExists = errors.New("writable transaction exists")
+	// ErrTxReadOnly is returned for writes in read-only tx.
+	ErrTxReadOnly = errors.New("transaction is read-only")
+	// ErrTxWritable is returned for read-only operations on writable tx.
+	ErrTxWritable = errors.New("transaction is writable")
+	// ErrTxClosed is returned when tx is used after commit or rollback.
+	ErrTxClosed = errors.New("transaction is closed")
+	// ErrTxManaged is returned when committing tx of Update or View.
+	ErrTxManaged = errors.New("transaction is managed")
+	// ErrKeyTooLarge is returned when key is larger than MaxKeySize.
+	ErrKeyTooLarge = errors.New("key is too large")
+	// ErrValueTooLarge is returned when value is larger than MaxValueSize.
+	ErrValueTooLarge = errors.New("value is too large")
+	// ErrMmapTooLarge is returned when DB outgrows Options.MaxMmapSize.
+	ErrMmapTooLarge = errors.New("memory map exceeds MaxMmapSize")
+	// ErrWALDisabled is returned by DB.Checkpoint without Options.WAL.
+	ErrWALDisabled = errors.New("write-ahead log is disabled")
+	// ErrInvalidSavepoint is returned by Tx.RollbackTo for savepoint of
+	// another tx, or one discarded by rolling back to an earlier one.
+	ErrInvalidSavepoint = errors.New("invalid savepoint")
+	// ErrNotAtPair is returned when cursor doesn't point to a pair.
+	ErrNotAtPair = errors.New("cursor is not at a pair")
+	// ErrChangefeedDisabled is returned by Tx.Changes without changefeed.
+	ErrChangefeedDisabled = errors.New("changefeed is disabled")
+	// ErrChangesTruncated is returned by Tx.Changes when changes
+	// requested are dropped from the changefeed ring.
+	ErrChangesTruncated = errors.New("changes are truncated")
+	// ErrNoMergeFunc is returned by Tx.Merge, and reads of merge
+	// records, without Options.Merge.
+	ErrNoMergeFunc = errors.New("merge function is not set")
+	// ErrComparatorMismatch is returned by Open when Options.CompareName
+	// differs from the key order of file.
+	ErrComparatorMismatch = errors.New("comparator mismatch")
+	// ErrEncryptionKey is returned by Open when Options.EncryptionKey
+	// doesn't match the key file is encrypted with.
+	ErrEncryptionKey = errors.New("encryption key mismatch")
+	// ErrUnsupportedVersion is returned by Open for files of a format
+	// version newer than FormatVersion.
+	ErrUnsupportedVersion = errors.New("unsupported format version")
+)
+
+const (
+	// MaxKeySize is the maximal key length.
+	MaxKeySize = 32768
+	// MaxValueSize is the maximal value length.
+	MaxValueSize = (1 << 31) - 2
+	// ComparatorNameSize is the maximal length of Options.CompareName.
+	ComparatorNameSize = 32
+)
@@ -0,0 +1,89 @@
+package db
+
+import (
+	"unsafe"
+
+	"github.com/daicang/mk/pkg/common"
+	"github.com/daicang/mk/pkg/page"
+)
+
+// extent is contiguous pages reserved for one commit,
+// spilled nodes take pages from it in order.
+type extent struct {
+	// First page id
+	start common.Pgid
+	// Buffer of all pages
+	buf []byte
+	// Pages used
+	used int
+	// Pages reserved
+	count int
+}
+
+// estimateSpill returns pages needed to spill materialized nodes.
+// Splits may need a few more, which are allocated separately.
+func (tx *Tx) estimateSpill() int {
+	count := 0
+	for _, n := range tx.nodes {
+		count += (n.Size()+page.PageSize-1)/page.PageSize + n.OverflowPages()
+	}
+	return count
+}
+
+// reserveExtent reserves one extent for spill when the commit is large
+// enough, so most dirty pages are written sequentially.
+func (tx *Tx) reserveExtent() error {
+	if tx.db.extentPages <= 0 {
+		return nil
+	}
+	count := tx.estimateSpill()
+	if count < tx.db.extentPages {
+		return nil
+	}
+	p, err := tx.db.allocate(count)
+	if err != nil {
+		return err
+	}
+	tx.extent = &extent{
+		start: p.Index(),
+		buf:   (*[common.MmapMaxSize]byte)(unsafe.Pointer(p))[:count*page.PageSize],
+		count: count,
+	}
+	return nil
+}
+
+// allocateExtent returns pages from reserved extent,
+// returns false when there's no extent or not enough pages left.
+func (tx *Tx) allocateExtent(count int) (*page.Page, bool) {
+	e := tx.extent
+	if e == nil || e.used+count > e.count {
+		return nil, false
+	}
+	p := page.FromBuffer(e.buf, common.Pgid(e.used))
+	p.SetIndex(e.start + common.Pgid(e.used))
+	p.SetOverflow(count - 1)
+	e.used += count
+	return p, true
+}
+
+// releaseExtent returns unused extent pages to freelist.
+func (tx *Tx) releaseExtent() {
+	e := tx.extent
+	if e == nil {
+		return
+	}
+	if e.used < e.count {
+		p := page.FromBuffer(e.buf, common.Pgid(e.used))
+		p.SetIndex(e.start + common.Pgid(e.used))
+		p.SetOverflow(e.count - e.used - 1)
+		tx.db.freelist.Add(p)
+	}
+	// Stop taking pages from extent
+	e.count = e.used
+}
+
+// inExtent returns whether page is in reserved extent.
+func (tx *Tx) inExtent(id common.Pgid) bool {
+	e := tx.extent
+	return e != nil && id >= e.start && id < e.start+common.Pgid(e.used)
+}
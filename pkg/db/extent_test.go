@@ -0,0 +1,73 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/daicang/mk/pkg/tree"
+)
+
+// nodeRuns returns the number of contiguous page runs holding tree nodes.
+func nodeRuns(tx *Tx) int {
+	ids := []int{}
+	tx.forEachNode(func(n *tree.Node, depth int) {
+		ids = append(ids, int(n.Index))
+	})
+	sort.Ints(ids)
+	runs := 0
+	for i, id := range ids {
+		if i == 0 || id != ids[i-1]+1 {
+			runs++
+		}
+	}
+	return runs
+}
+
+func TestExtentAllocation(t *testing.T) {
+	runs := map[int]int{}
+	for _, extentPages := range []int{0, 16} {
+		db, err := Open(Options{
+			Path:        dataPath(t),
+			ExtentPages: extentPages,
+		})
+		if err != nil {
+			t.Fatalf("Failed to open DB: %v", err)
+		}
+		kvs := map[string]string{}
+		for i := 0; i < 20000; i++ {
+			kvs[fmt.Sprintf("key-%06d", i)] = "value"
+		}
+		fillDB(t, db, kvs)
+
+		// Small updates scatter free pages
+		for round := 0; round < 20; round++ {
+			tx, _ := NewWritableTx(db)
+			for i := round; i < 20000; i += 997 {
+				mustSet(t, tx, []byte(fmt.Sprintf("key-%06d", i)), []byte("small update"))
+			}
+			mustCommit(t, tx)
+		}
+
+		// Rewrite all nodes in one large commit
+		tx, _ := NewWritableTx(db)
+		for k := range kvs {
+			mustSet(t, tx, []byte(k), []byte("large update"))
+		}
+		mustCommit(t, tx)
+
+		rtx, _ := NewReadOnlyTx(db)
+		for k := range kvs {
+			v := rtx.Get([]byte(k))
+			if string(v) != "large update" {
+				t.Fatalf("Key %s: get %q", k, v)
+			}
+		}
+		runs[extentPages] = nodeRuns(rtx)
+	}
+	t.Log(runs)
+	// Splits beyond the estimate may take a few extra runs
+	if runs[16] > 3 || runs[16] >= runs[0] {
+		t.Errorf("Expect extent to keep nodes contiguous, get %d runs, %d without extent", runs[16], runs[0])
+	}
+}
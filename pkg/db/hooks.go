@@ -0,0 +1,54 @@
+package db
+
+import "time"
+
+// Hooks are callbacks on DB events, for tracing, auditing invariants
+// or backpressure. Nil callbacks are skipped. Except OnCommit, they
+// run inside the writable tx with DB locks held, so they must return
+// quickly and not call DB or Tx methods.
+type Hooks struct {
+	// OnCommit is called after a tx commits and closes.
+	OnCommit func(info CommitInfo)
+	// OnSplit is called when a node splits into parts nodes at commit.
+	OnSplit func(txid uint64, parts int)
+	// OnMerge is called when a node is merged into a sibling or parent
+	// at commit.
+	OnMerge func(txid uint64)
+	// OnGrow is called after memory map grows, with sizes in bytes.
+	OnGrow func(oldSize, newSize int)
+	// OnAllocFail is called when count pages can't be allocated, e.g.
+	// disk is full or map reaches Options.MaxMmapSize.
+	OnAllocFail func(count int, err error)
+}
+
+// CommitInfo describes a committed tx.
+type CommitInfo struct {
+	TxID  uint64
+	Stats TxStats
+	// Duration is commit time, sync included
+	Duration time.Duration
+}
+
+// countSplit counts split of a node into parts nodes.
+func (tx *Tx) countSplit(parts int) {
+	tx.stats.Splits += parts - 1
+	if tx.db.hooks.OnSplit != nil && parts > 1 {
+		tx.db.hooks.OnSplit(tx.id, parts)
+	}
+}
+
+// countMerge counts a merged node.
+func (tx *Tx) countMerge() {
+	tx.stats.Merges++
+	if tx.db.hooks.OnMerge != nil {
+		tx.db.hooks.OnMerge(tx.id)
+	}
+}
+
+// allocFailed reports allocation failure of count pages, returns err.
+func (db *DB) allocFailed(count int, err error) error {
+	if db.hooks.OnAllocFail != nil {
+		db.hooks.OnAllocFail(count, err)
+	}
+	return err
+}
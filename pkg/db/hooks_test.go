@@ -0,0 +1,83 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/daicang/mk/pkg/common"
+)
+
+func TestHooks(t *testing.T) {
+	commits := []CommitInfo{}
+	splits, merges, grows := 0, 0, 0
+	allocFails := []error{}
+	db, err := Open(Options{
+		Path:        dataPath(t),
+		MaxMmapSize: 4 * common.MmapMinSize,
+		Hooks: Hooks{
+			OnCommit: func(info CommitInfo) {
+				commits = append(commits, info)
+			},
+			OnSplit: func(txid uint64, parts int) {
+				if parts < 2 {
+					t.Errorf("Tx %d splits node into %d parts", txid, parts)
+				}
+				splits += parts - 1
+			},
+			OnMerge: func(uint64) {
+				merges++
+			},
+			OnGrow: func(oldSize, newSize int) {
+				if newSize <= oldSize {
+					t.Errorf("Map grows from %d to %d", oldSize, newSize)
+				}
+				grows++
+			},
+			OnAllocFail: func(count int, err error) {
+				allocFails = append(allocFails, err)
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+
+	kvs := map[string]string{}
+	for i := 0; i < 200; i++ {
+		kvs[fmt.Sprintf("key-%04d", i)] = strings.Repeat("v", 1000)
+	}
+	fillDB(t, db, kvs)
+	tx, _ := NewWritableTx(db)
+	for key := range kvs {
+		mustRemove(t, tx, []byte(key))
+	}
+	mustCommit(t, tx)
+	if len(commits) != 2 || commits[1].TxID != tx.ID() || commits[1].Duration <= 0 {
+		t.Fatalf("Unexpected commits %+v", commits)
+	}
+	if commits[0].Stats.Splits != splits || splits == 0 {
+		t.Errorf("Expect %d splits, get %d", commits[0].Stats.Splits, splits)
+	}
+	if commits[1].Stats.Merges != merges || merges == 0 {
+		t.Errorf("Expect %d merges, get %d", commits[1].Stats.Merges, merges)
+	}
+	if grows == 0 {
+		t.Error("Expect map growth")
+	}
+
+	err = db.Update(func(tx *Tx) error {
+		_, err := tx.Set([]byte("large"), []byte(strings.Repeat("L", 4*common.MmapMinSize)))
+		return err
+	})
+	if !errors.Is(err, ErrMmapTooLarge) || len(allocFails) != 1 || !errors.Is(allocFails[0], ErrMmapTooLarge) {
+		t.Errorf("Expect allocation failure reported, get %v, %v", err, allocFails)
+	}
+	if len(commits) != 2 {
+		t.Errorf("Failed commit is reported")
+	}
+}
@@ -0,0 +1,112 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/daicang/mk/pkg/common"
+	"github.com/daicang/mk/pkg/freelist"
+	"github.com/daicang/mk/pkg/page"
+)
+
+// Info describes the snapshot of a tx, for inspection tools.
+type Info struct {
+	PageSize     int
+	MetaPages    int
+	TotalPages   common.Pgid
+	FreelistPage common.Pgid
+	RootPage     common.Pgid
+	FreePages    int
+	TxID         uint64
+	Sequence     uint64
+	// FormatVersion is the format of the last commit, 0 for files
+	// written before version 8
+	FormatVersion uint32
+}
+
+// PageInfo describes one page of a tx snapshot.
+type PageInfo struct {
+	ID common.Pgid
+	// Type is page type, or "free" for page in freelist
+	Type string
+	// Count is key count, free slot count or overflow value bytes
+	Count    int
+	Overflow int
+}
+
+// Info returns meta and page counts of tx snapshot.
+func (tx *Tx) Info() Info {
+	return Info{
+		PageSize:     page.PageSize,
+		MetaPages:    tx.db.metaPages,
+		TotalPages:   tx.meta.totalPages,
+		FreelistPage: tx.meta.freelistPage,
+		RootPage:     tx.meta.rootPage,
+		FreePages:    len(tx.freePages()),
+		TxID:         tx.meta.txid,
+		Sequence:     tx.meta.sequence,
+
+		FormatVersion: tx.meta.version,
+	}
+}
+
+// Pages lists pages of tx snapshot in id order. Pages following a
+// multi-page page are covered by it and not listed.
+func (tx *Tx) Pages() []PageInfo {
+	free := map[common.Pgid]bool{}
+	for _, id := range tx.freePages() {
+		free[id] = true
+	}
+	infos := []PageInfo{}
+	for id := common.Pgid(0); id < tx.meta.totalPages; id++ {
+		if free[id] {
+			infos = append(infos, PageInfo{ID: id, Type: "free"})
+			continue
+		}
+		p := tx.getPage(id)
+		infos = append(infos, PageInfo{
+			ID:       id,
+			Type:     p.Type(),
+			Count:    p.Count(),
+			Overflow: p.Overflow(),
+		})
+		id += common.Pgid(p.Overflow())
+	}
+	return infos
+}
+
+// freePages returns free pages recorded in freelist page of tx meta.
+func (tx *Tx) freePages() []common.Pgid {
+	return tx.readFreelist().IDs()
+}
+
+// readFreelist returns freelist recorded in freelist page of tx meta,
+// pages freed by the commit included. It's empty when the page is not
+// a freelist page.
+func (tx *Tx) readFreelist() *freelist.Freelist {
+	f := freelist.NewFreelist()
+	p := tx.getPage(tx.meta.freelistPage)
+	if p.IsFreelist() {
+		f.ReadPage(p)
+	}
+	return f
+}
+
+// String returns meta fields for print.
+func (m *Meta) String() string {
+	return fmt.Sprintf(
+		"magic=%#x totalPages=%d freelistPage=%d rootPage=%d txid=%d checksum=%#x sequence=%d changefeedPage=%d "+
+			"comparator=%q encrypted=%v version=%d",
+		m.magic, m.totalPages, m.freelistPage, m.rootPage, m.txid, m.checksum, m.sequence, m.changefeedPage,
+		m.comparatorName(), m.keyCheck != [keyCheckSize]byte{}, m.version,
+	)
+}
+
+// ReadMeta returns a copy of meta in page p, with error when p is not
+// a valid meta page.
+func ReadMeta(p *page.Page) (*Meta, error) {
+	if !p.IsMeta() {
+		return nil, fmt.Errorf("%w: page %d is not meta", ErrInvalidDB, p.Index())
+	}
+	m := pageMeta(p)
+	return m, m.validate()
+}
@@ -0,0 +1,67 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/daicang/mk/pkg/common"
+	"github.com/daicang/mk/pkg/page"
+)
+
+func TestInfo(t *testing.T) {
+	db := openDB(t)
+	kvs := map[string]string{}
+	for i := 0; i < 2000; i++ {
+		kvs[fmt.Sprintf("key-%04d", i)] = "value"
+	}
+	kvs["large"] = strings.Repeat("x", page.PageSize*2)
+	fillDB(t, db, kvs)
+	tx, _ := NewWritableTx(db)
+	for i := 0; i < 1000; i++ {
+		mustRemove(t, tx, []byte(fmt.Sprintf("key-%04d", i)))
+	}
+	mustCommit(t, tx)
+
+	rtx, _ := NewReadOnlyTx(db)
+	defer func() {
+		_ = rtx.Rollback()
+	}()
+	info := rtx.Info()
+	if info.PageSize != page.PageSize || info.MetaPages != 2 || info.TxID != rtx.ID() {
+		t.Errorf("Bad info: %+v", info)
+	}
+	if info.FreePages == 0 {
+		t.Error("Expect free pages after removing keys")
+	}
+
+	pages := rtx.Pages()
+	counts := map[string]int{}
+	next := common.Pgid(0)
+	for _, p := range pages {
+		if p.ID != next {
+			t.Fatalf("Expect page %d, get %d", next, p.ID)
+		}
+		next = p.ID + common.Pgid(p.Overflow) + 1
+		counts[p.Type]++
+	}
+	if next != info.TotalPages {
+		t.Errorf("Pages end at %d, expect %d", next, info.TotalPages)
+	}
+	if counts["meta"] != 2 || counts["freelist"] != 1 || counts["free"] != info.FreePages ||
+		counts["leaf"] == 0 || counts["internal"] == 0 || counts["overflow"] == 0 || counts["unknown"] != 0 {
+		t.Errorf("Bad page types: %v", counts)
+	}
+
+	m, err := ReadMeta(db.getPage(0))
+	if err != nil {
+		t.Fatalf("Failed to read meta: %v", err)
+	}
+	if m.txid > info.TxID || m.totalPages > info.TotalPages {
+		t.Errorf("Meta page 0 is newer than tx: %v", m)
+	}
+	if _, err := ReadMeta(db.getPage(info.RootPage)); !errors.Is(err, ErrInvalidDB) {
+		t.Errorf("Expect ErrInvalidDB for non-meta page, get %v", err)
+	}
+}
@@ -0,0 +1,172 @@
+package db
+
+import "github.com/daicang/mk/pkg/kv"
+
+// SetOp is operation between two key sets.
+type SetOp int
+
+const (
+	// SetUnion yields keys in either set.
+	SetUnion SetOp = iota
+	// SetIntersect yields keys in both sets.
+	SetIntersect
+	// SetDifference yields keys in the first set but not the second.
+	SetDifference
+)
+
+// KeySet is keys of a cursor within a range.
+// Zero range means all keys.
+type KeySet struct {
+	Cursor *Cursor
+	Range  kv.Range
+}
+
+// SetIterator streams result of a set operation in key order.
+// Keys are compared in full, so both sets are usually the same range
+// of two trees, e.g. a replica and its source.
+type SetIterator struct {
+	op   SetOp
+	a, b setSide
+}
+
+// setSide is current position in one set, key is nil at the end.
+type setSide struct {
+	set KeySet
+	k   kv.Key
+	v   kv.Value
+}
+
+// Union returns iterator of keys in a or b.
+func Union(a, b KeySet) *SetIterator {
+	return newSetIterator(SetUnion, a, b)
+}
+
+// Intersect returns iterator of keys in both a and b.
+func Intersect(a, b KeySet) *SetIterator {
+	return newSetIterator(SetIntersect, a, b)
+}
+
+// Difference returns iterator of keys in a but not in b.
+func Difference(a, b KeySet) *SetIterator {
+	return newSetIterator(SetDifference, a, b)
+}
+
+func newSetIterator(op SetOp, a, b KeySet) *SetIterator {
+	return &SetIterator{
+		op: op,
+		a:  setSide{set: a},
+		b:  setSide{set: b},
+	}
+}
+
+// First moves to the first key of result.
+// It returns the key with its values in a and b, a value is nil
+// when key is not in that set. Key is nil when result is empty.
+func (it *SetIterator) First() (kv.Key, kv.Value, kv.Value) {
+	it.a.seek(nil)
+	it.b.seek(nil)
+	return it.next()
+}
+
+// Next moves to the next key of result, key is nil at the end.
+func (it *SetIterator) Next() (kv.Key, kv.Value, kv.Value) {
+	return it.next()
+}
+
+// next finds the next result key from current positions,
+// then moves past it.
+func (it *SetIterator) next() (kv.Key, kv.Value, kv.Value) {
+	a, b := &it.a, &it.b
+	for {
+		if a.k == nil && (b.k == nil || it.op != SetUnion) {
+			return nil, nil, nil
+		}
+		c := compareSides(a, b)
+		switch it.op {
+		case SetUnion:
+			if c < 0 {
+				k, v := a.k, a.v
+				a.next()
+				return k, v, nil
+			}
+			if c > 0 {
+				k, v := b.k, b.v
+				b.next()
+				return k, nil, v
+			}
+
+		case SetIntersect:
+			if b.k == nil {
+				return nil, nil, nil
+			}
+			// Skip ahead in whichever side is behind
+			if c < 0 {
+				a.seek(b.k)
+				continue
+			}
+			if c > 0 {
+				b.seek(a.k)
+				continue
+			}
+
+		case SetDifference:
+			if c < 0 {
+				k, v := a.k, a.v
+				a.next()
+				return k, v, nil
+			}
+			if c > 0 {
+				b.seek(a.k)
+				continue
+			}
+			a.next()
+			b.next()
+			continue
+		}
+		// Key in both sets
+		k, va, vb := a.k, a.v, b.v
+		a.next()
+		b.next()
+		return k, va, vb
+	}
+}
+
+// compareSides compares current keys, a side at the end is the largest.
+func compareSides(a, b *setSide) int {
+	if a.k == nil {
+		return 1
+	}
+	if b.k == nil {
+		return -1
+	}
+	return a.set.Cursor.tx.db.compare(a.k, b.k)
+}
+
+// seek moves to the first key in set equal or larger than key, nil key
+// moves to the first key in set.
+func (s *setSide) seek(key kv.Key) {
+	r, cmp := s.set.Range, s.set.Cursor.tx.db.compare
+	if r.EmptyFunc(cmp) {
+		s.k, s.v = nil, nil
+		return
+	}
+	if key == nil || (r.Start != nil && cmp(key, r.Start) < 0) {
+		key = r.Start
+	}
+	s.moved(s.set.Cursor.seekFrom(key))
+}
+
+func (s *setSide) next() {
+	s.moved(s.set.Cursor.Next())
+}
+
+func (s *setSide) moved(k kv.Key, v kv.Value) {
+	if k != nil && s.set.Range.AfterEndFunc(k, s.set.Cursor.tx.db.compare) {
+		k = nil
+	}
+	if k != nil && v == nil {
+		// Keep empty value distinguishable from absence
+		v = kv.Value{}
+	}
+	s.k, s.v = k, v
+}
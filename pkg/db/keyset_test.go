@@ -0,0 +1,90 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/daicang/mk/pkg/kv"
+)
+
+// collectSet returns "key=a/b" of each result, "-" for absent value.
+func collectSet(it *SetIterator) []string {
+	result := []string{}
+	show := func(v kv.Value) string {
+		if v == nil {
+			return "-"
+		}
+		return string(v)
+	}
+	for k, va, vb := it.First(); k != nil; k, va, vb = it.Next() {
+		result = append(result, fmt.Sprintf("%s=%s/%s", k, show(va), show(vb)))
+	}
+	return result
+}
+
+func TestKeySetOps(t *testing.T) {
+	// a holds multiples of 2, b holds multiples of 3, in [0, 3000)
+	sets := []map[string]string{{}, {}}
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key-%05d", i)
+		if i%2 == 0 {
+			sets[0][key] = "a"
+		}
+		if i%3 == 0 {
+			sets[1][key] = "b"
+		}
+	}
+	cursors := []*Cursor{}
+	for _, kvs := range sets {
+		db := openDB(t)
+		fillDB(t, db, kvs)
+		tx, _ := NewReadOnlyTx(db)
+		cursors = append(cursors, tx.Cursor())
+	}
+
+	r := kv.Range{Start: []byte("key-00100"), End: []byte("key-02000")}
+	expect := map[SetOp][]string{}
+	for i := 100; i < 2000; i++ {
+		key := fmt.Sprintf("key-%05d", i)
+		switch {
+		case i%6 == 0:
+			expect[SetUnion] = append(expect[SetUnion], key+"=a/b")
+			expect[SetIntersect] = append(expect[SetIntersect], key+"=a/b")
+		case i%2 == 0:
+			expect[SetUnion] = append(expect[SetUnion], key+"=a/-")
+			expect[SetDifference] = append(expect[SetDifference], key+"=a/-")
+		case i%3 == 0:
+			expect[SetUnion] = append(expect[SetUnion], key+"=-/b")
+		}
+	}
+	a := KeySet{Cursor: cursors[0], Range: r}
+	b := KeySet{Cursor: cursors[1], Range: r}
+	results := map[SetOp]*SetIterator{
+		SetUnion:      Union(a, b),
+		SetIntersect:  Intersect(a, b),
+		SetDifference: Difference(a, b),
+	}
+	for op, it := range results {
+		get := collectSet(it)
+		if fmt.Sprint(get) != fmt.Sprint(expect[op]) {
+			t.Errorf("Op %d: expect %d keys, get %d", op, len(expect[op]), len(get))
+		}
+	}
+
+	// Sets with different ranges
+	b.Range = kv.Range{Start: []byte("key-01000")}
+	get := collectSet(Intersect(a, b))
+	if len(get) != 167 || get[0] != "key-01002=a/b" || get[166] != "key-01998=a/b" {
+		t.Errorf("Bad intersection of different ranges: %d keys", len(get))
+	}
+	get = collectSet(Difference(b, a))
+	if len(get) != 499 || get[0] != "key-01005=b/-" || get[166] != "key-02001=b/-" {
+		t.Errorf("Bad difference of different ranges: %d keys", len(get))
+	}
+
+	// Empty range
+	a.Range = kv.Range{Start: []byte("x"), End: []byte("a")}
+	if get = collectSet(Union(a, a)); len(get) != 0 {
+		t.Errorf("Union of empty sets should be empty, get %v", get)
+	}
+}
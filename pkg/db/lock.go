@@ -0,0 +1,28 @@
+package db
+
+import (
+	"time"
+)
+
+// lockRetryInterval is how often a locked file is polled.
+const lockRetryInterval = 50 * time.Millisecond
+
+// flock takes exclusive lock of DB file, so two DB instances, in one
+// process or not, never write the same file. The lock is released when
+// the file is closed. It waits at most timeout, 0 waits forever.
+func (db *DB) flock(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		locked, err := tryLock(db.osFile())
+		if err != nil {
+			return err
+		}
+		if locked {
+			return nil
+		}
+		if timeout > 0 && time.Now().After(deadline) {
+			return ErrTimeout
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
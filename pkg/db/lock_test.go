@@ -0,0 +1,47 @@
+package db
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestFileLock(t *testing.T) {
+	path := dataPath(t)
+	db, err := Open(Options{Path: path})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+
+	start := time.Now()
+	_, err = Open(Options{Path: path, Timeout: 100 * time.Millisecond})
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("Expect ErrTimeout opening locked file, get %v", err)
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		t.Errorf("Open returns before timeout: %v", time.Since(start))
+	}
+
+	// Waiting Open gets the lock once the holder closes
+	opened := make(chan error, 1)
+	go func() {
+		db2, err := Open(Options{Path: path})
+		if err == nil {
+			err = db2.Close()
+		}
+		opened <- err
+	}()
+	time.Sleep(2 * lockRetryInterval)
+	err = db.Close()
+	if err != nil {
+		t.Fatalf("Failed to close DB: %v", err)
+	}
+	select {
+	case err = <-opened:
+		if err != nil {
+			t.Errorf("Failed to open after close: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for lock")
+	}
+}
@@ -0,0 +1,38 @@
+package db
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+	errorLockViolation      = syscall.Errno(33)
+)
+
+var procLockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+// tryLock takes exclusive lock of f without waiting, returns false when
+// it's held by others. Windows locks are mandatory, so the locked byte
+// is far beyond file end to not block reads and writes.
+func tryLock(f *os.File) (bool, error) {
+	ol := syscall.Overlapped{Offset: ^uint32(0), OffsetHigh: ^uint32(0)}
+	r, _, err := procLockFileEx.Call(
+		f.Fd(),
+		lockfileExclusiveLock|lockfileFailImmediately,
+		0,
+		1,
+		0,
+		uintptr(unsafe.Pointer(&ol)),
+	)
+	if r != 0 {
+		return true, nil
+	}
+	if errors.Is(err, errorLockViolation) {
+		return false, nil
+	}
+	return false, os.NewSyscallError("LockFileEx", err)
+}
@@ -0,0 +1,111 @@
+package db
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// MemoryPath as Options.Path opens an in-memory DB. Pages are kept in
+// heap instead of a file, they are dropped on Close.
+const MemoryPath = ":memory:"
+
+// dbFile is the file DB reads and writes, *os.File or memFile.
+type dbFile interface {
+	io.ReaderAt
+	io.WriterAt
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+// memFile is a file in heap for in-memory DB.
+type memFile struct {
+	// lock makes writes of commit safe with reads of other tx
+	lock sync.RWMutex
+	buf  []byte
+}
+
+// ReadAt implements io.ReaderAt.
+func (f *memFile) ReadAt(b []byte, off int64) (int, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	if off >= int64(len(f.buf)) {
+		return 0, io.EOF
+	}
+	n := copy(b, f.buf[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt implements io.WriterAt, file grows to hold b.
+func (f *memFile) WriteAt(b []byte, off int64) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	end := off + int64(len(b))
+	if end > int64(len(f.buf)) {
+		f.resize(end)
+	}
+	return copy(f.buf[off:], b), nil
+}
+
+// Truncate changes file size.
+func (f *memFile) Truncate(size int64) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.resize(size)
+	return nil
+}
+
+// resize changes buffer size, new bytes are zero.
+func (f *memFile) resize(size int64) {
+	if size <= int64(cap(f.buf)) {
+		old := len(f.buf)
+		f.buf = f.buf[:size]
+		for i := old; i < len(f.buf); i++ {
+			f.buf[i] = 0
+		}
+		return
+	}
+	// Double capacity, so appending pages copies amortized O(1) bytes
+	capacity := 2 * int64(cap(f.buf))
+	if capacity < size {
+		capacity = size
+	}
+	buf := make([]byte, size, capacity)
+	copy(buf, f.buf)
+	f.buf = buf
+}
+
+// Stat returns file info with current size.
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return memFileInfo{size: int64(len(f.buf))}, nil
+}
+
+// Sync does nothing.
+func (f *memFile) Sync() error {
+	return nil
+}
+
+// Close does nothing, buffer is dropped with DB.
+func (f *memFile) Close() error {
+	return nil
+}
+
+// memFileInfo implements os.FileInfo for memFile.
+type memFileInfo struct {
+	size int64
+}
+
+func (fi memFileInfo) Name() string       { return MemoryPath }
+func (fi memFileInfo) Size() int64        { return fi.size }
+func (fi memFileInfo) Mode() os.FileMode  { return 0600 }
+func (fi memFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi memFileInfo) IsDir() bool        { return false }
+func (fi memFileInfo) Sys() interface{}   { return nil }
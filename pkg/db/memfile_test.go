@@ -0,0 +1,44 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestMemFile(t *testing.T) {
+	f := &memFile{}
+	buf := make([]byte, 4)
+	if _, err := f.ReadAt(buf, 0); !errors.Is(err, io.EOF) {
+		t.Errorf("Expect EOF reading empty file, get %v", err)
+	}
+
+	// Write beyond end grows file with zeros
+	if _, err := f.WriteAt([]byte("abcd"), 4); err != nil {
+		t.Fatal(err)
+	}
+	n, err := f.ReadAt(buf, 2)
+	if err != nil || n != 4 || !bytes.Equal(buf, []byte{0, 0, 'a', 'b'}) {
+		t.Errorf("Bad read: %d %v %q", n, err, buf)
+	}
+	n, err = f.ReadAt(buf, 6)
+	if !errors.Is(err, io.EOF) || n != 2 || !bytes.Equal(buf[:n], []byte("cd")) {
+		t.Errorf("Expect short read with EOF, get %d %v %q", n, err, buf[:n])
+	}
+
+	// Shrink then grow again, dropped bytes come back as zeros
+	if err := f.Truncate(5); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(8); err != nil {
+		t.Fatal(err)
+	}
+	fi, _ := f.Stat()
+	if fi.Size() != 8 || fi.Name() != MemoryPath {
+		t.Errorf("Bad file info: %s %d", fi.Name(), fi.Size())
+	}
+	if _, err := f.ReadAt(buf, 4); err != nil || !bytes.Equal(buf, []byte{'a', 0, 0, 0}) {
+		t.Errorf("Bad read after truncate: %v %q", err, buf)
+	}
+}
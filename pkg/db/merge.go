@@ -0,0 +1,167 @@
+package db
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/daicang/mk/pkg/audit"
+	"github.com/daicang/mk/pkg/kv"
+	"github.com/daicang/mk/pkg/tree"
+)
+
+// MergeFunc combines operand into old value of key, old is nil when
+// key is missing. It must not modify or keep old and operand.
+type MergeFunc func(key kv.Key, old, operand kv.Value) (kv.Value, error)
+
+// Merge records operand for key without applying it: the value of key
+// becomes a merge record holding the old value as base and operands in
+// merge order. Reads such as Get, GetReader and cursors fold the record
+// with Options.Merge, and Compact writes folded values, so merging a
+// key n times appends n operands instead of rewriting its value n
+// times. Error of merge function is returned by the reads then, a
+// failed read fails commit like other read errors.
+// It returns ErrNoMergeFunc without Options.Merge.
+//
+// Merge record:
+// base flag | base length uvarint | base | operand length uvarint | operand | ..
+// base flag is 0 without base, and base length and base are omitted.
+func (tx *Tx) Merge(key kv.Key, operand kv.Value) error {
+	err := tx.checkWritable()
+	if err != nil {
+		return err
+	}
+	if tx.db.merge == nil {
+		return ErrNoMergeFunc
+	}
+	if len(key) > MaxKeySize {
+		return ErrKeyTooLarge
+	}
+
+	curr := tx.root
+	for !curr.IsLeaf {
+		curr = tx.getChildAt(curr, curr.ChildIndexFunc(key, tx.db.compare))
+	}
+	found, i := curr.SearchFunc(key, tx.db.compare)
+	var old, record kv.Value
+	switch {
+	case !found:
+		record = appendBytes(kv.Value{0}, operand)
+	case curr.MergeAt(i):
+		old = tx.storedValueAt(curr, i)
+		// old may be in the memory map, copy before appending
+		record = appendBytes(append(kv.Value{}, old...), operand)
+	default:
+		old = tx.storedValueAt(curr, i)
+		record = appendBytes(appendBytes(kv.Value{1}, old), operand)
+	}
+	if tx.readErr != nil {
+		return tx.readErr
+	}
+	if len(record) > MaxValueSize {
+		return ErrValueTooLarge
+	}
+
+	tx.audit(audit.OpMerge, key, operand)
+	tx.version++
+
+	switch {
+	case !found:
+		tx.recordUndo(key, nil)
+	case curr.MergeAt(i):
+		tx.recordMergeUndo(key, old)
+	default:
+		tx.recordUndo(key, old)
+	}
+	setRecord(curr, found, i, key, record)
+	return nil
+}
+
+// setRecord sets key to merge record in leaf n, found and i are result
+// of searching key in n.
+func setRecord(n *tree.Node, found bool, i int, key kv.Key, record kv.Value) {
+	if found {
+		n.SetValueAt(i, record)
+	} else {
+		n.Balanced = false
+		n.InsertKeyValueAt(i, key, record)
+	}
+	n.SetMergeAt(i)
+}
+
+// restoreRecord sets key back to merge record, for RollbackTo.
+func (tx *Tx) restoreRecord(key kv.Key, record kv.Value) error {
+	curr := tx.root
+	for !curr.IsLeaf {
+		curr = tx.getChildAt(curr, curr.ChildIndexFunc(key, tx.db.compare))
+	}
+	if tx.readErr != nil {
+		return tx.readErr
+	}
+	found, i := curr.SearchFunc(key, tx.db.compare)
+	setRecord(curr, found, i, key, record)
+	return nil
+}
+
+// fold returns value of merge record of key, applying its operands to
+// its base with Options.Merge.
+func (tx *Tx) fold(key kv.Key, record kv.Value) (kv.Value, error) {
+	if tx.db.merge == nil {
+		return nil, fmt.Errorf("fold %q: %w", key, ErrNoMergeFunc)
+	}
+	// next reads uvarint length and the following bytes
+	next := func() (kv.Value, bool) {
+		n, size := binary.Uvarint(record)
+		if size <= 0 || n > uint64(len(record)-size) {
+			return nil, false
+		}
+		b := record[size : size+int(n)]
+		record = record[size+int(n):]
+		return b, true
+	}
+	corrupt := fmt.Errorf("%w: bad merge record of %q", ErrInvalidDB, key)
+	if len(record) == 0 || record[0] > 1 {
+		return nil, corrupt
+	}
+	var value kv.Value
+	hasBase := record[0] == 1
+	record = record[1:]
+	if hasBase {
+		var ok bool
+		value, ok = next()
+		if !ok {
+			return nil, corrupt
+		}
+	}
+	for len(record) > 0 {
+		operand, ok := next()
+		if !ok {
+			return nil, corrupt
+		}
+		var err error
+		value, err = tx.db.merge(key, value, operand)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if value == nil {
+		// Keep folded empty value distinguishable from missing key
+		value = kv.Value{}
+	}
+	return value, nil
+}
+
+// MergeAdd is a MergeFunc for counters, it adds operand to old value as
+// 8 byte big-endian uint64, missing value is 0.
+func MergeAdd(key kv.Key, old, operand kv.Value) (kv.Value, error) {
+	if len(operand) != 8 || (old != nil && len(old) != 8) {
+		return nil, fmt.Errorf("merge %q: counter and operand must be 8 bytes, get %d and %d",
+			key, len(old), len(operand))
+	}
+	sum := binary.BigEndian.Uint64(operand)
+	if old != nil {
+		sum += binary.BigEndian.Uint64(old)
+	}
+	value := make(kv.Value, 8)
+	binary.BigEndian.PutUint64(value, sum)
+	return value, nil
+}
@@ -0,0 +1,190 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/daicang/mk/pkg/audit"
+	"github.com/daicang/mk/pkg/kv"
+)
+
+// counter encodes n for MergeAdd.
+func counter(n uint64) kv.Value {
+	v := make(kv.Value, 8)
+	binary.BigEndian.PutUint64(v, n)
+	return v
+}
+
+func TestMerge(t *testing.T) {
+	db, err := Open(Options{Path: dataPath(t), Merge: MergeAdd})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	err = db.Update(func(tx *Tx) error {
+		for i := 0; i < 10; i++ {
+			if err := tx.Merge(kv.Key("hits"), counter(1)); err != nil {
+				return err
+			}
+		}
+		sp, err := tx.Savepoint()
+		if err != nil {
+			return err
+		}
+		if err := tx.Merge(kv.Key("hits"), counter(5)); err != nil {
+			return err
+		}
+		if v := tx.Get(kv.Key("hits")); !bytes.Equal(v, counter(15)) {
+			t.Errorf("Expect merged 15, get %v", v)
+		}
+		return tx.RollbackTo(sp)
+	})
+	if err != nil {
+		t.Fatalf("Failed to merge: %v", err)
+	}
+	err = db.Update(func(tx *Tx) error {
+		return tx.Merge(kv.Key("hits"), counter(3))
+	})
+	if err != nil {
+		t.Fatalf("Failed to merge: %v", err)
+	}
+	expectCounter(t, db, 13)
+	_ = db.View(func(tx *Tx) error {
+		if err := tx.Merge(kv.Key("hits"), counter(1)); !errors.Is(err, ErrTxReadOnly) {
+			t.Errorf("Expect ErrTxReadOnly, get %v", err)
+		}
+		return nil
+	})
+
+	// Error of merge function fails the read, and rolling back keeps
+	// value
+	err = db.Update(func(tx *Tx) error {
+		if err := tx.Merge(kv.Key("hits"), kv.Value("x")); err != nil {
+			t.Errorf("Failed to merge bad operand: %v", err)
+		}
+		_, err := tx.GetRef(kv.Key("hits"))
+		return err
+	})
+	if err == nil {
+		t.Errorf("Expect error reading bad operand")
+	}
+	expectCounter(t, db, 13)
+
+	// Set replaces merge record
+	err = db.Update(func(tx *Tx) error {
+		if err := tx.Merge(kv.Key("hits"), counter(1)); err != nil {
+			return err
+		}
+		old, err := tx.Set(kv.Key("hits"), counter(2))
+		if !bytes.Equal(old, counter(14)) {
+			t.Errorf("Expect old value 14, get %v", old)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Failed to set: %v", err)
+	}
+	expectCounter(t, db, 2)
+}
+
+// expectCounter checks value of key hits is counter n.
+func expectCounter(t *testing.T, db *DB, n uint64) {
+	t.Helper()
+	_ = db.View(func(tx *Tx) error {
+		if v := tx.Get(kv.Key("hits")); !bytes.Equal(v, counter(n)) {
+			t.Errorf("Expect counter %d, get %v", n, v)
+		}
+		return nil
+	})
+}
+
+func TestMergeWithoutFunc(t *testing.T) {
+	db := openDB(t)
+	defer func() { _ = db.Close() }()
+	err := db.Update(func(tx *Tx) error {
+		return tx.Merge(kv.Key("k"), counter(1))
+	})
+	if !errors.Is(err, ErrNoMergeFunc) {
+		t.Errorf("Expect ErrNoMergeFunc, get %v", err)
+	}
+}
+
+// TestMergeRecord checks merges append operands to a record without
+// applying them, and reads and Compact fold the record.
+func TestMergeRecord(t *testing.T) {
+	calls := 0
+	concat := func(key kv.Key, old, operand kv.Value) (kv.Value, error) {
+		calls++
+		return append(append(kv.Value{}, old...), operand...), nil
+	}
+	path := dataPath(t)
+	db, err := Open(Options{Path: path, Merge: concat, ChangefeedPages: 8})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	base := bytes.Repeat([]byte("b"), 3000)
+	fillDB(t, db, map[string]string{"log": string(base)})
+	start := db.meta.txid
+	expect := append(kv.Value{}, base...)
+	for i := 0; i < 20; i++ {
+		operand := kv.Value(fmt.Sprintf("-%d", i))
+		expect = append(expect, operand...)
+		err = db.Update(func(tx *Tx) error {
+			return tx.Merge(kv.Key("log"), operand)
+		})
+		if err != nil {
+			t.Fatalf("Failed to merge: %v", err)
+		}
+	}
+	if calls != 0 {
+		t.Errorf("Expect merges not calling merge function, get %d calls", calls)
+	}
+
+	tx, _ := NewReadOnlyTx(db)
+	curr := tx.root
+	for !curr.IsLeaf {
+		curr = tx.getChildAt(curr, curr.ChildIndex(kv.Key("log")))
+	}
+	found, i := curr.Search(kv.Key("log"))
+	if !found || !curr.MergeAt(i) {
+		t.Fatalf("Expect merge record")
+	}
+	// Base is kept as it is, followed by operands
+	record := tx.storedValueAt(curr, i)
+	if !bytes.HasPrefix(record, appendBytes(kv.Value{1}, base)) {
+		t.Errorf("Expect base at the start of record")
+	}
+	if v := tx.Get(kv.Key("log")); !bytes.Equal(v, expect) || calls != 20 {
+		t.Errorf("Expect folded value after 20 calls, get %d bytes after %d calls", len(v), calls)
+	}
+	_ = tx.Rollback()
+
+	list, err := changes(t, db, start)
+	if err != nil || len(list) != 20 || list[0] != fmt.Sprintf("%d %s log=-0", start+1, audit.OpMerge) {
+		t.Errorf("Expect merge changes, get %q, %v", list, err)
+	}
+
+	// Compact folds records, the copy is read without merge function
+	dstPath := filepath.Join(t.TempDir(), "compact")
+	if err := db.Compact(dstPath); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	dst, err := Open(Options{Path: dstPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = dst.Close() }()
+	_ = dst.View(func(tx *Tx) error {
+		if v := tx.Get(kv.Key("log")); !bytes.Equal(v, expect) {
+			t.Errorf("Expect folded value in compacted file, get %d bytes", len(v))
+		}
+		return nil
+	})
+}
@@ -0,0 +1,113 @@
+package db
+
+import (
+	"bytes"
+	"container/heap"
+
+	"github.com/daicang/mk/pkg/kv"
+)
+
+// MergedCursor iterates several cursors as one key-ordered stream.
+// Each pair is tagged with the index of the cursor it comes from.
+// Equal keys from different cursors are all returned, lower index first.
+// Cursors must order keys the same way, see Options.Compare.
+type MergedCursor struct {
+	cursors []*Cursor
+	heap    mergeHeap
+}
+
+// mergeItem is the current pair of one source cursor.
+type mergeItem struct {
+	source int
+	key    kv.Key
+	value  kv.Value
+}
+
+// mergeHeap orders items by key in the order of cmp.
+type mergeHeap struct {
+	items []mergeItem
+	cmp   kv.CompareFunc
+}
+
+func (h *mergeHeap) Len() int { return len(h.items) }
+
+func (h *mergeHeap) Less(i, j int) bool {
+	c := h.cmp(h.items[i].key, h.items[j].key)
+	if c == 0 {
+		return h.items[i].source < h.items[j].source
+	}
+	return c < 0
+}
+
+func (h *mergeHeap) Swap(i, j int) { h.items[i], h.items[j] = h.items[j], h.items[i] }
+
+func (h *mergeHeap) Push(x interface{}) { h.items = append(h.items, x.(mergeItem)) }
+
+func (h *mergeHeap) Pop() interface{} {
+	old := h.items
+	item := old[len(old)-1]
+	h.items = old[:len(old)-1]
+	return item
+}
+
+// MergeCursors returns merged cursor of given cursors.
+// Cursors may come from different transactions or databases.
+func MergeCursors(cursors ...*Cursor) *MergedCursor {
+	m := &MergedCursor{
+		cursors: cursors,
+		heap:    mergeHeap{cmp: bytes.Compare},
+	}
+	if len(cursors) > 0 {
+		m.heap.cmp = cursors[0].tx.db.compare
+	}
+	return m
+}
+
+// First moves all cursors to their first pair, returns the smallest one.
+// Source is -1 when all cursors are empty.
+func (m *MergedCursor) First() (int, kv.Key, kv.Value) {
+	return m.reset(func(c *Cursor) (kv.Key, kv.Value) { return c.First() })
+}
+
+// Seek moves all cursors to the first pair equal or larger than key.
+func (m *MergedCursor) Seek(key kv.Key) (int, kv.Key, kv.Value) {
+	return m.reset(func(c *Cursor) (kv.Key, kv.Value) { return c.Seek(key) })
+}
+
+// Next returns the next pair in merged order, source is -1 at the end.
+func (m *MergedCursor) Next() (int, kv.Key, kv.Value) {
+	if m.heap.Len() == 0 {
+		return -1, nil, nil
+	}
+	// Advance the source of the current pair
+	top := m.heap.items[0]
+	k, v := m.cursors[top.source].Next()
+	if k == nil {
+		heap.Pop(&m.heap)
+	} else {
+		m.heap.items[0].key = k
+		m.heap.items[0].value = v
+		heap.Fix(&m.heap, 0)
+	}
+	return m.current()
+}
+
+func (m *MergedCursor) reset(move func(c *Cursor) (kv.Key, kv.Value)) (int, kv.Key, kv.Value) {
+	m.heap.items = m.heap.items[:0]
+	for i, c := range m.cursors {
+		k, v := move(c)
+		if k != nil {
+			m.heap.items = append(m.heap.items, mergeItem{source: i, key: k, value: v})
+		}
+	}
+	heap.Init(&m.heap)
+	return m.current()
+}
+
+func (m *MergedCursor) current() (int, kv.Key, kv.Value) {
+	if m.heap.Len() == 0 {
+		return -1, nil, nil
+	}
+	top := m.heap.items[0]
+	return top.source, top.key, top.value
+}
@@ -0,0 +1,56 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+)
+
+func TestMergeCursors(t *testing.T) {
+	// One DB per tenant, keys interleave and partly collide
+	expect := []string{}
+	cursors := []*Cursor{}
+	for tenant := 0; tenant < 3; tenant++ {
+		db := openDB(t)
+		kvs := map[string]string{}
+		for i := tenant; i < 3000; i += tenant + 2 {
+			key := fmt.Sprintf("key-%05d", i)
+			kvs[key] = fmt.Sprint(tenant)
+			expect = append(expect, fmt.Sprintf("%s@%d", key, tenant))
+		}
+		fillDB(t, db, kvs)
+		tx, _ := NewReadOnlyTx(db)
+		cursors = append(cursors, tx.Cursor())
+	}
+	// Plus one empty source
+	emptyTx, _ := NewReadOnlyTx(openDB(t))
+	cursors = append(cursors, emptyTx.Cursor())
+	sort.Strings(expect)
+
+	m := MergeCursors(cursors...)
+	get := []string{}
+	for src, k, v := m.First(); src >= 0; src, k, v = m.Next() {
+		if string(v) != fmt.Sprint(src) {
+			t.Fatalf("Pair %s tagged with source %d has value %s", k, src, v)
+		}
+		get = append(get, fmt.Sprintf("%s@%d", k, src))
+	}
+	if fmt.Sprint(get) != fmt.Sprint(expect) {
+		t.Fatalf("Bad merge: expect %d pairs, get %d", len(expect), len(get))
+	}
+
+	// key-02998 is in all three tenants, they come in source order
+	src, k, _ := m.Seek([]byte("key-02997"))
+	for expect := 0; expect < 3; expect++ {
+		if string(k) != "key-02998" || src != expect {
+			t.Errorf("Expect key-02998@%d, get %s@%d", expect, k, src)
+		}
+		src, k, _ = m.Next()
+	}
+	if src != -1 {
+		t.Errorf("Expect end after last key, get source %d", src)
+	}
+	if src, _, _ = MergeCursors().First(); src != -1 {
+		t.Errorf("Merge of nothing should be empty")
+	}
+}
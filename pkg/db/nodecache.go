@@ -0,0 +1,177 @@
+package db
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/daicang/mk/pkg/common"
+	"github.com/daicang/mk/pkg/kv"
+	"github.com/daicang/mk/pkg/tree"
+)
+
+// nodeOverhead estimates heap bytes of a node besides keys and values.
+const nodeOverhead = 128
+
+// pairOverhead estimates heap bytes of slice headers of one pair.
+const pairOverhead = 56
+
+// nodeCache keeps nodes read by read-only transactions, so hot nodes
+// are decoded once instead of once per tx. Nodes in cache are shared
+// and never modified, writable tx reads its own nodes.
+//
+// A page holds the same node from allocation until it's freed and
+// allocated again, and it's only allocated again when no tx can read
+// the old node, see DB.releasePending. So a node is cached by page id,
+// and dropped when its page is allocated. Nodes read from memory map
+// are dropped when it's replaced, see DB.replaceMmap.
+type nodeCache struct {
+	lock sync.Mutex
+	// lru holds entries, the most recently used at front
+	lru     *list.List
+	entries map[common.Pgid]*list.Element
+	// size is estimated bytes of cached nodes
+	size    int
+	maxSize int
+	// gen increases on clear, nodes read before are not cached
+	gen uint64
+}
+
+// nodeEntry is one cached node.
+type nodeEntry struct {
+	id   common.Pgid
+	node *tree.Node
+	size int
+}
+
+// newNodeCache returns cache of nodes up to maxSize bytes.
+func newNodeCache(maxSize int) *nodeCache {
+	return &nodeCache{
+		lru:     list.New(),
+		entries: map[common.Pgid]*list.Element{},
+		maxSize: maxSize,
+	}
+}
+
+// get returns cached node of page id, nil when it's not cached.
+func (c *nodeCache) get(id common.Pgid) *tree.Node {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.entries[id]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*nodeEntry).node
+}
+
+// generation returns current generation, taken before reading a node
+// to put.
+func (c *nodeCache) generation() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.gen
+}
+
+// put caches node of page id read in generation gen, evicting least
+// recently used nodes over size limit. Nodes larger than the limit or
+// read before the last clear are not cached.
+func (c *nodeCache) put(id common.Pgid, n *tree.Node, gen uint64) {
+	size := nodeSize(n)
+	if size > c.maxSize {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if gen != c.gen {
+		return
+	}
+	if _, ok := c.entries[id]; ok {
+		// Another tx cached the same node
+		return
+	}
+	c.entries[id] = c.lru.PushFront(&nodeEntry{id: id, node: n, size: size})
+	c.size += size
+	for c.size > c.maxSize {
+		c.remove(c.lru.Back())
+	}
+}
+
+// invalidate drops nodes of count pages from id.
+func (c *nodeCache) invalidate(id common.Pgid, count int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for i := 0; i < count; i++ {
+		e, ok := c.entries[id+common.Pgid(i)]
+		if ok {
+			c.remove(e)
+		}
+	}
+}
+
+// clear drops all nodes.
+func (c *nodeCache) clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.lru.Init()
+	c.entries = map[common.Pgid]*list.Element{}
+	c.size = 0
+	c.gen++
+}
+
+// remove drops entry e, caller holds lock.
+func (c *nodeCache) remove(e *list.Element) {
+	entry := c.lru.Remove(e).(*nodeEntry)
+	delete(c.entries, entry.id)
+	c.size -= entry.size
+}
+
+// bytes returns estimated bytes of cached nodes, 0 for nil cache.
+func (c *nodeCache) bytes() int {
+	if c == nil {
+		return 0
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.size
+}
+
+// nodeSize estimates bytes held by node, in heap or memory map. Values
+// in overflow pages of lazy node are not held.
+func nodeSize(n *tree.Node) int {
+	size := nodeOverhead + pairOverhead*n.KeyCount()
+	for i, k := range n.Keys {
+		size += len(k)
+		if n.IsLeaf && !n.Lazy() {
+			size += len(n.Values[i])
+		}
+	}
+	if n.Lazy() {
+		size += n.Size()
+	}
+	return size
+}
+
+// copyNode returns a copy of node n with its own keys and values, for
+// nodes read into page buffers which are reused after tx closes.
+func copyNode(n *tree.Node) *tree.Node {
+	c := &tree.Node{
+		Index:  n.Index,
+		IsLeaf: n.IsLeaf,
+		Keys:   make([]kv.Key, len(n.Keys)),
+		Cids:   append([]common.Pgid(nil), n.Cids...),
+	}
+	for i, k := range n.Keys {
+		c.Keys[i] = append(kv.Key{}, k...)
+	}
+	if n.IsLeaf {
+		c.Values = make([]kv.Value, len(n.Values))
+		for i, v := range n.Values {
+			c.Values[i] = append(kv.Value{}, v...)
+		}
+		c.Merged = append([]bool(nil), n.Merged...)
+	}
+	if len(c.Keys) > 0 {
+		c.Key = c.Keys[0]
+	}
+	return c
+}
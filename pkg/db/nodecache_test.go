@@ -0,0 +1,139 @@
+package db
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/daicang/mk/pkg/common"
+	"github.com/daicang/mk/pkg/kv"
+	"github.com/daicang/mk/pkg/tree"
+)
+
+func TestNodeCacheLRU(t *testing.T) {
+	leaf := func(key string) *tree.Node {
+		return &tree.Node{IsLeaf: true, Keys: []kv.Key{kv.Key(key)}, Values: []kv.Value{kv.Value("v")}}
+	}
+	size := nodeSize(leaf("a"))
+	c := newNodeCache(2 * size)
+	c.put(1, leaf("a"), 0)
+	c.put(2, leaf("b"), 0)
+	// Page 1 is used, page 2 is evicted for page 3
+	if c.get(1) == nil {
+		t.Fatal("Expect page 1 cached")
+	}
+	c.put(3, leaf("c"), 0)
+	if c.get(2) != nil || c.get(1) == nil || c.get(3) == nil {
+		t.Error("Expect least recently used page 2 evicted")
+	}
+	if c.bytes() != 2*size {
+		t.Errorf("Expect %d bytes, get %d", 2*size, c.bytes())
+	}
+	c.invalidate(common.Pgid(1), 3)
+	if c.get(1) != nil || c.get(3) != nil || c.bytes() != 0 {
+		t.Error("Expect invalidated pages dropped")
+	}
+	// Nodes read before clear are not cached
+	gen := c.generation()
+	c.put(1, leaf("a"), gen)
+	c.clear()
+	c.put(2, leaf("b"), gen)
+	if c.get(1) != nil || c.get(2) != nil || c.bytes() != 0 {
+		t.Error("Expect nodes dropped by clear and stale node not cached")
+	}
+	// Nodes over the budget are not cached
+	c = newNodeCache(size - 1)
+	c.put(1, leaf("a"), 0)
+	if c.get(1) != nil {
+		t.Error("Expect node larger than cache not cached")
+	}
+}
+
+func TestNodeCache(t *testing.T) {
+	for _, noMmap := range []bool{false, true} {
+		db, err := Open(Options{Path: dataPath(t), NodeCacheSize: 256 << 10, NoMmap: noMmap})
+		if err != nil {
+			t.Fatalf("Failed to open DB: %v", err)
+		}
+		// Rewriting values reuses pages of cached nodes
+		for round := 0; round < 5; round++ {
+			kvs := map[string]string{}
+			for i := 0; i < 2000; i++ {
+				kvs[fmt.Sprintf("key-%04d", i)] = fmt.Sprintf("value-%d-%d", round, i)
+			}
+			fillDB(t, db, kvs)
+			for view := 0; view < 2; view++ {
+				checkPairs(t, db, kvs)
+			}
+		}
+		s := db.Stats()
+		if s.TxStats.SharedCacheHits == 0 || s.NodeCacheBytes == 0 || s.NodeCacheBytes > 256<<10 {
+			t.Errorf("Expect shared hits within budget, get %d hits of %d bytes",
+				s.TxStats.SharedCacheHits, s.NodeCacheBytes)
+		}
+		_ = db.Close()
+	}
+}
+
+func TestNodeCacheCursor(t *testing.T) {
+	db, err := Open(Options{Path: dataPath(t), NodeCacheSize: 1 << 20})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+	kvs := map[string]string{}
+	for i := 0; i < 2000; i++ {
+		kvs[fmt.Sprintf("key-%04d", i)] = fmt.Sprintf("value-%d", i)
+	}
+	fillDB(t, db, kvs)
+	checkPairs(t, db, kvs)
+
+	// Cursor, range and analyze descents read nodes cached by the
+	// first scan
+	tx, _ := NewReadOnlyTx(db)
+	defer func() { _ = tx.Rollback() }()
+	c := tx.Cursor()
+	count := 0
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		count++
+	}
+	if count != len(kvs) {
+		t.Errorf("Expect %d pairs from cursor, get %d", len(kvs), count)
+	}
+	if n := tx.CountRange(nil, nil); n != len(kvs) {
+		t.Errorf("Expect %d keys, get %d", len(kvs), n)
+	}
+	tx.Analyze()
+	if tx.stats.NodeCacheMisses != 0 || tx.stats.SharedCacheHits < 2 {
+		t.Errorf("Expect nodes from cache, get %d misses, %d hits",
+			tx.stats.NodeCacheMisses, tx.stats.SharedCacheHits)
+	}
+}
+
+func TestNodeCacheConcurrent(t *testing.T) {
+	db, err := Open(Options{Path: dataPath(t), NodeCacheSize: 1 << 20})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+	fillDB(t, db, map[string]string{"a": "0"})
+	wg := sync.WaitGroup{}
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				_ = db.View(func(tx *Tx) error {
+					if tx.Get(kv.Key("a")) == nil {
+						t.Error("Key a not found")
+					}
+					return nil
+				})
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		fillDB(t, db, map[string]string{"a": fmt.Sprint(i), fmt.Sprintf("k%d", i): "v"})
+	}
+	wg.Wait()
+}
@@ -0,0 +1,8 @@
+//go:build !race
+// +build !race
+
+package db
+
+// raceEnabled is whether tests run with the race detector, under which
+// sync.Pool drops buffers at random.
+const raceEnabled = false
@@ -0,0 +1,271 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/go-logr/logr"
+
+	"github.com/daicang/mk/pkg/audit"
+	"github.com/daicang/mk/pkg/common"
+	"github.com/daicang/mk/pkg/freelist"
+	"github.com/daicang/mk/pkg/tree"
+)
+
+var (
+	// ErrInvalidOption is returned for option value out of range.
+	ErrInvalidOption = errors.New("invalid option")
+)
+
+// Validate applies defaults and returns error naming the first invalid
+// field. Open validates options, so calling it is only needed to check
+// options early.
+//
+// Defaults: Durability is DurabilitySync, or DurabilityNone with NoSync.
+// MaxBatchSize and MaxBatchDelay are DefaultMaxBatchSize and
+// DefaultMaxBatchDelay. InitialMmapSize is common.MmapMinSize, and
+// MaxMmapSize is common.MmapMaxSize, which is also its upper bound.
+// WALCheckpointSize is DefaultWALCheckpointSize with WAL. FillPercent
+// is tree.DefaultFillPercent. Logger is logr.Discard().
+func (o *Options) Validate() error {
+	if o.Path == "" {
+		return fmt.Errorf("%w: Path is empty", ErrInvalidOption)
+	}
+	if o.AuditSegmentSize != 0 && o.AuditDir == "" {
+		return fmt.Errorf("%w: AuditSegmentSize is set without AuditDir", ErrInvalidOption)
+	}
+	if o.Timeout < 0 {
+		return fmt.Errorf("%w: Timeout %v is negative", ErrInvalidOption, o.Timeout)
+	}
+	if o.MaxBatchSize < 0 {
+		return fmt.Errorf("%w: MaxBatchSize %d is negative", ErrInvalidOption, o.MaxBatchSize)
+	}
+	if o.MaxBatchDelay < 0 {
+		return fmt.Errorf("%w: MaxBatchDelay %v is negative", ErrInvalidOption, o.MaxBatchDelay)
+	}
+	if o.Path == MemoryPath {
+		if o.WritableMmap {
+			return fmt.Errorf("%w: WritableMmap is set for in-memory DB", ErrInvalidOption)
+		}
+		if o.Mlock {
+			return fmt.Errorf("%w: Mlock is set for in-memory DB", ErrInvalidOption)
+		}
+		if o.WAL {
+			return fmt.Errorf("%w: WAL is set for in-memory DB", ErrInvalidOption)
+		}
+		o.NoMmap = true
+	}
+	if len(o.EncryptionKey) > 0 {
+		switch len(o.EncryptionKey) {
+		case 16, 24, 32:
+		default:
+			return fmt.Errorf("%w: EncryptionKey is %d bytes, not 16, 24 or 32", ErrInvalidOption, len(o.EncryptionKey))
+		}
+		if o.WritableMmap {
+			return fmt.Errorf("%w: EncryptionKey is set with WritableMmap", ErrInvalidOption)
+		}
+		if o.Mlock {
+			return fmt.Errorf("%w: EncryptionKey is set with Mlock", ErrInvalidOption)
+		}
+		if o.WAL {
+			return fmt.Errorf("%w: EncryptionKey is set with WAL", ErrInvalidOption)
+		}
+		o.NoMmap = true
+	}
+	if o.NoMmap && o.WritableMmap {
+		return fmt.Errorf("%w: NoMmap is set with WritableMmap", ErrInvalidOption)
+	}
+	if o.NoMmap && o.Mlock {
+		return fmt.Errorf("%w: NoMmap is set with Mlock", ErrInvalidOption)
+	}
+	if o.ODirect {
+		if o.Path == MemoryPath {
+			return fmt.Errorf("%w: ODirect is set for in-memory DB", ErrInvalidOption)
+		}
+		if o.WritableMmap {
+			return fmt.Errorf("%w: ODirect is set with WritableMmap", ErrInvalidOption)
+		}
+		if len(o.EncryptionKey) > 0 {
+			return fmt.Errorf("%w: ODirect is set with EncryptionKey", ErrInvalidOption)
+		}
+	}
+	if o.WAL && o.WritableMmap {
+		return fmt.Errorf("%w: WAL is set with WritableMmap", ErrInvalidOption)
+	}
+	if o.WALCheckpointSize < 0 {
+		return fmt.Errorf("%w: WALCheckpointSize %d is negative", ErrInvalidOption, o.WALCheckpointSize)
+	}
+	if o.WALCheckpointSize != 0 && !o.WAL {
+		return fmt.Errorf("%w: WALCheckpointSize is set without WAL", ErrInvalidOption)
+	}
+	if o.WAL && o.WALCheckpointSize == 0 {
+		o.WALCheckpointSize = DefaultWALCheckpointSize
+	}
+	if o.Logger.GetSink() == nil {
+		o.Logger = logr.Discard()
+	}
+	if (o.Compare == nil) != (o.CompareName == "") {
+		return fmt.Errorf("%w: Compare and CompareName must be set together", ErrInvalidOption)
+	}
+	if len(o.CompareName) > ComparatorNameSize {
+		return fmt.Errorf("%w: CompareName is longer than %d bytes", ErrInvalidOption, ComparatorNameSize)
+	}
+	if o.Compression < CompressionNone || o.Compression > CompressionFlate {
+		return fmt.Errorf("%w: Compression %d", ErrInvalidOption, o.Compression)
+	}
+	if o.CompressionThreshold < 0 {
+		return fmt.Errorf("%w: CompressionThreshold %d is negative", ErrInvalidOption, o.CompressionThreshold)
+	}
+	if o.FreelistType < freelist.TypeArray || o.FreelistType > freelist.TypeHashmap {
+		return fmt.Errorf("%w: FreelistType %d", ErrInvalidOption, o.FreelistType)
+	}
+	if o.FillPercent == 0 {
+		o.FillPercent = tree.DefaultFillPercent
+	}
+	if o.FillPercent < tree.MinFillPercent || o.FillPercent > tree.MaxFillPercent {
+		return fmt.Errorf("%w: FillPercent %v out of [%v, %v]", ErrInvalidOption,
+			o.FillPercent, tree.MinFillPercent, tree.MaxFillPercent)
+	}
+	if o.NodeCacheSize < 0 {
+		return fmt.Errorf("%w: NodeCacheSize %d is negative", ErrInvalidOption, o.NodeCacheSize)
+	}
+	if o.ChangefeedPages < 0 {
+		return fmt.Errorf("%w: ChangefeedPages %d is negative", ErrInvalidOption, o.ChangefeedPages)
+	}
+	if o.MaxTxDuration < 0 {
+		return fmt.Errorf("%w: MaxTxDuration %v is negative", ErrInvalidOption, o.MaxTxDuration)
+	}
+	if o.MmapAdvise < AdviceNormal || o.MmapAdvise > AdviceSequential {
+		return fmt.Errorf("%w: MmapAdvise %d", ErrInvalidOption, o.MmapAdvise)
+	}
+	if o.GrowthStep < 0 {
+		return fmt.Errorf("%w: GrowthStep %d is negative", ErrInvalidOption, o.GrowthStep)
+	}
+	if o.MaxMmapSize < 0 || o.MaxMmapSize > common.MmapMaxSize {
+		return fmt.Errorf("%w: MaxMmapSize %d out of [0, %d]", ErrInvalidOption, o.MaxMmapSize, common.MmapMaxSize)
+	}
+	if o.MaxMmapSize == 0 {
+		o.MaxMmapSize = common.MmapMaxSize
+	}
+	if o.InitialMmapSize < 0 || o.InitialMmapSize > o.MaxMmapSize {
+		return fmt.Errorf("%w: InitialMmapSize %d out of [0, %d]", ErrInvalidOption, o.InitialMmapSize, o.MaxMmapSize)
+	}
+	if o.InitialMmapSize == 0 {
+		o.InitialMmapSize = common.MmapMinSize
+		if o.InitialMmapSize > o.MaxMmapSize {
+			o.InitialMmapSize = o.MaxMmapSize
+		}
+	}
+	err := o.runtime().validate()
+	if err != nil {
+		return err
+	}
+	if o.NoSync {
+		if o.Durability == DurabilitySync {
+			return fmt.Errorf("%w: NoSync is set with Durability sync", ErrInvalidOption)
+		}
+		o.Durability = DurabilityNone
+	}
+	if o.Durability == DurabilityDefault {
+		o.Durability = DurabilitySync
+	}
+	if o.MaxBatchSize == 0 {
+		o.MaxBatchSize = DefaultMaxBatchSize
+	}
+	if o.MaxBatchDelay == 0 {
+		o.MaxBatchDelay = DefaultMaxBatchDelay
+	}
+	return nil
+}
+
+// runtime returns the part of options which can change at runtime.
+func (o *Options) runtime() RuntimeOptions {
+	return RuntimeOptions{
+		Durability:       o.Durability,
+		ExtentPages:      o.ExtentPages,
+		AuditSegmentSize: o.AuditSegmentSize,
+	}
+}
+
+// RuntimeOptions are options which can be changed while DB is open.
+// See Options for their meaning.
+type RuntimeOptions struct {
+	Durability       Durability
+	ExtentPages      int
+	AuditSegmentSize int64
+}
+
+// validate returns error naming the first invalid field.
+func (o RuntimeOptions) validate() error {
+	if o.Durability < DurabilityDefault || o.Durability > DurabilityNone {
+		return fmt.Errorf("%w: Durability %d", ErrInvalidOption, o.Durability)
+	}
+	if o.ExtentPages < 0 {
+		return fmt.Errorf("%w: ExtentPages %d is negative", ErrInvalidOption, o.ExtentPages)
+	}
+	if o.AuditSegmentSize < 0 {
+		return fmt.Errorf("%w: AuditSegmentSize %d is negative", ErrInvalidOption, o.AuditSegmentSize)
+	}
+	return nil
+}
+
+// RuntimeOptions returns current runtime options.
+func (db *DB) RuntimeOptions() RuntimeOptions {
+	db.metalock.Lock()
+	defer db.metalock.Unlock()
+	return RuntimeOptions{
+		Durability:       db.durability,
+		ExtentPages:      db.extentPages,
+		AuditSegmentSize: db.auditSegmentSize,
+	}
+}
+
+// SetOptions validates and applies runtime options, usually modified
+// from RuntimeOptions. Changes take effect from the next commit, each
+// change is logged and written to audit log when enabled.
+// SetOptions waits for the writable tx to close, so it must not be
+// called from a goroutine holding one.
+func (db *DB) SetOptions(opts RuntimeOptions) error {
+	err := opts.validate()
+	if err != nil {
+		return err
+	}
+	// Writable tx reads options without metalock, holding rwlock
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	db.metalock.Lock()
+	if db.state == stateClosed {
+		db.metalock.Unlock()
+		return ErrDBClosed
+	}
+	old := RuntimeOptions{
+		Durability:       db.durability,
+		ExtentPages:      db.extentPages,
+		AuditSegmentSize: db.auditSegmentSize,
+	}
+	records := []audit.Record{}
+	changed := func(name string, from, to interface{}) {
+		db.logger.Info("option changed", "name", name, "from", from, "to", to)
+		records = append(records, audit.NewOptionRecord(db.meta.txid, name, from, to))
+	}
+	if opts.Durability != old.Durability {
+		db.durability = opts.Durability
+		changed("Durability", old.Durability, opts.Durability)
+	}
+	if opts.ExtentPages != old.ExtentPages {
+		db.extentPages = opts.ExtentPages
+		changed("ExtentPages", old.ExtentPages, opts.ExtentPages)
+	}
+	if opts.AuditSegmentSize != old.AuditSegmentSize {
+		db.auditSegmentSize = opts.AuditSegmentSize
+		if db.audit != nil {
+			db.audit.SetMaxSize(opts.AuditSegmentSize)
+		}
+		changed("AuditSegmentSize", old.AuditSegmentSize, opts.AuditSegmentSize)
+	}
+	db.metalock.Unlock()
+	if db.audit != nil {
+		return db.audit.Append(records)
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/daicang/mk/pkg/audit"
+	"github.com/daicang/mk/pkg/common"
+	"github.com/daicang/mk/pkg/log"
+)
+
+func TestSetOptions(t *testing.T) {
+	dir := t.TempDir()
+	logs := bytes.Buffer{}
+	db, err := Open(Options{
+		Path:     filepath.Join(dir, "data"),
+		AuditDir: filepath.Join(dir, "audit"),
+		Logger:   log.New(log.Options{Output: &logs, Level: log.LevelInfo}).Logr(),
+	})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	fillDB(t, db, map[string]string{"a": "1"})
+
+	for _, bad := range []RuntimeOptions{
+		{Durability: DurabilityNone + 1},
+		{ExtentPages: -1},
+		{AuditSegmentSize: -1},
+	} {
+		err := db.SetOptions(bad)
+		if !errors.Is(err, ErrInvalidOption) {
+			t.Errorf("Options %+v: expect invalid option, get %v", bad, err)
+		}
+	}
+	if db.RuntimeOptions() != (RuntimeOptions{Durability: DurabilitySync}) {
+		t.Errorf("Invalid options should not be applied, get %+v", db.RuntimeOptions())
+	}
+
+	opts := db.RuntimeOptions()
+	opts.Durability = DurabilityNone
+	opts.ExtentPages = 32
+	err = db.SetOptions(opts)
+	if err != nil {
+		t.Fatalf("Failed to set options: %v", err)
+	}
+	if db.RuntimeOptions() != opts {
+		t.Errorf("Expect options %+v, get %+v", opts, db.RuntimeOptions())
+	}
+	if !strings.Contains(logs.String(), "option changed name=ExtentPages") {
+		t.Errorf("Expect option change logged, get %q", logs.String())
+	}
+	// Unchanged options are not recorded
+	err = db.SetOptions(opts)
+	if err != nil {
+		t.Fatalf("Failed to set options: %v", err)
+	}
+
+	durable := db.DurableTxID()
+	fillDB(t, db, map[string]string{"b": "2"})
+	if db.DurableTxID() != durable {
+		t.Errorf("Commit after switching to no sync moved durable id")
+	}
+
+	records := []string{}
+	err = audit.Read(filepath.Join(dir, "audit"), func(r audit.Record) error {
+		records = append(records, fmt.Sprintf("%d %s %s %s", r.TxID, r.Op, r.Key, r.Detail))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to read audit log: %v", err)
+	}
+	expect := "1 set a ,1 option Durability sync -> none,1 option ExtentPages 0 -> 32,2 set b "
+	if strings.Join(records, ",") != expect {
+		t.Errorf("Expect audit records %q, get %q", expect, records)
+	}
+}
+
+func TestValidateOptions(t *testing.T) {
+	opts := Options{Path: "data"}
+	err := opts.Validate()
+	if err != nil {
+		t.Fatalf("Expect valid options, get %v", err)
+	}
+	if opts.Durability != DurabilitySync {
+		t.Errorf("Expect default durability sync, get %s", opts.Durability)
+	}
+	if opts.InitialMmapSize != common.MmapMinSize || opts.MaxMmapSize != common.MmapMaxSize {
+		t.Errorf("Bad default mmap sizes %d, %d", opts.InitialMmapSize, opts.MaxMmapSize)
+	}
+	if opts.Logger.GetSink() == nil || opts.Logger.Enabled() {
+		t.Errorf("Expect default logger discarding messages")
+	}
+	opts = Options{Path: "data", WAL: true}
+	if err := opts.Validate(); err != nil || opts.WALCheckpointSize != DefaultWALCheckpointSize {
+		t.Errorf("Bad default WAL checkpoint size %d, %v", opts.WALCheckpointSize, err)
+	}
+
+	for field, bad := range map[string]Options{
+		"Path":              {},
+		"AuditSegmentSize":  {Path: "data", AuditSegmentSize: 1024},
+		"Durability":        {Path: "data", Durability: -1},
+		"ExtentPages":       {Path: "data", ExtentPages: -1},
+		"NoSync":            {Path: "data", NoSync: true, Durability: DurabilitySync},
+		"MaxBatchSize":      {Path: "data", MaxBatchSize: -1},
+		"MaxBatchDelay":     {Path: "data", MaxBatchDelay: -1},
+		"GrowthStep":        {Path: "data", GrowthStep: -1},
+		"MmapAdvise":        {Path: "data", MmapAdvise: -1},
+		"NoMmap":            {Path: "data", NoMmap: true, WritableMmap: true},
+		"Mlock":             {Path: "data", NoMmap: true, Mlock: true},
+		"WAL":               {Path: "data", WAL: true, WritableMmap: true},
+		"WALCheckpointSize": {Path: "data", WALCheckpointSize: 1 << 20},
+		"MaxMmapSize":       {Path: "data", MaxMmapSize: common.MmapMaxSize + 1},
+		"InitialMmapSize":   {Path: "data", InitialMmapSize: 1 << 20, MaxMmapSize: 1 << 19},
+		"ChangefeedPages":   {Path: "data", ChangefeedPages: -1},
+		"Compare":           {Path: "data", CompareName: "reverse"},
+		"Compression":       {Path: "data", Compression: -1},
+		"Threshold":         {Path: "data", CompressionThreshold: -1},
+		"NodeCacheSize":     {Path: "data", NodeCacheSize: -1},
+		"FillPercent":       {Path: "data", FillPercent: 1.5},
+		"FreelistType":      {Path: "data", FreelistType: -1},
+		"EncryptionKey":     {Path: "data", EncryptionKey: []byte("short")},
+		"ODirect":           {Path: MemoryPath, ODirect: true},
+		"ODirect is set":    {Path: "data", ODirect: true, WritableMmap: true},
+		"set with WAL":      {Path: "data", EncryptionKey: make([]byte, 16), WAL: true},
+		"CompareName":       {Path: "data", Compare: bytes.Compare, CompareName: strings.Repeat("x", ComparatorNameSize+1)},
+	} {
+		err := bad.Validate()
+		if !errors.Is(err, ErrInvalidOption) || !strings.Contains(err.Error(), field) {
+			t.Errorf("Expect error naming %s, get %v", field, err)
+		}
+	}
+
+	opts = Options{Path: "data", NoSync: true}
+	err = opts.Validate()
+	if err != nil || opts.Durability != DurabilityNone {
+		t.Errorf("Expect NoSync to set durability none, get %s, %v", opts.Durability, err)
+	}
+
+	if _, err := Open(Options{Path: dataPath(t), ExtentPages: -1}); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("Open should reject invalid options, get %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+package db
+
+import (
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/daicang/mk/pkg/common"
+	"github.com/daicang/mk/pkg/page"
+)
+
+// poolClasses are page counts of pooled buffers, up to extents and
+// nodes of 256 pages. Larger buffers are allocated from heap and not
+// reused.
+var poolClasses = [...]int{1, 2, 4, 8, 16, 32, 64, 128, 256}
+
+// PoolStats counts page buffer requests.
+type PoolStats struct {
+	// Buffers reused from pool
+	Hits uint64
+	// Buffers allocated from heap
+	Misses uint64
+}
+
+// pagePool reuses page buffers by size class.
+// Every buffer in pool is zeroed.
+type pagePool struct {
+	classes [len(poolClasses)]sync.Pool
+	hits    uint64
+	misses  uint64
+}
+
+// classOf returns index of the smallest class holding count pages,
+// -1 when count is larger than all classes.
+func classOf(count int) int {
+	for i, c := range poolClasses {
+		if count <= c {
+			return i
+		}
+	}
+	return -1
+}
+
+// get returns zeroed buffer of count pages.
+func (pp *pagePool) get(count int) []byte {
+	i := classOf(count)
+	if i >= 0 {
+		buf, ok := pp.classes[i].Get().([]byte)
+		if ok {
+			atomic.AddUint64(&pp.hits, 1)
+			return buf[:count*page.PageSize]
+		}
+	}
+	atomic.AddUint64(&pp.misses, 1)
+	size := count
+	if i >= 0 {
+		size = poolClasses[i]
+	}
+	return make([]byte, size*page.PageSize)[:count*page.PageSize]
+}
+
+// put zeroes and returns buffer of page from get.
+func (pp *pagePool) put(p *page.Page) {
+	count := p.Overflow() + 1
+	i := classOf(count)
+	if i < 0 {
+		return
+	}
+	// Buffer of page is as large as its class
+	buf := (*[common.MmapMaxSize]byte)(unsafe.Pointer(p))[:poolClasses[i]*page.PageSize]
+	used := buf[:count*page.PageSize]
+	for j := range used {
+		used[j] = 0
+	}
+	pp.classes[i].Put(buf) // nolint: staticcheck
+}
+
+// stats returns request counts.
+func (pp *pagePool) stats() PoolStats {
+	return PoolStats{
+		Hits:   atomic.LoadUint64(&pp.hits),
+		Misses: atomic.LoadUint64(&pp.misses),
+	}
+}
+
+// PoolStats returns page buffer pool counts.
+func (db *DB) PoolStats() PoolStats {
+	return db.pagePool.stats()
+}
+
+// directAlign is the alignment of buffers, offsets and sizes of
+// O_DIRECT writes, see Options.ODirect.
+const directAlign = 4096
+
+// alignedBuffer returns zeroed buffer of size bytes starting at a
+// multiple of directAlign.
+func alignedBuffer(size int) []byte {
+	buf := make([]byte, size+directAlign)
+	off := (directAlign - int(uintptr(unsafe.Pointer(&buf[0]))%directAlign)) % directAlign
+	return buf[off : off+size : off+size]
+}
@@ -0,0 +1,93 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+	"unsafe"
+
+	"github.com/daicang/mk/pkg/page"
+)
+
+func TestPagePool(t *testing.T) {
+	pp := pagePool{}
+	large := poolClasses[len(poolClasses)-1] + 1
+	for _, count := range []int{1, 3, 8, large} {
+		buf := pp.get(count)
+		if len(buf) != count*page.PageSize {
+			t.Errorf("Get %d pages: buffer size %d", count, len(buf))
+		}
+		p := page.FromBuffer(buf, 0)
+		p.SetOverflow(count - 1)
+		buf[len(buf)-1] = 1
+		pp.put(p)
+	}
+	if s := pp.stats(); s.Hits != 0 || s.Misses != 4 {
+		t.Errorf("Expect 4 misses, get %+v", s)
+	}
+
+	// 3 pages are served by the 4-page class, buffers are zeroed
+	for _, count := range []int{1, 2, 4, 8, large} {
+		buf := pp.get(count)
+		for _, b := range buf {
+			if b != 0 {
+				t.Fatalf("Get %d pages: buffer is not zeroed", count)
+			}
+		}
+	}
+	if raceEnabled {
+		t.Skip("sync.Pool drops buffers at random under the race detector")
+	}
+	// Class 2 and oversized buffers are new
+	if s := pp.stats(); s.Hits != 3 || s.Misses != 6 {
+		t.Errorf("Expect 3 hits and 6 misses, get %+v", s)
+	}
+}
+
+func TestPagePoolReuse(t *testing.T) {
+	db := openDB(t)
+	for i := 0; i < 5; i++ {
+		tx, _ := NewWritableTx(db)
+		// Large values make multi-page nodes
+		mustSet(t, tx, []byte("large"), make([]byte, 2*page.PageSize))
+		mustSet(t, tx, []byte{byte(i)}, []byte("small"))
+		mustCommit(t, tx)
+	}
+	if s := db.PoolStats(); s.Hits == 0 {
+		t.Errorf("Expect page buffers reused, get %+v", s)
+	}
+}
+
+func TestAlignedBuffer(t *testing.T) {
+	for _, size := range []int{page.PageSize, 3 * page.PageSize, maxWriteSize} {
+		buf := alignedBuffer(size)
+		if len(buf) != size || cap(buf) != size {
+			t.Errorf("Expect buffer of %d bytes, get len %d cap %d", size, len(buf), cap(buf))
+		}
+		if addr := uintptr(unsafe.Pointer(&buf[0])); addr%directAlign != 0 {
+			t.Errorf("Buffer at %#x is not aligned", addr)
+		}
+	}
+}
+
+// sink keeps benchmark buffers from being optimized away.
+var sink []byte
+
+func BenchmarkPagePool(b *testing.B) {
+	for _, count := range []int{1, 16, 256} {
+		b.Run(fmt.Sprintf("pool-%d", count), func(b *testing.B) {
+			pp := pagePool{}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				p := page.FromBuffer(pp.get(count), 0)
+				p.SetOverflow(count - 1)
+				pp.put(p)
+			}
+		})
+		b.Run(fmt.Sprintf("make-%d", count), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				sink = make([]byte, count*page.PageSize)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package db
+
+import (
+	"bytes"
+
+	"github.com/daicang/mk/pkg/kv"
+	"github.com/daicang/mk/pkg/tree"
+)
+
+// CountRange returns number of keys in [start, end).
+// Nil start or end means unbounded. Leaves are counted by binary search
+// and stepped through by their parents, values are never read.
+func (tx *Tx) CountRange(start, end kv.Key) int {
+	r := kv.Range{Start: start, End: end}
+	if r.EmptyFunc(tx.db.compare) {
+		return 0
+	}
+	// Path from root to current leaf, with index of child on the path
+	type level struct {
+		node  *tree.Node
+		index int
+	}
+	var path []level
+	n := tx.root
+	for !n.IsLeaf {
+		i := 0
+		if start != nil {
+			i = n.ChildIndexFunc(start, tx.db.compare)
+		}
+		path = append(path, level{node: n, index: i})
+		n = tx.peekNode(n.GetChildID(i), n)
+	}
+	first := 0
+	if start != nil {
+		_, first = n.SearchFunc(start, tx.db.compare)
+	}
+	count := 0
+	for {
+		last := n.KeyCount()
+		if end != nil {
+			_, last = n.SearchFunc(end, tx.db.compare)
+		}
+		if last > first {
+			count += last - first
+		}
+		if last < n.KeyCount() {
+			return count
+		}
+		// Step to the first leaf on the right
+		for len(path) > 0 {
+			top := path[len(path)-1]
+			if top.index < top.node.KeyCount()-1 {
+				break
+			}
+			path = path[:len(path)-1]
+		}
+		if len(path) == 0 {
+			return count
+		}
+		top := &path[len(path)-1]
+		top.index++
+		n = tx.peekNode(top.node.GetChildID(top.index), top.node)
+		for !n.IsLeaf {
+			path = append(path, level{node: n, index: 0})
+			n = tx.peekNode(n.GetChildID(0), n)
+		}
+		first = 0
+	}
+}
+
+// Count returns number of keys, counted by walking all leaves.
+func (tx *Tx) Count() int {
+	return tx.CountRange(nil, nil)
+}
+
+// MinKey returns the smallest pair with given prefix, nil key when not found.
+// Without bytewise order, it scans from the first key, see DB.Bytewise.
+func (tx *Tx) MinKey(prefix kv.Key) (kv.Key, kv.Value) {
+	if !tx.db.Bytewise() {
+		c := tx.Cursor()
+		return scanPrefix(prefix, c.First, c.Next)
+	}
+	k, v := tx.Cursor().Seek(prefix)
+	if k == nil || !bytes.HasPrefix(k, prefix) {
+		return nil, nil
+	}
+	return k, v
+}
+
+// MaxKey returns the largest pair with given prefix, nil key when not found.
+// It descends towards the prefix end instead of scanning the prefix.
+// Without bytewise order, it scans from the last key, see DB.Bytewise.
+func (tx *Tx) MaxKey(prefix kv.Key) (kv.Key, kv.Value) {
+	if !tx.db.Bytewise() {
+		c := tx.Cursor()
+		return scanPrefix(prefix, c.Last, c.Prev)
+	}
+	k, v := tx.lastBelow(tx.root, kv.PrefixEnd(prefix))
+	if k == nil || tx.readErr != nil || !bytes.HasPrefix(k, prefix) {
+		return nil, nil
+	}
+	return k, v
+}
+
+// scanPrefix returns the first pair with prefix from start moving by
+// move, nil key when not found.
+func scanPrefix(prefix kv.Key, start, move func() (kv.Key, kv.Value)) (kv.Key, kv.Value) {
+	for k, v := start(); k != nil; k, v = move() {
+		if bytes.HasPrefix(k, prefix) {
+			return k, v
+		}
+	}
+	return nil, nil
+}
+
+// lastBelow returns the largest pair under n with key < end,
+// nil end means no upper bound.
+func (tx *Tx) lastBelow(n *tree.Node, end kv.Key) (kv.Key, kv.Value) {
+	// i is index of the last key < end
+	i := n.KeyCount() - 1
+	if end != nil {
+		_, i = n.SearchFunc(end, tx.db.compare)
+		i--
+	}
+	if n.IsLeaf {
+		if i < 0 {
+			return nil, nil
+		}
+		return n.GetKeyAt(i), tx.valueAt(n, i)
+	}
+	// Children may be emptied by the tx, fall back to left siblings
+	for ; i >= 0; i-- {
+		k, v := tx.lastBelow(tx.peekNode(n.GetChildID(i), n), end)
+		if k != nil {
+			return k, v
+		}
+	}
+	return nil, nil
+}
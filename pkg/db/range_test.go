@@ -0,0 +1,154 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/daicang/mk/pkg/page"
+	"github.com/daicang/mk/pkg/testutil"
+	"github.com/daicang/mk/pkg/tree"
+)
+
+func TestCountRange(t *testing.T) {
+	db := openDB(t)
+	tx, _ := NewReadOnlyTx(db)
+	if n := tx.CountRange(nil, nil); n != 0 {
+		t.Errorf("Empty DB should count 0, get %d", n)
+	}
+
+	kvs := map[string]string{}
+	for i := 0; i < 10000; i += 2 {
+		kvs[fmt.Sprintf("key-%05d", i)] = "value"
+	}
+	fillDB(t, db, kvs)
+
+	tx, _ = NewWritableTx(db)
+	cases := []struct {
+		start, end string
+		expect     int
+	}{
+		{"", "", 5000},
+		{"key-00000", "key-00010", 5},
+		{"key-00001", "key-00011", 5},
+		{"key-01000", "", 4500},
+		{"", "key-01000", 500},
+		{"key-05000", "key-05000", 0},
+		{"key-06000", "key-05000", 0},
+		{"key-99999", "", 0},
+		{"a", "b", 0},
+	}
+	for _, c := range cases {
+		var start, end []byte
+		if c.start != "" {
+			start = []byte(c.start)
+		}
+		if c.end != "" {
+			end = []byte(c.end)
+		}
+		if n := tx.CountRange(start, end); n != c.expect {
+			t.Errorf("CountRange(%q, %q): expect %d, get %d", c.start, c.end, c.expect, n)
+		}
+	}
+
+	// Uncommitted changes are counted
+	for i := 1; i < 1000; i += 2 {
+		mustSet(t, tx, []byte(fmt.Sprintf("key-%05d", i)), []byte("new"))
+	}
+	for i := 1000; i < 3000; i += 2 {
+		mustRemove(t, tx, []byte(fmt.Sprintf("key-%05d", i)))
+	}
+	if n := tx.CountRange(nil, nil); n != 4500 {
+		t.Errorf("Expect 4500 keys in tx, get %d", n)
+	}
+	if n := tx.CountRange([]byte("key-00500"), []byte("key-03010")); n != 505 {
+		t.Errorf("Expect 505 keys in range, get %d", n)
+	}
+}
+
+func TestMinMaxKey(t *testing.T) {
+	db := openDB(t)
+	tx, _ := NewReadOnlyTx(db)
+	if k, _ := tx.MaxKey(nil); k != nil {
+		t.Errorf("Empty DB should have no max key, get %s", k)
+	}
+
+	kvs := map[string]string{}
+	for _, ns := range []string{"a", "b", "c"} {
+		for i := 0; i < 2000; i++ {
+			kvs[fmt.Sprintf("%s/%05d", ns, i)] = fmt.Sprint(i)
+		}
+	}
+	fillDB(t, db, kvs)
+
+	tx, _ = NewWritableTx(db)
+	cases := []struct {
+		prefix   string
+		min, max string
+	}{
+		{"", "a/00000", "c/01999"},
+		{"a/", "a/00000", "a/01999"},
+		{"b/", "b/00000", "b/01999"},
+		{"b/001", "b/00100", "b/00199"},
+		{"c/01999", "c/01999", "c/01999"},
+		{"d", "", ""},
+		{"b/5", "", ""},
+		{"\xff", "", ""},
+	}
+	for _, c := range cases {
+		k, _ := tx.MinKey([]byte(c.prefix))
+		if string(k) != c.min {
+			t.Errorf("MinKey(%q): expect %q, get %q", c.prefix, c.min, k)
+		}
+		k, v := tx.MaxKey([]byte(c.prefix))
+		if string(k) != c.max {
+			t.Errorf("MaxKey(%q): expect %q, get %q", c.prefix, c.max, k)
+		}
+		if k != nil && string(v) != kvs[c.max] {
+			t.Errorf("MaxKey(%q): expect value %q, get %q", c.prefix, kvs[c.max], v)
+		}
+	}
+
+	// Empty the tail of namespace b, max key comes from earlier leaves
+	for i := 100; i < 2000; i++ {
+		mustRemove(t, tx, []byte(fmt.Sprintf("b/%05d", i)))
+	}
+	if k, _ := tx.MaxKey([]byte("b/")); string(k) != "b/00099" {
+		t.Errorf("Expect b/00099 after removal, get %s", k)
+	}
+	if k, _ := tx.MinKey([]byte("b/01")); k != nil {
+		t.Errorf("Expect no key with removed prefix, get %s", k)
+	}
+}
+
+func TestCountRangeNoValues(t *testing.T) {
+	db, err := Open(Options{Path: dataPath(t), Compression: CompressionFlate})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+	kvs := map[string]string{}
+	for i := 0; i < 200; i++ {
+		kvs[fmt.Sprintf("key-%05d", i)] = strings.Repeat("v", 2*page.PageSize)
+	}
+	for i := 0; i < 200; i++ {
+		kvs[fmt.Sprintf("raw-%05d", i)] = string(testutil.RandomByteArray(2 * page.PageSize))
+	}
+	fillDB(t, db, kvs)
+
+	tx, _ := NewReadOnlyTx(db)
+	defer func() { _ = tx.Rollback() }()
+	if n := tx.CountRange(nil, nil); n != 400 {
+		t.Errorf("Expect 400 keys, get %d", n)
+	}
+	if n := tx.CountRange([]byte("key-00050"), []byte("raw-00050")); n != 200 {
+		t.Errorf("Expect 200 keys in range, get %d", n)
+	}
+	// No overflow page is read
+	read := len(tx.readPages)
+	nodes := 0
+	tx.forEachNode(func(*tree.Node, int) { nodes++ })
+	if read > nodes {
+		t.Errorf("Expect at most %d tree pages read, get %d", nodes, read)
+	}
+}
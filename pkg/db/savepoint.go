@@ -0,0 +1,120 @@
+package db
+
+import (
+	"github.com/daicang/mk/pkg/kv"
+)
+
+// Savepoint marks a state of writable tx, see Tx.RollbackTo.
+type Savepoint struct {
+	tx *Tx
+	id uint64
+	// undo, mutations and changes are lengths of tx logs at the savepoint
+	undo        int
+	mutations   int
+	changes     int
+	changeCount int
+	sequence    uint64
+}
+
+// undoEntry reverts one change: key is set back to value, or removed
+// when value is nil.
+type undoEntry struct {
+	key   kv.Key
+	value kv.Value
+	// merge marks value a merge record, see Tx.Merge
+	merge bool
+}
+
+// Savepoint returns a savepoint at current state of writable tx, so a
+// group of changes after it can be reverted by RollbackTo without
+// rolling back the whole tx. Changes are logged for undo from the first
+// savepoint until tx is closed.
+func (tx *Tx) Savepoint() (*Savepoint, error) {
+	err := tx.checkWritable()
+	if err != nil {
+		return nil, err
+	}
+	tx.lastSavepoint++
+	sp := &Savepoint{
+		tx:        tx,
+		id:        tx.lastSavepoint,
+		undo:      len(tx.undo),
+		mutations: len(tx.mutations),
+		sequence:  tx.meta.sequence,
+
+		changes:     len(tx.changes),
+		changeCount: tx.changeCount,
+	}
+	tx.savepoints = append(tx.savepoints, sp.id)
+	return sp, nil
+}
+
+// RollbackTo reverts changes made after sp, including NextSequence
+// calls. sp stays valid, savepoints made after it are discarded and
+// return ErrInvalidSavepoint.
+func (tx *Tx) RollbackTo(sp *Savepoint) error {
+	err := tx.checkWritable()
+	if err != nil {
+		return err
+	}
+	if sp.tx != tx {
+		return ErrInvalidSavepoint
+	}
+	n := len(tx.savepoints)
+	for n > 0 && tx.savepoints[n-1] != sp.id {
+		n--
+	}
+	if n == 0 {
+		return ErrInvalidSavepoint
+	}
+	tx.savepoints = tx.savepoints[:n]
+
+	// Revert in reverse order, reverting logs more entries which are
+	// dropped after
+	entries := append([]undoEntry{}, tx.undo[sp.undo:]...)
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		switch {
+		case e.value == nil:
+			_, err = tx.Remove(e.key)
+		case e.merge:
+			err = tx.restoreRecord(e.key, e.value)
+		default:
+			_, err = tx.Set(e.key, e.value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	tx.undo = tx.undo[:sp.undo]
+	tx.mutations = tx.mutations[:sp.mutations]
+	tx.changes = tx.changes[:sp.changes]
+	tx.changeCount = sp.changeCount
+	tx.meta.sequence = sp.sequence
+	return nil
+}
+
+// recordUndo logs how to revert a change of key when there's a
+// savepoint, value is the old value, nil when key didn't exist.
+func (tx *Tx) recordUndo(key kv.Key, value kv.Value) {
+	if len(tx.savepoints) == 0 {
+		return
+	}
+	tx.undo = append(tx.undo, undoEntry{
+		key:   append(kv.Key{}, key...),
+		value: value,
+	})
+}
+
+// recordMergeUndo is recordUndo for key whose old value is a merge
+// record.
+func (tx *Tx) recordMergeUndo(key kv.Key, record kv.Value) {
+	if len(tx.savepoints) == 0 {
+		return
+	}
+	tx.undo = append(tx.undo, undoEntry{
+		key:   append(kv.Key{}, key...),
+		value: record,
+		merge: true,
+	})
+}
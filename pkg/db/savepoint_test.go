@@ -0,0 +1,90 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/daicang/mk/pkg/audit"
+)
+
+func TestSavepoint(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data")
+	db, err := Open(Options{Path: path, AuditDir: filepath.Join(dir, "audit")})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	kvs := map[string]string{}
+	for i := 0; i < 1000; i++ {
+		kvs[fmt.Sprintf("key-%04d", i)] = "base"
+	}
+	fillDB(t, db, kvs)
+
+	tx, _ := NewWritableTx(db)
+	mustSet(t, tx, []byte("a"), []byte("1"))
+	kvs["a"] = "1"
+	seq, _ := tx.NextSequence()
+	sp, err := tx.Savepoint()
+	if err != nil {
+		t.Fatalf("Failed to create savepoint: %v", err)
+	}
+
+	// Changes after savepoint are reverted, twice
+	for round := 0; round < 2; round++ {
+		mustSet(t, tx, []byte("a"), []byte("2"))
+		mustSet(t, tx, []byte("b"), []byte("2"))
+		for i := 0; i < 1000; i += 2 {
+			mustRemove(t, tx, []byte(fmt.Sprintf("key-%04d", i)))
+		}
+		c := tx.Cursor()
+		c.Seek([]byte("key-0001"))
+		if err := c.Delete(); err != nil {
+			t.Fatalf("Failed to delete: %v", err)
+		}
+		if _, err := tx.NextSequence(); err != nil {
+			t.Fatalf("Failed to get sequence: %v", err)
+		}
+		inner, _ := tx.Savepoint()
+		mustSet(t, tx, []byte("c"), []byte("3"))
+
+		if err := tx.RollbackTo(sp); err != nil {
+			t.Fatalf("Failed to rollback to savepoint: %v", err)
+		}
+		if err := tx.RollbackTo(inner); !errors.Is(err, ErrInvalidSavepoint) {
+			t.Errorf("Expect inner savepoint discarded, get %v", err)
+		}
+		checkScan(t, tx.Cursor(), kvs)
+	}
+	if next, _ := tx.NextSequence(); next != seq+1 {
+		t.Errorf("Expect sequence %d after rollback, get %d", seq+1, next)
+	}
+	mustCommit(t, tx)
+
+	tx, _ = NewWritableTx(db)
+	if err := tx.RollbackTo(sp); !errors.Is(err, ErrInvalidSavepoint) {
+		t.Errorf("Expect savepoint of another tx invalid, get %v", err)
+	}
+	mustCommit(t, tx)
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	checkBackup(t, path, kvs)
+
+	// Reverted changes are not audited
+	keys := []string{}
+	err = audit.Read(filepath.Join(dir, "audit"), func(r audit.Record) error {
+		if r.TxID == 2 {
+			keys = append(keys, string(r.Key))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to read audit log: %v", err)
+	}
+	if strings.Join(keys, ",") != "a" {
+		t.Errorf("Expect audit records of a, get %v", keys)
+	}
+}
@@ -0,0 +1,140 @@
+package db
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/daicang/mk/pkg/kv"
+	"github.com/daicang/mk/pkg/tree"
+)
+
+// errScanStopped stops shards after one fails.
+var errScanStopped = errors.New("scan stopped")
+
+// Scan calls fn for pairs in [start, end) in key order, nil bound means
+// unbounded. It stops at the first error from fn and returns it, or
+// when tx context is done and returns its error.
+// Only leaves holding the range are read.
+func (tx *Tx) Scan(start, end kv.Key, fn func(k kv.Key, v kv.Value) error) error {
+	r := kv.Range{Start: start, End: end}
+	if r.EmptyFunc(tx.db.compare) {
+		return nil
+	}
+	c := tx.Cursor()
+	for k, v := c.seekFrom(start); k != nil && !r.AfterEndFunc(k, tx.db.compare); k, v = c.Next() {
+		err := fn(k, v)
+		if err != nil {
+			return err
+		}
+	}
+	return c.Err()
+}
+
+// ForEach calls fn for all pairs in key order, it stops at the first
+// error from fn and returns it. Key and value are only valid in fn.
+func (tx *Tx) ForEach(fn func(k kv.Key, v kv.Value) error) error {
+	if tx.closed() {
+		return ErrTxClosed
+	}
+	return tx.Scan(nil, nil, fn)
+}
+
+// ParallelScan splits keys into about given number of shards and calls fn
+// for every pair, shards run concurrently over the snapshot of this tx.
+// Pairs of one shard come in key order, fn gets the shard index, so
+// per-shard state needs no locking.
+// It returns the first error from fn, other shards stop soon after.
+func (tx *Tx) ParallelScan(ranges int, fn func(shard int, key kv.Key, value kv.Value) error) error {
+	if tx.writable {
+		return ErrTxWritable
+	}
+	if tx.closed() {
+		return ErrTxClosed
+	}
+	shards := tx.shardRanges(ranges)
+	clones := make([]*Tx, 0, len(shards))
+	defer func() {
+		for _, clone := range clones {
+			clone.close()
+		}
+	}()
+	for range shards {
+		clone, err := tx.Clone()
+		if err != nil {
+			return err
+		}
+		clones = append(clones, clone)
+	}
+
+	var stop int32
+	errs := make([]error, len(shards))
+	wg := sync.WaitGroup{}
+	for i, r := range shards {
+		wg.Add(1)
+		go func(i int, r kv.Range, clone *Tx) {
+			defer wg.Done()
+			err := clone.Scan(r.Start, r.End, func(k kv.Key, v kv.Value) error {
+				if atomic.LoadInt32(&stop) != 0 {
+					return errScanStopped
+				}
+				return fn(i, k, v)
+			})
+			if err != nil && !errors.Is(err, errScanStopped) {
+				errs[i] = err
+				atomic.StoreInt32(&stop, 1)
+			}
+		}(i, r, clones[i])
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shardRanges splits keyspace into at most n ranges by separator keys
+// of internal nodes, so each range covers a similar number of subtrees.
+// It descends until a level has enough nodes, leaves are never read.
+func (tx *Tx) shardRanges(n int) []kv.Range {
+	// Separator keys of the current level, in key order
+	keys := []kv.Key{}
+	level := []*tree.Node{tx.root}
+	for len(level) > 0 && !level[0].IsLeaf {
+		keys = keys[:0]
+		next := []*tree.Node{}
+		for _, node := range level {
+			for i := 0; i < node.KeyCount(); i++ {
+				keys = append(keys, node.GetKeyAt(i))
+				next = append(next, tx.peekNode(node.GetChildID(i), node))
+			}
+		}
+		if len(keys) >= n {
+			break
+		}
+		level = next
+	}
+
+	// Pick evenly spaced boundaries, the first key bounds nothing
+	bounds := []kv.Key{}
+	for i := 1; i < n; i++ {
+		j := i * len(keys) / n
+		if j == 0 {
+			continue
+		}
+		if len(bounds) == 0 || !bounds[len(bounds)-1].EqualTo(keys[j]) {
+			bounds = append(bounds, keys[j])
+		}
+	}
+
+	ranges := []kv.Range{}
+	var start kv.Key
+	for _, b := range bounds {
+		ranges = append(ranges, kv.Range{Start: start, End: b})
+		start = b
+	}
+	return append(ranges, kv.Range{Start: start})
+}
@@ -0,0 +1,182 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/daicang/mk/pkg/kv"
+	"github.com/daicang/mk/pkg/testutil"
+)
+
+func TestScan(t *testing.T) {
+	db := openDB(t)
+	kvs := map[string]string{}
+	for i := 0; i < 5000; i += 2 {
+		kvs[fmt.Sprintf("key-%05d", i)] = fmt.Sprint(i)
+	}
+	fillDB(t, db, kvs)
+	tx, _ := NewReadOnlyTx(db)
+
+	cases := []struct {
+		start, end  string
+		count       int
+		first, last string
+	}{
+		{"", "", 2500, "key-00000", "key-04998"},
+		{"key-01000", "key-02000", 500, "key-01000", "key-01998"},
+		{"key-01001", "key-01005", 2, "key-01002", "key-01004"},
+		{"key-04990", "", 5, "key-04990", "key-04998"},
+		{"", "key-00004", 2, "key-00000", "key-00002"},
+		{"key-02000", "key-02000", 0, "", ""},
+		{"key-03000", "key-01000", 0, "", ""},
+		{"key-99999", "", 0, "", ""},
+	}
+	for _, c := range cases {
+		var start, end kv.Key
+		if c.start != "" {
+			start = []byte(c.start)
+		}
+		if c.end != "" {
+			end = []byte(c.end)
+		}
+		keys := []string{}
+		err := tx.Scan(start, end, func(k kv.Key, v kv.Value) error {
+			if string(v) != kvs[string(k)] {
+				return fmt.Errorf("key %s: expect %s, get %s", k, kvs[string(k)], v)
+			}
+			keys = append(keys, string(k))
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Scan [%s, %s): %v", c.start, c.end, err)
+		}
+		if len(keys) != c.count {
+			t.Errorf("Scan [%s, %s): expect %d keys, get %d", c.start, c.end, c.count, len(keys))
+			continue
+		}
+		if c.count > 0 && (keys[0] != c.first || keys[len(keys)-1] != c.last) {
+			t.Errorf("Scan [%s, %s): get %s .. %s", c.start, c.end, keys[0], keys[len(keys)-1])
+		}
+	}
+
+	errStop := errors.New("stop")
+	count := 0
+	err := tx.Scan(nil, nil, func(k kv.Key, v kv.Value) error {
+		count++
+		if count == 10 {
+			return errStop
+		}
+		return nil
+	})
+	if !errors.Is(err, errStop) || count != 10 {
+		t.Errorf("Expect scan to stop at error, get %v after %d keys", err, count)
+	}
+}
+
+func TestForEach(t *testing.T) {
+	db := openDB(t)
+	kvs := testutil.RandomKV(2000)
+	fillDB(t, db, kvs)
+	tx, _ := NewReadOnlyTx(db)
+
+	var last kv.Key
+	count := 0
+	err := tx.ForEach(func(k kv.Key, v kv.Value) error {
+		if last != nil && !k.GreaterEqual(last) {
+			t.Errorf("Key %q after %q", k, last)
+		}
+		last = append(last[:0], k...)
+		if string(v) != kvs[string(k)] {
+			t.Errorf("Key %q: expect %q, get %q", k, kvs[string(k)], v)
+		}
+		count++
+		return nil
+	})
+	if err != nil || count != len(kvs) {
+		t.Errorf("Expect %d pairs, get %d, %v", len(kvs), count, err)
+	}
+
+	errStop := errors.New("stop")
+	count = 0
+	err = tx.ForEach(func(k kv.Key, v kv.Value) error {
+		count++
+		if count == 10 {
+			return errStop
+		}
+		return nil
+	})
+	if !errors.Is(err, errStop) || count != 10 {
+		t.Errorf("Expect stop after 10 pairs, get %d, %v", count, err)
+	}
+
+	err = tx.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.ForEach(nil); !errors.Is(err, ErrTxClosed) {
+		t.Errorf("Expect ErrTxClosed, get %v", err)
+	}
+}
+
+func TestParallelScan(t *testing.T) {
+	db := openDB(t)
+	kvs := map[string]string{}
+	for i := 0; i < 20000; i++ {
+		kvs[fmt.Sprintf("key-%06d", i)] = fmt.Sprint(i)
+	}
+	fillDB(t, db, kvs)
+	tx, _ := NewReadOnlyTx(db)
+
+	for _, ranges := range []int{0, 1, 3, 8, 100000} {
+		mu := sync.Mutex{}
+		seen := map[string]string{}
+		// Pairs of one shard are ordered, shards don't overlap
+		last := map[int]string{}
+		shards := map[int]bool{}
+		err := tx.ParallelScan(ranges, func(shard int, k kv.Key, v kv.Value) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if l, exist := last[shard]; exist && l >= string(k) {
+				return fmt.Errorf("shard %d: %s after %s", shard, k, l)
+			}
+			if _, exist := seen[string(k)]; exist {
+				return fmt.Errorf("key %s visited twice", k)
+			}
+			last[shard] = string(k)
+			shards[shard] = true
+			seen[string(k)] = string(v)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Ranges %d: %v", ranges, err)
+		}
+		if len(seen) != len(kvs) {
+			t.Errorf("Ranges %d: expect %d keys, get %d", ranges, len(kvs), len(seen))
+		}
+		if ranges > 1 && len(shards) < 2 {
+			t.Errorf("Ranges %d: expect multiple shards, get %d", ranges, len(shards))
+		}
+		if len(shards) > ranges && len(shards) > 1 {
+			t.Errorf("Ranges %d: get %d shards", ranges, len(shards))
+		}
+	}
+
+	errStop := errors.New("stop")
+	err := tx.ParallelScan(4, func(shard int, k kv.Key, v kv.Value) error {
+		return errStop
+	})
+	if !errors.Is(err, errStop) {
+		t.Errorf("Expect error from callback, get %v", err)
+	}
+
+	// Empty DB
+	etx, _ := NewReadOnlyTx(openDB(t))
+	err = etx.ParallelScan(4, func(shard int, k kv.Key, v kv.Value) error {
+		return fmt.Errorf("unexpected key %s", k)
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,54 @@
+package db
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+// HandleSignals shuts DB down on the first of given signals,
+// SIGTERM and SIGINT by default. Shutdown refuses new writable
+// transactions, syncs committed changes and closes the file, read
+// transactions keep working on the memory map. With Options.NoMmap
+// they read the file, which stays open until Close.
+// The returned channel receives the shutdown result, it is closed
+// without value when ctx is done before any signal.
+func (db *DB) HandleSignals(ctx context.Context, signals ...os.Signal) <-chan error {
+	if len(signals) == 0 {
+		signals = []os.Signal{syscall.SIGTERM, syscall.SIGINT}
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, signals...)
+
+	done := make(chan error, 1)
+	go func() {
+		defer close(done)
+		defer signal.Stop(sigs)
+		select {
+		case <-ctx.Done():
+		case <-sigs:
+			done <- db.shutdown()
+		}
+	}()
+	return done
+}
+
+// shutdown stops writes, syncs and closes DB file, which is kept open
+// for reads without memory map. It waits for the open writable
+// transaction.
+func (db *DB) shutdown() error {
+	db.metalock.Lock()
+	stopped := atomic.CompareAndSwapInt32(&db.state, stateOpen, stateStopped)
+	db.metalock.Unlock()
+	if !stopped {
+		return ErrDBClosed
+	}
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	if db.noMmap {
+		return db.closeLogs()
+	}
+	return db.release()
+}
@@ -0,0 +1,74 @@
+//go:build !windows
+// +build !windows
+
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestHandleSignals(t *testing.T) {
+	for _, noMmap := range []bool{false, true} {
+		t.Run(fmt.Sprintf("NoMmap=%v", noMmap), func(t *testing.T) {
+			testHandleSignals(t, noMmap)
+		})
+	}
+}
+
+func testHandleSignals(t *testing.T, noMmap bool) {
+	db, err := Open(Options{
+		Path:       dataPath(t),
+		Durability: DurabilityNone,
+		NoMmap:     noMmap,
+	})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	fillDB(t, db, map[string]string{"key": "value"})
+
+	// Canceled handler does nothing
+	ctx, cancel := context.WithCancel(context.Background())
+	done := db.HandleSignals(ctx, syscall.SIGUSR1)
+	cancel()
+	if err, ok := <-done; ok {
+		t.Errorf("Expect no shutdown after cancel, get %v", err)
+	}
+	fillDB(t, db, map[string]string{"key2": "value"})
+
+	done = db.HandleSignals(context.Background(), syscall.SIGUSR1)
+	err = syscall.Kill(syscall.Getpid(), syscall.SIGUSR1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatalf("Shutdown failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for shutdown")
+	}
+
+	if _, err := NewWritableTx(db); !errors.Is(err, ErrDBClosed) {
+		t.Errorf("Expect ErrDBClosed after shutdown, get %v", err)
+	}
+	tx, _ := NewReadOnlyTx(db)
+	if db.DurableTxID() != tx.ID() {
+		t.Errorf("Expect all commits synced, durable id %d, last commit %d", db.DurableTxID(), tx.ID())
+	}
+	// Without memory map, reads go to the file kept open until Close
+	if v := tx.Get([]byte("key")); string(v) != "value" {
+		t.Errorf("Expect reads after shutdown, get %q", v)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Errorf("Failed to close after shutdown: %v", err)
+	}
+}
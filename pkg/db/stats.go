@@ -0,0 +1,142 @@
+package db
+
+import (
+	"time"
+)
+
+// LatencyBounds are upper bounds of LatencyHistogram buckets.
+var LatencyBounds = [...]time.Duration{
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// LatencyHistogram counts durations in buckets of LatencyBounds.
+type LatencyHistogram struct {
+	// Counts[i] counts durations up to LatencyBounds[i] and larger
+	// than the previous bound, the last one counts larger durations
+	Counts [len(LatencyBounds) + 1]uint64
+	// Count is the number of durations
+	Count uint64
+	// Sum is the sum of durations
+	Sum time.Duration
+}
+
+// observe adds one duration.
+func (h *LatencyHistogram) observe(d time.Duration) {
+	i := 0
+	for i < len(LatencyBounds) && d > LatencyBounds[i] {
+		i++
+	}
+	h.Counts[i]++
+	h.Count++
+	h.Sum += d
+}
+
+// Stats holds DB statistics. Counters count from open or the last
+// ResetStats, gauges tell current state.
+type Stats struct {
+	// OpenReadTxN is the number of open read-only transactions
+	OpenReadTxN int
+	// LongestReadTxDuration is how long the oldest open read-only
+	// transaction is open
+	LongestReadTxDuration time.Duration
+	// Commits is the number of commits
+	Commits int
+	// CommitLatency is the histogram of commit time, sync included
+	CommitLatency LatencyHistogram
+	// TxStats sums stats of closed transactions, bytes written per
+	// commit is TxStats.BytesWritten / Commits
+	TxStats TxStats
+	// FreePages is free pages after the last commit, not reset
+	FreePages int
+	// PendingPages is pages freed by the last commits which open
+	// transactions may still read, not reset
+	PendingPages int
+	// FreeSpans is runs of contiguous free pages after the last
+	// commit, many small spans for few free pages mean fragmentation,
+	// not reset
+	FreeSpans int
+	// LargestFreeSpan is pages of the largest free span after the last
+	// commit, not reset
+	LargestFreeSpan int
+	// MmapSize is memory map size in bytes after the last commit,
+	// not reset
+	MmapSize int
+	// NodeCacheBytes is estimated bytes of nodes in DB node cache,
+	// not reset
+	NodeCacheBytes int
+}
+
+// Stats returns current statistics.
+func (db *DB) Stats() Stats {
+	now := time.Now()
+	db.metalock.Lock()
+	defer db.metalock.Unlock()
+	s := db.stats
+	s.NodeCacheBytes = db.nodeCache.bytes()
+	for _, tx := range db.txs {
+		if tx.writable {
+			continue
+		}
+		s.OpenReadTxN++
+		if d := now.Sub(tx.start); d > s.LongestReadTxDuration {
+			s.LongestReadTxDuration = d
+		}
+	}
+	return s
+}
+
+// ResetStats resets counters of Stats, open transactions are still
+// counted when they close.
+func (db *DB) ResetStats() {
+	db.metalock.Lock()
+	defer db.metalock.Unlock()
+	db.stats = Stats{
+		FreePages:       db.stats.FreePages,
+		PendingPages:    db.stats.PendingPages,
+		FreeSpans:       db.stats.FreeSpans,
+		LargestFreeSpan: db.stats.LargestFreeSpan,
+		MmapSize:        db.stats.MmapSize,
+	}
+}
+
+// updateGauges records freelist and map size, caller holds metalock
+// and the freelist is not changing.
+func (db *DB) updateGauges() {
+	fs := db.freelist.Stats()
+	db.stats.FreePages = fs.FreePages
+	db.stats.PendingPages = fs.PendingPages
+	db.stats.FreeSpans = fs.Spans
+	db.stats.LargestFreeSpan = fs.LargestSpan
+	db.stats.MmapSize = db.mmapSize
+}
+
+// watch reports read-only tx if it's still open after MaxTxDuration.
+func (tx *Tx) watch() {
+	if tx.db.maxTxDuration == 0 {
+		return
+	}
+	tx.longTimer = time.AfterFunc(tx.db.maxTxDuration, tx.reportLong)
+}
+
+// reportLong reports tx open too long, it only reads fields which never
+// change, so it can race with close.
+func (tx *Tx) reportLong() {
+	d := time.Since(tx.start)
+	if tx.db.onLongTx != nil {
+		tx.db.onLongTx(tx.id, d)
+		return
+	}
+	tx.db.logger.Info("Read-only tx open too long keeps freed pages from reuse", "id", tx.id, "duration", d)
+}
@@ -0,0 +1,138 @@
+package db
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/daicang/mk/pkg/page"
+)
+
+func TestLongTx(t *testing.T) {
+	reported := make(chan uint64, 10)
+	db, err := Open(Options{
+		Path:          dataPath(t),
+		MaxTxDuration: 50 * time.Millisecond,
+		OnLongTx: func(txid uint64, d time.Duration) {
+			if d < 50*time.Millisecond {
+				t.Errorf("Tx %d reported after %v", txid, d)
+			}
+			reported <- txid
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+	fillDB(t, db, map[string]string{"key": "value"})
+
+	long, _ := NewReadOnlyTx(db)
+	short, _ := NewReadOnlyTx(db)
+	if err := short.Rollback(); err != nil {
+		t.Fatalf("Failed to rollback: %v", err)
+	}
+	clone, _ := long.Clone()
+	wtx, _ := NewWritableTx(db)
+	stats := db.Stats()
+	if stats.OpenReadTxN != 2 {
+		t.Errorf("Expect 2 open read tx, get %d", stats.OpenReadTxN)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case id := <-reported:
+			if id != long.ID() {
+				t.Errorf("Expect tx %d reported, get %d", long.ID(), id)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Long tx is not reported")
+		}
+	}
+	if d := db.Stats().LongestReadTxDuration; d < 50*time.Millisecond {
+		t.Errorf("Expect longest read tx over 50ms, get %v", d)
+	}
+	for _, tx := range []*Tx{long, clone, wtx} {
+		if err := tx.Rollback(); err != nil {
+			t.Fatalf("Failed to rollback: %v", err)
+		}
+	}
+	if stats := db.Stats(); stats.OpenReadTxN != 0 || stats.LongestReadTxDuration != 0 {
+		t.Errorf("Expect no open read tx, get %+v", stats)
+	}
+	select {
+	case id := <-reported:
+		t.Errorf("Unexpected report of tx %d", id)
+	default:
+	}
+}
+
+func TestStatsCounters(t *testing.T) {
+	db := openDB(t)
+	defer func() {
+		_ = db.Close()
+	}()
+	kvs := map[string]string{}
+	for i := 0; i < 2000; i++ {
+		kvs[fmt.Sprintf("key-%04d", i)] = fmt.Sprintf("value-%d", i)
+	}
+	fillDB(t, db, kvs)
+	tx, _ := NewWritableTx(db)
+	for i := 0; i < 2000; i++ {
+		mustRemove(t, tx, []byte(fmt.Sprintf("key-%04d", i)))
+	}
+	mustCommit(t, tx)
+	tx, _ = NewReadOnlyTx(db)
+	for i := 0; i < 10; i++ {
+		_ = tx.Get([]byte("key"))
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Failed to rollback: %v", err)
+	}
+
+	stats := db.Stats()
+	if stats.Commits != 2 || stats.CommitLatency.Count != 2 {
+		t.Errorf("Expect 2 commits, get %d, latency count %d", stats.Commits, stats.CommitLatency.Count)
+	}
+	total := uint64(0)
+	for _, n := range stats.CommitLatency.Counts {
+		total += n
+	}
+	if total != 2 || stats.CommitLatency.Sum <= 0 {
+		t.Errorf("Bad commit latency %+v", stats.CommitLatency)
+	}
+	s := stats.TxStats
+	if s.Splits == 0 || s.Merges == 0 {
+		t.Errorf("Expect splits and merges, get %+v", s)
+	}
+	if s.PagesAllocated == 0 || s.PagesFreed == 0 || s.NodeCacheHits == 0 || s.NodeCacheMisses == 0 {
+		t.Errorf("Expect pages and node lookups counted, get %+v", s)
+	}
+	if s.PagesGrown == 0 || s.PagesGrown > s.PagesAllocated {
+		t.Errorf("Expect part of allocated pages grown, get %+v", s)
+	}
+	if s.BytesWritten < (s.PagesDirtied+stats.Commits)*page.PageSize {
+		t.Errorf("Expect dirty pages and metas written, get %+v", s)
+	}
+
+	if stats.FreePages+stats.PendingPages == 0 || stats.MmapSize == 0 {
+		t.Errorf("Expect free pages and map size after deletes, get %+v", stats)
+	}
+	if stats.FreePages > 0 && (stats.FreeSpans == 0 || stats.LargestFreeSpan == 0) {
+		t.Errorf("Expect free spans of free pages, get %+v", stats)
+	}
+
+	db.ResetStats()
+	gauges := Stats{
+		FreePages:       stats.FreePages,
+		PendingPages:    stats.PendingPages,
+		FreeSpans:       stats.FreeSpans,
+		LargestFreeSpan: stats.LargestFreeSpan,
+		MmapSize:        stats.MmapSize,
+	}
+	if stats := db.Stats(); !reflect.DeepEqual(stats, gauges) {
+		t.Errorf("Expect counters reset, get %+v", stats)
+	}
+}
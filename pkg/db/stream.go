@@ -0,0 +1,266 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"unsafe"
+
+	"github.com/daicang/mk/pkg/audit"
+	"github.com/daicang/mk/pkg/codec"
+	"github.com/daicang/mk/pkg/common"
+	"github.com/daicang/mk/pkg/kv"
+	"github.com/daicang/mk/pkg/page"
+	"github.com/daicang/mk/pkg/tree"
+)
+
+// SetReader sets key with size bytes read from r, for values too large
+// to hold in memory. Values larger than page.MaxInlineValue are written
+// to overflow pages page by page while reading, instead of at commit.
+// Value is not compressed. It returns io.ErrUnexpectedEOF when r ends
+// before size bytes.
+//
+// Changefeed, audit log and savepoints record values, so with them the
+// value is read back into memory once.
+func (tx *Tx) SetReader(key kv.Key, r io.Reader, size int64) error {
+	err := tx.checkWritable()
+	if err != nil {
+		return err
+	}
+	if len(key) > MaxKeySize {
+		return ErrKeyTooLarge
+	}
+	if size > MaxValueSize {
+		return ErrValueTooLarge
+	}
+	if size < 0 {
+		return fmt.Errorf("negative value size %d", size)
+	}
+	if !page.IsOverflowValue(int(size)) {
+		value := make(kv.Value, size)
+		_, err = io.ReadFull(r, value)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Set(key, value)
+		return err
+	}
+
+	ov, err := tx.writeStream(r, int(size))
+	if err != nil {
+		return err
+	}
+	curr := tx.root
+	for !curr.IsLeaf {
+		curr = tx.getChildAt(curr, curr.ChildIndexFunc(key, tx.db.compare))
+	}
+	if tx.db.audit != nil || tx.db.changefeedPages > 0 {
+		value := page.ReadOverflow(tx.getPage, ov.Head, ov.Size)
+		tx.audit(audit.OpSet, key, value)
+	}
+	tx.version++
+
+	found, i := curr.SearchFunc(key, tx.db.compare)
+	if found {
+		if len(tx.savepoints) > 0 {
+			tx.recordUndo(key, tx.valueAt(curr, i))
+		}
+	} else {
+		tx.recordUndo(key, nil)
+		curr.Balanced = false
+		curr.InsertKeyValueAt(i, key, nil)
+	}
+	curr.SetStoredAt(i, ov)
+	return nil
+}
+
+// writeStream writes size bytes from r to a chain of overflow pages.
+// Each page is written to file once it's filled, so the value is not
+// held in memory. The pages are free in the last commit, so writing
+// them before commit changes nothing readers see.
+func (tx *Tx) writeStream(r io.Reader, size int) (tree.Overflow, error) {
+	count := page.OverflowPages(size)
+	ids := make([]common.Pgid, 0, count)
+	chunk := make([]byte, page.OverflowCapacity)
+	var p *page.Page
+	for j := 0; j < count; j++ {
+		if p == nil {
+			var err error
+			p, err = tx.allocate(1)
+			if err != nil {
+				return tree.Overflow{}, err
+			}
+			ids = append(ids, p.Index())
+			tx.trackStream(ids)
+		}
+		n := size - j*page.OverflowCapacity
+		if n > len(chunk) {
+			n = len(chunk)
+		}
+		_, err := io.ReadFull(r, chunk[:n])
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return tree.Overflow{}, err
+		}
+		// Next page is allocated first, its id is written in this page
+		var next *page.Page
+		nextID := common.Pgid(0)
+		if j+1 < count {
+			next, err = tx.allocate(1)
+			if err != nil {
+				return tree.Overflow{}, err
+			}
+			ids = append(ids, next.Index())
+			tx.trackStream(ids)
+			nextID = next.Index()
+		}
+		p.WriteOverflow(chunk[:n], nextID)
+		err = tx.flushStreamPage(p)
+		if err != nil {
+			return tree.Overflow{}, err
+		}
+		p = next
+	}
+	return tree.Overflow{Head: ids[0], Size: size}, nil
+}
+
+// trackStream records pages of stream chain, so they're freed at commit
+// when the chain is not in tree, including chains of failed writes.
+func (tx *Tx) trackStream(ids []common.Pgid) {
+	if tx.streams == nil {
+		tx.streams = map[common.Pgid][]common.Pgid{}
+	}
+	tx.streams[ids[0]] = ids
+}
+
+// flushStreamPage writes page of stream chain to file and returns its
+// buffer to pool. Pages in writable memory map are synced at commit.
+func (tx *Tx) flushStreamPage(p *page.Page) error {
+	if tx.db.writableMmap {
+		return nil
+	}
+	buf := (*[common.MmapMaxSize]byte)(unsafe.Pointer(p))[:page.PageSize]
+	_, err := tx.db.file.WriteAt(buf, int64(p.Index())*int64(page.PageSize))
+	if err != nil {
+		return tx.db.ioError(fmt.Errorf("write page %d: %w", p.Index(), err))
+	}
+	tx.streamed = true
+	tx.stats.BytesWritten += page.PageSize
+	err = tx.invalidateMmap(page.Pages{p})
+	if err != nil {
+		return err
+	}
+	delete(tx.pages, p.Index())
+	tx.db.pagePool.put(p)
+	return nil
+}
+
+// releaseStreams frees chains of values set by SetReader which are
+// replaced or removed before commit, after spill links the others.
+func (tx *Tx) releaseStreams() {
+	for _, ids := range tx.streams {
+		for _, id := range ids {
+			p := &page.Page{}
+			p.SetIndex(id)
+			tx.db.freelist.Add(p)
+			tx.stats.PagesFreed++
+		}
+	}
+	tx.streams = nil
+}
+
+// GetReader returns a reader of value of given key, nil when key is not
+// found. Values in overflow pages are read page by page instead of
+// assembled in heap, compressed ones are decoded while reading. Merge
+// records are folded in heap first, see Tx.Merge. The reader is valid
+// like values of GetRef, reads after tx is closed return ErrTxClosed.
+func (tx *Tx) GetReader(key kv.Key) (io.Reader, error) {
+	if tx.closed() {
+		return nil, ErrTxClosed
+	}
+	curr := tx.root
+	for !curr.IsLeaf {
+		curr = tx.getChildAt(curr, curr.ChildIndexFunc(key, tx.db.compare))
+	}
+	if tx.readErr != nil {
+		return nil, tx.readErr
+	}
+	found, i := curr.SearchFunc(key, tx.db.compare)
+	if !found {
+		return nil, nil
+	}
+	ov := curr.OverflowAt(i)
+	if ov.Head == 0 || curr.MergeAt(i) {
+		v := tx.valueAt(curr, i)
+		if tx.readErr != nil {
+			return nil, tx.readErr
+		}
+		return bytes.NewReader(v), nil
+	}
+	r := &overflowReader{tx: tx, next: ov.Head}
+	if !ov.Compressed {
+		return r, nil
+	}
+	return codec.NewReader(r)
+}
+
+// overflowReader reads value in a chain of overflow pages.
+type overflowReader struct {
+	tx *Tx
+	// next is the next page to read, 0 at the end of chain
+	next common.Pgid
+	// data is unread bytes of current page
+	data []byte
+	// buf is current page read without memory map, it goes back to
+	// pool when the next page is read
+	buf *page.Page
+}
+
+// Read reads value bytes of the current page into b.
+func (r *overflowReader) Read(b []byte) (int, error) {
+	for len(r.data) == 0 {
+		if r.tx.closed() {
+			return 0, ErrTxClosed
+		}
+		if r.next == 0 {
+			r.release()
+			return 0, io.EOF
+		}
+		p, err := r.readPage(r.next)
+		if err != nil {
+			return 0, err
+		}
+		r.data = p.OverflowData()
+		r.next = p.GetOverflowNext()
+	}
+	n := copy(b, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// readPage returns overflow page id. Without memory map, the page is
+// read into buf instead of tx buffers, so one page is held at a time.
+func (r *overflowReader) readPage(id common.Pgid) (*page.Page, error) {
+	tx := r.tx
+	if _, ok := tx.pages[id]; ok || !tx.db.noMmap {
+		return tx.getPage(id), nil
+	}
+	r.release()
+	tx.readPages[id] = true
+	p, err := tx.db.readPage(id)
+	if err != nil {
+		return nil, err
+	}
+	r.buf = p
+	return p, nil
+}
+
+// release returns buf to pool.
+func (r *overflowReader) release() {
+	if r.buf != nil {
+		r.tx.db.pagePool.put(r.buf)
+		r.buf = nil
+	}
+}
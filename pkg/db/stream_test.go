@@ -0,0 +1,180 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/daicang/mk/pkg/kv"
+	"github.com/daicang/mk/pkg/page"
+)
+
+// readAll reads value of key with GetReader.
+func readAll(t *testing.T, tx *Tx, key string) kv.Value {
+	t.Helper()
+	r, err := tx.GetReader(kv.Key(key))
+	if err != nil || r == nil {
+		t.Fatalf("Failed to get reader of %s: %v", key, err)
+	}
+	v, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", key, err)
+	}
+	return v
+}
+
+func TestStream(t *testing.T) {
+	blob := bytes.Repeat([]byte("0123456789abcdef"), 10*page.PageSize+3)
+	for name, opts := range map[string]Options{
+		"mmap":     {Path: dataPath(t)},
+		"no mmap":  {Path: dataPath(t), NoMmap: true},
+		"memory":   {Path: MemoryPath},
+		"wal":      {Path: dataPath(t), WAL: true},
+		"writable": {Path: dataPath(t), WritableMmap: true},
+		"encrypted": {
+			Path:          dataPath(t),
+			EncryptionKey: bytes.Repeat([]byte{1}, 16),
+		},
+	} {
+		db, err := Open(opts)
+		if err != nil {
+			t.Fatalf("%s: failed to open DB: %v", name, err)
+		}
+		fillDB(t, db, map[string]string{"a": "1", "b": "2"})
+		tx, err := NewWritableTx(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []string{"blob", "replaced", "removed"} {
+			if err := tx.SetReader(kv.Key(key), bytes.NewReader(blob), int64(len(blob))); err != nil {
+				t.Fatalf("%s: failed to set reader: %v", name, err)
+			}
+		}
+		// Streamed pages are not held by tx, except pages in writable
+		// memory map
+		if len(tx.pages) > 1 && !opts.WritableMmap {
+			t.Errorf("%s: expect streamed pages written, tx holds %d", name, len(tx.pages))
+		}
+		if v := readAll(t, tx, "blob"); !bytes.Equal(v, blob) {
+			t.Errorf("%s: streamed value mismatch in writable tx", name)
+		}
+		mustSet(t, tx, kv.Key("replaced"), kv.Value("small"))
+		mustRemove(t, tx, kv.Key("removed"))
+		mustCommit(t, tx)
+		if errs := checkErrors(t, db); len(errs) > 0 {
+			t.Errorf("%s: check fails after stream: %v", name, errs)
+		}
+
+		err = db.View(func(tx *Tx) error {
+			if v := readAll(t, tx, "blob"); !bytes.Equal(v, blob) {
+				t.Errorf("%s: streamed value mismatch", name)
+			}
+			if !bytes.Equal(tx.Get(kv.Key("blob")), blob) {
+				t.Errorf("%s: Get mismatch for streamed value", name)
+			}
+			if v := readAll(t, tx, "replaced"); string(v) != "small" {
+				t.Errorf("%s: expect small value, get %.20q", name, v)
+			}
+			if r, err := tx.GetReader(kv.Key("removed")); r != nil || err != nil {
+				t.Errorf("%s: expect nil reader for missing key, get %v", name, err)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		_ = db.Close()
+	}
+}
+
+func TestStreamErrors(t *testing.T) {
+	db := openDB(t)
+	defer func() { _ = db.Close() }()
+	kvs := map[string]string{"a": "1", "large": strings.Repeat("l", 2*page.PageSize)}
+	fillDB(t, db, kvs)
+	tx, err := NewWritableTx(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := int64(3 * page.PageSize)
+	short := strings.NewReader(strings.Repeat("x", page.PageSize))
+	if err := tx.SetReader(kv.Key("short"), short, size); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expect io.ErrUnexpectedEOF for short reader, get %v", err)
+	}
+	if err := tx.SetReader(kv.Key("large"), short, MaxValueSize+1); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("Expect ErrValueTooLarge, get %v", err)
+	}
+	// Small values are set like Set
+	if err := tx.SetReader(kv.Key("small"), strings.NewReader("small value"), 5); err != nil {
+		t.Fatalf("Failed to set small value: %v", err)
+	}
+	// Savepoint reverts streamed value
+	sp, err := tx.Savepoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := bytes.Repeat([]byte("b"), int(size))
+	if err := tx.SetReader(kv.Key("a"), bytes.NewReader(blob), size); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.RollbackTo(sp); err != nil {
+		t.Fatal(err)
+	}
+	mustCommit(t, tx)
+	// Pages of failed and reverted streams are freed
+	if errs := checkErrors(t, db); len(errs) > 0 {
+		t.Errorf("Check fails after stream errors: %v", errs)
+	}
+	kvs["small"] = "small"
+	checkPairs(t, db, kvs)
+
+	tx, err = NewReadOnlyTx(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.SetReader(kv.Key("a"), short, 1); !errors.Is(err, ErrTxReadOnly) {
+		t.Errorf("Expect ErrTxReadOnly, get %v", err)
+	}
+	r, err := tx.GetReader(kv.Key("large"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = tx.Rollback()
+	if _, err := ioutil.ReadAll(r); !errors.Is(err, ErrTxClosed) {
+		t.Errorf("Expect ErrTxClosed reading after tx is closed, get %v", err)
+	}
+	if _, err := tx.GetReader(kv.Key("a")); !errors.Is(err, ErrTxClosed) {
+		t.Errorf("Expect ErrTxClosed, get %v", err)
+	}
+}
+
+func TestStreamCompressed(t *testing.T) {
+	db, err := Open(Options{Path: dataPath(t), Compression: CompressionFlate})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+	text := strings.Repeat("compressible text ", page.PageSize)
+	fillDB(t, db, map[string]string{"text": text})
+
+	tx, err := NewReadOnlyTx(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := tx.GetReader(kv.Key("text"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 10)
+	if _, err := io.ReadFull(r, buf); err != nil || string(buf) != text[:10] {
+		t.Errorf("Failed to read compressed value: %q %v", buf, err)
+	}
+	rest, err := ioutil.ReadAll(r)
+	if err != nil || string(buf)+string(rest) != text {
+		t.Errorf("Compressed value mismatch: %v", err)
+	}
+	_ = tx.Rollback()
+}
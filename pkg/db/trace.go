@@ -0,0 +1,54 @@
+package db
+
+import "context"
+
+// Tracer starts spans of commit phases, an adapter can forward them to
+// OpenTelemetry or another tracing system.
+type Tracer interface {
+	// Start starts span name as a child of the span in ctx, returns
+	// the context holding the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is one traced operation.
+type Span interface {
+	// SetAttribute attaches key and value to span.
+	SetAttribute(key string, value interface{})
+	// End finishes span.
+	End()
+}
+
+// noopSpan is returned without Options.Tracer.
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(string, interface{}) {}
+
+func (noopSpan) End() {}
+
+// txSpan makes its span the parent of spans started in tx until End.
+type txSpan struct {
+	Span
+	tx     *Tx
+	parent context.Context
+}
+
+// End ends span and restores the parent span of tx.
+func (s *txSpan) End() {
+	s.Span.End()
+	s.tx.ctx = s.parent
+}
+
+// startSpan starts span name as a child of the current span of tx.
+func (tx *Tx) startSpan(name string) Span {
+	if tx.db.tracer == nil {
+		return noopSpan{}
+	}
+	parent := tx.ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, span := tx.db.tracer.Start(parent, name)
+	s := &txSpan{Span: span, tx: tx, parent: tx.ctx}
+	tx.ctx = ctx
+	return s
+}
@@ -0,0 +1,101 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/daicang/mk/pkg/common"
+)
+
+// spanKey is context key of the current recorded span.
+type spanKey struct{}
+
+// recordedSpan is a span recorded by testTracer.
+type recordedSpan struct {
+	name   string
+	parent string
+	attrs  map[string]interface{}
+	ended  bool
+}
+
+func (s *recordedSpan) SetAttribute(key string, value interface{}) {
+	s.attrs[key] = value
+}
+
+func (s *recordedSpan) End() {
+	s.ended = true
+}
+
+// testTracer records started spans.
+type testTracer struct {
+	spans []*recordedSpan
+}
+
+func (t *testTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	s := &recordedSpan{name: name, attrs: map[string]interface{}{}}
+	if parent, ok := ctx.Value(spanKey{}).(*recordedSpan); ok {
+		s.parent = parent.name
+	}
+	t.spans = append(t.spans, s)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func TestTracer(t *testing.T) {
+	tracer := &testTracer{}
+	db, err := Open(Options{Path: dataPath(t), Tracer: tracer})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+	kvs := map[string]string{}
+	for i := 0; i < 100; i++ {
+		kvs[fmt.Sprintf("key-%04d", i)] = strings.Repeat("v", 2000)
+	}
+	fillDB(t, db, kvs)
+
+	parents := map[string]string{}
+	var commit *recordedSpan
+	for _, s := range tracer.spans {
+		if !s.ended {
+			t.Errorf("Span %s is not ended", s.name)
+		}
+		parents[s.name] = s.parent
+		if s.name == "commit" {
+			commit = s
+		}
+	}
+	expected := map[string]string{"commit": "", "spill": "commit", "mmap grow": "spill", "write": "commit"}
+	for name, parent := range expected {
+		if p, ok := parents[name]; !ok || p != parent {
+			t.Errorf("Expect span %s with parent %q, get %q", name, parent, p)
+		}
+	}
+	if commit == nil || commit.attrs["dirty_pages"].(int) == 0 || commit.attrs["bytes"].(int) == 0 {
+		t.Errorf("Unexpected commit span %+v", commit)
+	}
+
+	// Failed commit is recorded
+	tracer.spans = nil
+	small, err := Open(Options{Path: dataPath(t), Tracer: tracer, MaxMmapSize: common.MmapMinSize})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer func() {
+		_ = small.Close()
+	}()
+	tx, _ := NewWritableTx(small)
+	for key, value := range kvs {
+		mustSet(t, tx, []byte(key), []byte(value))
+	}
+	if err := tx.Commit(); !errors.Is(err, ErrMmapTooLarge) {
+		t.Fatalf("Expect ErrMmapTooLarge, get %v", err)
+	}
+	if len(tracer.spans) == 0 || tracer.spans[0].name != "commit" || tracer.spans[0].attrs["error"] == nil {
+		t.Errorf("Expect error on commit span, get %+v", tracer.spans)
+	}
+}
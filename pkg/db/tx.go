@@ -1,21 +1,31 @@
 package db
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"sort"
+	"sync/atomic"
+	"time"
 	"unsafe"
 
+	"github.com/daicang/mk/pkg/audit"
 	"github.com/daicang/mk/pkg/common"
 	"github.com/daicang/mk/pkg/kv"
+	"github.com/daicang/mk/pkg/mmap"
 	"github.com/daicang/mk/pkg/page"
 	"github.com/daicang/mk/pkg/tree"
 )
 
 // Tx represents transaction.
+// Read-only tx reads the snapshot of the last commit when it's created,
+// changes of the writable tx and later commits are not visible to it.
+// Pages of the snapshot are not reused until the tx is closed.
 type Tx struct {
 	db *DB
 	// Transaction ID
-	id uint32
+	id uint64
 	// Read-only mark
 	writable bool
 	// Pointer to mata struct
@@ -24,169 +34,990 @@ type Tx struct {
 	root *tree.Node
 	// All accessed nodes in this transaction.
 	nodes map[common.Pgid]*tree.Node
-	// All accessed pages in this transaction.
+	// Dirty pages allocated in this transaction.
 	pages map[common.Pgid]*page.Page
+	// Pages read from memory map in this transaction.
+	readPages map[common.Pgid]bool
+	// buffers holds pages read from file without memory map,
+	// they go back to page pool on close.
+	buffers map[common.Pgid]*page.Page
+	// readErr is the first error reading a page from file or decoding
+	// a value, later reads see an empty leaf or nil value, see getPage
+	readErr error
+	// Page accounting
+	stats TxStats
+	// Mutations to write to audit log at commit
+	mutations []audit.Record
+	// changes are encoded changes to append to changefeed at commit
+	changes []byte
+	// changeCount is number of changes in changes
+	changeCount int
+	// version increases on every change, cursors use it to detect changes.
+	version uint64
+	// sync is whether commit syncs to disk
+	sync bool
+	// extent reserved for spill, nil when not used
+	extent *extent
+	// managed tx is committed or closed by Update or View
+	managed bool
+	// savepoints are ids of savepoints which can be rolled back to
+	savepoints []uint64
+	// lastSavepoint is id of the last savepoint
+	lastSavepoint uint64
+	// start is when tx is created
+	start time.Time
+	// longTimer reports read-only tx open longer than MaxTxDuration
+	longTimer *time.Timer
+	// undo reverts changes since the first savepoint, see RollbackTo
+	undo []undoEntry
+	// streams are pages of values written by SetReader by their first
+	// page, chains not in tree at commit are freed
+	streams map[common.Pgid][]common.Pgid
+	// streamed is whether SetReader wrote pages to file before commit
+	streamed bool
+	// ctx is the context of BeginTx, or holds the current span while
+	// committing, nil is context.Background()
+	ctx context.Context
+	// mmaps are memory maps replaced while tx is open, see replaceMmap
+	mmaps []*staleMmap
+}
+
+// TxStats counts distinct pages and nodes touched by one transaction.
+type TxStats struct {
+	// Pages read from memory map
+	PagesRead int
+	// Nodes written to new pages at commit
+	PagesDirtied int
+	// Pages allocated, overflow pages included
+	PagesAllocated int
+	// Pages of PagesAllocated which grew the file, the rest are
+	// reused from freelist
+	PagesGrown int
+	// Pages returned to freelist, overflow pages included
+	PagesFreed int
+	// Nodes split at commit
+	Splits int
+	// Nodes merged into a sibling or parent at commit
+	Merges int
+	// Node lookups served by nodes already read in this tx
+	NodeCacheHits int
+	// Node lookups which read a page
+	NodeCacheMisses int
+	// Node lookups of read-only tx served by DB node cache, see
+	// Options.NodeCacheSize
+	SharedCacheHits int
+	// Bytes of pages and meta written at commit
+	BytesWritten int
+	// Bytes saved by compressing values, see Options.Compression
+	BytesCompressed int
+}
+
+// add adds counts of o to s.
+func (s *TxStats) add(o TxStats) {
+	s.PagesRead += o.PagesRead
+	s.PagesDirtied += o.PagesDirtied
+	s.PagesAllocated += o.PagesAllocated
+	s.PagesGrown += o.PagesGrown
+	s.PagesFreed += o.PagesFreed
+	s.Splits += o.Splits
+	s.Merges += o.Merges
+	s.NodeCacheHits += o.NodeCacheHits
+	s.NodeCacheMisses += o.NodeCacheMisses
+	s.SharedCacheHits += o.SharedCacheHits
+	s.BytesWritten += o.BytesWritten
+	s.BytesCompressed += o.BytesCompressed
+}
+
+// ID returns transaction id.
+// Writable tx gets a new id, read-only tx shares id of the last commit.
+func (tx *Tx) ID() uint64 {
+	return tx.id
+}
+
+// Stats returns page accounting of this transaction.
+func (tx *Tx) Stats() TxStats {
+	if tx.readPages != nil {
+		tx.stats.PagesRead = len(tx.readPages)
+	}
+	return tx.stats
 }
 
 // NewWritableTx creates new writable transaction.
-func NewWritableTx(db *DB) (*Tx, bool) {
+// It returns ErrTxExists without waiting when another writable tx is
+// open. After a failed write, see DB.Health, it returns the failure.
+func NewWritableTx(db *DB) (*Tx, error) {
+	db.metalock.Lock()
+	defer db.metalock.Unlock()
 	if db.writableTx != nil {
-		fmt.Println("Cannot create multiple writable tx")
-		return nil, false
+		return nil, ErrTxExists
+	}
+	if atomic.LoadInt32(&db.state) != stateOpen {
+		return nil, ErrDBClosed
+	}
+	if db.failed != nil {
+		return nil, db.failed
 	}
-	rootPage := db.getPage(db.meta.rootPage)
-	root := &tree.Node{
-		Parent: nil,
+	// Not contended: shutdown takes it only after the state changes
+	db.rwlock.Lock()
+	err := db.releasePending()
+	if err != nil {
+		db.rwlock.Unlock()
+		return nil, err
+	}
+	tx := Tx{
+		db:        db,
+		id:        db.meta.txid + 1,
+		writable:  true,
+		meta:      db.meta.copy(),
+		nodes:     map[common.Pgid]*tree.Node{},
+		pages:     map[common.Pgid]*page.Page{},
+		readPages: map[common.Pgid]bool{},
+		start:     time.Now(),
+	}
+	err = tx.readRoot()
+	if err != nil {
+		db.rwlock.Unlock()
+		return nil, err
 	}
 
-	fmt.Printf("rootid=%d\n", db.meta.rootPage)
-	fmt.Printf("Page: %s\n", rootPage)
+	db.txWait.Add(1)
+	db.txs = append(db.txs, &tx)
+	db.writableTx = &tx
 
-	root.ReadPage(rootPage)
-	fmt.Printf("Node: %s\n", root)
+	return &tx, nil
+}
 
-	// TESTING
-	if !root.IsLeaf {
-		panic("root should be leaf")
+// NewReadOnlyTx returns new read-only transaction on the snapshot of
+// the last commit. It must be closed with Rollback, or pages freed by
+// later commits are never reused.
+func NewReadOnlyTx(db *DB) (*Tx, error) {
+	db.metalock.Lock()
+	defer db.metalock.Unlock()
+	if atomic.LoadInt32(&db.state) == stateClosed {
+		return nil, ErrDBClosed
 	}
-
 	tx := Tx{
-		db:       db,
-		id:       1,
-		writable: true,
-		meta:     db.meta.copy(),
-		root:     root,
-		nodes:    map[common.Pgid]*tree.Node{},
-		pages:    map[common.Pgid]*page.Page{},
+		db:        db,
+		id:        db.meta.txid,
+		writable:  false,
+		meta:      db.meta.copy(),
+		nodes:     map[common.Pgid]*tree.Node{},
+		pages:     map[common.Pgid]*page.Page{},
+		readPages: map[common.Pgid]bool{},
+		start:     time.Now(),
+	}
+	err := tx.readRoot()
+	if err != nil {
+		return nil, err
 	}
+	tx.watch()
+	db.txWait.Add(1)
+	db.txs = append(db.txs, &tx)
 
-	tx.nodes[db.meta.rootPage] = root
-	tx.pages[db.meta.rootPage] = rootPage
+	return &tx, nil
+}
 
-	db.txs = append(db.txs, &tx)
-	db.writableTx = &tx
+// BeginTx returns a new transaction bound to ctx. Unlike NewWritableTx,
+// a writable tx waits for the open writable tx until ctx is done.
+// Cursors of the tx stop when ctx is done, see Cursor.Err, and commit
+// after that fails with the ctx error.
+func (db *DB) BeginTx(ctx context.Context, writable bool) (*Tx, error) {
+	if !writable {
+		tx, err := NewReadOnlyTx(db)
+		if err != nil {
+			return nil, err
+		}
+		tx.ctx = ctx
+		return tx, nil
+	}
+	for {
+		err := ctx.Err()
+		if err != nil {
+			return nil, err
+		}
+		tx, err := NewWritableTx(db)
+		if err == nil {
+			tx.ctx = ctx
+			return tx, nil
+		}
+		if !errors.Is(err, ErrTxExists) {
+			return nil, err
+		}
+		err = db.waitWriter(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
 
-	return &tx, true
+// waitWriter waits until the open writable tx is closed or ctx is done.
+func (db *DB) waitWriter(ctx context.Context) error {
+	closed := make(chan struct{})
+	go func() {
+		// Writable tx holds rwlock until it's closed
+		db.rwlock.Lock()
+		db.rwlock.Unlock() // nolint: staticcheck
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-// NewReadOnlyTx returns new read-only transaction.
-func NewReadOnlyTx(db *DB) (*Tx, bool) {
-	rootPage := db.getPage(db.meta.rootPage)
-	root := &tree.Node{
-		Parent: nil,
+// Update runs fn in a new writable transaction. The transaction is
+// committed when fn returns nil, and rolled back when fn returns an
+// error or panics. fn must not commit the transaction itself.
+func (db *DB) Update(fn func(*Tx) error) error {
+	tx, err := NewWritableTx(db)
+	if err != nil {
+		return err
 	}
-	root.ReadPage(rootPage)
+	return tx.run(fn)
+}
 
-	tx := Tx{
-		db:       db,
-		id:       1,
-		writable: false,
-		meta:     db.meta.copy(),
-		root:     root,
-		nodes:    map[common.Pgid]*tree.Node{},
-		pages:    map[common.Pgid]*page.Page{},
+// run runs fn in managed writable tx, see Update.
+func (tx *Tx) run(fn func(*Tx) error) error {
+	tx.managed = true
+	defer func() {
+		if !tx.closed() {
+			tx.rollback()
+		}
+	}()
+
+	err := fn(tx)
+	if err != nil {
+		return err
 	}
+	tx.managed = false
+	return tx.Commit()
+}
 
-	tx.nodes[db.meta.rootPage] = root
-	tx.pages[db.meta.rootPage] = rootPage
-	db.txs = append(db.txs, &tx)
+// View runs fn in a new read-only transaction, and closes the
+// transaction when fn returns.
+func (db *DB) View(fn func(*Tx) error) error {
+	tx, err := NewReadOnlyTx(db)
+	if err != nil {
+		return err
+	}
+	tx.managed = true
+	defer tx.close()
+
+	return fn(tx)
+}
+
+// Clone returns a new read-only transaction on the same snapshot.
+// Transactions are not goroutine-safe, but each clone has its own node
+// cache and accounting, so clones can be read by different goroutines.
+func (tx *Tx) Clone() (*Tx, error) {
+	if tx.writable {
+		return nil, ErrTxWritable
+	}
+	if tx.closed() {
+		return nil, ErrTxClosed
+	}
+	clone := Tx{
+		db:        tx.db,
+		id:        tx.id,
+		writable:  false,
+		meta:      tx.meta.copy(),
+		nodes:     map[common.Pgid]*tree.Node{},
+		pages:     map[common.Pgid]*page.Page{},
+		readPages: map[common.Pgid]bool{},
+		start:     time.Now(),
+		ctx:       tx.ctx,
+	}
+	err := clone.readRoot()
+	if err != nil {
+		return nil, err
+	}
+	clone.watch()
+	tx.db.metalock.Lock()
+	tx.db.txWait.Add(1)
+	tx.db.txs = append(tx.db.txs, &clone)
+	tx.db.metalock.Unlock()
+
+	return &clone, nil
+}
+
+// readRoot reads root node of tx meta. On read error, page buffers go
+// back to pool, as tx is not created.
+func (tx *Tx) readRoot() error {
+	tx.root = tx.readNode(tx.meta.rootPage, nil)
+	tx.nodes[tx.meta.rootPage] = tx.root
+	if tx.readErr != nil {
+		for _, p := range tx.buffers {
+			tx.db.pagePool.put(p)
+		}
+		return tx.readErr
+	}
+	return nil
+}
+
+// closed returns whether tx is committed or rolled back.
+func (tx *Tx) closed() bool {
+	return tx.nodes == nil
+}
+
+// checkWritable returns error when tx can't be modified.
+func (tx *Tx) checkWritable() error {
+	if !tx.writable {
+		return ErrTxReadOnly
+	}
+	if tx.closed() {
+		return ErrTxClosed
+	}
+	return nil
+}
 
-	return &tx, true
+// NextSequence returns the next value of a sequence kept in meta,
+// starting from 1. It's committed with the tx, so ids returned by a
+// rolled back tx are returned again.
+func (tx *Tx) NextSequence() (uint64, error) {
+	err := tx.checkWritable()
+	if err != nil {
+		return 0, err
+	}
+	tx.meta.sequence++
+	return tx.meta.sequence, nil
 }
 
 // allocate returns contiguous pages.
-func (tx *Tx) allocate(count int) (*page.Page, bool) {
+func (tx *Tx) allocate(count int) (*page.Page, error) {
 	if !tx.writable {
 		panic("Read only tx can't allocate")
 	}
-	return tx.db.allocate(count)
+	p, ok := tx.allocateExtent(count)
+	if !ok {
+		var err error
+		p, err = tx.db.allocate(count)
+		if err != nil {
+			return nil, err
+		}
+	}
+	tx.pages[p.Index()] = p
+	tx.stats.PagesAllocated += count
+
+	return p, nil
 }
 
-func (tx *Tx) close() {}
+// freePage returns page to freelist, with overflow pages of leaf page.
+func (tx *Tx) freePage(id common.Pgid) {
+	p := tx.getPage(id)
+	if p.IsLeaf() {
+		for i := 0; i < p.Count(); i++ {
+			for oid := p.GetOverflowAt(i); oid != 0; {
+				op := tx.getPage(oid)
+				oid = op.GetOverflowNext()
+				tx.db.freelist.Add(op)
+				tx.stats.PagesFreed++
+			}
+		}
+	}
+	tx.db.freelist.Add(p)
+	tx.stats.PagesFreed += p.Overflow() + 1
+}
+
+// writeOverflows writes values of leaf node larger than
+// page.MaxInlineValue to chains of overflow pages, compressed with
+// Options.Compression when it's smaller. Returns location of values,
+// zero for values kept in leaf page. Stored values keep their chains.
+func (tx *Tx) writeOverflows(n *tree.Node) ([]tree.Overflow, error) {
+	if !n.IsLeaf {
+		return nil, nil
+	}
+	overflows := make([]tree.Overflow, n.KeyCount())
+	for i, value := range n.Values {
+		if ov := n.StoredAt(i); ov.Head != 0 {
+			overflows[i] = ov
+			delete(tx.streams, ov.Head)
+			continue
+		}
+		if !page.IsOverflowValue(len(value)) {
+			continue
+		}
+		ov := &overflows[i]
+		value, ov.Compressed = tx.compress(value)
+		ov.Size = len(value)
+		// Allocate the whole chain first, each page links to the next
+		chain := make([]*page.Page, page.OverflowPages(len(value)))
+		for j := range chain {
+			p, err := tx.allocate(1)
+			if err != nil {
+				return nil, err
+			}
+			chain[j] = p
+		}
+		for j, p := range chain {
+			next := common.Pgid(0)
+			if j+1 < len(chain) {
+				next = chain[j+1].Index()
+			}
+			value = p.WriteOverflow(value, next)
+		}
+		ov.Head = chain[0].Index()
+	}
+	return overflows, nil
+}
+
+// close detaches transaction from DB.
+func (tx *Tx) close() {
+	if tx.closed() {
+		return
+	}
+	tx.db.metalock.Lock()
+	defer tx.db.metalock.Unlock()
+	for i, t := range tx.db.txs {
+		if t == tx {
+			tx.db.txs = append(tx.db.txs[:i], tx.db.txs[i+1:]...)
+			break
+		}
+	}
+	if tx.writable {
+		tx.db.writableTx = nil
+		tx.db.rwlock.Unlock()
+	}
+	if tx.longTimer != nil {
+		tx.longTimer.Stop()
+	}
+	tx.db.releaseMmaps(tx)
+	tx.stats.PagesRead = len(tx.readPages)
+	tx.db.stats.TxStats.add(tx.stats)
+	for _, p := range tx.buffers {
+		tx.db.pagePool.put(p)
+	}
+	tx.buffers = nil
+	tx.streams = nil
+	tx.nodes = nil
+	tx.pages = nil
+	tx.readPages = nil
+	tx.db.txWait.Done()
+}
+
+// Rollback drops changes of writable tx and closes transaction.
+// Read-only tx must be rolled back when done, see DB.Close.
+func (tx *Tx) Rollback() error {
+	if tx.managed {
+		return ErrTxManaged
+	}
+	if tx.closed() {
+		return ErrTxClosed
+	}
+	tx.rollback()
+	return nil
+}
 
 // Commit balance b+tree, write changes to disk, and close transaction.
-func (tx *Tx) Commit() bool {
-	if !tx.writable {
-		panic("commit read-only tx")
+// Failed transaction is rolled back.
+func (tx *Tx) Commit() error {
+	return tx.CommitWith(DurabilityDefault)
+}
+
+// CommitWith commits with given durability instead of the DB-wide one,
+// e.g. to sync only critical writes.
+// Syncing a commit also makes all earlier commits durable.
+func (tx *Tx) CommitWith(d Durability) (err error) {
+	if tx.managed {
+		return ErrTxManaged
+	}
+	err = tx.checkWritable()
+	if err != nil {
+		return err
+	}
+	if tx.ctx != nil && tx.ctx.Err() != nil {
+		err = tx.ctx.Err()
+		tx.rollback()
+		return err
+	}
+	if tx.readErr != nil {
+		err = tx.readErr
+		tx.rollback()
+		return err
 	}
+	span := tx.startSpan("commit")
+	defer func() {
+		span.SetAttribute("txid", tx.id)
+		span.SetAttribute("dirty_pages", tx.stats.PagesDirtied)
+		span.SetAttribute("bytes", tx.stats.BytesWritten)
+		if err != nil {
+			span.SetAttribute("error", err.Error())
+		}
+		span.End()
+	}()
+	start := time.Now()
+	if d == DurabilityDefault {
+		d = tx.db.durability
+	}
+	tx.sync = d != DurabilityNone
 	// Merge underfill nodes
 	for _, node := range tx.nodes {
 		tx.merge(node)
 	}
 
+	// Large spill takes pages from one extent
+	err = tx.reserveExtent()
+	if err != nil {
+		tx.rollback()
+		return fmt.Errorf("reserve extent: %w", err)
+	}
+
 	// Split nodes and write to memory page
-	ok := tx.spillNode(tx.root)
-	if !ok {
-		fmt.Println("Failed to spill")
+	spill := tx.startSpan("spill")
+	err = tx.spillNode(tx.root)
+	spill.SetAttribute("dirty_pages", tx.stats.PagesDirtied)
+	spill.End()
+	if err != nil {
 		tx.rollback()
-		return false
+		return fmt.Errorf("spill: %w", err)
 	}
+	// Merge reads siblings, an empty leaf in place of a failed read
+	// must not be written
+	if tx.readErr != nil {
+		err = tx.readErr
+		tx.rollback()
+		return err
+	}
+	tx.releaseExtent()
+	tx.releaseStreams()
 
 	// Root may be changed after spill
 	tx.root = tx.root.Root()
+	tx.meta.rootPage = tx.root.Index
+	tx.meta.txid = tx.id
 
-	// Write to disk
-	ok = tx.write()
-	if !ok {
-		fmt.Println("Failed to write transaction")
+	err = tx.writeChangefeed()
+	if err != nil {
 		tx.rollback()
-		return false
+		return fmt.Errorf("write changefeed: %w", err)
+	}
+
+	// Free pages at the end are dropped, file is truncated after
+	// commit
+	tx.meta.totalPages = tx.db.freelist.Shrink(tx.meta.totalPages)
+
+	// Write freelist to new page
+	err = tx.writeFreelist()
+	if err != nil {
+		tx.rollback()
+		return fmt.Errorf("write freelist: %w", err)
+	}
+
+	// Write pages and meta to disk
+	err = tx.writeCommit()
+	if err != nil {
+		tx.rollback()
+		return err
+	}
+
+	tx.db.metalock.Lock()
+	tx.db.meta = tx.meta.copy()
+	tx.db.freelist.Commit(tx.id)
+	tx.db.stats.Commits++
+	latency := time.Since(start)
+	tx.db.stats.CommitLatency.observe(latency)
+	tx.db.updateGauges()
+	if tx.sync {
+		tx.db.durableTxid = tx.id
 	}
+	tx.db.metalock.Unlock()
 
+	// File is truncated after meta is written, failure only keeps it
+	// large
+	err = tx.db.shrink(tx.id)
+	if err != nil {
+		tx.db.logger.Error(err, "Failed to shrink DB file", "id", tx.id)
+	}
+
+	// Changes are committed now, audit failure won't fail commit.
+	if tx.db.audit != nil {
+		err = tx.db.audit.Append(tx.mutations)
+		if err != nil {
+			tx.db.logger.Error(err, "Failed to write audit log", "id", tx.id)
+		}
+	}
+
+	tx.db.logger.V(1).Info(
+		"tx committed",
+		"id", tx.id,
+		"read", len(tx.readPages),
+		"dirtied", tx.stats.PagesDirtied,
+		"allocated", tx.stats.PagesAllocated,
+		"freed", tx.stats.PagesFreed,
+	)
+	var snapshot *Tx
+	if tx.db.strictMode {
+		// Take snapshot before next writer can commit
+		snapshot, err = NewReadOnlyTx(tx.db)
+	}
 	tx.close()
-	return true
+	if snapshot != nil && err == nil {
+		strictCheck(snapshot)
+	}
+	if tx.db.hooks.OnCommit != nil {
+		tx.db.hooks.OnCommit(CommitInfo{TxID: tx.id, Stats: tx.stats, Duration: latency})
+	}
+	if tx.db.wal != nil {
+		tx.db.autoCheckpoint()
+	}
+	return nil
+}
+
+// writeFreelist moves the freelist to a newly allocated page.
+// Pages freed by this transaction are written as free, but are only
+// reused after no reader can see them, see DB.releasePending.
+func (tx *Tx) writeFreelist() error {
+	f := tx.db.freelist
+	tx.freePage(tx.meta.freelistPage)
+	// Size is estimated before allocation, which only shrinks freelist.
+	size := f.Size()
+	p, err := tx.allocate((size + page.PageSize - 1) / page.PageSize)
+	if err != nil {
+		return err
+	}
+	f.WritePage(p)
+	tx.meta.freelistPage = p.Index()
+
+	return nil
+}
+
+// writeCommit writes pages and meta of the transaction. With WAL they
+// are logged first, and the log is synced instead of DB file.
+func (tx *Tx) writeCommit() error {
+	span := tx.startSpan("write")
+	defer func() {
+		span.SetAttribute("pages", len(tx.pages))
+		span.SetAttribute("bytes", tx.stats.BytesWritten)
+		span.End()
+	}()
+	if tx.db.wal != nil {
+		tx.db.walSem <- struct{}{}
+		defer func() {
+			<-tx.db.walSem
+		}()
+		if tx.streamed {
+			// Streamed pages are not logged, and replaying older
+			// images of them would overwrite them, so they're synced
+			// and the log is dropped
+			_, err := tx.db.checkpoint()
+			if err != nil {
+				return err
+			}
+		}
+		err := tx.writeLog()
+		if err != nil {
+			return err
+		}
+	}
+	err := tx.write()
+	if err != nil {
+		return err
+	}
+	// Write meta to finish the transaction
+	return tx.writeMeta()
+}
+
+// syncFile returns whether commit syncs DB file.
+func (tx *Tx) syncFile() bool {
+	return tx.sync && tx.db.wal == nil
+}
+
+// metaBuffer returns page of tx meta and its id, metas are written to
+// meta pages in turn. The buffer is from page pool, callers put it
+// back after writing it.
+func (tx *Tx) metaBuffer() (common.Pgid, []byte) {
+	id := common.Pgid(tx.meta.txid % uint64(tx.db.metaPages))
+	buf := tx.db.pagePool.get(1)
+	p := page.FromBuffer(buf, 0)
+	p.SetIndex(id)
+	p.SetFlag(page.FlagMeta)
+	// Files of older versions are upgraded by the first commit
+	tx.meta.version = FormatVersion
+	tx.meta.checksum = tx.meta.sum()
+	tx.meta.write(p)
+	return id, buf
+}
+
+// writeMeta writes meta to one of meta pages in turn, so the meta of
+// last commit is kept when this write is torn.
+func (tx *Tx) writeMeta() error {
+	id, buf := tx.metaBuffer()
+	_, err := tx.db.file.WriteAt(buf, int64(id)*int64(page.PageSize))
+	tx.db.pagePool.put(page.FromBuffer(buf, 0))
+	if err != nil {
+		return tx.db.ioError(fmt.Errorf("write meta: %w", err))
+	}
+	tx.stats.BytesWritten += len(buf)
+	if !tx.syncFile() {
+		return nil
+	}
+	err = tx.db.file.Sync()
+	if err != nil {
+		return tx.db.ioError(fmt.Errorf("sync meta: %w", err))
+	}
+
+	return nil
 }
 
 // write writes all pages hold by this transaction.
-func (tx *Tx) write() bool {
+func (tx *Tx) write() error {
 	pages := page.Pages{}
 	for _, p := range tx.pages {
 		pages = append(pages, p)
+		tx.stats.BytesWritten += (p.Overflow() + 1) * page.PageSize
 	}
 	sort.Sort(pages)
 
-	// Write pages to disk
+	if tx.db.writableMmap {
+		if !tx.sync {
+			return nil
+		}
+		return tx.syncMmap(pages)
+	}
+
+	err := tx.writePages(pages)
+	if err != nil {
+		return err
+	}
+	if tx.syncFile() {
+		err := tx.db.file.Sync()
+		if err != nil {
+			return tx.db.ioError(fmt.Errorf("sync pages: %w", err))
+		}
+	}
+	err = tx.invalidateMmap(pages)
+	if err != nil {
+		return err
+	}
+
+	// Return page buffers to pool, extent goes back as one buffer
 	for _, p := range pages {
-		pos := int64(p.Index) * int64(page.PageSize)
-		size := (p.Overflow + 1) * page.PageSize
-		buf := (*[common.MmapMaxSize]byte)(unsafe.Pointer(p))
-		_, err := tx.db.file.WriteAt(buf[:size], pos)
+		if !tx.inExtent(p.Index()) {
+			tx.db.pagePool.put(p)
+		}
+	}
+	if e := tx.extent; e != nil {
+		tx.extent = nil
+		p := page.FromBuffer(e.buf, 0)
+		p.SetOverflow(len(e.buf)/page.PageSize - 1)
+		tx.db.pagePool.put(p)
+	}
+
+	return nil
+}
+
+// maxWriteSize is the most bytes of adjacent pages written at once.
+const maxWriteSize = 1 << 20
+
+// writePages writes sorted pages to file. Adjacent pages are merged
+// into writes of at most maxWriteSize bytes, so large commits take few
+// syscalls. Pages of the extent are written in place, others are
+// copied into DB write buffer first. With Options.ODirect, all pages
+// are copied into the buffer, which is aligned for O_DIRECT.
+func (tx *Tx) writePages(pages page.Pages) error {
+	var file io.WriterAt = tx.db.file
+	if tx.db.direct != nil {
+		file = tx.db.direct
+	}
+	for i := 0; i < len(pages); {
+		first := pages[i]
+		size := (first.Overflow() + 1) * page.PageSize
+		end := first.Index() + common.Pgid(first.Overflow()+1)
+		j := i + 1
+		for ; j < len(pages) && pages[j].Index() == end; j++ {
+			n := (pages[j].Overflow() + 1) * page.PageSize
+			if size+n > maxWriteSize {
+				break
+			}
+			size += n
+			end += common.Pgid(pages[j].Overflow() + 1)
+		}
+		data := (*[common.MmapMaxSize]byte)(unsafe.Pointer(first))[:size]
+		inPlace := j == i+1 || (tx.inExtent(first.Index()) && tx.inExtent(end-1))
+		if !inPlace || tx.db.direct != nil {
+			if tx.db.writeBuf == nil {
+				tx.db.writeBuf = alignedBuffer(maxWriteSize)
+			}
+			buf := tx.db.writeBuf
+			if size > len(buf) {
+				// A node larger than maxWriteSize is written alone
+				buf = alignedBuffer(size)
+			}
+			pos := 0
+			for _, p := range pages[i:j] {
+				n := (p.Overflow() + 1) * page.PageSize
+				pos += copy(buf[pos:], (*[common.MmapMaxSize]byte)(unsafe.Pointer(p))[:n])
+			}
+			data = buf[:size]
+		}
+		_, err := file.WriteAt(data, int64(first.Index())*int64(page.PageSize))
+		if err != nil {
+			return tx.db.ioError(fmt.Errorf("write pages %d-%d: %w", first.Index(), end-1, err))
+		}
+		i = j
+	}
+	return nil
+}
+
+// invalidateMmap makes memory map read pages written with WriteAt.
+// Written ranges are invalidated before meta makes them visible.
+func (tx *Tx) invalidateMmap(pages page.Pages) error {
+	if tx.db.noMmap {
+		return nil
+	}
+	for _, r := range dirtyRanges(pages) {
+		start := int(r.start) * page.PageSize
+		end := int(r.end) * page.PageSize
+		err := invalidateRange(tx.db.mmData()[start:end], tx.db.mlock)
 		if err != nil {
-			fmt.Printf("Failed to write page: %v\n", err)
-			return false
+			return fmt.Errorf("invalidate memory map: %w", err)
 		}
 	}
+	return nil
+}
+
+// invalidateRange invalidates b, locked pages can't be invalidated
+// so they are unlocked and locked again.
+func invalidateRange(b []byte, locked bool) error {
+	if !locked {
+		return mmap.Invalidate(b)
+	}
+	err := mmap.Unlock(b)
+	if err != nil {
+		return err
+	}
+	err = mmap.Invalidate(b)
+	if err != nil {
+		return err
+	}
+	return mmap.Lock(b)
+}
 
-	// Return single pages to page pool
+// pageRange is pages [start, end).
+type pageRange struct {
+	start common.Pgid
+	end   common.Pgid
+}
+
+// dirtyRanges returns ranges covered by sorted pages,
+// adjacent pages are merged into one range.
+func dirtyRanges(pages page.Pages) []pageRange {
+	ranges := []pageRange{}
 	for _, p := range pages {
-		if p.Overflow == 0 {
-			buf := (*[common.MmapMaxSize]byte)(unsafe.Pointer(p))[:page.PageSize]
-			for i := range buf {
-				buf[i] = 0
+		end := p.Index() + common.Pgid(p.Overflow()+1)
+		last := len(ranges) - 1
+		if last >= 0 && ranges[last].end >= p.Index() {
+			if end > ranges[last].end {
+				ranges[last].end = end
 			}
-			tx.db.singlePages.Put(buf) // nolint: staticcheck
+			continue
 		}
+		ranges = append(ranges, pageRange{start: p.Index(), end: end})
 	}
+	return ranges
+}
 
-	return true
+// syncMmap flushes dirty pages written into writable memory map,
+// only ranges dirtied by this transaction are synced.
+func (tx *Tx) syncMmap(pages page.Pages) error {
+	for _, r := range dirtyRanges(pages) {
+		start := int(r.start) * page.PageSize
+		end := int(r.end) * page.PageSize
+		err := mmap.Sync(tx.db.osFile(), tx.db.mmData()[start:end])
+		if err != nil {
+			return tx.db.ioError(fmt.Errorf("sync pages: %w", err))
+		}
+	}
+	return nil
 }
 
-// TODO:
+// rollback drops all changes and closes transaction.
 func (tx *Tx) rollback() {
-	// delete()
+	if tx.writable {
+		tx.db.freelist.Rollback()
+	}
+	tx.close()
 }
 
 // getPage returns page from pgid.
 func (tx *Tx) getPage(id common.Pgid) *page.Page {
-	// Check page buffer first
+	// Check dirty pages first
 	p, exist := tx.pages[id]
 	if exist {
 		return p
 	}
 	// If not found, return page from memory map
-	p = tx.db.getPage(id)
-	tx.pages[id] = p
+	tx.readPages[id] = true
+	if !tx.db.noMmap {
+		return tx.db.getPage(id)
+	}
+	p, exist = tx.buffers[id]
+	if exist {
+		return p
+	}
+	if tx.buffers == nil {
+		tx.buffers = map[common.Pgid]*page.Page{}
+	}
+	p, err := tx.db.readPage(id)
+	if err != nil {
+		// Callers can't fail, so they see an empty leaf and the
+		// error is returned by the tx operation instead
+		tx.readFailed(err)
+		return emptyLeaf()
+	}
+	tx.buffers[id] = p
+	return p
+}
+
+// readFailed records err of reading a page or value, the first one is
+// returned by tx operations.
+func (tx *Tx) readFailed(err error) {
+	if tx.readErr == nil {
+		tx.readErr = err
+	}
+}
 
+// valueAt returns value i of leaf n, nil when it fails to decode.
+// Merge records are folded, see Tx.Merge.
+func (tx *Tx) valueAt(n *tree.Node, i int) kv.Value {
+	v := tx.storedValueAt(n, i)
+	if v == nil || !n.MergeAt(i) {
+		return v
+	}
+	v, err := tx.fold(n.GetKeyAt(i), v)
+	if err != nil {
+		tx.readFailed(err)
+		return nil
+	}
+	return v
+}
+
+// storedValueAt returns value i of leaf n as stored, nil when it fails
+// to decode.
+func (tx *Tx) storedValueAt(n *tree.Node, i int) kv.Value {
+	v, err := n.ValueAt(i)
+	if err != nil {
+		tx.readFailed(fmt.Errorf("%w: %v", ErrInvalidDB, err))
+		return nil
+	}
+	return v
+}
+
+// readPage reads node n from page id, recording a value failing to
+// decode.
+func (tx *Tx) readPage(n *tree.Node, id common.Pgid) {
+	err := n.ReadPage(tx.getPage(id), tx.getPage)
+	if err != nil {
+		tx.readFailed(fmt.Errorf("%w: %v", ErrInvalidDB, err))
+	}
+}
+
+// emptyLeaf returns a leaf page with no pairs, in place of a page failed
+// to read. As an overflow page, it holds no bytes and ends the chain.
+func emptyLeaf() *page.Page {
+	p := page.FromBuffer(make([]byte, page.PageSize), 0)
+	p.SetFlag(page.FlagLeaf)
 	return p
 }
 
@@ -194,84 +1025,226 @@ func (tx *Tx) getPage(id common.Pgid) *page.Page {
 func (tx *Tx) getNode(id common.Pgid, parent *tree.Node) *tree.Node {
 	n, exist := tx.nodes[id]
 	if exist {
+		tx.stats.NodeCacheHits++
 		return n
 	}
-
-	p := tx.getPage(id)
-	n = &tree.Node{
-		Parent: parent,
-	}
-
-	n.ReadPage(p)
+	n = tx.readNode(id, parent)
 	tx.nodes[id] = n
 
 	return n
 }
 
-// Get searches given key, returns (found, value)
-func (tx *Tx) Get(key kv.Key) (bool, kv.Value) {
+// readNode returns node of page id. Read-only tx reads it lazily, and
+// gets it from DB node cache when enabled, where nodes are shared and
+// have no parent, see nodeCache.
+func (tx *Tx) readNode(id common.Pgid, parent *tree.Node) *tree.Node {
+	if tx.writable {
+		tx.stats.NodeCacheMisses++
+		n := &tree.Node{Parent: parent}
+		tx.readPage(n, id)
+		return n
+	}
+	cache := tx.db.nodeCache
+	if cache == nil {
+		tx.stats.NodeCacheMisses++
+		n := &tree.Node{Parent: parent}
+		n.ReadPageLazy(tx.getPage(id), tx.getPage)
+		return n
+	}
+	n := cache.get(id)
+	if n != nil {
+		tx.stats.SharedCacheHits++
+		return n
+	}
+	tx.stats.NodeCacheMisses++
+	// Taken before reading the page, which may be in a map replaced
+	// meanwhile
+	gen := cache.generation()
+	n = &tree.Node{}
+	if tx.db.noMmap {
+		// Page buffer is reused after tx closes, cache a copy
+		tx.readPage(n, id)
+		n = copyNode(n)
+	} else {
+		// Pages of memory map stay valid, overflow pages are read
+		// without tx, which may be closed when other tx reads them
+		n.ReadPageLazy(tx.getPage(id), tx.db.getPage)
+	}
+	if tx.readErr == nil {
+		cache.put(id, n, gen)
+	}
+	return n
+}
+
+// Get returns a copy of value of given key, nil when key is not found,
+// tx is closed or a page fails to read. Stored empty value is returned
+// as non-nil. See GetRef to read value without copy.
+func (tx *Tx) Get(key kv.Key) kv.Value {
+	v, _ := tx.GetRef(key)
+	return v.Copy()
+}
+
+// GetRef returns value of given key without copy, nil when key is not
+// found. The value points into the memory map or a page buffer of tx:
+// it's valid until tx is closed, and in writable tx until the key is
+// set or removed. It must not be modified, Value.Copy makes a copy to
+// keep or change. Values in overflow pages are assembled in heap once.
+func (tx *Tx) GetRef(key kv.Key) (kv.Value, error) {
+	if tx.closed() {
+		return nil, ErrTxClosed
+	}
 	curr := tx.root
 	for !curr.IsLeaf {
-		_, i := curr.Search(key)
-		curr = tx.getChildAt(curr, i)
+		curr = tx.getChildAt(curr, curr.ChildIndexFunc(key, tx.db.compare))
 	}
-	found, i := curr.Search(key)
-	if found {
-		return true, curr.GetValueAt(i)
+	found, i := curr.SearchFunc(key, tx.db.compare)
+	if !found {
+		return nil, tx.readErr
 	}
-	return false, kv.Value{}
+	v := tx.valueAt(curr, i)
+	if tx.readErr != nil {
+		return nil, tx.readErr
+	}
+	return v, nil
 }
 
-// Set sets key with value, returns (found, oldValue)
-func (tx *Tx) Set(key kv.Key, value kv.Value) (bool, kv.Value) {
-	if !tx.writable {
-		panic("Readonly transaction")
+// GetMany returns values of given keys in the same order, nil for keys
+// not found. Keys are searched in key order, each search goes up the
+// path of the previous key only as far as needed instead of from root.
+// Values are not copied, they're valid like values of GetRef.
+func (tx *Tx) GetMany(keys []kv.Key) ([]kv.Value, error) {
+	if tx.closed() {
+		return nil, ErrTxClosed
 	}
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool {
+		return tx.db.compare(keys[order[a]], keys[order[b]]) < 0
+	})
 
-	curr := tx.root
-	for {
-		found, i := curr.Search(key)
-
-		if curr.IsLeaf {
-			if found {
-				oldValue := curr.GetValueAt(i)
-				curr.SetValueAt(i, value)
-				return true, oldValue
+	// Path from root to current leaf, end of each node is the first
+	// key of its right sibling, nil when unbounded.
+	type level struct {
+		node *tree.Node
+		end  kv.Key
+	}
+	path := []level{{node: tx.root}}
+	values := make([]kv.Value, len(keys))
+	for _, i := range order {
+		key := keys[i]
+		// Keys come in order, so only the end bound can be passed
+		for len(path) > 1 {
+			end := path[len(path)-1].end
+			if end == nil || tx.db.compare(key, end) < 0 {
+				break
 			}
-			curr.Balanced = false
-			curr.InsertKeyValueAt(i, key, value)
-
-			return false, kv.Value{}
+			path = path[:len(path)-1]
+		}
+		top := path[len(path)-1]
+		for !top.node.IsLeaf {
+			j := top.node.ChildIndexFunc(key, tx.db.compare)
+			end := top.end
+			if j+1 < top.node.KeyCount() {
+				end = top.node.GetKeyAt(j + 1)
+			}
+			top = level{node: tx.getChildAt(top.node, j), end: end}
+			path = append(path, top)
+		}
+		found, j := top.node.SearchFunc(key, tx.db.compare)
+		if found {
+			values[i] = tx.valueAt(top.node, j)
 		}
-
-		curr = tx.getChildAt(curr, i)
 	}
+	if tx.readErr != nil {
+		return nil, tx.readErr
+	}
+	return values, nil
 }
 
-// Remove removes given key from node recursively, returns (found, oldValue).
-func (tx *Tx) Remove(key kv.Key) (bool, kv.Value) {
-	if !tx.writable {
-		panic("Readonly transaction")
+// Set sets key with value, returns old value, nil when key is new.
+// Leaves split only at commit, so inserts into a leaf grown by this tx
+// copy all its pairs, and a tx inserting n keys into one leaf costs
+// O(n^2). Bulk loads should commit every few thousand keys.
+func (tx *Tx) Set(key kv.Key, value kv.Value) (kv.Value, error) {
+	err := tx.checkWritable()
+	if err != nil {
+		return nil, err
+	}
+	if len(key) > MaxKeySize {
+		return nil, ErrKeyTooLarge
+	}
+	if len(value) > MaxValueSize {
+		return nil, ErrValueTooLarge
+	}
+	if value == nil {
+		// Keep stored empty value distinguishable from missing key
+		value = kv.Value{}
 	}
 
 	curr := tx.root
+	for !curr.IsLeaf {
+		curr = tx.getChildAt(curr, curr.ChildIndexFunc(key, tx.db.compare))
+	}
+	if tx.readErr != nil {
+		return nil, tx.readErr
+	}
 
-	for {
-		found, i := curr.Search(key)
+	tx.audit(audit.OpSet, key, value)
+	tx.version++
 
-		if curr.IsLeaf {
-			if !found {
-				return false, nil
-			}
+	found, i := curr.SearchFunc(key, tx.db.compare)
+	if found {
+		oldValue := tx.valueAt(curr, i)
+		tx.recordUndo(key, oldValue)
+		curr.SetValueAt(i, value)
+		return oldValue, nil
+	}
+	tx.recordUndo(key, nil)
+	curr.Balanced = false
+	curr.InsertKeyValueAt(i, key, value)
 
-			curr.Balanced = false
-			_, value := curr.RemoveKeyValueAt(i)
+	return nil, nil
+}
 
-			return true, value
-		}
+// Remove removes given key, returns removed value, nil when key is not found.
+func (tx *Tx) Remove(key kv.Key) (kv.Value, error) {
+	err := tx.checkWritable()
+	if err != nil {
+		return nil, err
+	}
 
-		curr = tx.getChildAt(curr, i)
+	curr := tx.root
+	for !curr.IsLeaf {
+		curr = tx.getChildAt(curr, curr.ChildIndexFunc(key, tx.db.compare))
+	}
+	if tx.readErr != nil {
+		return nil, tx.readErr
 	}
+
+	found, i := curr.SearchFunc(key, tx.db.compare)
+	if !found {
+		return nil, nil
+	}
+	tx.audit(audit.OpRemove, key, nil)
+	tx.version++
+	curr.Balanced = false
+	value := tx.valueAt(curr, i)
+	curr.RemoveKeyValueAt(i)
+	tx.recordUndo(key, value)
+
+	return value, nil
+}
+
+// audit records mutation for changefeed and audit log when they're
+// enabled.
+func (tx *Tx) audit(op string, key kv.Key, value kv.Value) {
+	tx.recordChange(op, key, value)
+	if tx.db.audit == nil {
+		return
+	}
+	tx.mutations = append(tx.mutations, audit.NewRecord(tx.id, op, key, value))
 }
 
 // getChildAt returns one child node.
@@ -282,56 +1255,96 @@ func (tx *Tx) getChildAt(n *tree.Node, i int) *tree.Node {
 	return tx.getNode(n.GetChildID(i), n)
 }
 
+// childPosition returns index of child in its parent.
+func childPosition(n *tree.Node) int {
+	for i := 0; i < n.Parent.KeyCount(); i++ {
+		if n.Parent.GetChildID(i) == n.Index {
+			return i
+		}
+	}
+	panic(fmt.Sprintf("%s not found in parent", n))
+}
+
 // spill recursively splits node and writes to pages(not to disk).
-func (tx *Tx) spillNode(n *tree.Node) bool {
+func (tx *Tx) spillNode(n *tree.Node) error {
 	if n.Spilled {
-		return true
+		return nil
 	}
-	// Spill children first
-	for i := 0; i < n.KeyCount(); i++ {
-		ch := tx.getChildAt(n, i)
-		ok := tx.spillNode(ch)
-		if !ok {
-			return false
+	// Spill materialized children first.
+	// Spilling children changes n.Cids, so collect them beforehand.
+	if !n.IsLeaf {
+		children := []*tree.Node{}
+		for _, cid := range n.Cids {
+			ch, exist := tx.nodes[cid]
+			if exist {
+				children = append(children, ch)
+			}
+		}
+		for _, ch := range children {
+			err := tx.spillNode(ch)
+			if err != nil {
+				return err
+			}
 		}
 	}
 	// Split self
-	for _, node := range n.Split() {
-		// Ensure page for each node.
+	nodes := n.SplitFill(tx.db.fillPercent)
+	tx.countSplit(len(nodes))
+	for _, node := range nodes {
 		// Only the first node could have associated page,
 		// free this page first.
 		if node.Index != 0 {
-			tx.db.freelist.Add(tx.getPage(node.Index))
-			// Mark node as page-freed
-			node.Index = 0
+			tx.freePage(node.Index)
 		}
 		// Then allocate page for node.
-		// For simplicity, allocate one more page
-		p, ok := tx.allocate((n.Size() / page.PageSize) + 1)
-		if !ok {
-			return false
+		size := node.Size()
+		p, err := tx.allocate((size + page.PageSize - 1) / page.PageSize)
+		if err != nil {
+			return err
+		}
+		node.Index = p.Index()
+		overflows, err := tx.writeOverflows(node)
+		if err != nil {
+			return err
 		}
-		node.Index = p.Index
 		// Write to page
-		node.WritePage(p)
+		node.WritePage(p, overflows)
 		node.Spilled = true
-		if node.Key == nil {
-			node.Key = node.Keys[0]
-		}
+		tx.stats.PagesDirtied++
 
-		// Insert new node to parent.
+		// Insert new node to parent, or update existing index.
 		if !node.IsRoot() {
-			_, i := node.Parent.Search(node.Key)
-			node.Parent.InsertKeyChildAt(i, node.Key, node.Index)
+			parent := node.Parent
+			key := node.Keys[0]
+			found := false
+			i := 0
+			if node.Key != nil {
+				found, i = parent.SearchFunc(node.Key, tx.db.compare)
+			}
+			if found {
+				parent.Keys[i] = key
+				parent.SetChildID(i, node.Index)
+			} else {
+				_, i = parent.SearchFunc(key, tx.db.compare)
+				parent.InsertKeyChildAt(i, key, node.Index)
+			}
+		}
+		if node.KeyCount() > 0 {
+			node.Key = node.Keys[0]
 		}
 	}
-	return true
+	// Root split creates a new parent, which needs spill too.
+	if n.Parent != nil && n.Parent.Index == 0 {
+		return tx.spillNode(n.Parent)
+	}
+	return nil
 }
 
 // merge merges underfill nodes.
-// merge runs a bottom-up way.
+// merge runs a bottom-up way. It stops on a sibling failed to read,
+// commit returns the error then.
 func (tx *Tx) merge(n *tree.Node) {
-	if n.Balanced {
+	if n.Balanced || tx.readErr != nil {
 		return
 	}
 	n.Balanced = true
@@ -343,75 +1356,157 @@ func (tx *Tx) merge(n *tree.Node) {
 		// When root has only one child, merge with it
 		if !n.IsLeaf && n.KeyCount() == 1 {
 			child := tx.getChildAt(n, 0)
+			if tx.readErr != nil {
+				return
+			}
 
 			n.IsLeaf = child.IsLeaf
 			n.Keys = child.Keys
 			n.Values = child.Values
+			n.Stored = child.Stored
+			n.Merged = child.Merged
 			n.Cids = child.Cids
 			// Reparent grand children
-			for i := 0; i < n.KeyCount(); i++ {
-				tx.getChildAt(n, i).Parent = n
-			}
+			tx.reparent(n, n)
 			tx.freeNode(child)
+			tx.countMerge()
+			// Root may still have only one child
+			n.Balanced = false
+			tx.merge(n)
 		}
 		return
 	}
 
+	parent := n.Parent
 	if n.KeyCount() == 0 {
 		// Remove empty node, also remove inode from parent
-		// n.key could be different to Parent index key
-		_, i := n.Parent.Search(n.Key)
-		n.Parent.RemoveKeyChildAt(i)
+		parent.RemoveKeyChildAt(childPosition(n))
 		tx.freeNode(n)
+		tx.countMerge()
 		// check parent merge
-		tx.merge(n.Parent)
+		parent.Balanced = false
+		tx.merge(parent)
 		return
 	}
 
-	if n.Parent.KeyCount() < 2 {
-		panic("Parent should have at least one child")
+	if parent.KeyCount() < 2 {
+		// No sibling to merge with, parent will be merged later.
+		parent.Balanced = false
+		tx.merge(parent)
+		return
 	}
 
 	var from *tree.Node
 	var to *tree.Node
 	var fromIdx int
 
-	if n.Index == n.Parent.Cids[0] {
+	pos := childPosition(n)
+	if pos == 0 {
 		// Leftmost node, merge right sibling with it
 		fromIdx = 1
-		from = tx.getChildAt(n.Parent, 1)
+		from = tx.getChildAt(parent, 1)
 		to = n
 	} else {
 		// merge current node with left sibling
-		_, i := n.Parent.Search(n.Key)
-		fromIdx = i
+		fromIdx = pos
 		from = n
-		to = tx.getChildAt(n.Parent, i-1)
+		to = tx.getChildAt(parent, pos-1)
+	}
+	if tx.readErr != nil {
+		return
 	}
 
 	// Check node type
 	if from.IsLeaf != to.IsLeaf {
 		panic("Sibling nodes should have same type")
 	}
-	// Reparent from node child
-	for i := 0; i < from.KeyCount(); i++ {
-		tx.getChildAt(from, i).Parent = to
+	if tx.borrow(to, from) {
+		return
 	}
+	// Reparent from node child
+	tx.reparent(from, to)
 
-	to.Keys = append(to.Keys, from.Keys...)
-	to.Values = append(to.Values, from.Values...)
-	to.Cids = append(to.Cids, from.Cids...)
+	to.AppendPairs(from)
 
-	n.Parent.RemoveKeyChildAt(fromIdx)
+	parent.RemoveKeyChildAt(fromIdx)
 	tx.freeNode(from)
-	tx.merge(n.Parent)
+	tx.countMerge()
+	parent.Balanced = false
+	tx.merge(parent)
+}
+
+// borrow moves pairs between siblings left and right, when merging
+// them makes a node which splits again at spill. Pairs move towards
+// the underfill one until it's filled or the other would underfill.
+// Returns false when siblings should be merged instead.
+func (tx *Tx) borrow(left, right *tree.Node) bool {
+	if left.Size()+right.Size()-page.HeaderSize <= page.PageSize {
+		return false
+	}
+	if left.Underfill() {
+		for left.Underfill() {
+			tx.movePair(right, 0, left, left.KeyCount())
+			if right.Underfill() {
+				tx.movePair(left, left.KeyCount()-1, right, 0)
+				break
+			}
+		}
+	} else {
+		for right.Underfill() {
+			tx.movePair(left, left.KeyCount()-1, right, 0)
+			if left.Underfill() {
+				tx.movePair(right, 0, left, left.KeyCount())
+				break
+			}
+		}
+	}
+	// Index of right node in parent is its first key
+	parent := right.Parent
+	parent.Keys[childPosition(right)] = right.Keys[0]
+	right.Key = right.Keys[0]
+	return true
+}
+
+// movePair moves pair i of from to position j of to.
+func (tx *Tx) movePair(from *tree.Node, i int, to *tree.Node, j int) {
+	if from.IsLeaf {
+		ov := from.StoredAt(i)
+		merged := from.MergeAt(i)
+		key, value := from.RemoveKeyValueAt(i)
+		to.InsertKeyValueAt(j, key, value)
+		if ov.Head != 0 {
+			to.SetStoredAt(j, ov)
+		}
+		if merged {
+			to.SetMergeAt(j)
+		}
+		return
+	}
+	key, cid := from.RemoveKeyChildAt(i)
+	to.InsertKeyChildAt(j, key, cid)
+	ch, exist := tx.nodes[cid]
+	if exist {
+		ch.Parent = to
+	}
+}
+
+// reparent sets parent of materialized children of from to node to.
+func (tx *Tx) reparent(from, to *tree.Node) {
+	if from.IsLeaf {
+		return
+	}
+	for _, cid := range from.Cids {
+		ch, exist := tx.nodes[cid]
+		if exist {
+			ch.Parent = to
+		}
+	}
 }
 
 // freeNode returns page to freelistx.
 func (tx *Tx) freeNode(n *tree.Node) {
 	delete(tx.nodes, n.Index)
-	delete(tx.pages, n.Index)
 	if n.Index != 0 {
-		tx.db.freelist.Add(tx.getPage(n.Index))
+		tx.freePage(n.Index)
 	}
 }
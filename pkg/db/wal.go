@@ -0,0 +1,192 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/daicang/mk/pkg/common"
+	"github.com/daicang/mk/pkg/page"
+	"github.com/daicang/mk/pkg/wal"
+)
+
+const (
+	// WALSuffix is appended to DB path to name the write-ahead log.
+	WALSuffix = "-wal"
+	// DefaultWALCheckpointSize is default Options.WALCheckpointSize.
+	DefaultWALCheckpointSize = 4 << 20
+)
+
+// CheckpointMode tells DB.Checkpoint how to treat a running commit.
+type CheckpointMode int
+
+const (
+	// CheckpointPassive skips checkpoint when a commit is writing.
+	CheckpointPassive CheckpointMode = iota
+	// CheckpointFull waits for the writing commit.
+	CheckpointFull
+)
+
+// Checkpoint syncs DB file and truncates write-ahead log, returns the
+// number of logged pages it applied. Commits write pages to DB file
+// right after logging them, so checkpoint only makes them durable in
+// DB file, and moves DurableTxID to the last commit.
+// It returns ErrWALDisabled without Options.WAL.
+func (db *DB) Checkpoint(mode CheckpointMode) (int, error) {
+	if db.wal == nil {
+		return 0, ErrWALDisabled
+	}
+	if mode == CheckpointPassive {
+		select {
+		case db.walSem <- struct{}{}:
+		default:
+			return 0, nil
+		}
+	} else {
+		db.walSem <- struct{}{}
+	}
+	defer func() {
+		<-db.walSem
+	}()
+	if atomic.LoadInt32(&db.state) == stateClosed {
+		return 0, ErrDBClosed
+	}
+	return db.checkpoint()
+}
+
+// checkpoint syncs DB file and truncates log, caller holds walSem.
+func (db *DB) checkpoint() (int, error) {
+	db.metalock.Lock()
+	txid := db.meta.txid
+	db.metalock.Unlock()
+	err := db.file.Sync()
+	if err != nil {
+		return 0, db.ioError(fmt.Errorf("sync for checkpoint: %w", err))
+	}
+	pages := db.wal.Pages()
+	err = db.wal.Truncate()
+	if err != nil {
+		return 0, db.ioError(fmt.Errorf("truncate WAL: %w", err))
+	}
+	db.metalock.Lock()
+	if txid > db.durableTxid {
+		db.durableTxid = txid
+	}
+	db.metalock.Unlock()
+	return pages, nil
+}
+
+// autoCheckpoint checkpoints when log reaches Options.WALCheckpointSize.
+// Commits are durable in the log, so a failure is only logged.
+func (db *DB) autoCheckpoint() {
+	db.walSem <- struct{}{}
+	defer func() {
+		<-db.walSem
+	}()
+	if db.wal.Size() < db.walCheckpointSize {
+		return
+	}
+	_, err := db.checkpoint()
+	if err != nil {
+		db.logger.Error(err, "Failed to checkpoint WAL")
+	}
+}
+
+// openWAL opens write-ahead log and replays its commits to DB file.
+//
+// Commits are logged before their pages are written, so a torn write
+// is repaired by writing the pages again. Commits without sync may
+// reach DB file before the log, then the log is older than DB file,
+// and replaying it would overwrite newer pages, so it's dropped.
+func (db *DB) openWAL() error {
+	l, err := wal.Open(db.path + WALSuffix)
+	if err != nil {
+		return fmt.Errorf("open WAL: %w", err)
+	}
+	err = db.replayWAL(l)
+	if err == nil {
+		err = l.Truncate()
+	}
+	if err != nil {
+		_ = l.Close()
+		return fmt.Errorf("replay WAL: %w", err)
+	}
+	db.wal = l
+	db.walSem = make(chan struct{}, 1)
+	return nil
+}
+
+// replayWAL writes pages of logged commits to DB file and syncs it.
+func (db *DB) replayWAL(l *wal.Log) error {
+	last, logged := uint64(0), false
+	err := l.Replay(func(txid uint64, _ []wal.Image) error {
+		last, logged = txid, true
+		return nil
+	})
+	if err != nil || !logged {
+		return err
+	}
+	fileTxid := uint64(0)
+	buf := make([]byte, 2*page.PageSize)
+	_, err = db.file.ReadAt(buf, 0)
+	if err == nil {
+		// Both metas may be torn, then the log has the meta
+		mt, _, merr := pickMeta(page.FromBuffer(buf, 0), page.FromBuffer(buf, 1))
+		if merr == nil {
+			fileTxid = mt.txid
+		}
+	}
+	if fileTxid > last {
+		db.logger.Info("Drop WAL older than DB file", "wal", last, "file", fileTxid)
+		return nil
+	}
+	pages := 0
+	err = l.Replay(func(txid uint64, images []wal.Image) error {
+		pages += len(images)
+		for _, img := range images {
+			_, err := db.file.WriteAt(img.Data, int64(img.ID)*int64(page.PageSize))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	db.logger.Info("Replayed WAL", "txid", last, "pages", pages)
+	return db.file.Sync()
+}
+
+// closeWAL closes and removes the log, DB file is synced.
+func (db *DB) closeWAL() error {
+	db.walSem <- struct{}{}
+	defer func() {
+		<-db.walSem
+	}()
+	err := db.wal.Close()
+	if err != nil {
+		return err
+	}
+	return os.Remove(db.path + WALSuffix)
+}
+
+// writeLog appends dirty pages and meta to the log, syncs it for
+// synced commits.
+func (tx *Tx) writeLog() error {
+	images := make([]wal.Image, 0, len(tx.pages)+1)
+	for _, p := range tx.pages {
+		size := (p.Overflow() + 1) * page.PageSize
+		buf := (*[common.MmapMaxSize]byte)(unsafe.Pointer(p))
+		images = append(images, wal.Image{ID: p.Index(), Data: buf[:size]})
+	}
+	id, buf := tx.metaBuffer()
+	images = append(images, wal.Image{ID: id, Data: buf})
+	err := tx.db.wal.Append(tx.id, images, tx.sync)
+	tx.db.pagePool.put(page.FromBuffer(buf, 0))
+	if err != nil {
+		return tx.db.ioError(fmt.Errorf("write WAL: %w", err))
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestWAL(t *testing.T) {
+	path := dataPath(t)
+	db, err := Open(Options{Path: path, WAL: true})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	kvs := map[string]string{}
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 1000; i++ {
+			kvs[fmt.Sprintf("key-%04d", i)] = fmt.Sprintf("value-%d-%d", round, i)
+		}
+		fillDB(t, db, kvs)
+	}
+	if db.wal.Size() == 0 {
+		t.Error("Expect commits in WAL")
+	}
+	if db.DurableTxID() != db.meta.txid {
+		t.Errorf("Expect commit durable in WAL, durable %d, last %d", db.DurableTxID(), db.meta.txid)
+	}
+
+	// Passive checkpoint doesn't wait for a writing commit
+	db.walSem <- struct{}{}
+	if pages, err := db.Checkpoint(CheckpointPassive); pages != 0 || err != nil {
+		t.Errorf("Expect passive checkpoint skipped, get %d, %v", pages, err)
+	}
+	<-db.walSem
+	pages, err := db.Checkpoint(CheckpointFull)
+	if err != nil {
+		t.Fatalf("Failed to checkpoint: %v", err)
+	}
+	if pages == 0 || db.wal.Size() != 0 {
+		t.Errorf("Checkpoint applied %d pages, WAL size %d", pages, db.wal.Size())
+	}
+	if pages, err := db.Checkpoint(CheckpointPassive); pages != 0 || err != nil {
+		t.Errorf("Expect empty checkpoint, get %d, %v", pages, err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	if _, err := os.Stat(path + WALSuffix); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expect WAL removed on close, get %v", err)
+	}
+	if _, err := db.Checkpoint(CheckpointFull); !errors.Is(err, ErrDBClosed) {
+		t.Errorf("Expect ErrDBClosed, get %v", err)
+	}
+	checkBackup(t, path, kvs)
+
+	db = openDB(t)
+	if _, err := db.Checkpoint(CheckpointFull); !errors.Is(err, ErrWALDisabled) {
+		t.Errorf("Expect ErrWALDisabled, get %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+}
+
+func TestWALAutoCheckpoint(t *testing.T) {
+	db, err := Open(Options{Path: dataPath(t), WAL: true, WALCheckpointSize: 1})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+	fillDB(t, db, map[string]string{"key": "value"})
+	if db.wal.Size() != 0 {
+		t.Errorf("Expect WAL checkpointed after commit, size %d", db.wal.Size())
+	}
+}
+
+// crashCopy copies DB file and WAL of open db to a new path, as they
+// would be found after a crash.
+func crashCopy(t *testing.T, db *DB, damage func(data, log []byte) ([]byte, []byte)) string {
+	t.Helper()
+	data, err := ioutil.ReadFile(db.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log, err := ioutil.ReadFile(db.path + WALSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, log = damage(data, log)
+	path := dataPath(t)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path+WALSuffix, log, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestWALReplay(t *testing.T) {
+	db, err := Open(Options{Path: dataPath(t), WAL: true})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+	kvs := map[string]string{}
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 500; i++ {
+			kvs[fmt.Sprintf("key-%d-%04d", round, i)] = fmt.Sprintf("value-%d", i)
+		}
+		fillDB(t, db, kvs)
+	}
+	// Lost DB file writes and a torn log tail
+	path := crashCopy(t, db, func(data, log []byte) ([]byte, []byte) {
+		return make([]byte, len(data)), append(log, 1, 2, 3)
+	})
+	stale := crashCopy(t, db, func(data, log []byte) ([]byte, []byte) {
+		return data, log
+	})
+
+	rdb, err := Open(Options{Path: path, WAL: true})
+	if err != nil {
+		t.Fatalf("Failed to open with WAL: %v", err)
+	}
+	if errs := checkErrors(t, rdb); len(errs) != 0 {
+		t.Errorf("Check after replay: %v", errs)
+	}
+	if err := rdb.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	checkBackup(t, path, kvs)
+
+	// Log older than DB file is dropped
+	kvs["later"] = "commit"
+	fillDB(t, db, kvs)
+	path = crashCopy(t, db, func(data, _ []byte) ([]byte, []byte) {
+		log, err := ioutil.ReadFile(stale + WALSuffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data, log
+	})
+	rdb, err = Open(Options{Path: path, WAL: true})
+	if err != nil {
+		t.Fatalf("Failed to open with stale WAL: %v", err)
+	}
+	if err := rdb.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	checkBackup(t, path, kvs)
+}
@@ -0,0 +1,73 @@
+package db
+
+import (
+	"unsafe"
+
+	"github.com/daicang/mk/pkg/common"
+	"github.com/daicang/mk/pkg/kv"
+	"github.com/daicang/mk/pkg/page"
+	"github.com/daicang/mk/pkg/tree"
+)
+
+// warmSink keeps page reads of Warm from being optimized out.
+var warmSink byte
+
+// Warm reads all pages of subtrees holding keys with given prefix,
+// so they are loaded into OS page cache. Nil prefix warms the whole tree,
+// so does any prefix without bytewise order, see DB.Bytewise.
+// Returns the number of pages read.
+func (db *DB) Warm(prefix kv.Key) int {
+	tx, err := NewReadOnlyTx(db)
+	if err != nil {
+		return 0
+	}
+	defer tx.close()
+	r := kv.PrefixRange(prefix)
+	if !db.Bytewise() {
+		r = kv.Range{}
+	}
+	return tx.warmNode(tx.root, r)
+}
+
+// warmNode touches node page and pages of children overlapping r.
+func (tx *Tx) warmNode(n *tree.Node, r kv.Range) int {
+	count := tx.touchPage(n.Index)
+	if n.IsLeaf {
+		return count + tx.touchOverflows(n.Index)
+	}
+	for i := 0; i < n.KeyCount(); i++ {
+		// Child i holds keys in [Keys[i], Keys[i+1]), the first child
+		// also holds keys smaller than Keys[0].
+		if i > 0 && r.AfterEndFunc(n.GetKeyAt(i), tx.db.compare) {
+			break
+		}
+		if i+1 < n.KeyCount() && r.Start != nil && tx.db.compare(n.GetKeyAt(i+1), r.Start) <= 0 {
+			continue
+		}
+		count += tx.warmNode(tx.peekNode(n.GetChildID(i), n), r)
+	}
+	return count
+}
+
+// touchOverflows touches overflow pages of leaf page, returns page count.
+func (tx *Tx) touchOverflows(id common.Pgid) int {
+	count := 0
+	p := tx.getPage(id)
+	for i := 0; i < p.Count(); i++ {
+		for oid := p.GetOverflowAt(i); oid != 0; oid = tx.getPage(oid).GetOverflowNext() {
+			count += tx.touchPage(oid)
+		}
+	}
+	return count
+}
+
+// touchPage reads one byte of each memory page, returns page count.
+func (tx *Tx) touchPage(id common.Pgid) int {
+	p := tx.getPage(id)
+	buf := (*[common.MmapMaxSize]byte)(unsafe.Pointer(p))
+	count := p.Overflow() + 1
+	for i := 0; i < count; i++ {
+		warmSink += buf[i*page.PageSize]
+	}
+	return count
+}
@@ -0,0 +1,41 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/daicang/mk/pkg/tree"
+)
+
+func TestWarm(t *testing.T) {
+	db := openDB(t)
+	if count := db.Warm(nil); count != 1 {
+		t.Errorf("Expect only root page in empty DB, get %d", count)
+	}
+
+	kvs := map[string]string{}
+	for i := 0; i < 10000; i++ {
+		kvs[fmt.Sprintf("%c-%05d", 'a'+i%5, i)] = fmt.Sprint(i)
+	}
+	fillDB(t, db, kvs)
+
+	tx, _ := NewReadOnlyTx(db)
+	total := 0
+	tx.forEachNode(func(n *tree.Node, depth int) {
+		total += tx.getPage(n.Index).Overflow() + 1
+	})
+	depth := tx.TreeProfile().Depth
+
+	if count := db.Warm(nil); count != total {
+		t.Errorf("Expect to warm all %d pages, get %d", total, count)
+	}
+	for _, prefix := range []string{"a", "c-", "e-09995"} {
+		count := db.Warm([]byte(prefix))
+		if count < depth || count > total/3 {
+			t.Errorf("Prefix %s: expect part of %d pages, get %d", prefix, total, count)
+		}
+	}
+	if count := db.Warm([]byte("z")); count > depth+1 {
+		t.Errorf("Expect only the path to the last leaf, get %d", count)
+	}
+}
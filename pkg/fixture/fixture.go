@@ -0,0 +1,164 @@
+// Package fixture writes and verifies canonical DB files,
+// used to detect accidental on-disk format changes.
+package fixture
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/daicang/mk/pkg/db"
+)
+
+// FormatVersion is the on-disk format written by current code, fixture
+// of each version up to it is kept in testdata.
+const FormatVersion = db.FormatVersion
+
+// ErrMismatch is returned when fixture content differs from Pairs.
+var ErrMismatch = errors.New("fixture content mismatch")
+
+const (
+	pairCount = 600
+)
+
+// Options returns options to write and read fixture of given format
+// version at path. A fixture enables the feature which changed layout
+// in its version, so the feature is covered by compatibility tests.
+func Options(path string, version int) db.Options {
+	opts := db.Options{Path: path}
+	switch version {
+	case 4:
+		// Comparator name in meta
+		opts.Compare = reverse
+		opts.CompareName = "fixture-reverse"
+	case 5:
+		// Compressed bit of values in overflow pages
+		opts.Compression = db.CompressionFlate
+	case 6:
+		// Encrypted page slots and key check in meta
+		opts.EncryptionKey = []byte("mk fixture encryption key 32byte")
+	}
+	return opts
+}
+
+// reverse orders keys in reverse bytewise order.
+func reverse(a, b []byte) int {
+	return bytes.Compare(b, a)
+}
+
+// Pairs returns canonical content of fixture DB.
+// Content is deterministic: it mixes key/value sizes so fixture has
+// several levels and one multi-page node.
+func Pairs() map[string]string {
+	kvs := map[string]string{}
+	for i := 0; i < pairCount; i++ {
+		// Every third key is removed by Generate
+		if i%3 == 2 {
+			continue
+		}
+		key := fmt.Sprintf("fixture-%05d", i)
+		kvs[key] = strings.Repeat(string(rune('a'+i%26)), i%97)
+	}
+	kvs["large"] = strings.Repeat("L", 3*4096)
+	return kvs
+}
+
+// Generate writes fixture DB of FormatVersion to given path.
+// Pairs are written in two commits and then partly removed,
+// so the freelist is not empty.
+func Generate(path string) error {
+	d, err := db.Open(Options(path, FormatVersion))
+	if err != nil {
+		return fmt.Errorf("open fixture: %w", err)
+	}
+	err = generate(d)
+	cerr := d.Close()
+	if err != nil {
+		return err
+	}
+	return cerr
+}
+
+// generate writes pairs of Generate to d. Update rolls back the tx of a
+// failed step.
+func generate(d *db.DB) error {
+	kvs := Pairs()
+	keys := []string{}
+	for i := 0; i < pairCount; i++ {
+		keys = append(keys, fmt.Sprintf("fixture-%05d", i))
+	}
+
+	for _, half := range [][]string{keys[:pairCount/2], keys[pairCount/2:]} {
+		err := d.Update(func(tx *db.Tx) error {
+			for _, key := range half {
+				_, err := tx.Set([]byte(key), []byte("placeholder"))
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return d.Update(func(tx *db.Tx) error {
+		for _, key := range keys {
+			var err error
+			value, exist := kvs[key]
+			if exist {
+				_, err = tx.Set([]byte(key), []byte(value))
+			} else {
+				_, err = tx.Remove([]byte(key))
+			}
+			if err != nil {
+				return err
+			}
+		}
+		_, err := tx.Set([]byte("large"), []byte(kvs["large"]))
+		return err
+	})
+}
+
+// Verify opens fixture DB of given format version and checks it holds
+// exactly Pairs.
+func Verify(path string, version int) error {
+	d, err := db.Open(Options(path, version))
+	if err != nil {
+		return fmt.Errorf("open fixture: %w", err)
+	}
+	err = d.View(verify)
+	cerr := d.Close()
+	if err != nil {
+		return err
+	}
+	return cerr
+}
+
+// verify checks tx holds exactly Pairs.
+func verify(tx *db.Tx) error {
+	kvs := Pairs()
+	keys := []string{}
+	for key := range kvs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := tx.Get([]byte(key))
+		if value == nil {
+			return fmt.Errorf("%w: key %s not found", ErrMismatch, key)
+		}
+		if string(value) != kvs[key] {
+			return fmt.Errorf("%w: key %s has value %q", ErrMismatch, key, value)
+		}
+	}
+	profile := tx.TreeProfile()
+	count := profile.Levels[profile.Depth-1].Keys
+	if count != len(kvs) {
+		return fmt.Errorf("%w: expect %d keys, get %d", ErrMismatch, len(kvs), count)
+	}
+	return nil
+}
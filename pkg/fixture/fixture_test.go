@@ -0,0 +1,176 @@
+package fixture
+
+import (
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/daicang/mk/pkg/db"
+	"github.com/daicang/mk/pkg/page"
+)
+
+var (
+	update = flag.Bool("update", false, "regenerate fixture and golden pages of current format version")
+)
+
+// fixturePath returns fixture path of given format version.
+// Fixtures are written with 4KB pages.
+func fixturePath(version int) string {
+	return filepath.Join("testdata", fmt.Sprintf("v%d.db", version))
+}
+
+// copyFixture copies fixture to temp dir, so tests never modify it.
+func copyFixture(t *testing.T, src string) string {
+	buf, err := ioutil.ReadFile(src)
+	if err != nil {
+		t.Fatalf("Failed to read fixture: %v", err)
+	}
+	dst := filepath.Join(t.TempDir(), filepath.Base(src))
+	err = ioutil.WriteFile(dst, buf, 0600)
+	if err != nil {
+		t.Fatalf("Failed to copy fixture: %v", err)
+	}
+	return dst
+}
+
+func TestGenerate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data")
+	err := Generate(path)
+	if err != nil {
+		t.Fatalf("Failed to generate: %v", err)
+	}
+	err = Verify(path, FormatVersion)
+	if err != nil {
+		t.Fatalf("Failed to verify: %v", err)
+	}
+
+	if *update {
+		_ = os.Remove(fixturePath(FormatVersion))
+		err = Generate(fixturePath(FormatVersion))
+		if err != nil {
+			t.Fatalf("Failed to update fixture: %v", err)
+		}
+	}
+}
+
+func TestCompatibility(t *testing.T) {
+	if page.PageSize != 4096 {
+		t.Skipf("Fixtures use 4KB pages, OS page size is %d", page.PageSize)
+	}
+	for version := 1; version <= FormatVersion; version++ {
+		path := copyFixture(t, fixturePath(version))
+		err := Verify(path, version)
+		if err != nil {
+			t.Errorf("Format version %d: %v", version, err)
+		}
+		// Older files are upgraded by the first commit
+		d, err := db.Open(Options(path, version))
+		if err != nil {
+			t.Fatalf("Format version %d: %v", version, err)
+		}
+		err = d.Update(func(tx *db.Tx) error {
+			_, err := tx.Set([]byte("upgraded"), []byte("1"))
+			return err
+		})
+		if err != nil {
+			t.Errorf("Format version %d: failed to commit: %v", version, err)
+		}
+		_ = d.View(func(tx *db.Tx) error {
+			if v := tx.Info().FormatVersion; v != FormatVersion {
+				t.Errorf("Format version %d: expect version %d after commit, get %d", version, FormatVersion, v)
+			}
+			return nil
+		})
+		_ = d.Close()
+	}
+}
+
+// goldenPath returns golden file path of the first page of given type.
+func goldenPath(typ string) string {
+	return filepath.Join("testdata", "pages", typ+".page")
+}
+
+// goldenTypes are page types locked by golden files.
+var goldenTypes = []string{"meta", "freelist", "internal", "leaf", "overflow"}
+
+// firstPages returns bytes of the first page of each golden type in
+// the DB file at path, with the pages it covers.
+func firstPages(t *testing.T, path string) map[string][]byte {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := db.Open(Options(path, FormatVersion))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = d.Close() }()
+	pages := map[string][]byte{}
+	err = d.View(func(tx *db.Tx) error {
+		for _, info := range tx.Pages() {
+			if _, ok := pages[info.Type]; ok {
+				continue
+			}
+			start := int(info.ID) * page.PageSize
+			pages[info.Type] = buf[start : start+(info.Overflow+1)*page.PageSize]
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pages
+}
+
+// TestGoldenPages locks the byte layout of pages written by Generate,
+// which is deterministic. A change of layout must come with a new
+// FormatVersion, then run with -update to write new fixture and pages.
+func TestGoldenPages(t *testing.T) {
+	if page.PageSize != 4096 {
+		t.Skipf("Golden pages are 4KB, OS page size is %d", page.PageSize)
+	}
+	path := filepath.Join(t.TempDir(), "data")
+	err := Generate(path)
+	if err != nil {
+		t.Fatalf("Failed to generate: %v", err)
+	}
+	pages := firstPages(t, path)
+	for _, typ := range goldenTypes {
+		got, ok := pages[typ]
+		if !ok {
+			t.Fatalf("Fixture has no %s page", typ)
+		}
+		if *update {
+			err = ioutil.WriteFile(goldenPath(typ), got, 0644)
+			if err != nil {
+				t.Fatalf("Failed to update golden page: %v", err)
+			}
+			continue
+		}
+		expect, err := ioutil.ReadFile(goldenPath(typ))
+		if err != nil {
+			t.Fatalf("Failed to read golden page: %v", err)
+		}
+		if bytes.Equal(got, expect) {
+			continue
+		}
+		if len(got) != len(expect) {
+			t.Errorf("%s page: expect %d bytes, get %d", typ, len(expect), len(got))
+			continue
+		}
+		// Show the first 16-byte line which differs
+		for i := range got {
+			if got[i] != expect[i] {
+				line := i / 16 * 16
+				t.Errorf("%s page differs at offset %#x, expect:\n%sget:\n%s", typ, i,
+					hex.Dump(expect[line:line+16]), hex.Dump(got[line:line+16]))
+				break
+			}
+		}
+	}
+}
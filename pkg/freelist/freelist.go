@@ -1,6 +1,9 @@
 package freelist
 
 import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
 	"sort"
 	"unsafe"
 
@@ -10,8 +13,33 @@ import (
 
 const (
 	maxFreeSlot = 1 << 34
+	// pgidSize is size of free page id in page, ids are little-endian.
+	pgidSize = 4
 )
 
+// Type is how free pages are indexed.
+type Type int
+
+const (
+	// TypeArray keeps free pages in a sorted array. Allocation scans it
+	// for the first run of pages, so it slows down as free pages grow.
+	TypeArray Type = iota
+	// TypeHashmap keeps free pages in maps of spans by size, so
+	// allocation and free take O(1) for large DB with many free pages.
+	TypeHashmap
+)
+
+// String returns type name for print.
+func (t Type) String() string {
+	switch t {
+	case TypeArray:
+		return "array"
+	case TypeHashmap:
+		return "hashmap"
+	}
+	return fmt.Sprintf("Type(%d)", int(t))
+}
+
 type pgids []common.Pgid
 
 func (p pgids) Len() int           { return len(p) }
@@ -46,24 +74,50 @@ func merge(a, b pgids) pgids {
 }
 
 // Freelist tracks unused page slots in mmap.
+// Pages freed by a transaction become pending when it commits, and are
+// reused only after Release, when no reader can still see them.
 type Freelist struct {
-	// free page ids
+	// free page ids of TypeArray
 	ids pgids
+	// spans holds free pages of TypeHashmap, nil for TypeArray
+	spans *spanMap
+	// pages freed by committed transactions, by transaction id
+	pending map[uint64]pgids
 	// pages to be freed by the end of transaction
 	txFreed pgids
+	// pages allocated by current transaction, returned on rollback
+	txAllocated pgids
 }
 
-// NewFreelist returns empty freelist.
+// NewFreelist returns empty freelist of TypeArray.
 func NewFreelist() *Freelist {
-	return &Freelist{
-		ids:     []common.Pgid{},
-		txFreed: []common.Pgid{},
+	return New(TypeArray)
+}
+
+// New returns empty freelist of given type.
+func New(typ Type) *Freelist {
+	f := &Freelist{
+		ids:         pgids{},
+		pending:     map[uint64]pgids{},
+		txFreed:     pgids{},
+		txAllocated: pgids{},
 	}
+	if typ == TypeHashmap {
+		f.spans = newSpanMap()
+	}
+	return f
 }
 
 // Allocate find n contiguous pages slots from freelist,
 // returns (start pgid, succeed)
 func (f *Freelist) Allocate(n int) (common.Pgid, bool) {
+	if f.spans != nil {
+		start, ok := f.spans.allocate(n)
+		for i := 0; ok && i < n; i++ {
+			f.txAllocated = append(f.txAllocated, start+common.Pgid(i))
+		}
+		return start, ok
+	}
 	startID := common.Pgid(0)
 	lastID := common.Pgid(0)
 
@@ -75,6 +129,7 @@ func (f *Freelist) Allocate(n int) (common.Pgid, bool) {
 
 		if int(currentID-startID+1) == n {
 			// Found n continuous pages, take out from pgids
+			f.txAllocated = append(f.txAllocated, f.ids[i+1-n:i+1]...)
 			copy(f.ids[i+1-n:], f.ids[i+1:])
 			f.ids = f.ids[:len(f.ids)-n]
 
@@ -87,32 +142,169 @@ func (f *Freelist) Allocate(n int) (common.Pgid, bool) {
 	return 0, false
 }
 
+// Shrink takes free pages at the end of total pages, so the file can
+// be truncated to fewer pages, returns the new total. Like allocated
+// pages, they're returned on Rollback.
+func (f *Freelist) Shrink(total common.Pgid) common.Pgid {
+	if f.spans != nil {
+		start, ok := f.spans.shrink(total)
+		for id := start; ok && id < total; id++ {
+			f.txAllocated = append(f.txAllocated, id)
+		}
+		return start
+	}
+	i := len(f.ids)
+	for i > 0 && f.ids[i-1] == total-1 {
+		i--
+		total--
+	}
+	f.txAllocated = append(f.txAllocated, f.ids[i:]...)
+	f.ids = f.ids[:i]
+	return total
+}
+
 // Add adds page to freelist tx cache.
+// The page itself is left untouched, since it may live in the read-only mmap.
 func (f *Freelist) Add(p *page.Page) {
-	if p.Index == 0 {
-		panic("Page already freed")
+	if p.Index() == 0 {
+		panic("Cannot free meta page")
 	}
-	for i := 0; i <= p.Overflow; i++ {
-		f.txFreed = append(f.txFreed, p.Index+common.Pgid(i))
+	for i := 0; i <= p.Overflow(); i++ {
+		f.txFreed = append(f.txFreed, p.Index()+common.Pgid(i))
 	}
-	p.Index = 0
 }
 
-// Release put tx cache pages to freelist.
-func (f *Freelist) Release() {
-	sort.Sort(f.txFreed)
-	f.ids = merge(f.ids, f.txFreed)
+// Commit moves pages freed by transaction txid to pending.
+func (f *Freelist) Commit(txid uint64) {
+	if len(f.txFreed) > 0 {
+		sort.Sort(f.txFreed)
+		f.pending[txid] = merge(f.pending[txid], f.txFreed)
+	}
 	f.txFreed = pgids{}
+	f.txAllocated = pgids{}
+}
+
+// Release makes pages freed by transactions up to txid reusable,
+// returns sorted ids of released pages.
+// Pages freed by tx N are only referenced by snapshots before N,
+// so they can be reused once the oldest reader has id N or larger.
+func (f *Freelist) Release(txid uint64) []common.Pgid {
+	released := pgids{}
+	for id, ids := range f.pending {
+		if id <= txid {
+			released = merge(released, ids)
+			delete(f.pending, id)
+		}
+	}
+	f.free(released)
+	return released
+}
+
+// free makes sorted ids free.
+func (f *Freelist) free(ids pgids) {
+	if f.spans != nil {
+		f.spans.free(ids)
+		return
+	}
+	f.ids = merge(f.ids, ids)
+}
+
+// freeIDs returns sorted ids of free pages.
+func (f *Freelist) freeIDs() pgids {
+	if f.spans != nil {
+		return f.spans.ids()
+	}
+	return f.ids
 }
 
-// Rollback clears transaction freed pages.
+// Rollback returns pages allocated by transaction, and clears
+// transaction freed pages.
 func (f *Freelist) Rollback() {
-	f.txFreed = []common.Pgid{}
+	sort.Sort(f.txAllocated)
+	f.free(f.txAllocated)
+	f.txFreed = pgids{}
+	f.txAllocated = pgids{}
+}
+
+// PendingCount returns number of pending pages.
+func (f *Freelist) PendingCount() int {
+	count := 0
+	for _, ids := range f.pending {
+		count += len(ids)
+	}
+	return count
+}
+
+// FreeCount returns number of free pages, pending pages are not included.
+func (f *Freelist) FreeCount() int {
+	if f.spans != nil {
+		return f.spans.count
+	}
+	return len(f.ids)
+}
+
+// Stats describes free pages and how they're fragmented.
+type Stats struct {
+	// FreePages is number of free pages, pending pages not included
+	FreePages int
+	// PendingPages is number of pages waiting for readers to close
+	PendingPages int
+	// Spans is number of runs of contiguous free pages
+	Spans int
+	// LargestSpan is pages of the largest span, the largest allocation
+	// served without growing the file
+	LargestSpan int
+	// SpanHistogram counts spans by size, item i counts spans of
+	// [2^i, 2^(i+1)) pages
+	SpanHistogram []int
+}
+
+// addSpan counts span of size pages.
+func (s *Stats) addSpan(size, count int) {
+	s.Spans += count
+	if size > s.LargestSpan {
+		s.LargestSpan = size
+	}
+	class := bits.Len(uint(size)) - 1
+	for len(s.SpanHistogram) <= class {
+		s.SpanHistogram = append(s.SpanHistogram, 0)
+	}
+	s.SpanHistogram[class] += count
+}
+
+// Stats returns free page stats. Spans are counted from the span map
+// of TypeHashmap, and by a scan of free ids for TypeArray.
+func (f *Freelist) Stats() Stats {
+	s := Stats{
+		FreePages:    f.FreeCount(),
+		PendingPages: f.PendingCount(),
+	}
+	if f.spans != nil {
+		for _, size := range f.spans.sizes {
+			s.addSpan(size, len(f.spans.bySize[size]))
+		}
+		return s
+	}
+	for i := 0; i < len(f.ids); {
+		j := i + 1
+		for j < len(f.ids) && f.ids[j] == f.ids[j-1]+1 {
+			j++
+		}
+		s.addSpan(j-i, 1)
+		i = j
+	}
+	return s
+}
+
+// IDs returns free page ids, pending pages are not included.
+func (f *Freelist) IDs() []common.Pgid {
+	return append([]common.Pgid{}, f.freeIDs()...)
 }
 
 // Size returns size when write to memory page.
 func (f *Freelist) Size() int {
-	return page.HeaderSize + int(unsafe.Sizeof(uint32(0)))*len(f.ids)
+	count := f.FreeCount() + f.PendingCount() + len(f.txFreed)
+	return page.HeaderSize + pgidSize*count
 }
 
 // ReadPage reads freelist from page.
@@ -120,19 +312,36 @@ func (f *Freelist) ReadPage(p *page.Page) {
 	if !p.IsFreelist() {
 		panic("page type mismatch")
 	}
-	buf := (*[maxFreeSlot]common.Pgid)(unsafe.Pointer(&p.Data))
-	for i := 0; i < p.Count; i++ {
-		f.ids = append(f.ids, buf[i])
+	ids := make(pgids, p.Count())
+	buf := slotBuffer(p, len(ids))
+	for i := range ids {
+		ids[i] = common.Pgid(binary.LittleEndian.Uint32(buf[i*pgidSize:]))
 	}
+	f.free(ids)
 }
 
-// WritePage write freelist to page.
+// WritePage write freelist to page, as it will be after the transaction
+// commits. Pending pages are written as free, since there's no reader
+// when the file is opened again.
 // page header | pgid 1 | pgid 2 | ..
 func (f *Freelist) WritePage(p *page.Page) {
+	txFreed := append(pgids{}, f.txFreed...)
+	sort.Sort(txFreed)
+	ids := merge(f.freeIDs(), txFreed)
+	for _, pending := range f.pending {
+		ids = merge(ids, pending)
+	}
+
 	p.SetFlag(page.FlagFreelist)
-	p.Count = len(f.ids)
-	buf := (*[maxFreeSlot]common.Pgid)(unsafe.Pointer(&p.Data))
-	for i, id := range f.ids {
-		buf[i] = id
+	p.SetCount(len(ids))
+	buf := slotBuffer(p, len(ids))
+	for i, id := range ids {
+		binary.LittleEndian.PutUint32(buf[i*pgidSize:], uint32(id))
 	}
 }
+
+// slotBuffer returns data bytes of count free page ids in p.
+func slotBuffer(p *page.Page, count int) []byte {
+	size := count * pgidSize
+	return (*[maxFreeSlot * pgidSize]byte)(unsafe.Pointer(&p.Data))[:size:size]
+}
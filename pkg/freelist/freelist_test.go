@@ -1,6 +1,7 @@
 package freelist
 
 import (
+	"bytes"
 	"reflect"
 	"testing"
 
@@ -32,7 +33,7 @@ func TestMerge(t *testing.T) {
 	}
 
 	a = pgids{1, 3, 4, 7, 9}
-	b = pgids{2, 4, 6, 8, 10, 11, 12}
+	b = pgids{2, 5, 6, 8, 10, 11, 12}
 	expect = pgids{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
 	result = merge(b, a)
 	if !reflect.DeepEqual(result, expect) {
@@ -67,7 +68,7 @@ func TestAllocate(t *testing.T) {
 		t.Errorf("incorrect ids: %v", f.ids)
 	}
 
-	f.ids = pgids{1, 3, 5, 6, 7}
+	f.ids = pgids{1, 3, 5, 6, 8}
 	_, success = f.Allocate(3)
 	if success {
 		t.Errorf("allocate should fail")
@@ -93,4 +94,114 @@ func TestReadWrite(t *testing.T) {
 	if !reflect.DeepEqual(f.ids, f1.ids) {
 		t.Errorf("failed to read / write")
 	}
+	if !reflect.DeepEqual([]common.Pgid(f.ids), f1.IDs()) {
+		t.Errorf("IDs returns %v", f1.IDs())
+	}
+	// Ids are little-endian after header
+	if id := buf[page.HeaderSize+2*pgidSize:][:pgidSize]; !bytes.Equal(id, []byte{2, 0, 0, 0}) {
+		t.Errorf("Expect little-endian id 2, get %x", id)
+	}
+}
+
+func TestPending(t *testing.T) {
+	f := NewFreelist()
+	f.ids = pgids{3, 4, 5, 9}
+	newPage := func(id common.Pgid) *page.Page {
+		p := page.FromBuffer(make([]byte, page.PageSize), 0)
+		p.SetIndex(id)
+		return p
+	}
+
+	// Rollback returns allocated pages and drops freed ones
+	if _, ok := f.Allocate(2); !ok {
+		t.Fatal("allocate failed")
+	}
+	f.Add(newPage(7))
+	f.Rollback()
+	if !reflect.DeepEqual(f.ids, pgids{3, 4, 5, 9}) || len(f.txFreed) != 0 {
+		t.Errorf("incorrect ids after rollback: %v, freed %v", f.ids, f.txFreed)
+	}
+
+	// Committed frees are pending until released
+	id, _ := f.Allocate(1)
+	f.Add(newPage(8))
+	f.Add(newPage(2))
+	f.Commit(5)
+	if id != 3 || !reflect.DeepEqual(f.ids, pgids{4, 5, 9}) || !reflect.DeepEqual(f.pending[5], pgids{2, 8}) {
+		t.Errorf("incorrect ids after commit: %v, pending %v", f.ids, f.pending)
+	}
+	if _, ok := f.Allocate(3); ok {
+		t.Error("pending pages should not be allocated")
+	}
+
+	f.Add(newPage(10))
+	f.Commit(6)
+
+	// Written freelist holds pending and freed pages as free
+	f.Add(newPage(1))
+	buf := make([]byte, f.Size())
+	p := page.FromBuffer(buf, 0)
+	f.WritePage(p)
+	f1 := NewFreelist()
+	f1.ReadPage(p)
+	if !reflect.DeepEqual(f1.ids, pgids{1, 2, 4, 5, 8, 9, 10}) {
+		t.Errorf("incorrect written ids: %v", f1.ids)
+	}
+
+	// Pages are released by transaction id
+	f.Rollback()
+	f.Release(4)
+	if f.PendingCount() != 3 {
+		t.Errorf("expect 3 pending pages, get %v", f.pending)
+	}
+	released := f.Release(5)
+	if !reflect.DeepEqual(released, []common.Pgid{2, 8}) {
+		t.Errorf("incorrect released ids: %v", released)
+	}
+	if !reflect.DeepEqual(f.ids, pgids{2, 4, 5, 8, 9}) || f.PendingCount() != 1 {
+		t.Errorf("incorrect ids after release: %v, pending %v", f.ids, f.pending)
+	}
+	f.Release(6)
+	if !reflect.DeepEqual(f.ids, pgids{2, 4, 5, 8, 9, 10}) || f.PendingCount() != 0 || f.FreeCount() != 6 {
+		t.Errorf("incorrect ids after release: %v, pending %v", f.ids, f.pending)
+	}
+}
+
+func TestStats(t *testing.T) {
+	for _, typ := range []Type{TypeArray, TypeHashmap} {
+		f := New(typ)
+		f.free(pgids{2, 3, 4, 5, 7, 9, 10, 11})
+		f.pending[1] = pgids{20}
+		s := f.Stats()
+		expect := Stats{
+			FreePages:     8,
+			PendingPages:  1,
+			Spans:         3,
+			LargestSpan:   4,
+			SpanHistogram: []int{1, 1, 1},
+		}
+		if !reflect.DeepEqual(s, expect) {
+			t.Errorf("%s: expect %+v, get %+v", typ, expect, s)
+		}
+	}
+}
+
+func TestShrink(t *testing.T) {
+	for _, typ := range []Type{TypeArray, TypeHashmap} {
+		f := New(typ)
+		f.free(pgids{3, 5, 6, 7})
+		if total := f.Shrink(10); total != 10 {
+			t.Errorf("%s: expect 10 pages without free tail, get %d", typ, total)
+		}
+		if total := f.Shrink(8); total != 5 {
+			t.Errorf("%s: expect 5 pages after shrink, get %d", typ, total)
+		}
+		if !reflect.DeepEqual(f.IDs(), []common.Pgid{3}) {
+			t.Errorf("%s: incorrect ids after shrink: %v", typ, f.IDs())
+		}
+		f.Rollback()
+		if !reflect.DeepEqual(f.IDs(), []common.Pgid{3, 5, 6, 7}) {
+			t.Errorf("%s: incorrect ids after rollback: %v", typ, f.IDs())
+		}
+	}
 }
@@ -0,0 +1,126 @@
+package freelist
+
+import (
+	"sort"
+
+	"github.com/daicang/mk/pkg/common"
+)
+
+// spanMap indexes free pages as spans of contiguous pages, by first
+// page, last page and size. Freeing a page merges it with the spans
+// next to it, and allocation takes a span of the size, so both stay
+// O(1) however many pages are free. Allocating a size without spans
+// splits the smallest larger one, found by binary search of sizes.
+type spanMap struct {
+	// forward maps first page of span to its size
+	forward map[common.Pgid]int
+	// backward maps last page of span to its size
+	backward map[common.Pgid]int
+	// bySize holds first pages of spans by size
+	bySize map[int]map[common.Pgid]struct{}
+	// sizes are sorted keys of bySize
+	sizes []int
+	// count is number of free pages
+	count int
+}
+
+// newSpanMap returns empty span map.
+func newSpanMap() *spanMap {
+	return &spanMap{
+		forward:  map[common.Pgid]int{},
+		backward: map[common.Pgid]int{},
+		bySize:   map[int]map[common.Pgid]struct{}{},
+	}
+}
+
+// addSpan adds span of size pages from start, which must not touch
+// other spans.
+func (m *spanMap) addSpan(start common.Pgid, size int) {
+	m.forward[start] = size
+	m.backward[start+common.Pgid(size-1)] = size
+	starts, ok := m.bySize[size]
+	if !ok {
+		starts = map[common.Pgid]struct{}{}
+		m.bySize[size] = starts
+		i := sort.SearchInts(m.sizes, size)
+		m.sizes = append(m.sizes, 0)
+		copy(m.sizes[i+1:], m.sizes[i:])
+		m.sizes[i] = size
+	}
+	starts[start] = struct{}{}
+	m.count += size
+}
+
+// removeSpan removes span of size pages from start.
+func (m *spanMap) removeSpan(start common.Pgid, size int) {
+	delete(m.forward, start)
+	delete(m.backward, start+common.Pgid(size-1))
+	starts := m.bySize[size]
+	delete(starts, start)
+	if len(starts) == 0 {
+		delete(m.bySize, size)
+		i := sort.SearchInts(m.sizes, size)
+		m.sizes = append(m.sizes[:i], m.sizes[i+1:]...)
+	}
+	m.count -= size
+}
+
+// free adds pages of ids, merged with adjacent spans.
+func (m *spanMap) free(ids pgids) {
+	for _, id := range ids {
+		start, size := id, 1
+		if prev, ok := m.backward[id-1]; ok {
+			start -= common.Pgid(prev)
+			size += prev
+			m.removeSpan(start, prev)
+		}
+		if next, ok := m.forward[id+1]; ok {
+			size += next
+			m.removeSpan(id+1, next)
+		}
+		m.addSpan(start, size)
+	}
+}
+
+// allocate takes n contiguous pages, returns (start pgid, succeed).
+// The smallest span of at least n pages is taken, so large spans are
+// kept for large allocations. The rest of a larger span stays free.
+func (m *spanMap) allocate(n int) (common.Pgid, bool) {
+	i := sort.SearchInts(m.sizes, n)
+	if i == len(m.sizes) {
+		return 0, false
+	}
+	size := m.sizes[i]
+	for start := range m.bySize[size] {
+		m.removeSpan(start, size)
+		if size > n {
+			m.addSpan(start+common.Pgid(n), size-n)
+		}
+		return start, true
+	}
+	return 0, false
+}
+
+// shrink takes span ending at page total-1, returns (its start,
+// succeed), total when there's no such span.
+func (m *spanMap) shrink(total common.Pgid) (common.Pgid, bool) {
+	size, ok := m.backward[total-1]
+	if !ok {
+		return total, false
+	}
+	start := total - common.Pgid(size)
+	m.removeSpan(start, size)
+	return start, true
+}
+
+// ids returns sorted ids of free pages.
+func (m *spanMap) ids() pgids {
+	ids := make(pgids, 0, m.count)
+	for start, size := range m.forward {
+		for i := 0; i < size; i++ {
+			ids = append(ids, start+common.Pgid(i))
+		}
+	}
+	sort.Sort(ids)
+	return ids
+}
@@ -0,0 +1,118 @@
+package freelist
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/daicang/mk/pkg/common"
+	"github.com/daicang/mk/pkg/page"
+)
+
+func TestSpanMap(t *testing.T) {
+	m := newSpanMap()
+	m.free(pgids{3, 5, 4, 9, 10, 20})
+	// 3-5 and 9-10 are merged
+	if !reflect.DeepEqual(m.forward, map[common.Pgid]int{3: 3, 9: 2, 20: 1}) {
+		t.Errorf("incorrect spans: %v", m.forward)
+	}
+	if !reflect.DeepEqual(m.ids(), pgids{3, 4, 5, 9, 10, 20}) || m.count != 6 {
+		t.Errorf("incorrect ids: %v, count %d", m.ids(), m.count)
+	}
+
+	// Exact span is taken first
+	if id, ok := m.allocate(2); !ok || id != 9 {
+		t.Errorf("expect span 9, get %d %v", id, ok)
+	}
+	// Larger span is split
+	if id, ok := m.allocate(2); !ok || id != 3 {
+		t.Errorf("expect span 3, get %d %v", id, ok)
+	}
+	if !reflect.DeepEqual(m.forward, map[common.Pgid]int{5: 1, 20: 1}) || len(m.backward) != 2 {
+		t.Errorf("incorrect spans after allocate: %v %v", m.forward, m.backward)
+	}
+	if _, ok := m.allocate(2); ok {
+		t.Error("allocate should fail")
+	}
+	m.free(pgids{4, 6})
+	if !reflect.DeepEqual(m.forward, map[common.Pgid]int{4: 3, 20: 1}) || len(m.bySize) != 2 {
+		t.Errorf("incorrect spans after free: %v %v", m.forward, m.bySize)
+	}
+}
+
+func TestHashmapFreelist(t *testing.T) {
+	f := New(TypeHashmap)
+	f.free(pgids{3, 4, 5, 9})
+	newPage := func(id common.Pgid) *page.Page {
+		p := page.FromBuffer(make([]byte, page.PageSize), 0)
+		p.SetIndex(id)
+		return p
+	}
+
+	// Rollback returns allocated pages
+	if _, ok := f.Allocate(3); !ok {
+		t.Fatal("allocate failed")
+	}
+	f.Rollback()
+	if !reflect.DeepEqual(f.IDs(), []common.Pgid{3, 4, 5, 9}) || f.FreeCount() != 4 {
+		t.Errorf("incorrect ids after rollback: %v", f.IDs())
+	}
+
+	// Freed pages are pending until released, then merge into spans
+	id, _ := f.Allocate(1)
+	f.Add(newPage(8))
+	f.Add(newPage(id))
+	f.Commit(5)
+	if f.FreeCount() != 3 || f.PendingCount() != 2 {
+		t.Errorf("expect 3 free and 2 pending, get %d %d", f.FreeCount(), f.PendingCount())
+	}
+	f.Release(5)
+	if !reflect.DeepEqual(f.IDs(), []common.Pgid{3, 4, 5, 8, 9}) {
+		t.Errorf("incorrect ids after release: %v", f.IDs())
+	}
+
+	// Written page is read by either type
+	buf := make([]byte, f.Size())
+	p := page.FromBuffer(buf, 0)
+	f.WritePage(p)
+	for _, typ := range []Type{TypeArray, TypeHashmap} {
+		f1 := New(typ)
+		f1.ReadPage(p)
+		if !reflect.DeepEqual(f1.IDs(), f.IDs()) {
+			t.Errorf("%s: incorrect ids read: %v", typ, f1.IDs())
+		}
+	}
+	if got, ok := f.Allocate(2); !ok || got != 8 {
+		t.Errorf("expect span 8, get %d %v", got, ok)
+	}
+}
+
+// benchmarkAllocate allocates and frees one page in freelist of typ
+// holding free pages in runs of 4 pages.
+func benchmarkAllocate(b *testing.B, typ Type, free int) {
+	f := New(typ)
+	ids := pgids{}
+	for i := 0; i < free; i++ {
+		ids = append(ids, common.Pgid(2+i+i/4))
+	}
+	f.free(ids)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		id, ok := f.Allocate(1)
+		if !ok {
+			b.Fatal("allocate failed")
+		}
+		f.txAllocated = f.txAllocated[:0]
+		f.free(pgids{id})
+	}
+}
+
+func BenchmarkAllocate(b *testing.B) {
+	for _, typ := range []Type{TypeArray, TypeHashmap} {
+		for _, free := range []int{1000, 100000, 1000000} {
+			b.Run(fmt.Sprintf("%s-%d", typ, free), func(b *testing.B) {
+				benchmarkAllocate(b, typ, free)
+			})
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package kv
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Encoders below append values to keys so that bytewise order of
+// encoded keys is the natural order of values, and keys built from
+// several fields sort by the first field, then the second and so on.
+// Fixed size values are appended as is, byte strings are escaped and
+// terminated, so a shorter string sorts first and a key with fewer
+// fields is a prefix of keys extending it, which PrefixRange covers.
+
+// ErrInvalidEncoding is returned when decoding bytes not made by the
+// matching encoder.
+var ErrInvalidEncoding = errors.New("invalid key encoding")
+
+const (
+	// escape starts escape sequences of byte strings
+	escape byte = 0x00
+	// escapedZero follows escape for a 0x00 in the string
+	escapedZero byte = 0xff
+	// terminator follows escape at the end of the string
+	terminator byte = 0x01
+
+	// timeSize is size of encoded time: seconds | nanoseconds
+	timeSize = 12
+)
+
+// Tuple element tags, in the order elements of different types sort.
+const (
+	tagBytes byte = iota + 1
+	tagString
+	tagInt64
+	tagUint64
+	tagFloat64
+	tagTime
+)
+
+// AppendUint64 appends v as 8 bytes big-endian.
+func AppendUint64(dst []byte, v uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	return append(dst, b[:]...)
+}
+
+// DecodeUint64 decodes uint64 at the start of b, returns the rest.
+func DecodeUint64(b []byte) (uint64, []byte, error) {
+	if len(b) < 8 {
+		return 0, nil, fmt.Errorf("%w: uint64 needs 8 bytes, get %d", ErrInvalidEncoding, len(b))
+	}
+	return binary.BigEndian.Uint64(b), b[8:], nil
+}
+
+// AppendInt64 appends v with sign bit flipped, so negative values sort
+// before positive ones.
+func AppendInt64(dst []byte, v int64) []byte {
+	return AppendUint64(dst, uint64(v)^(1<<63))
+}
+
+// DecodeInt64 decodes int64 at the start of b, returns the rest.
+func DecodeInt64(b []byte) (int64, []byte, error) {
+	u, rest, err := DecodeUint64(b)
+	return int64(u ^ (1 << 63)), rest, err
+}
+
+// AppendFloat64 appends v so that floats sort numerically, with -0
+// before +0 and NaN after +Inf.
+func AppendFloat64(dst []byte, v float64) []byte {
+	u := math.Float64bits(v)
+	if u&(1<<63) != 0 {
+		// Negative: larger magnitude sorts first
+		u = ^u
+	} else {
+		u |= 1 << 63
+	}
+	return AppendUint64(dst, u)
+}
+
+// DecodeFloat64 decodes float64 at the start of b, returns the rest.
+func DecodeFloat64(b []byte) (float64, []byte, error) {
+	u, rest, err := DecodeUint64(b)
+	if u&(1<<63) != 0 {
+		u &^= 1 << 63
+	} else {
+		u = ^u
+	}
+	return math.Float64frombits(u), rest, err
+}
+
+// AppendTime appends t as Unix seconds and nanoseconds, so times sort
+// chronologically. Location is not kept, decoded time is in UTC.
+func AppendTime(dst []byte, t time.Time) []byte {
+	dst = AppendInt64(dst, t.Unix())
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(t.Nanosecond()))
+	return append(dst, b[:]...)
+}
+
+// DecodeTime decodes time at the start of b, returns the rest.
+func DecodeTime(b []byte) (time.Time, []byte, error) {
+	if len(b) < timeSize {
+		return time.Time{}, nil, fmt.Errorf("%w: time needs %d bytes, get %d", ErrInvalidEncoding, timeSize, len(b))
+	}
+	sec, rest, _ := DecodeInt64(b)
+	nsec := binary.BigEndian.Uint32(rest)
+	if nsec >= uint32(time.Second) {
+		return time.Time{}, nil, fmt.Errorf("%w: %d nanoseconds", ErrInvalidEncoding, nsec)
+	}
+	return time.Unix(sec, int64(nsec)).UTC(), rest[4:], nil
+}
+
+// AppendBytes appends v with 0x00 escaped as 0x00 0xff and a 0x00 0x01
+// terminator, so it may be followed by other fields.
+func AppendBytes(dst []byte, v []byte) []byte {
+	for _, c := range v {
+		if c == escape {
+			dst = append(dst, escape, escapedZero)
+		} else {
+			dst = append(dst, c)
+		}
+	}
+	return append(dst, escape, terminator)
+}
+
+// DecodeBytes decodes byte string at the start of b, returns a copy of
+// it and the rest.
+func DecodeBytes(b []byte) ([]byte, []byte, error) {
+	v := []byte{}
+	for i := 0; i < len(b); i++ {
+		if b[i] != escape {
+			v = append(v, b[i])
+			continue
+		}
+		if i+1 == len(b) {
+			break
+		}
+		switch b[i+1] {
+		case escapedZero:
+			v = append(v, escape)
+			i++
+		case terminator:
+			return v, b[i+2:], nil
+		default:
+			return nil, nil, fmt.Errorf("%w: bad escape %#x", ErrInvalidEncoding, b[i+1])
+		}
+	}
+	return nil, nil, fmt.Errorf("%w: byte string not terminated", ErrInvalidEncoding)
+}
+
+// AppendString is AppendBytes of string.
+func AppendString(dst []byte, v string) []byte {
+	return AppendBytes(dst, []byte(v))
+}
+
+// DecodeString decodes string at the start of b, returns the rest.
+func DecodeString(b []byte) (string, []byte, error) {
+	v, rest, err := DecodeBytes(b)
+	return string(v), rest, err
+}
+
+// EncodeTuple encodes elements into a key, each with a type tag, so the
+// key decodes without knowing the types. Supported types are []byte,
+// string, int, int64, uint64, float64 and time.Time; ints are encoded
+// as int64. Elements of different types at one position sort in that
+// order of types.
+func EncodeTuple(elems ...interface{}) (Key, error) {
+	k := Key{}
+	for i, e := range elems {
+		switch v := e.(type) {
+		case []byte:
+			k = AppendBytes(append(k, tagBytes), v)
+		case string:
+			k = AppendString(append(k, tagString), v)
+		case int:
+			k = AppendInt64(append(k, tagInt64), int64(v))
+		case int64:
+			k = AppendInt64(append(k, tagInt64), v)
+		case uint64:
+			k = AppendUint64(append(k, tagUint64), v)
+		case float64:
+			k = AppendFloat64(append(k, tagFloat64), v)
+		case time.Time:
+			k = AppendTime(append(k, tagTime), v)
+		default:
+			return nil, fmt.Errorf("tuple element %d: unsupported type %T", i, e)
+		}
+	}
+	return k, nil
+}
+
+// DecodeTuple decodes key made by EncodeTuple. Integers decode as
+// int64, byte strings as []byte and string as they were encoded.
+func DecodeTuple(k Key) ([]interface{}, error) {
+	elems := []interface{}{}
+	b := []byte(k)
+	for len(b) > 0 {
+		tag := b[0]
+		b = b[1:]
+		var e interface{}
+		var err error
+		switch tag {
+		case tagBytes:
+			e, b, err = DecodeBytes(b)
+		case tagString:
+			e, b, err = DecodeString(b)
+		case tagInt64:
+			e, b, err = DecodeInt64(b)
+		case tagUint64:
+			e, b, err = DecodeUint64(b)
+		case tagFloat64:
+			e, b, err = DecodeFloat64(b)
+		case tagTime:
+			e, b, err = DecodeTime(b)
+		default:
+			err = fmt.Errorf("%w: unknown tag %#x", ErrInvalidEncoding, tag)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("tuple element %d: %w", len(elems), err)
+		}
+		elems = append(elems, e)
+	}
+	return elems, nil
+}
@@ -0,0 +1,151 @@
+package kv
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// checkOrder checks encoded values sort like values, values must be
+// sorted.
+func checkOrder(t *testing.T, name string, count int, encode func(i int) []byte) {
+	t.Helper()
+	for i := 1; i < count; i++ {
+		a, b := encode(i-1), encode(i)
+		if bytes.Compare(a, b) >= 0 {
+			t.Errorf("%s: value %d encoded to %x, not before value %d %x", name, i-1, a, i, b)
+		}
+	}
+}
+
+func TestEncodeOrder(t *testing.T) {
+	uints := []uint64{0, 1, 255, 256, 1 << 32, math.MaxUint64}
+	checkOrder(t, "uint64", len(uints), func(i int) []byte { return AppendUint64(nil, uints[i]) })
+
+	ints := []int64{math.MinInt64, -1 << 32, -256, -1, 0, 1, 255, math.MaxInt64}
+	checkOrder(t, "int64", len(ints), func(i int) []byte { return AppendInt64(nil, ints[i]) })
+
+	floats := []float64{math.Inf(-1), -1e300, -1.5, -1e-300, math.Copysign(0, -1), 0, 1e-300, 1, 1.5, 1e300, math.Inf(1)}
+	checkOrder(t, "float64", len(floats), func(i int) []byte { return AppendFloat64(nil, floats[i]) })
+
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	times := []time.Time{
+		time.Date(1, 1, 1, 0, 0, 0, 0, time.UTC),
+		base.Add(-time.Nanosecond), base, base.Add(time.Nanosecond), base.Add(time.Second),
+		time.Date(3000, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	checkOrder(t, "time", len(times), func(i int) []byte { return AppendTime(nil, times[i]) })
+
+	strs := []string{"", "\x00", "\x00\x00", "\x00\x01", "\x01", "a", "a\x00", "a\x00b", "ab", "b", "\xff"}
+	checkOrder(t, "string", len(strs), func(i int) []byte { return AppendString(nil, strs[i]) })
+
+	// Random ints sort like their encodings
+	r := rand.New(rand.NewSource(1))
+	values := make([]int64, 1000)
+	keys := make([]string, len(values))
+	for i := range values {
+		values[i] = r.Int63() - r.Int63()
+	}
+	sort.Slice(values, func(a, b int) bool { return values[a] < values[b] })
+	for i, v := range values {
+		keys[i] = string(AppendInt64(nil, v))
+	}
+	if !sort.StringsAreSorted(keys) {
+		t.Error("Random int64 encodings are not sorted")
+	}
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	b := AppendUint64(nil, 42)
+	b = AppendInt64(b, -7)
+	b = AppendFloat64(b, -2.5)
+	now := time.Unix(1600000000, 123456789).UTC()
+	b = AppendTime(b, now)
+	b = AppendBytes(b, []byte("a\x00b"))
+	b = AppendString(b, "tail")
+
+	u, b, err := DecodeUint64(b)
+	if err != nil || u != 42 {
+		t.Fatalf("Bad uint64 %d %v", u, err)
+	}
+	i, b, err := DecodeInt64(b)
+	if err != nil || i != -7 {
+		t.Fatalf("Bad int64 %d %v", i, err)
+	}
+	f, b, err := DecodeFloat64(b)
+	if err != nil || f != -2.5 {
+		t.Fatalf("Bad float64 %v %v", f, err)
+	}
+	tm, b, err := DecodeTime(b)
+	if err != nil || !tm.Equal(now) {
+		t.Fatalf("Bad time %v %v", tm, err)
+	}
+	bs, b, err := DecodeBytes(b)
+	if err != nil || string(bs) != "a\x00b" {
+		t.Fatalf("Bad bytes %q %v", bs, err)
+	}
+	s, b, err := DecodeString(b)
+	if err != nil || s != "tail" || len(b) != 0 {
+		t.Fatalf("Bad string %q %v, rest %x", s, err, b)
+	}
+
+	for _, bad := range [][]byte{{1, 2}, {'a'}, {'a', 0x00}, {'a', 0x00, 0x02}} {
+		if _, _, err := DecodeBytes(bad); !errors.Is(err, ErrInvalidEncoding) {
+			t.Errorf("Expect ErrInvalidEncoding for %x, get %v", bad, err)
+		}
+	}
+	if _, _, err := DecodeTime(AppendInt64(nil, 0)); !errors.Is(err, ErrInvalidEncoding) {
+		t.Errorf("Expect ErrInvalidEncoding for short time, get %v", err)
+	}
+}
+
+func TestTuple(t *testing.T) {
+	now := time.Unix(1600000000, 5).UTC()
+	k, err := EncodeTuple("user", 42, uint64(7), 1.5, now, []byte{0, 1})
+	if err != nil {
+		t.Fatalf("Failed to encode tuple: %v", err)
+	}
+	elems, err := DecodeTuple(k)
+	if err != nil {
+		t.Fatalf("Failed to decode tuple: %v", err)
+	}
+	expect := []interface{}{"user", int64(42), uint64(7), 1.5, now, []byte{0, 1}}
+	if !reflect.DeepEqual(elems, expect) {
+		t.Errorf("Expect %v, get %v", expect, elems)
+	}
+
+	// Tuples sort field by field, a prefix tuple covers its extensions
+	user, _ := EncodeTuple("user")
+	tuples := [][]interface{}{
+		{"user"},
+		{"user", -1},
+		{"user", 0},
+		{"user", 0, "a"},
+		{"user", 1},
+		{"user\x00"},
+		{"users"},
+	}
+	checkOrder(t, "tuple", len(tuples), func(i int) []byte {
+		k, _ := EncodeTuple(tuples[i]...)
+		return k
+	})
+	r := PrefixRange(user)
+	for i, tuple := range tuples {
+		k, _ := EncodeTuple(tuple...)
+		if r.Contains(k) != (i < 5) {
+			t.Errorf("Prefix range of user contains %v: %v", tuple, r.Contains(k))
+		}
+	}
+
+	if _, err := EncodeTuple(struct{}{}); err == nil {
+		t.Error("Expect error for unsupported type")
+	}
+	if _, err := DecodeTuple(Key{0x7f}); !errors.Is(err, ErrInvalidEncoding) {
+		t.Errorf("Expect ErrInvalidEncoding for unknown tag, get %v", err)
+	}
+}
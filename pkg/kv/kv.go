@@ -8,12 +8,27 @@ type Key []byte
 // Value represents type for value
 type Value []byte
 
-func (k Key) lessThan(other Key) bool { // nolint
-	return bytes.Compare(k, other) == -1
+// CompareFunc orders keys, returns negative when a sorts before b, 0
+// when they're equal and positive otherwise. bytes.Compare is the
+// default order.
+type CompareFunc func(a, b []byte) int
+
+// Copy returns a copy of k in heap, nil for nil k.
+func (k Key) Copy() Key {
+	if k == nil {
+		return nil
+	}
+	return append(Key{}, k...)
 }
 
-func (k Key) lessEqual(other Key) bool { // nolint
-	return bytes.Compare(k, other) < 1
+// Copy returns a copy of v in heap, nil for nil v. Values from
+// Tx.GetRef and cursors point into pages of tx, a copy outlives the tx
+// and can be modified.
+func (v Value) Copy() Value {
+	if v == nil {
+		return nil
+	}
+	return append(Value{}, v...)
 }
 
 func (k Key) GreaterEqual(other Key) bool {
@@ -23,3 +38,113 @@ func (k Key) GreaterEqual(other Key) bool {
 func (k Key) EqualTo(other Key) bool {
 	return bytes.Equal(k, other)
 }
+
+// PrefixEnd returns the smallest key larger than all keys with given prefix,
+// nil when there's no such key (prefix is empty or all 0xff).
+func PrefixEnd(prefix Key) Key {
+	end := append(Key{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// Range is half-open key range [Start, End).
+// Nil Start means no lower bound, nil End means no upper bound.
+type Range struct {
+	Start Key
+	End   Key
+}
+
+// PrefixRange returns range of all keys with given prefix. It holds
+// exactly those keys only in bytewise order, other orders don't keep
+// keys with a prefix together.
+func PrefixRange(prefix Key) Range {
+	r := Range{
+		End: PrefixEnd(prefix),
+	}
+	if len(prefix) > 0 {
+		r.Start = append(Key{}, prefix...)
+	}
+	return r
+}
+
+// Contains returns whether key is in range.
+func (r Range) Contains(key Key) bool {
+	return r.ContainsFunc(key, bytes.Compare)
+}
+
+// ContainsFunc is Contains in the order of cmp.
+func (r Range) ContainsFunc(key Key, cmp CompareFunc) bool {
+	if r.Start != nil && cmp(key, r.Start) < 0 {
+		return false
+	}
+	return r.End == nil || cmp(key, r.End) < 0
+}
+
+// Empty returns whether no key is in range.
+func (r Range) Empty() bool {
+	return r.EmptyFunc(bytes.Compare)
+}
+
+// EmptyFunc is Empty in the order of cmp.
+func (r Range) EmptyFunc(cmp CompareFunc) bool {
+	return r.Start != nil && r.End != nil && cmp(r.End, r.Start) <= 0
+}
+
+// AfterEnd returns whether key is beyond the upper bound.
+func (r Range) AfterEnd(key Key) bool {
+	return r.AfterEndFunc(key, bytes.Compare)
+}
+
+// AfterEndFunc is AfterEnd in the order of cmp.
+func (r Range) AfterEndFunc(key Key, cmp CompareFunc) bool {
+	return r.End != nil && cmp(key, r.End) >= 0
+}
+
+// Overlaps returns whether two ranges share any key.
+func (r Range) Overlaps(other Range) bool {
+	return r.OverlapsFunc(other, bytes.Compare)
+}
+
+// OverlapsFunc is Overlaps in the order of cmp.
+func (r Range) OverlapsFunc(other Range, cmp CompareFunc) bool {
+	return !r.ClampFunc(other, cmp).EmptyFunc(cmp)
+}
+
+// Clamp returns intersection of two ranges.
+func (r Range) Clamp(other Range) Range {
+	return r.ClampFunc(other, bytes.Compare)
+}
+
+// ClampFunc is Clamp in the order of cmp.
+func (r Range) ClampFunc(other Range, cmp CompareFunc) Range {
+	c := r
+	if other.Start != nil && (c.Start == nil || cmp(c.Start, other.Start) < 0) {
+		c.Start = other.Start
+	}
+	if other.End != nil && (c.End == nil || cmp(other.End, c.End) < 0) {
+		c.End = other.End
+	}
+	return c
+}
+
+// ClampKey returns the nearest key in range for a start position,
+// nil when range is empty.
+func (r Range) ClampKey(key Key) Key {
+	return r.ClampKeyFunc(key, bytes.Compare)
+}
+
+// ClampKeyFunc is ClampKey in the order of cmp.
+func (r Range) ClampKeyFunc(key Key, cmp CompareFunc) Key {
+	if r.EmptyFunc(cmp) {
+		return nil
+	}
+	if r.Start != nil && cmp(key, r.Start) < 0 {
+		return r.Start
+	}
+	return key
+}
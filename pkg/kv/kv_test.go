@@ -0,0 +1,133 @@
+package kv
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPrefixEnd(t *testing.T) {
+	cases := []struct {
+		prefix Key
+		expect Key
+	}{
+		{Key("abc"), Key("abd")},
+		{Key{'a', 0xff}, Key("b")},
+		{Key{0xff, 0xff}, nil},
+		{Key{}, nil},
+		{nil, nil},
+	}
+	for _, c := range cases {
+		get := PrefixEnd(c.prefix)
+		if !bytes.Equal(get, c.expect) || (get == nil) != (c.expect == nil) {
+			t.Errorf("PrefixEnd(%q): expect %q, get %q", c.prefix, c.expect, get)
+		}
+	}
+
+	prefix := Key("abc")
+	end := PrefixEnd(prefix)
+	if prefix[2] != 'c' {
+		t.Error("PrefixEnd should not modify prefix")
+	}
+	r := PrefixRange(prefix)
+	for _, k := range []string{"abc", "abc\x00", "abc\xff\xff"} {
+		if !r.Contains(Key(k)) {
+			t.Errorf("%q should be in prefix range", k)
+		}
+	}
+	for _, k := range []string{"ab", "abd", string(end)} {
+		if r.Contains(Key(k)) {
+			t.Errorf("%q should not be in prefix range", k)
+		}
+	}
+}
+
+func TestRange(t *testing.T) {
+	all := Range{}
+	ab := Range{Start: Key("a"), End: Key("b")}
+	bc := Range{Start: Key("b"), End: Key("c")}
+	ac := Range{Start: Key("a"), End: Key("c")}
+
+	if !all.Contains(Key("")) || !all.Contains(Key("zzz")) || all.Empty() {
+		t.Error("Unbounded range should contain everything")
+	}
+	if !ab.Contains(Key("a")) || !ab.Contains(Key("azz")) || ab.Contains(Key("b")) {
+		t.Error("Range should be half-open")
+	}
+	if ab.Overlaps(bc) || bc.Overlaps(ab) {
+		t.Error("Adjacent ranges should not overlap")
+	}
+	if !ab.Overlaps(ac) || !all.Overlaps(bc) {
+		t.Error("Ranges should overlap")
+	}
+	if !(Range{Start: Key("b"), End: Key("a")}).Empty() {
+		t.Error("Reversed range should be empty")
+	}
+
+	c := ac.Clamp(Range{Start: Key("abc")})
+	if string(c.Start) != "abc" || string(c.End) != "c" {
+		t.Errorf("Bad clamp: %q", c)
+	}
+	c = all.Clamp(bc)
+	if string(c.Start) != "b" || string(c.End) != "c" {
+		t.Errorf("Bad clamp of unbounded range: %q", c)
+	}
+	if !ab.Clamp(bc).Empty() {
+		t.Error("Clamp of disjoint ranges should be empty")
+	}
+
+	if string(bc.ClampKey(Key("a"))) != "b" || string(bc.ClampKey(Key("bb"))) != "bb" {
+		t.Error("Bad ClampKey")
+	}
+	if !bc.AfterEnd(Key("c")) || bc.AfterEnd(Key("bz")) || all.AfterEnd(Key("z")) {
+		t.Error("Bad AfterEnd")
+	}
+}
+
+func TestRangeFunc(t *testing.T) {
+	reverse := func(a, b []byte) int {
+		return bytes.Compare(b, a)
+	}
+	// In reverse order, "c" comes before "b"
+	cb := Range{Start: Key("c"), End: Key("b")}
+	if cb.EmptyFunc(reverse) || !cb.Empty() {
+		t.Error("Bad EmptyFunc")
+	}
+	if !cb.AfterEndFunc(Key("a"), reverse) || cb.AfterEndFunc(Key("bb"), reverse) {
+		t.Error("Bad AfterEndFunc")
+	}
+	if !cb.ContainsFunc(Key("bb"), reverse) || cb.ContainsFunc(Key("b"), reverse) || cb.Contains(Key("bb")) {
+		t.Error("Bad ContainsFunc")
+	}
+	// Unbounded start is the first key in reverse order
+	da := Range{End: Key("a")}
+	if c := cb.ClampFunc(da, reverse); !c.Start.EqualTo(Key("c")) || !c.End.EqualTo(Key("b")) {
+		t.Errorf("Bad ClampFunc: %q", c)
+	}
+	if !cb.OverlapsFunc(da, reverse) || cb.OverlapsFunc(Range{Start: Key("a")}, reverse) {
+		t.Error("Bad OverlapsFunc")
+	}
+	if k := cb.ClampKeyFunc(Key("d"), reverse); !k.EqualTo(Key("c")) {
+		t.Errorf("Bad ClampKeyFunc: %q", k)
+	}
+	if k := cb.ClampKeyFunc(Key("bb"), reverse); !k.EqualTo(Key("bb")) {
+		t.Errorf("Bad ClampKeyFunc: %q", k)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	if Key(nil).Copy() != nil || Value(nil).Copy() != nil {
+		t.Error("Expect nil copy of nil")
+	}
+	if v := (Value{}).Copy(); v == nil || len(v) != 0 {
+		t.Error("Expect empty copy of empty value")
+	}
+	v := Value("abc")
+	c := v.Copy()
+	c[0] = 'x'
+	if string(v) != "abc" || string(c) != "xbc" {
+		t.Errorf("Expect independent copy, get %s and %s", v, c)
+	}
+	if k := Key("k").Copy(); string(k) != "k" {
+		t.Errorf("Expect k, get %s", k)
+	}
+}
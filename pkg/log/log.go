@@ -0,0 +1,229 @@
+// Package log provides a minimal leveled key-value logger.
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is log severity.
+type Level int
+
+const (
+	// LevelDebug is for diagnostic details.
+	LevelDebug Level = iota
+	// LevelInfo is for normal events.
+	LevelInfo
+	// LevelError is for failures.
+	LevelError
+)
+
+// String returns level name for print.
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LEVEL(%d)", int(l))
+}
+
+// Format is log line encoding.
+type Format int
+
+const (
+	// FormatText prints "time level name msg key=value ..".
+	FormatText Format = iota
+	// FormatJSON prints one JSON object per line.
+	FormatJSON
+)
+
+// Options holds info to create logger.
+type Options struct {
+	// Output defaults to stderr.
+	Output io.Writer
+	// Level is minimal level to print.
+	Level Level
+	// Format defaults to text.
+	Format Format
+}
+
+// Logger writes one line per event.
+type Logger struct {
+	name   string
+	level  Level
+	format Format
+	out    io.Writer
+	// mu is shared by loggers derived from the same root.
+	mu *sync.Mutex
+}
+
+// levelOff is above every level, loggers with it print nothing.
+const levelOff = LevelError + 1
+
+var (
+	// global is the package logger.
+	global = New(Options{Level: LevelInfo})
+)
+
+// New returns logger with given options.
+func New(opts Options) *Logger {
+	out := opts.Output
+	if out == nil {
+		out = os.Stderr
+	}
+	return &Logger{
+		level:  opts.Level,
+		format: opts.Format,
+		out:    out,
+		mu:     &sync.Mutex{},
+	}
+}
+
+// Discard returns logger which prints nothing.
+func Discard() *Logger {
+	return &Logger{
+		level: levelOff,
+		out:   ioutil.Discard,
+		mu:    &sync.Mutex{},
+	}
+}
+
+// Global returns package logger.
+func Global() *Logger {
+	return global
+}
+
+// SetGlobal replaces package logger.
+func SetGlobal(l *Logger) {
+	global = l
+}
+
+// WithName returns logger with name appended, separated by dot.
+func (l *Logger) WithName(name string) *Logger {
+	nl := *l
+	if nl.name == "" {
+		nl.name = name
+	} else {
+		nl.name = l.name + "." + name
+	}
+	return &nl
+}
+
+// Enabled returns whether given level is printed.
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+// Debug logs diagnostic message with key-value pairs.
+func (l *Logger) Debug(msg string, kvs ...interface{}) {
+	l.log(LevelDebug, msg, kvs)
+}
+
+// Info logs message with key-value pairs.
+func (l *Logger) Info(msg string, kvs ...interface{}) {
+	l.log(LevelInfo, msg, kvs)
+}
+
+// Error logs error with key-value pairs.
+func (l *Logger) Error(err error, msg string, kvs ...interface{}) {
+	l.log(LevelError, msg, append([]interface{}{"error", err}, kvs...))
+}
+
+func (l *Logger) log(level Level, msg string, kvs []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	var line string
+	if l.format == FormatJSON {
+		line = l.encodeJSON(level, msg, kvs)
+	} else {
+		line = l.encodeText(level, msg, kvs)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = io.WriteString(l.out, line)
+}
+
+// encodeText returns text line.
+func (l *Logger) encodeText(level Level, msg string, kvs []interface{}) string {
+	sb := strings.Builder{}
+	sb.WriteString(time.Now().Format(time.RFC3339))
+	sb.WriteString(" ")
+	sb.WriteString(level.String())
+	if l.name != "" {
+		sb.WriteString(" ")
+		sb.WriteString(l.name)
+	}
+	sb.WriteString(" ")
+	sb.WriteString(msg)
+	flatKv(&sb, kvs)
+	sb.WriteString("\n")
+
+	return sb.String()
+}
+
+// encodeJSON returns JSON line, fields keep the order they are given.
+func (l *Logger) encodeJSON(level Level, msg string, kvs []interface{}) string {
+	sb := strings.Builder{}
+	sb.WriteString("{")
+	writeJSONField(&sb, "ts", time.Now().Format(time.RFC3339Nano))
+	sb.WriteString(",")
+	writeJSONField(&sb, "level", level.String())
+	if l.name != "" {
+		sb.WriteString(",")
+		writeJSONField(&sb, "logger", l.name)
+	}
+	sb.WriteString(",")
+	writeJSONField(&sb, "msg", msg)
+	for i := 0; i < len(kvs); i += 2 {
+		value := interface{}("<missing>")
+		if i+1 < len(kvs) {
+			value = kvs[i+1]
+		}
+		sb.WriteString(",")
+		writeJSONField(&sb, fmt.Sprint(kvs[i]), value)
+	}
+	sb.WriteString("}\n")
+
+	return sb.String()
+}
+
+// writeJSONField writes "key":value.
+// Errors and values that can't be marshaled are written as strings.
+func writeJSONField(sb *strings.Builder, key string, value interface{}) {
+	k, _ := json.Marshal(key)
+	sb.Write(k)
+	sb.WriteString(":")
+
+	if err, ok := value.(error); ok {
+		value = err.Error()
+	}
+	v, err := json.Marshal(value)
+	if err != nil {
+		v, _ = json.Marshal(fmt.Sprint(value))
+	}
+	sb.Write(v)
+}
+
+// flatKv appends " key=value" for each pair.
+func flatKv(sb *strings.Builder, kvs []interface{}) {
+	for i := 0; i < len(kvs); i += 2 {
+		key := fmt.Sprint(kvs[i])
+		value := interface{}("<missing>")
+		if i+1 < len(kvs) {
+			value = kvs[i+1]
+		}
+		fmt.Fprintf(sb, " %s=%v", key, value)
+	}
+}
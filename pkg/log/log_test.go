@@ -0,0 +1,117 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLogLevel(t *testing.T) {
+	buf := bytes.Buffer{}
+	l := New(Options{Output: &buf, Level: LevelInfo})
+
+	l.Debug("hidden")
+	if buf.Len() != 0 {
+		t.Errorf("Debug should be filtered: %s", buf.String())
+	}
+
+	l.WithName("db").WithName("tx").Info("committed", "id", 3, "pages", 5)
+	line := buf.String()
+	for _, s := range []string{"INFO", "db.tx", "committed", "id=3", "pages=5"} {
+		if !strings.Contains(line, s) {
+			t.Errorf("Missing %q in %q", s, line)
+		}
+	}
+
+	buf.Reset()
+	l.Error(errors.New("boom"), "failed", "odd")
+	line = buf.String()
+	for _, s := range []string{"ERROR", "error=boom", "odd=<missing>"} {
+		if !strings.Contains(line, s) {
+			t.Errorf("Missing %q in %q", s, line)
+		}
+	}
+}
+
+func TestLogJSON(t *testing.T) {
+	buf := bytes.Buffer{}
+	l := New(Options{Output: &buf, Level: LevelDebug, Format: FormatJSON})
+
+	l.WithName("db").Debug("committed", "id", 3, "ok", true, "ratio", 0.5, "keys", []string{"a"}, "ch", make(chan int))
+	l.Error(errors.New("boom"), "failed")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expect 2 lines, get %q", buf.String())
+	}
+
+	first := map[string]interface{}{}
+	err := json.Unmarshal([]byte(lines[0]), &first)
+	if err != nil {
+		t.Fatalf("Invalid JSON %q: %v", lines[0], err)
+	}
+	expect := map[string]interface{}{
+		"level":  "DEBUG",
+		"logger": "db",
+		"msg":    "committed",
+		"id":     float64(3),
+		"ok":     true,
+		"ratio":  0.5,
+	}
+	for k, v := range expect {
+		if first[k] != v {
+			t.Errorf("Field %s: expect %v, get %v", k, v, first[k])
+		}
+	}
+	if _, ok := first["keys"].([]interface{}); !ok {
+		t.Errorf("Slice should be JSON array: %v", first["keys"])
+	}
+	if _, ok := first["ch"].(string); !ok {
+		t.Errorf("Unmarshalable value should be string: %v", first["ch"])
+	}
+	if _, ok := first["ts"]; !ok {
+		t.Errorf("Missing timestamp: %q", lines[0])
+	}
+
+	second := map[string]interface{}{}
+	err = json.Unmarshal([]byte(lines[1]), &second)
+	if err != nil || second["error"] != "boom" {
+		t.Errorf("Error should be string field: %q", lines[1])
+	}
+}
+
+func TestDiscard(t *testing.T) {
+	l := Discard().WithName("db")
+	for _, level := range []Level{LevelDebug, LevelInfo, LevelError} {
+		if l.Enabled(level) {
+			t.Errorf("Discard logger enables %s", level)
+		}
+	}
+	l.Error(errors.New("boom"), "failed")
+}
+
+func TestLogr(t *testing.T) {
+	buf := bytes.Buffer{}
+	l := New(Options{Output: &buf, Level: LevelInfo}).Logr()
+
+	l.V(1).Info("hidden")
+	if buf.Len() != 0 {
+		t.Errorf("Verbose message should be filtered: %s", buf.String())
+	}
+
+	l.WithName("db").WithValues("path", "data").Info("committed", "id", 3)
+	line := buf.String()
+	for _, s := range []string{"INFO", "db", "committed", "path=data id=3"} {
+		if !strings.Contains(line, s) {
+			t.Errorf("Missing %q in %q", s, line)
+		}
+	}
+
+	buf.Reset()
+	l.Error(errors.New("boom"), "failed")
+	if !strings.Contains(buf.String(), "ERROR") || !strings.Contains(buf.String(), "error=boom") {
+		t.Errorf("Bad error line %q", buf.String())
+	}
+}
@@ -0,0 +1,64 @@
+package log
+
+import (
+	"github.com/go-logr/logr"
+)
+
+// Logr returns logr.Logger printing through l. logr verbosity 0 is
+// LevelInfo, higher verbosities are LevelDebug.
+func (l *Logger) Logr() logr.Logger {
+	return logr.New(&sink{l: l})
+}
+
+// sink adapts Logger to logr.LogSink.
+type sink struct {
+	l *Logger
+	// values are added by WithValues, printed before call pairs.
+	values []interface{}
+}
+
+// level returns Logger level for logr verbosity.
+func level(v int) Level {
+	if v > 0 {
+		return LevelDebug
+	}
+	return LevelInfo
+}
+
+// Init implements logr.LogSink.
+func (s *sink) Init(logr.RuntimeInfo) {}
+
+// Enabled implements logr.LogSink.
+func (s *sink) Enabled(v int) bool {
+	return s.l.Enabled(level(v))
+}
+
+// Info implements logr.LogSink.
+func (s *sink) Info(v int, msg string, kvs ...interface{}) {
+	s.l.log(level(v), msg, s.pairs(kvs))
+}
+
+// Error implements logr.LogSink.
+func (s *sink) Error(err error, msg string, kvs ...interface{}) {
+	s.l.Error(err, msg, s.pairs(kvs)...)
+}
+
+// WithValues implements logr.LogSink.
+func (s *sink) WithValues(kvs ...interface{}) logr.LogSink {
+	return &sink{l: s.l, values: s.pairs(kvs)}
+}
+
+// WithName implements logr.LogSink.
+func (s *sink) WithName(name string) logr.LogSink {
+	return &sink{l: s.l.WithName(name), values: s.values}
+}
+
+// pairs returns values followed by kvs, without changing values.
+func (s *sink) pairs(kvs []interface{}) []interface{} {
+	if len(s.values) == 0 {
+		return kvs
+	}
+	all := make([]interface{}, 0, len(s.values)+len(kvs))
+	all = append(all, s.values...)
+	return append(all, kvs...)
+}
@@ -0,0 +1,140 @@
+// Package metrics exports DB.Stats through expvar and in the Prometheus
+// text exposition format, so commit rate, tree depth, freelist and map
+// size can be graphed without glue code. Prometheus output is written
+// directly and needs no client library.
+package metrics
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/daicang/mk/pkg/db"
+)
+
+const (
+	counter = "counter"
+	gauge   = "gauge"
+)
+
+// metric is one sample of a counter or gauge.
+type metric struct {
+	name  string
+	help  string
+	kind  string
+	value float64
+}
+
+// collect reads stats of d. Tree depth is read in a read-only
+// transaction and left out when it fails, e.g. DB is closed.
+func collect(d *db.DB) ([]metric, db.LatencyHistogram) {
+	s := d.Stats()
+	t := s.TxStats
+	metrics := []metric{
+		{"commits_total", "Committed transactions.", counter, float64(s.Commits)},
+		{"pages_read_total", "Pages read by closed transactions.", counter, float64(t.PagesRead)},
+		{"pages_dirtied_total", "Nodes written to new pages at commit.", counter, float64(t.PagesDirtied)},
+		{"pages_allocated_total", "Pages allocated, overflow pages included.", counter, float64(t.PagesAllocated)},
+		{"pages_grown_total", "Allocated pages which grew the file.", counter, float64(t.PagesGrown)},
+		{"pages_freed_total", "Pages returned to freelist.", counter, float64(t.PagesFreed)},
+		{"node_splits_total", "Nodes split at commit.", counter, float64(t.Splits)},
+		{"node_merges_total", "Nodes merged at commit.", counter, float64(t.Merges)},
+		{"node_cache_hits_total", "Node lookups served by cached nodes.", counter, float64(t.NodeCacheHits)},
+		{"node_cache_misses_total", "Node lookups which read a page.", counter, float64(t.NodeCacheMisses)},
+		{"node_cache_shared_hits_total", "Node lookups served by DB node cache.", counter,
+			float64(t.SharedCacheHits)},
+		{"written_bytes_total", "Bytes of pages and meta written at commit.", counter, float64(t.BytesWritten)},
+		{"compressed_bytes_total", "Bytes saved by compressing values.", counter, float64(t.BytesCompressed)},
+		{"free_pages", "Free pages after the last commit.", gauge, float64(s.FreePages)},
+		{"pending_pages", "Freed pages open transactions may still read.", gauge, float64(s.PendingPages)},
+		{"free_spans", "Runs of contiguous free pages.", gauge, float64(s.FreeSpans)},
+		{"largest_free_span_pages", "Pages of the largest free span.", gauge, float64(s.LargestFreeSpan)},
+		{"mmap_size_bytes", "Memory map size.", gauge, float64(s.MmapSize)},
+		{"node_cache_bytes", "Estimated bytes of nodes in DB node cache.", gauge, float64(s.NodeCacheBytes)},
+		{"open_read_transactions", "Open read-only transactions.", gauge, float64(s.OpenReadTxN)},
+		{"longest_read_transaction_seconds", "Age of the oldest open read-only transaction.", gauge,
+			s.LongestReadTxDuration.Seconds()},
+	}
+	depth := 0
+	err := d.View(func(tx *db.Tx) error {
+		depth = tx.Depth()
+		return nil
+	})
+	if err == nil {
+		metrics = append(metrics, metric{"tree_depth", "B+tree level count.", gauge, float64(depth)})
+	}
+	return metrics, s.CommitLatency
+}
+
+// Snapshot returns stats of d as a map from metric name to value,
+// commit latency is a map holding bucket counts, count and sum.
+func Snapshot(d *db.DB) map[string]interface{} {
+	metrics, h := collect(d)
+	m := make(map[string]interface{}, len(metrics)+1)
+	for _, mt := range metrics {
+		m[mt.name] = mt.value
+	}
+	buckets := make(map[string]uint64, len(h.Counts))
+	for i, n := range h.Counts {
+		buckets[bucketName(i)] = n
+	}
+	m["commit_latency"] = map[string]interface{}{
+		"buckets": buckets,
+		"count":   h.Count,
+		"sum":     h.Sum.Seconds(),
+	}
+	return m
+}
+
+// bucketName returns upper bound of latency bucket i.
+func bucketName(i int) string {
+	if i == len(db.LatencyBounds) {
+		return "+Inf"
+	}
+	return formatFloat(db.LatencyBounds[i].Seconds())
+}
+
+// Publish publishes Snapshot of d as expvar variable name, which shows
+// in /debug/vars. Like expvar.Publish, it panics if name is used.
+func Publish(name string, d *db.DB) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return Snapshot(d)
+	}))
+}
+
+// WritePrometheus writes stats of d in Prometheus text format, metric
+// names have prefix "mk_".
+func WritePrometheus(w io.Writer, d *db.DB) error {
+	metrics, h := collect(d)
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		fmt.Fprintf(bw, "# HELP mk_%s %s\n# TYPE mk_%s %s\n", m.name, m.help, m.name, m.kind)
+		fmt.Fprintf(bw, "mk_%s %s\n", m.name, formatFloat(m.value))
+	}
+	name := "mk_commit_latency_seconds"
+	fmt.Fprintf(bw, "# HELP %s Commit time, sync included.\n# TYPE %s histogram\n", name, name)
+	cumulative := uint64(0)
+	for i, n := range h.Counts {
+		cumulative += n
+		fmt.Fprintf(bw, "%s_bucket{le=\"%s\"} %d\n", name, bucketName(i), cumulative)
+	}
+	fmt.Fprintf(bw, "%s_sum %s\n%s_count %d\n", name, formatFloat(h.Sum.Seconds()), name, h.Count)
+	return bw.Flush()
+}
+
+// formatFloat formats v in the shortest exact form.
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Handler returns HTTP handler serving WritePrometheus of d, to be
+// scraped by Prometheus.
+func Handler(d *db.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_ = WritePrometheus(w, d)
+	})
+}
@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/daicang/mk/pkg/db"
+)
+
+func openDB(t *testing.T) *db.DB {
+	t.Helper()
+	d, err := db.Open(db.Options{Path: filepath.Join(t.TempDir(), "data")})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	err = d.Update(func(tx *db.Tx) error {
+		for i := 0; i < 1000; i++ {
+			_, err := tx.Set([]byte(fmt.Sprintf("key-%04d", i)), []byte("value"))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to update: %v", err)
+	}
+	return d
+}
+
+func TestPublish(t *testing.T) {
+	d := openDB(t)
+	defer func() {
+		_ = d.Close()
+	}()
+	Publish("mk_test", d)
+	m := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(expvar.Get("mk_test").String()), &m); err != nil {
+		t.Fatalf("Failed to decode expvar: %v", err)
+	}
+	if m["commits_total"] != 1.0 || m["tree_depth"].(float64) < 2 {
+		t.Errorf("Unexpected expvar %v", m)
+	}
+	latency := m["commit_latency"].(map[string]interface{})
+	if latency["count"] != 1.0 || len(latency["buckets"].(map[string]interface{})) != len(db.LatencyBounds)+1 {
+		t.Errorf("Unexpected commit latency %v", latency)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	d := openDB(t)
+	w := httptest.NewRecorder()
+	Handler(d).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, line := range []string{
+		"# TYPE mk_commits_total counter",
+		"mk_commits_total 1",
+		"# TYPE mk_commit_latency_seconds histogram",
+		"mk_commit_latency_seconds_bucket{le=\"+Inf\"} 1",
+		"mk_commit_latency_seconds_count 1",
+		"# TYPE mk_tree_depth gauge",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Expect %q in output:\n%s", line, body)
+		}
+	}
+
+	// Tree depth is left out after close
+	if err := d.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	w = httptest.NewRecorder()
+	Handler(d).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body = w.Body.String()
+	if strings.Contains(body, "mk_tree_depth") || !strings.Contains(body, "mk_commits_total 1\n") {
+		t.Errorf("Unexpected output after close:\n%s", body)
+	}
+}
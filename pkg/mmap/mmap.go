@@ -0,0 +1,25 @@
+// Package mmap maps files into memory with the calls of each platform.
+// Platforms without memory map support return ErrUnsupported.
+package mmap
+
+import "errors"
+
+var (
+	// ErrUnsupported is returned on platforms without memory map.
+	ErrUnsupported = errors.New("memory map is not supported on this platform")
+)
+
+// Advice is access pattern hint of a map, see Advise.
+type Advice int
+
+const (
+	// Normal gives no hint.
+	Normal Advice = iota
+	// Random expects random reads, OS doesn't read ahead.
+	Random
+	// Sequential expects scans, OS reads ahead aggressively.
+	Sequential
+	// DontNeed drops pages from the map, they are read again from file
+	// on access.
+	DontNeed
+)
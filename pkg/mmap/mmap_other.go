@@ -0,0 +1,45 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !openbsd && !windows
+// +build !darwin,!dragonfly,!freebsd,!linux,!openbsd,!windows
+
+package mmap
+
+import "os"
+
+// TruncateMapped tells whether a mapped file can be truncated, there
+// are no maps here.
+const TruncateMapped = true
+
+// Map returns ErrUnsupported.
+func Map(f *os.File, size int, writable bool) ([]byte, error) {
+	return nil, ErrUnsupported
+}
+
+// Unmap returns ErrUnsupported.
+func Unmap(b []byte) error {
+	return ErrUnsupported
+}
+
+// Sync returns ErrUnsupported.
+func Sync(f *os.File, b []byte) error {
+	return ErrUnsupported
+}
+
+// Invalidate returns ErrUnsupported.
+func Invalidate(b []byte) error {
+	return ErrUnsupported
+}
+
+// Advise returns ErrUnsupported.
+func Advise(b []byte, advice Advice) error {
+	return ErrUnsupported
+}
+
+// Lock returns ErrUnsupported.
+func Lock(b []byte) error {
+	return ErrUnsupported
+}
+
+// Unlock returns ErrUnsupported.
+func Unlock(b []byte) error {
+	return ErrUnsupported
+}
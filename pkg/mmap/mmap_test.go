@@ -0,0 +1,78 @@
+package mmap
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMap(t *testing.T) {
+	size := os.Getpagesize() * 4
+	path := filepath.Join(t.TempDir(), "data")
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	if err := f.Truncate(int64(size)); err != nil {
+		t.Fatal(err)
+	}
+
+	// File writes are seen by read-only map
+	b, err := Map(f, size, false)
+	if err != nil {
+		t.Fatalf("Failed to map: %v", err)
+	}
+	if _, err := f.WriteAt([]byte("hello"), 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := Invalidate(b); err != nil {
+		t.Fatalf("Failed to invalidate: %v", err)
+	}
+	if !bytes.Equal(b[100:105], []byte("hello")) {
+		t.Errorf("Map doesn't see file write: %q", b[100:105])
+	}
+	for _, advice := range []Advice{Random, Sequential, Normal, DontNeed} {
+		if err := Advise(b, advice); err != nil {
+			t.Errorf("Failed to advise %d: %v", advice, err)
+		}
+	}
+	if !bytes.Equal(b[100:105], []byte("hello")) {
+		t.Errorf("Map content lost after DontNeed: %q", b[100:105])
+	}
+	// Lock may be denied by RLIMIT_MEMLOCK
+	if err := Lock(b); err == nil {
+		if err := Unlock(b); err != nil {
+			t.Errorf("Failed to unlock: %v", err)
+		}
+	} else {
+		t.Logf("Lock: %v", err)
+	}
+	if err := Unmap(b); err != nil {
+		t.Fatalf("Failed to unmap: %v", err)
+	}
+
+	// Writable map writes go to file
+	b, err = Map(f, size, true)
+	if err != nil {
+		t.Fatalf("Failed to map writable: %v", err)
+	}
+	copy(b[size-5:], "world")
+	if err := Sync(f, b); err != nil {
+		t.Fatalf("Failed to sync: %v", err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data[size-5:], []byte("world")) {
+		t.Errorf("Map write not in file: %q", data[size-5:])
+	}
+	if err := Unmap(b); err != nil {
+		t.Fatalf("Failed to unmap: %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+//go:build darwin || dragonfly || freebsd || linux || openbsd
+// +build darwin dragonfly freebsd linux openbsd
+
+package mmap
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// TruncateMapped tells whether a mapped file can be truncated, pages
+// beyond the new file end must not be touched then.
+const TruncateMapped = true
+
+// Map maps the first size bytes of f as shared memory, writes into a
+// writable map go to f. size may be larger than file, pages beyond
+// file end must not be touched until file is extended.
+func Map(f *os.File, size int, writable bool) ([]byte, error) {
+	prot := syscall.PROT_READ
+	if writable {
+		prot |= syscall.PROT_WRITE
+	}
+	b, err := syscall.Mmap(int(f.Fd()), 0, size, prot, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("mmap: %w", err)
+	}
+	return b, nil
+}
+
+// Unmap unmaps b returned by Map.
+func Unmap(b []byte) error {
+	err := syscall.Munmap(b)
+	if err != nil {
+		return fmt.Errorf("munmap: %w", err)
+	}
+	return nil
+}
+
+// Sync writes range b of a writable map of f to disk.
+func Sync(f *os.File, b []byte) error {
+	return msync(b, syscall.MS_SYNC)
+}
+
+// Invalidate makes range b of a map read what was written to file
+// with WriteAt. Map and file share page cache on Linux, but not on
+// every platform.
+func Invalidate(b []byte) error {
+	return msync(b, syscall.MS_INVALIDATE)
+}
+
+// Advise tells OS how range b of a map is accessed.
+func Advise(b []byte, advice Advice) error {
+	flag := syscall.MADV_NORMAL
+	switch advice {
+	case Random:
+		flag = syscall.MADV_RANDOM
+	case Sequential:
+		flag = syscall.MADV_SEQUENTIAL
+	case DontNeed:
+		flag = syscall.MADV_DONTNEED
+	}
+	return rangeCall("madvise", syscall.SYS_MADVISE, b, flag)
+}
+
+// Lock locks range b of a map in memory, so reads never fault.
+func Lock(b []byte) error {
+	return rangeCall("mlock", syscall.SYS_MLOCK, b, 0)
+}
+
+// Unlock unlocks range b locked by Lock.
+func Unlock(b []byte) error {
+	return rangeCall("munlock", syscall.SYS_MUNLOCK, b, 0)
+}
+
+func msync(b []byte, flags int) error {
+	return rangeCall("msync", syscall.SYS_MSYNC, b, flags)
+}
+
+// rangeCall calls syscall trap taking address and length of b, and arg.
+func rangeCall(name string, trap uintptr, b []byte, arg int) error {
+	_, _, errno := syscall.Syscall(
+		trap,
+		uintptr(unsafe.Pointer(&b[0])),
+		uintptr(len(b)),
+		uintptr(arg),
+	)
+	if errno != 0 {
+		return fmt.Errorf("%s: %w", name, errno)
+	}
+	return nil
+}
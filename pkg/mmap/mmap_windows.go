@@ -0,0 +1,113 @@
+package mmap
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	kernel32          = syscall.NewLazyDLL("kernel32.dll")
+	procVirtualLock   = kernel32.NewProc("VirtualLock")
+	procVirtualUnlock = kernel32.NewProc("VirtualUnlock")
+)
+
+// TruncateMapped tells whether a mapped file can be truncated, Windows
+// refuses to while a view of the file is open.
+const TruncateMapped = false
+
+// Map maps the first size bytes of f as shared memory, writes into a
+// writable map go to f. A file mapping can't be larger than the file,
+// so f is extended to size first.
+func Map(f *os.File, size int, writable bool) ([]byte, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < int64(size) {
+		err = f.Truncate(int64(size))
+		if err != nil {
+			return nil, fmt.Errorf("extend file to map: %w", err)
+		}
+	}
+	protect := uint32(syscall.PAGE_READONLY)
+	access := uint32(syscall.FILE_MAP_READ)
+	if writable {
+		protect = syscall.PAGE_READWRITE
+		access = syscall.FILE_MAP_WRITE
+	}
+	sizeHigh := uint32(uint64(size) >> 32)
+	sizeLow := uint32(uint64(size) & 0xffffffff)
+	h, err := syscall.CreateFileMapping(syscall.Handle(f.Fd()), nil, protect, sizeHigh, sizeLow, nil)
+	if err != nil {
+		return nil, os.NewSyscallError("CreateFileMapping", err)
+	}
+	addr, err := syscall.MapViewOfFile(h, access, 0, 0, uintptr(size))
+	// The view keeps mapping object alive, close handle either way
+	cerr := syscall.CloseHandle(h)
+	if err != nil {
+		return nil, os.NewSyscallError("MapViewOfFile", err)
+	}
+	if cerr != nil {
+		_ = syscall.UnmapViewOfFile(addr)
+		return nil, os.NewSyscallError("CloseHandle", cerr)
+	}
+	var b []byte
+	hdr := (*reflect.SliceHeader)(unsafe.Pointer(&b))
+	hdr.Data = addr
+	hdr.Len = size
+	hdr.Cap = size
+	return b, nil
+}
+
+// Unmap unmaps b returned by Map.
+func Unmap(b []byte) error {
+	err := syscall.UnmapViewOfFile(uintptr(unsafe.Pointer(&b[0])))
+	if err != nil {
+		return os.NewSyscallError("UnmapViewOfFile", err)
+	}
+	return nil
+}
+
+// Sync writes range b of a writable map of f to disk. Flushing a view
+// only starts writes, f is flushed to wait for them.
+func Sync(f *os.File, b []byte) error {
+	err := syscall.FlushViewOfFile(uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)))
+	if err != nil {
+		return os.NewSyscallError("FlushViewOfFile", err)
+	}
+	return f.Sync()
+}
+
+// Invalidate makes range b of a map read what was written to file
+// with WriteAt. Views of local files are coherent with file writes,
+// so there's nothing to do.
+func Invalidate(b []byte) error {
+	return nil
+}
+
+// Advise tells OS how range b of a map is accessed. There's no such
+// hint on Windows, it does nothing.
+func Advise(b []byte, advice Advice) error {
+	return nil
+}
+
+// Lock locks range b of a map in memory, so reads never fault.
+func Lock(b []byte) error {
+	r, _, err := procVirtualLock.Call(uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)))
+	if r == 0 {
+		return os.NewSyscallError("VirtualLock", err)
+	}
+	return nil
+}
+
+// Unlock unlocks range b locked by Lock.
+func Unlock(b []byte) error {
+	r, _, err := procVirtualUnlock.Call(uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)))
+	if r == 0 {
+		return os.NewSyscallError("VirtualUnlock", err)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package modeltest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/daicang/mk/pkg/db"
+	"github.com/daicang/mk/pkg/freelist"
+	"github.com/google/gofuzz/bytesource"
+)
+
+// maxFuzzSteps bounds steps of one fuzz input, so each run is quick.
+const maxFuzzSteps = 2000
+
+// fuzzOptions are DB options picked by the first byte of fuzz input.
+var fuzzOptions = []db.Options{
+	{StrictMode: true},
+	{StrictMode: true, FreelistType: freelist.TypeHashmap},
+	{StrictMode: true, NoMmap: true},
+	{StrictMode: true, WritableMmap: true},
+	{StrictMode: true, WAL: true, WALCheckpointSize: 1 << 14},
+	{StrictMode: true, PoisonFreed: true, FillPercent: 0.9},
+}
+
+// Fuzz is the go-fuzz entry point, run it with
+//
+//	go-fuzz-build github.com/daicang/mk/pkg/modeltest && go-fuzz
+//
+// Input picks DB options with its first byte, then each step with the
+// rest, read by a gofuzz byte source. A small key space and large values
+// make splits, merges and overflow pages likely in a short run. It
+// panics when DB diverges from the model or fails a check.
+func Fuzz(data []byte) int {
+	if len(data) == 0 {
+		return -1
+	}
+	cfg := DefaultConfig(0)
+	cfg.DB = fuzzOptions[int(data[0])%len(fuzzOptions)]
+	cfg.Keys = 64
+	cfg.MaxValueSize = 2000
+	// Each step reads about 3 numbers of 8 bytes
+	cfg.Steps = len(data) / 24
+	if cfg.Steps > maxFuzzSteps {
+		cfg.Steps = maxFuzzSteps
+	}
+
+	dir, err := ioutil.TempDir("", "mk-fuzz")
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	err = run(filepath.Join(dir, "data"), cfg, bytesource.New(data[1:]))
+	if err != nil {
+		panic(err)
+	}
+	return 1
+}
@@ -0,0 +1,26 @@
+package modeltest
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestFuzz(t *testing.T) {
+	if Fuzz(nil) != -1 {
+		t.Error("Expect empty input rejected")
+	}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 4*len(fuzzOptions); i++ {
+		data := make([]byte, 1+rnd.Intn(24*maxFuzzSteps))
+		_, _ = rnd.Read(data)
+		data[0] = byte(i)
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Fatalf("Input %d with options %+v: %v", i, fuzzOptions[i%len(fuzzOptions)], r)
+				}
+			}()
+			Fuzz(data)
+		}()
+	}
+}
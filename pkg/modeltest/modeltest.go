@@ -0,0 +1,392 @@
+// Package modeltest drives random operations against both DB
+// and an in-memory map, and checks they stay equivalent.
+package modeltest
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+
+	"github.com/daicang/mk/pkg/db"
+	"github.com/daicang/mk/pkg/kv"
+)
+
+// ErrMismatch is returned when DB diverges from the model.
+var ErrMismatch = errors.New("db mismatch with model")
+
+// Op is one step type.
+type Op int
+
+const (
+	// OpSet sets a random key.
+	OpSet Op = iota
+	// OpRemove removes a random key.
+	OpRemove
+	// OpGet reads a random key in the writable tx.
+	OpGet
+	// OpCommit commits and checks the whole DB.
+	OpCommit
+	// OpReopen drops uncommitted changes and reopens DB.
+	OpReopen
+	// OpScan scans the writable tx with a cursor.
+	OpScan
+	// OpScanRange scans a random key range of the writable tx with
+	// Tx.Scan.
+	OpScanRange
+	opCount
+)
+
+// String returns op name for print.
+func (o Op) String() string {
+	return [...]string{"set", "remove", "get", "commit", "reopen", "scan", "scanrange"}[o]
+}
+
+// Config holds harness parameters.
+type Config struct {
+	// Steps to run
+	Steps int
+	// Key space size, small key space exercises overwrite and remove.
+	Keys int
+	// Maximal value length
+	MaxValueSize int
+	// Weights of each Op, indexed by Op
+	Weights [opCount]int
+	// Random seed
+	Seed int64
+	// DB options, Path is set by Run
+	DB db.Options
+}
+
+// DefaultConfig returns a config mixing all operations.
+func DefaultConfig(seed int64) Config {
+	return Config{
+		Steps:        5000,
+		Keys:         2000,
+		MaxValueSize: 200,
+		Weights: [opCount]int{
+			OpSet:    60,
+			OpRemove: 30,
+			OpGet:    20,
+			OpCommit: 3,
+			OpReopen: 1,
+			OpScan:   1,
+			// Ranges are short, so they're cheaper than full scans
+			OpScanRange: 5,
+		},
+		Seed: seed,
+	}
+}
+
+// harness holds DB and model state.
+type harness struct {
+	path string
+	cfg  Config
+	rnd  *rand.Rand
+	db   *db.DB
+	tx   *db.Tx
+	// committed is the model of what DB holds on disk.
+	committed map[string]string
+	// pending is the model of the current writable tx.
+	pending map[string]string
+	// history of recent steps, for failure report.
+	history []string
+}
+
+// Run runs cfg.Steps random steps on a new DB at path.
+func Run(path string, cfg Config) error {
+	return run(path, cfg, rand.NewSource(cfg.Seed))
+}
+
+// run runs cfg.Steps steps chosen by src on a new DB at path.
+func run(path string, cfg Config, src rand.Source) error {
+	h := harness{
+		path:      path,
+		cfg:       cfg,
+		rnd:       rand.New(src),
+		committed: map[string]string{},
+		pending:   map[string]string{},
+	}
+	err := h.open()
+	if err != nil {
+		return err
+	}
+	for step := 0; step < cfg.Steps; step++ {
+		err = h.step()
+		if err != nil {
+			return fmt.Errorf("step %d: %w\nrecent steps:\n%s", step, err, strings.Join(h.history, "\n"))
+		}
+	}
+	// Always finish with a checked commit
+	err = h.commit()
+	if err != nil {
+		return err
+	}
+	return h.db.Close()
+}
+
+// open opens DB at path, previous DB is closed without committing.
+func (h *harness) open() error {
+	if h.db != nil {
+		if h.tx != nil {
+			err := h.tx.Rollback()
+			if err != nil {
+				return err
+			}
+		}
+		err := h.db.Close()
+		if err != nil {
+			return err
+		}
+	}
+	opts := h.cfg.DB
+	opts.Path = h.path
+	d, err := db.Open(opts)
+	if err != nil {
+		return err
+	}
+	h.db = d
+	h.tx = nil
+	return nil
+}
+
+// writable returns current writable tx, creating one if needed.
+func (h *harness) writable() (*db.Tx, error) {
+	if h.tx != nil {
+		return h.tx, nil
+	}
+	tx, err := db.NewWritableTx(h.db)
+	if err != nil {
+		return nil, err
+	}
+	h.tx = tx
+	h.pending = copyMap(h.committed)
+	return tx, nil
+}
+
+func (h *harness) chooseOp() Op {
+	total := 0
+	for _, w := range h.cfg.Weights {
+		total += w
+	}
+	p := h.rnd.Intn(total)
+	for op, w := range h.cfg.Weights {
+		if p < w {
+			return Op(op)
+		}
+		p -= w
+	}
+	return OpSet
+}
+
+func (h *harness) record(format string, args ...interface{}) {
+	h.history = append(h.history, fmt.Sprintf(format, args...))
+	if len(h.history) > 20 {
+		h.history = h.history[1:]
+	}
+}
+
+func (h *harness) step() error {
+	op := h.chooseOp()
+	key := fmt.Sprintf("key-%d", h.rnd.Intn(h.cfg.Keys))
+
+	switch op {
+	case OpSet:
+		tx, err := h.writable()
+		if err != nil {
+			return err
+		}
+		value := strings.Repeat(string(rune('a'+h.rnd.Intn(26))), h.rnd.Intn(h.cfg.MaxValueSize+1))
+		h.record("set %s len=%d", key, len(value))
+		old, exist := h.pending[key]
+		got, err := tx.Set([]byte(key), []byte(value))
+		if err != nil {
+			return err
+		}
+		if (got != nil) != exist || string(got) != old {
+			return fmt.Errorf("%w: set %s returns %q, model (%v, %q)", ErrMismatch, key, got, exist, old)
+		}
+		h.pending[key] = value
+
+	case OpRemove:
+		tx, err := h.writable()
+		if err != nil {
+			return err
+		}
+		h.record("remove %s", key)
+		old, exist := h.pending[key]
+		got, err := tx.Remove([]byte(key))
+		if err != nil {
+			return err
+		}
+		if (got != nil) != exist || string(got) != old {
+			return fmt.Errorf("%w: remove %s returns %q, model (%v, %q)", ErrMismatch, key, got, exist, old)
+		}
+		delete(h.pending, key)
+
+	case OpGet:
+		tx, err := h.writable()
+		if err != nil {
+			return err
+		}
+		h.record("get %s", key)
+		expect, exist := h.pending[key]
+		got := tx.Get([]byte(key))
+		if (got != nil) != exist || string(got) != expect {
+			return fmt.Errorf("%w: get %s returns %q, model (%v, %q)", ErrMismatch, key, got, exist, expect)
+		}
+
+	case OpScan:
+		tx, err := h.writable()
+		if err != nil {
+			return err
+		}
+		h.record("scan")
+		return compare(tx, h.pending)
+
+	case OpScanRange:
+		tx, err := h.writable()
+		if err != nil {
+			return err
+		}
+		end := fmt.Sprintf("key-%d", h.rnd.Intn(h.cfg.Keys))
+		if end < key {
+			key, end = end, key
+		}
+		h.record("scanrange %s %s", key, end)
+		return compareRange(tx, h.pending, key, end)
+
+	case OpCommit:
+		h.record("commit")
+		return h.commit()
+
+	case OpReopen:
+		h.record("reopen")
+		// Uncommitted changes are dropped
+		err := h.open()
+		if err != nil {
+			return err
+		}
+		return h.check()
+	}
+	return nil
+}
+
+// commit commits current tx if any, then checks DB against model.
+func (h *harness) commit() error {
+	if h.tx != nil {
+		err := h.tx.Commit()
+		if err != nil {
+			return err
+		}
+		h.tx = nil
+		h.committed = h.pending
+	}
+	return h.check()
+}
+
+// check compares a read-only view of DB with committed model.
+func (h *harness) check() error {
+	tx, err := db.NewReadOnlyTx(h.db)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	err = compare(tx, h.committed)
+	if err != nil {
+		return err
+	}
+	for key, expect := range h.committed {
+		got := tx.Get([]byte(key))
+		if got == nil || string(got) != expect {
+			return fmt.Errorf("%w: key %s is %q, model %q", ErrMismatch, key, got, expect)
+		}
+	}
+	// All model keys are found, equal count means no extra keys.
+	profile := tx.TreeProfile()
+	count := profile.Levels[profile.Depth-1].Keys
+	if count != len(h.committed) {
+		return fmt.Errorf("%w: db has %d keys, model has %d", ErrMismatch, count, len(h.committed))
+	}
+	// Drain the channel, tx is in use until it's closed
+	for checkErr := range tx.Check() {
+		if err == nil {
+			err = checkErr
+		}
+	}
+	return err
+}
+
+// compare scans tx both ways and compares with model, also checks key order.
+func compare(tx *db.Tx, model map[string]string) error {
+	count := 0
+	var last []byte
+	c := tx.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if last != nil && string(last) >= string(k) {
+			return fmt.Errorf("%w: scan returns %q after %q", ErrMismatch, k, last)
+		}
+		last = append(last[:0], k...)
+		expect, exist := model[string(k)]
+		if !exist || string(v) != expect {
+			return fmt.Errorf("%w: scan returns %q=%q, model (%v, %q)", ErrMismatch, k, v, exist, expect)
+		}
+		count++
+	}
+	if count != len(model) {
+		return fmt.Errorf("%w: scan returns %d keys, model has %d", ErrMismatch, count, len(model))
+	}
+
+	// Reverse scan returns the same keys backward
+	count = 0
+	last = nil
+	for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
+		if last != nil && string(last) <= string(k) {
+			return fmt.Errorf("%w: reverse scan returns %q after %q", ErrMismatch, k, last)
+		}
+		last = append(last[:0], k...)
+		count++
+	}
+	if count != len(model) {
+		return fmt.Errorf("%w: reverse scan returns %d keys, model has %d", ErrMismatch, count, len(model))
+	}
+	return nil
+}
+
+// compareRange compares pairs of tx in [start, end) with model.
+func compareRange(tx *db.Tx, model map[string]string, start, end string) error {
+	expect := []string{}
+	for k := range model {
+		if k >= start && k < end {
+			expect = append(expect, k)
+		}
+	}
+	sort.Strings(expect)
+	i := 0
+	err := tx.Scan([]byte(start), []byte(end), func(k kv.Key, v kv.Value) error {
+		if i >= len(expect) || string(k) != expect[i] || string(v) != model[expect[i]] {
+			return fmt.Errorf("%w: scan [%s, %s) returns %q=%q at %d, model has %d keys",
+				ErrMismatch, start, end, k, v, i, len(expect))
+		}
+		i++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if i != len(expect) {
+		return fmt.Errorf("%w: scan [%s, %s) returns %d keys, model has %d", ErrMismatch, start, end, i, len(expect))
+	}
+	return nil
+}
+
+func copyMap(m map[string]string) map[string]string {
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
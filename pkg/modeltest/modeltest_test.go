@@ -0,0 +1,71 @@
+package modeltest
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestModel(t *testing.T) {
+	for seed := int64(0); seed < 5; seed++ {
+		cfg := DefaultConfig(seed)
+		err := Run(filepath.Join(t.TempDir(), "data"), cfg)
+		if err != nil {
+			t.Fatalf("seed %d: %v", seed, err)
+		}
+	}
+}
+
+func TestModelLargeValues(t *testing.T) {
+	cfg := DefaultConfig(42)
+	cfg.Keys = 300
+	cfg.MaxValueSize = 3000
+	err := Run(filepath.Join(t.TempDir(), "data"), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestModelDeleteHeavy(t *testing.T) {
+	cfg := DefaultConfig(7)
+	cfg.Steps = 20000
+	cfg.Weights[OpSet] = 40
+	cfg.Weights[OpRemove] = 60
+	cfg.DB.StrictMode = true
+	cfg.DB.PoisonFreed = true
+	err := Run(filepath.Join(t.TempDir(), "data"), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestModelWritableMmap(t *testing.T) {
+	for seed := int64(0); seed < 3; seed++ {
+		cfg := DefaultConfig(seed)
+		cfg.MaxValueSize = 1000
+		cfg.DB.WritableMmap = true
+		err := Run(filepath.Join(t.TempDir(), "data"), cfg)
+		if err != nil {
+			t.Fatalf("seed %d: %v", seed, err)
+		}
+	}
+}
+
+func TestModelNoMmap(t *testing.T) {
+	cfg := DefaultConfig(11)
+	cfg.MaxValueSize = 3000
+	cfg.DB.NoMmap = true
+	err := Run(filepath.Join(t.TempDir(), "data"), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestModelWAL(t *testing.T) {
+	cfg := DefaultConfig(13)
+	cfg.DB.WAL = true
+	cfg.DB.WALCheckpointSize = 1 << 16
+	err := Run(filepath.Join(t.TempDir(), "data"), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,6 +1,7 @@
 package page
 
 import (
+	"encoding/binary"
 	"fmt"
 	"os"
 	"unsafe"
@@ -18,50 +19,125 @@ const (
 	FlagInternal = 1 << 2
 	// FlagLeaf is leaf page flag
 	FlagLeaf = 1 << 3
-	// HeaderSize is page header size
-	HeaderSize = int(unsafe.Sizeof(Page{}))
+	// FlagOverflow is overflow page flag
+	FlagOverflow = 1 << 4
+	// FlagChangefeed is changefeed page flag
+	FlagChangefeed = 1 << 5
+	// HeaderSize is page header size, data starts right after it.
+	HeaderSize = int(unsafe.Offsetof(((*Page)(nil)).Data))
 )
 
 const (
 	// PairInfoSize is size for each pair info
 	PairInfoSize = int(unsafe.Sizeof(pairInfo{}))
-	maxPairs     = 1 << 10
+	maxPairs     = 1 << 27
+	// maxBufSize bounds the array type used to view page data.
+	maxBufSize = 1 << 31
+	// pgidSize is size of next page id in overflow page.
+	pgidSize = int(unsafe.Sizeof(common.Pgid(0)))
+	// compressedBit marks value size of compressed values, values are
+	// smaller than 1<<31 bytes.
+	compressedBit = 1 << 31
+	// prefixShift is the position of prefix length in key size, keys
+	// are smaller than 1<<16 bytes.
+	prefixShift = 16
+	// storedKeyMask masks the size of key bytes stored in page
+	storedKeyMask = 1<<prefixShift - 1
+	// mergeBit marks key size of merge records, prefixes are smaller
+	// than 1<<15 bytes.
+	mergeBit = 1 << 31
+	// MaxPrefix is the maximal shared prefix length of a key.
+	MaxPrefix = 1<<15 - 1
 )
 
 var (
 	// PageSize is OS page size, normally 4KB
 	PageSize = os.Getpagesize()
+	// MaxInlineValue is the largest value stored in leaf page,
+	// larger values are stored in a chain of overflow pages.
+	MaxInlineValue = PageSize / 4
+	// OverflowCapacity is value bytes held by one overflow page.
+	OverflowCapacity = PageSize - HeaderSize - pgidSize
 )
 
 // Page is the basic mmap block
 // internal page: page struct | data | key | key | ..
 // leaf     page: page struct | data | key | value | key | ..
+// overflow page: page struct | next pgid | value bytes
+//
+// Header, pair infos and next pgid are little-endian at fixed offsets,
+// read and written by methods, so files move across architectures. The
+// layout is what 64-bit little-endian builds wrote when Page was cast
+// from Go ints, so those files read unchanged:
+//
+//	0  overflow uint64
+//	8  count    uint64
+//	16 index    uint32
+//	20 flags    uint16
+//	24 data
+//
+// Leaf pair with value larger than MaxInlineValue keeps only the key
+// in leaf page, its childID is the first page of overflow chain.
+//
+// Keys of leaf page may be prefix compressed: a key sharing a prefix
+// with the first key of page stores the prefix length in pair info and
+// only the rest of key bytes, see SetPrefixAt.
 type Page struct {
 	// overflow counter, 0 for single page
-	Overflow int
+	overflow [8]byte
 	// key/freeslot count
-	Count int
-	// starting addr of data.
-	Data uintptr
+	count [8]byte
 	// index at mmap file
-	Index common.Pgid
+	index [4]byte
 	// type mark
-	Flags uint16
+	flags [2]byte
+	_     [2]byte
+	// starting addr of data, must be the last field.
+	Data uintptr
 }
 
 // pairInfo stores metadata for:
 // - key-value pair (for leaf node)
 // - b+tree index   (for internal node)
+//
+// Fields are little-endian uint32:
+//
+//	offset: &page.data + offset = &key
+//	keySize: key length, stored key bytes in low 16 bits and length
+//	of the prefix shared with key 0 in the next 15 bits, with mergeBit
+//	for merge record, &key + stored key size = &value
+//	valueSize: value length, 0 for internal node, with compressedBit
+//	for compressed value
+//	childID: child pgid, for leaf node the first overflow page or 0
 type pairInfo struct {
-	// &page.data + offset = &key
-	offset uint32
-	// key length
-	// &key + keySize = &value
-	keySize uint32
-	// value length, 0 for internal node
-	valueSize uint32
-	// child pgid, 0 for leaf node
-	childID common.Pgid
+	offset    [4]byte
+	keySize   [4]byte
+	valueSize [4]byte
+	childID   [4]byte
+}
+
+func (pi *pairInfo) getOffset() uint32 {
+	return binary.LittleEndian.Uint32(pi.offset[:])
+}
+
+func (pi *pairInfo) getKeySize() uint32 {
+	return binary.LittleEndian.Uint32(pi.keySize[:])
+}
+
+func (pi *pairInfo) setKeySize(size uint32) {
+	binary.LittleEndian.PutUint32(pi.keySize[:], size)
+}
+
+func (pi *pairInfo) getValueSize() uint32 {
+	return binary.LittleEndian.Uint32(pi.valueSize[:])
+}
+
+func (pi *pairInfo) setValueSize(size uint32) {
+	binary.LittleEndian.PutUint32(pi.valueSize[:], size)
+}
+
+func (pi *pairInfo) getChildID() common.Pgid {
+	return common.Pgid(binary.LittleEndian.Uint32(pi.childID[:]))
 }
 
 type Pages []*Page
@@ -71,7 +147,7 @@ func (pgs Pages) Len() int {
 }
 
 func (pgs Pages) Less(i, j int) bool {
-	return pgs[i].Index < pgs[j].Index
+	return pgs[i].Index() < pgs[j].Index()
 }
 
 func (pgs Pages) Swap(i, j int) {
@@ -83,47 +159,108 @@ func (p *Page) String() string {
 	return fmt.Sprintf(
 		"%s[%d] keys=%d, overflow=%d",
 		p.getType(),
-		p.Index,
-		p.Count,
-		p.Overflow,
+		p.Index(),
+		p.Count(),
+		p.Overflow(),
 	)
 }
 
+// Overflow returns number of pages following this page, 0 for single
+// page.
+func (p *Page) Overflow() int {
+	return int(binary.LittleEndian.Uint64(p.overflow[:]))
+}
+
+func (p *Page) SetOverflow(n int) {
+	binary.LittleEndian.PutUint64(p.overflow[:], uint64(n))
+}
+
+// Count returns key count, free slot count or bytes of overflow value.
+func (p *Page) Count() int {
+	return int(binary.LittleEndian.Uint64(p.count[:]))
+}
+
+func (p *Page) SetCount(n int) {
+	binary.LittleEndian.PutUint64(p.count[:], uint64(n))
+}
+
+// Index returns page id in file.
+func (p *Page) Index() common.Pgid {
+	return common.Pgid(binary.LittleEndian.Uint32(p.index[:]))
+}
+
+func (p *Page) SetIndex(id common.Pgid) {
+	binary.LittleEndian.PutUint32(p.index[:], uint32(id))
+}
+
+// Flags returns type flags of page.
+func (p *Page) Flags() uint16 {
+	return binary.LittleEndian.Uint16(p.flags[:])
+}
+
+// SetFlags replaces flags of page, SetFlag adds one.
+func (p *Page) SetFlags(flags uint16) {
+	binary.LittleEndian.PutUint16(p.flags[:], flags)
+}
+
 func (p *Page) SetFlag(flag uint16) {
-	p.Flags |= flag
+	p.SetFlags(p.Flags() | flag)
 }
 
 func (p *Page) IsMeta() bool {
-	return (p.Flags & FlagMeta) != 0
+	return (p.Flags() & FlagMeta) != 0
 }
 
 func (p *Page) IsFreelist() bool {
-	return (p.Flags & FlagFreelist) != 0
+	return (p.Flags() & FlagFreelist) != 0
 }
 
 func (p *Page) IsLeaf() bool {
-	return (p.Flags & FlagLeaf) != 0
+	return (p.Flags() & FlagLeaf) != 0
 }
 
 func (p *Page) IsInternal() bool {
-	return (p.Flags & FlagInternal) != 0
+	return (p.Flags() & FlagInternal) != 0
 }
 
-// getType returns page type as string
-func (p *Page) getType() string {
-	if (p.Flags & FlagMeta) != 0 {
-		return "meta page"
+func (p *Page) IsOverflow() bool {
+	return (p.Flags() & FlagOverflow) != 0
+}
+
+func (p *Page) IsChangefeed() bool {
+	return (p.Flags() & FlagChangefeed) != 0
+}
+
+// Type returns page type name, or "unknown" when no type flag is set.
+func (p *Page) Type() string {
+	if (p.Flags() & FlagMeta) != 0 {
+		return "meta"
+	}
+	if (p.Flags() & FlagFreelist) != 0 {
+		return "freelist"
+	}
+	if (p.Flags() & FlagInternal) != 0 {
+		return "internal"
 	}
-	if (p.Flags & FlagFreelist) != 0 {
-		return "freelist page"
+	if (p.Flags() & FlagLeaf) != 0 {
+		return "leaf"
 	}
-	if (p.Flags & FlagInternal) != 0 {
-		return "internal page"
+	if (p.Flags() & FlagOverflow) != 0 {
+		return "overflow"
 	}
-	if (p.Flags & FlagLeaf) != 0 {
-		return "leaf page"
+	if (p.Flags() & FlagChangefeed) != 0 {
+		return "changefeed"
+	}
+	return "unknown"
+}
+
+// getType returns page type as string
+func (p *Page) getType() string {
+	t := p.Type()
+	if t == "unknown" {
+		panic("Unknown page")
 	}
-	panic("Unknown page")
+	return t + " page"
 }
 
 func (p *Page) getPairInfo(i int) *pairInfo {
@@ -132,42 +269,174 @@ func (p *Page) getPairInfo(i int) *pairInfo {
 
 func (p *Page) SetPairInfo(i int, ks, vs uint32, cid common.Pgid, offset uint32) {
 	pi := p.getPairInfo(i)
-	pi.offset = offset
-	pi.keySize = ks
+	binary.LittleEndian.PutUint32(pi.offset[:], offset)
+	pi.setKeySize(ks)
+	binary.LittleEndian.PutUint32(pi.childID[:], uint32(cid))
 
 	if p.IsLeaf() {
-		pi.valueSize = vs
-	} else {
-		pi.childID = cid
+		pi.setValueSize(vs)
 	}
 }
 
 // GetKeyAt returns key with given index.
-// note: the key is in mmap buffer, not heap
+// note: the key is in mmap buffer, not heap, except keys with shared
+// prefix which are copied to heap.
 func (p *Page) GetKeyAt(i int) kv.Key {
+	prefix := p.GetPrefixAt(i)
+	if prefix == 0 {
+		return p.storedKeyAt(i)
+	}
+	stored := p.storedKeyAt(i)
+	key := make(kv.Key, prefix+len(stored))
+	copy(key, p.storedKeyAt(0)[:prefix])
+	copy(key[prefix:], stored)
+	return key
+}
+
+// storedKeyAt returns key bytes of given index stored in page, without
+// shared prefix.
+func (p *Page) storedKeyAt(i int) kv.Key {
 	pair := p.getPairInfo(i)
-	buf := (*[maxPairs]byte)(unsafe.Pointer(&p.Data))[pair.offset:]
-	return buf[:pair.keySize]
+	buf := (*[maxBufSize]byte)(unsafe.Pointer(&p.Data))[pair.getOffset():]
+	return buf[:pair.getKeySize()&storedKeyMask]
+}
+
+// GetPrefixAt returns length of the prefix key with given index shares
+// with key 0, which is not stored in page.
+func (p *Page) GetPrefixAt(i int) int {
+	return int(p.getPairInfo(i).getKeySize() &^ mergeBit >> prefixShift)
+}
+
+// SetPrefixAt records that key with given index shares prefix bytes
+// with key 0, its key size set by SetPairInfo is the rest of key.
+// Only leaf pages compress keys, prefix is at most MaxPrefix.
+func (p *Page) SetPrefixAt(i int, prefix int) {
+	if i == 0 || !p.IsLeaf() || prefix > MaxPrefix {
+		panic(fmt.Sprintf("error: prefix %d of key %d in %s", prefix, i, p.getType()))
+	}
+	pi := p.getPairInfo(i)
+	pi.setKeySize(pi.getKeySize()&(storedKeyMask|mergeBit) | uint32(prefix)<<prefixShift)
 }
 
 // GetValueAt returns value with given index.
 // note: the value is in mmap buffer, not heap
+// Values in overflow pages are read with ReadOverflow.
 func (p *Page) GetValueAt(i int) kv.Value {
 	if p.IsInternal() {
 		panic("error: get value at internal page")
 	}
 	pair := p.getPairInfo(i)
-	valueOffset := pair.offset + pair.keySize
-	buf := (*[maxPairs]byte)(unsafe.Pointer(&p.Data))[valueOffset:]
+	if pair.getChildID() != 0 {
+		panic("error: get value stored in overflow pages")
+	}
+	valueOffset := pair.getOffset() + pair.getKeySize()&storedKeyMask
+	buf := (*[maxBufSize]byte)(unsafe.Pointer(&p.Data))[valueOffset:]
+
+	return buf[:pair.getValueSize()&^compressedBit]
+}
+
+// GetOverflowAt returns the first overflow page of value with given
+// index, 0 when value is in leaf page.
+// Files written before overflow pages have 0 childID in leaf pages.
+func (p *Page) GetOverflowAt(i int) common.Pgid {
+	if p.IsInternal() {
+		panic("error: get overflow at internal page")
+	}
+	return p.getPairInfo(i).getChildID()
+}
 
-	return buf[:pair.valueSize]
+// GetValueSizeAt returns value length with given index, the
+// compressed length for compressed value.
+func (p *Page) GetValueSizeAt(i int) int {
+	return int(p.getPairInfo(i).getValueSize() &^ compressedBit)
+}
+
+// IsCompressedAt returns whether value with given index is compressed,
+// see codec.Encode.
+func (p *Page) IsCompressedAt(i int) bool {
+	return p.getPairInfo(i).getValueSize()&compressedBit != 0
+}
+
+// SetCompressedAt marks value with given index compressed.
+func (p *Page) SetCompressedAt(i int) {
+	pi := p.getPairInfo(i)
+	pi.setValueSize(pi.getValueSize() | compressedBit)
+}
+
+// IsMergeAt returns whether value with given index is a merge record,
+// which readers fold with the merge function of DB.
+func (p *Page) IsMergeAt(i int) bool {
+	return p.getPairInfo(i).getKeySize()&mergeBit != 0
+}
+
+// SetMergeAt marks value with given index a merge record.
+func (p *Page) SetMergeAt(i int) {
+	pi := p.getPairInfo(i)
+	pi.setKeySize(pi.getKeySize() | mergeBit)
 }
 
 func (p *Page) GetChildPgid(i int) common.Pgid {
 	if p.IsLeaf() {
 		panic("error: get child at leaf page")
 	}
-	return p.getPairInfo(i).childID
+	return p.getPairInfo(i).getChildID()
+}
+
+// IsOverflowValue returns whether value of given size is stored in
+// overflow pages.
+func IsOverflowValue(size int) bool {
+	return size > MaxInlineValue
+}
+
+// OverflowPages returns number of overflow pages holding value of given size.
+func OverflowPages(size int) int {
+	return (size + OverflowCapacity - 1) / OverflowCapacity
+}
+
+// GetOverflowNext returns next page of overflow chain, 0 at the end.
+func (p *Page) GetOverflowNext() common.Pgid {
+	return common.Pgid(binary.LittleEndian.Uint32(p.dataBytes(pgidSize)))
+}
+
+// dataBytes returns the first n bytes of page data.
+func (p *Page) dataBytes(n int) []byte {
+	return (*[maxBufSize]byte)(unsafe.Pointer(&p.Data))[:n:n]
+}
+
+// getOverflowData returns buffer for value bytes of overflow page.
+func (p *Page) getOverflowData() []byte {
+	buf := (*[maxBufSize]byte)(unsafe.Pointer(&p.Data))
+	return buf[pgidSize : pgidSize+OverflowCapacity]
+}
+
+// OverflowData returns value bytes held by overflow page. Capacity is
+// capped too, so reading it to the end doesn't leave a pointer beyond
+// page buffer.
+func (p *Page) OverflowData() []byte {
+	count := p.Count()
+	return p.getOverflowData()[:count:count]
+}
+
+// WriteOverflow makes page an overflow page followed by next, and
+// writes the head of value into it. Returns the rest of value.
+func (p *Page) WriteOverflow(value kv.Value, next common.Pgid) kv.Value {
+	p.SetFlag(FlagOverflow)
+	binary.LittleEndian.PutUint32(p.dataBytes(pgidSize), uint32(next))
+	n := copy(p.getOverflowData(), value)
+	p.SetCount(n)
+	return value[n:]
+}
+
+// ReadOverflow returns copy of value with given size, stored in
+// overflow chain starting from head. get returns page by id.
+func ReadOverflow(get func(common.Pgid) *Page, head common.Pgid, size int) kv.Value {
+	value := make(kv.Value, 0, size)
+	for id := head; id != 0; {
+		p := get(id)
+		value = append(value, p.OverflowData()...)
+		id = p.GetOverflowNext()
+	}
+	return value
 }
 
 // FromBuffer returns page with given index in a buffer.
@@ -1,24 +1,35 @@
 package page
 
-import "testing"
+import (
+	"bytes"
+	"testing"
+	"unsafe"
+)
 
 func TestPageFlag(t *testing.T) {
 	buf := make([]byte, PageSize)
 	p := FromBuffer(buf, 0)
-	p.Index = 46
-	p.Count = 42
+	p.SetIndex(46)
+	p.SetCount(42)
 
-	getPgid := FromBuffer(buf, 0).Index
+	getPgid := FromBuffer(buf, 0).Index()
 	if getPgid != 46 {
 		t.Errorf("pgid expect 46, get %d", getPgid)
 	}
 
-	getKeyCount := FromBuffer(buf, 0).Count
+	getKeyCount := FromBuffer(buf, 0).Count()
 	if getKeyCount != 42 {
 		t.Errorf("count expect 42, get %d", getKeyCount)
 	}
 
+	if typ := p.Type(); typ != "unknown" {
+		t.Errorf("type expect unknown, get %s", typ)
+	}
+
 	p.SetFlag(FlagMeta)
+	if typ := p.Type(); typ != "meta" {
+		t.Errorf("type expect meta, get %s", typ)
+	}
 	isMeta := FromBuffer(buf, 0).IsMeta()
 	if !isMeta {
 		t.Error("Page should be meta")
@@ -30,3 +41,45 @@ func TestPageFlag(t *testing.T) {
 		t.Error("Page should be freelist")
 	}
 }
+
+func TestPageLayout(t *testing.T) {
+	if HeaderSize != 24 || PairInfoSize != 16 {
+		t.Fatalf("Expect 24 byte header and 16 byte pair info, get %d %d", HeaderSize, PairInfoSize)
+	}
+	buf := make([]byte, PageSize)
+	p := FromBuffer(buf, 0)
+	p.SetOverflow(0x0102)
+	p.SetCount(0x0304)
+	p.SetIndex(0x05060708)
+	p.SetFlag(FlagLeaf)
+	p.SetPairInfo(0, 3, 5, 0x0a0b0c0d, 0x10)
+	p.SetCompressedAt(0)
+
+	// Fields are little-endian at fixed offsets
+	expect := []byte{
+		0x02, 0x01, 0, 0, 0, 0, 0, 0,
+		0x04, 0x03, 0, 0, 0, 0, 0, 0,
+		0x08, 0x07, 0x06, 0x05,
+		FlagLeaf, 0, 0, 0,
+		0x10, 0, 0, 0,
+		3, 0, 0, 0,
+		5, 0, 0, 0x80,
+		0x0d, 0x0c, 0x0b, 0x0a,
+	}
+	if !bytes.Equal(buf[:len(expect)], expect) {
+		t.Errorf("Unexpected layout:\n%x\nexpect:\n%x", buf[:len(expect)], expect)
+	}
+	if p.Overflow() != 0x0102 || p.Count() != 0x0304 || p.Index() != 0x05060708 || p.Flags() != FlagLeaf {
+		t.Errorf("Header read back wrong: %s", p)
+	}
+	if p.GetOverflowAt(0) != 0x0a0b0c0d || p.GetValueSizeAt(0) != 5 || !p.IsCompressedAt(0) {
+		t.Error("Pair info read back wrong")
+	}
+
+	o := FromBuffer(make([]byte, PageSize), 0)
+	o.WriteOverflow([]byte("abc"), 0x01020304)
+	data := (*[HeaderSize + 4]byte)(unsafe.Pointer(o))[HeaderSize:]
+	if !bytes.Equal(data, []byte{4, 3, 2, 1}) || o.GetOverflowNext() != 0x01020304 {
+		t.Errorf("Expect little-endian next pgid, get %x", data)
+	}
+}
@@ -0,0 +1,259 @@
+// Package server exposes a DB over network protocols, for quick
+// integrations and debugging.
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/daicang/mk/pkg/db"
+	"github.com/daicang/mk/pkg/kv"
+)
+
+const (
+	// TxIDHeader holds id of the snapshot read, or of the commit made.
+	TxIDHeader = "X-Mk-Txid"
+	// keysPath prefixes key endpoints, key follows path escaped.
+	keysPath = "/keys/"
+	// scanPath lists pairs by prefix.
+	scanPath = "/scan"
+	// DefaultScanLimit is default limit of pairs returned by scan.
+	DefaultScanLimit = 1000
+)
+
+// Pair is one pair in scan response. Keys and values may be any bytes,
+// so they're base64 encoded in JSON.
+type Pair struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// httpHandler serves DB over HTTP.
+type httpHandler struct {
+	db *db.DB
+	// maxValueSize bounds PUT body, db.MaxValueSize but in tests
+	maxValueSize int
+}
+
+// NewHTTPHandler returns HTTP handler of d serving:
+//   - GET /keys/{key}: value as body, 404 when not found
+//   - PUT /keys/{key}: sets body as value, 413 when it's larger than
+//     db.MaxValueSize
+//   - DELETE /keys/{key}: removes key, 404 when not found
+//   - GET /scan?prefix=&limit=: JSON array of pairs with prefix, at most
+//     limit pairs, DefaultScanLimit by default, see Pair
+//
+// Key is path escaped, so it may hold "/" as "%2F". Responses carry the
+// txid of the snapshot read or commit made in TxIDHeader, and reads
+// carry it as ETag. GET with matching If-None-Match returns 304, PUT
+// and DELETE with If-Match fail with 412 when DB changed since the txid.
+func NewHTTPHandler(d *db.DB) http.Handler {
+	return &httpHandler{db: d, maxValueSize: db.MaxValueSize}
+}
+
+// ServeHTTP dispatches request by path.
+func (h *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.EscapedPath()
+	switch {
+	case strings.HasPrefix(path, keysPath):
+		key, err := url.PathUnescape(path[len(keysPath):])
+		if err != nil || key == "" {
+			http.Error(w, "bad key", http.StatusBadRequest)
+			return
+		}
+		h.serveKey(w, r, kv.Key(key))
+	case path == scanPath:
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		h.serveScan(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// etag returns ETag of txid.
+func etag(txid uint64) string {
+	return `"` + strconv.FormatUint(txid, 10) + `"`
+}
+
+// setTxID sets txid headers of response.
+func setTxID(w http.ResponseWriter, txid uint64, tag bool) {
+	w.Header().Set(TxIDHeader, strconv.FormatUint(txid, 10))
+	if tag {
+		w.Header().Set("ETag", etag(txid))
+	}
+}
+
+func methodNotAllowed(w http.ResponseWriter, methods ...string) {
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+}
+
+// writeError writes status matching err.
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, db.ErrKeyTooLarge):
+		status = http.StatusBadRequest
+	case errors.Is(err, db.ErrValueTooLarge):
+		status = http.StatusRequestEntityTooLarge
+	case errors.Is(err, db.ErrDBClosed):
+		status = http.StatusServiceUnavailable
+	}
+	http.Error(w, err.Error(), status)
+}
+
+var (
+	// errPrecondition fails update when If-Match doesn't match.
+	errPrecondition = errors.New("precondition failed")
+	// errNotFound fails removal of missing key.
+	errNotFound = errors.New("not found")
+	// errLimit stops scan at limit.
+	errLimit = errors.New("limit reached")
+)
+
+func (h *httpHandler) serveKey(w http.ResponseWriter, r *http.Request, key kv.Key) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		h.get(w, r, key)
+	case http.MethodPut, http.MethodDelete:
+		h.update(w, r, key)
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete)
+	}
+}
+
+func (h *httpHandler) get(w http.ResponseWriter, r *http.Request, key kv.Key) {
+	var txid uint64
+	var value kv.Value
+	err := h.db.View(func(tx *db.Tx) error {
+		txid = tx.ID()
+		if v := tx.Get(key); v != nil {
+			value = append(kv.Value{}, v...)
+		}
+		return nil
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	setTxID(w, txid, true)
+	if value == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Header.Get("If-None-Match") == etag(txid) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(value)))
+	if r.Method == http.MethodGet {
+		_, _ = w.Write(value)
+	}
+}
+
+func (h *httpHandler) update(w http.ResponseWriter, r *http.Request, key kv.Key) {
+	remove := r.Method == http.MethodDelete
+	var value kv.Value
+	if !remove {
+		// Body is read up to one byte over the limit, so a larger body
+		// fails without being buffered
+		if r.ContentLength > int64(h.maxValueSize) {
+			writeError(w, db.ErrValueTooLarge)
+			return
+		}
+		body := http.MaxBytesReader(w, r.Body, int64(h.maxValueSize)+1)
+		var err error
+		value, err = ioutil.ReadAll(body)
+		if len(value) > h.maxValueSize {
+			writeError(w, db.ErrValueTooLarge)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	match := r.Header.Get("If-Match")
+	var txid uint64
+	err := h.db.Update(func(tx *db.Tx) error {
+		txid = tx.ID()
+		if match != "" && match != etag(tx.ID()-1) {
+			return errPrecondition
+		}
+		if !remove {
+			_, err := tx.Set(key, value)
+			return err
+		}
+		old, err := tx.Remove(key)
+		if err == nil && old == nil {
+			return errNotFound
+		}
+		return err
+	})
+	switch {
+	case errors.Is(err, errPrecondition):
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+	case errors.Is(err, errNotFound):
+		http.NotFound(w, r)
+	case err != nil:
+		writeError(w, err)
+	default:
+		setTxID(w, txid, false)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (h *httpHandler) serveScan(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	prefix := kv.Key(q.Get("prefix"))
+	limit := DefaultScanLimit
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			http.Error(w, "bad limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	// Without bytewise order, keys with prefix are not together
+	rng := kv.PrefixRange(prefix)
+	if !h.db.Bytewise() {
+		rng = kv.Range{}
+	}
+	var txid uint64
+	pairs := []Pair{}
+	err := h.db.View(func(tx *db.Tx) error {
+		txid = tx.ID()
+		err := tx.Scan(rng.Start, rng.End, func(k kv.Key, v kv.Value) error {
+			if !bytes.HasPrefix(k, prefix) {
+				return nil
+			}
+			if len(pairs) == limit {
+				return errLimit
+			}
+			pairs = append(pairs, Pair{Key: append([]byte{}, k...), Value: append([]byte{}, v...)})
+			return nil
+		})
+		if errors.Is(err, errLimit) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	setTxID(w, txid, true)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(pairs)
+}
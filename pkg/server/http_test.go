@@ -0,0 +1,160 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/daicang/mk/pkg/db"
+)
+
+func openDB(t *testing.T) *db.DB {
+	t.Helper()
+	d, err := db.Open(db.Options{Path: filepath.Join(t.TempDir(), "data")})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = d.Close()
+	})
+	return d
+}
+
+// do serves one request, returns the response.
+func do(h http.Handler, method, target, body string, headers ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	for i := 0; i+1 < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestHTTPKeys(t *testing.T) {
+	h := NewHTTPHandler(openDB(t))
+	if w := do(h, "GET", "/keys/a%2Fb", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expect 404 for missing key, get %d", w.Code)
+	}
+	w := do(h, "PUT", "/keys/a%2Fb", "value")
+	if w.Code != http.StatusNoContent || w.Header().Get(TxIDHeader) == "" {
+		t.Fatalf("Failed to put: %d %s", w.Code, w.Body)
+	}
+	txid := w.Header().Get(TxIDHeader)
+
+	w = do(h, "GET", "/keys/a%2Fb", "")
+	if w.Code != http.StatusOK || w.Body.String() != "value" || w.Header().Get("ETag") != `"`+txid+`"` {
+		t.Errorf("Unexpected get: %d %q %v", w.Code, w.Body, w.Header())
+	}
+	if w := do(h, "GET", "/keys/a%2Fb", "", "If-None-Match", `"`+txid+`"`); w.Code != http.StatusNotModified {
+		t.Errorf("Expect 304 for matching ETag, get %d", w.Code)
+	}
+
+	// Conditional writes
+	if w := do(h, "PUT", "/keys/a%2Fb", "new", "If-Match", `"0"`); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expect 412 for stale If-Match, get %d", w.Code)
+	}
+	if w := do(h, "PUT", "/keys/a%2Fb", "new", "If-Match", `"`+txid+`"`); w.Code != http.StatusNoContent {
+		t.Errorf("Expect put with current If-Match, get %d %s", w.Code, w.Body)
+	}
+	if w := do(h, "GET", "/keys/a%2Fb", ""); w.Body.String() != "new" {
+		t.Errorf("Expect new value, get %q", w.Body)
+	}
+
+	if w := do(h, "DELETE", "/keys/a%2Fb", ""); w.Code != http.StatusNoContent {
+		t.Errorf("Failed to delete: %d %s", w.Code, w.Body)
+	}
+	if w := do(h, "DELETE", "/keys/a%2Fb", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expect 404 deleting missing key, get %d", w.Code)
+	}
+	// Body over the value limit, with and without Content-Length
+	h.(*httpHandler).maxValueSize = 4
+	if w := do(h, "PUT", "/keys/a", "large"); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expect 413 for large value, get %d", w.Code)
+	}
+	r := httptest.NewRequest("PUT", "/keys/a", ioutil.NopCloser(strings.NewReader("large")))
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expect 413 for large chunked value, get %d", w.Code)
+	}
+	if w := do(h, "PUT", "/keys/a", "fits"); w.Code != http.StatusNoContent {
+		t.Errorf("Expect value at limit set, get %d %s", w.Code, w.Body)
+	}
+	if w := do(h, "POST", "/keys/a", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expect 405, get %d", w.Code)
+	}
+	if w := do(h, "GET", "/other", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expect 404 for unknown path, get %d", w.Code)
+	}
+}
+
+func TestHTTPScan(t *testing.T) {
+	h := NewHTTPHandler(openDB(t))
+	for _, key := range []string{"user:1", "user:2", "user:3", "item:1"} {
+		if w := do(h, "PUT", "/keys/"+key, "v-"+key); w.Code != http.StatusNoContent {
+			t.Fatalf("Failed to put: %d", w.Code)
+		}
+	}
+	// Not valid UTF-8
+	if w := do(h, "PUT", "/keys/bin%FF", "\xff\xfe"); w.Code != http.StatusNoContent {
+		t.Fatalf("Failed to put: %d", w.Code)
+	}
+	pair := func(key string) Pair {
+		return Pair{Key: []byte(key), Value: []byte("v-" + key)}
+	}
+	for target, expected := range map[string][]Pair{
+		"/scan?prefix=user:":         {pair("user:1"), pair("user:2"), pair("user:3")},
+		"/scan?prefix=user:&limit=2": {pair("user:1"), pair("user:2")},
+		"/scan?prefix=none":          {},
+		"/scan?prefix=bin":           {{Key: []byte("bin\xff"), Value: []byte("\xff\xfe")}},
+		"/scan?limit=2":              {{Key: []byte("bin\xff"), Value: []byte("\xff\xfe")}, pair("item:1")},
+	} {
+		w := do(h, "GET", target, "")
+		pairs := []Pair{}
+		if err := json.Unmarshal(w.Body.Bytes(), &pairs); err != nil || w.Code != http.StatusOK {
+			t.Errorf("%s: bad response %d %s", target, w.Code, w.Body)
+			continue
+		}
+		if !reflect.DeepEqual(pairs, expected) {
+			t.Errorf("%s: expect %q, get %q", target, expected, pairs)
+		}
+	}
+	if w := do(h, "GET", "/scan?limit=0", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Expect 400 for bad limit, get %d", w.Code)
+	}
+}
+
+func TestHTTPScanCompare(t *testing.T) {
+	d, err := db.Open(db.Options{
+		Path:        filepath.Join(t.TempDir(), "data"),
+		Compare:     func(a, b []byte) int { return bytes.Compare(b, a) },
+		CompareName: "reverse",
+	})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer func() { _ = d.Close() }()
+	h := NewHTTPHandler(d)
+	for _, key := range []string{"user:1", "user:2", "item:1"} {
+		if w := do(h, "PUT", "/keys/"+key, "v"); w.Code != http.StatusNoContent {
+			t.Fatalf("Failed to put: %d", w.Code)
+		}
+	}
+	// Prefix range is empty in reverse order, keys are filtered instead
+	w := do(h, "GET", "/scan?prefix=user:", "")
+	pairs := []Pair{}
+	if err := json.Unmarshal(w.Body.Bytes(), &pairs); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Bad response %d %s", w.Code, w.Body)
+	}
+	expected := []Pair{{Key: []byte("user:2"), Value: []byte("v")}, {Key: []byte("user:1"), Value: []byte("v")}}
+	if !reflect.DeepEqual(pairs, expected) {
+		t.Errorf("Expect %q, get %q", expected, pairs)
+	}
+}
@@ -0,0 +1,559 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/daicang/mk/pkg/db"
+	"github.com/daicang/mk/pkg/kv"
+)
+
+const (
+	// maxBulkSize bounds bulk string length of requests, as Redis does.
+	maxBulkSize = 512 << 20
+	// maxArgs bounds argument count of requests.
+	maxArgs = 1 << 20
+	// maxLineSize bounds inline commands and array and bulk headers.
+	maxLineSize = 64 << 10
+	// defaultScanCount is keys SCAN visits without COUNT.
+	defaultScanCount = 10
+)
+
+// ErrServerClosed is returned by RESPServer.Serve after Close.
+var ErrServerClosed = errors.New("server closed")
+
+// errProtocol is returned for malformed request, connection is closed.
+var errProtocol = errors.New("protocol error")
+
+// RESPServer serves DB to Redis clients with the RESP protocol. It
+// supports GET, SET, DEL, MGET, SCAN, PING, ECHO and QUIT, each command
+// runs in its own transaction.
+type RESPServer struct {
+	db *db.DB
+	// mu protects fields below
+	mu        sync.Mutex
+	listeners map[net.Listener]bool
+	conns     map[net.Conn]bool
+	closed    bool
+	// wg counts connection goroutines
+	wg sync.WaitGroup
+}
+
+// NewRESPServer returns RESP server of d.
+func NewRESPServer(d *db.DB) *RESPServer {
+	return &RESPServer{
+		db:        d,
+		listeners: map[net.Listener]bool{},
+		conns:     map[net.Conn]bool{},
+	}
+}
+
+// Serve accepts connections on l until Close, then returns
+// ErrServerClosed. l is closed when Serve returns.
+func (s *RESPServer) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		_ = l.Close()
+		return ErrServerClosed
+	}
+	s.listeners[l] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+		_ = l.Close()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			_ = conn.Close()
+			return ErrServerClosed
+		}
+		s.conns[conn] = true
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+// Close closes listeners and connections, and waits for running
+// commands to finish.
+func (s *RESPServer) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		_ = l.Close()
+	}
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+// serveConn runs commands of one connection until it's closed.
+func (s *RESPServer) serveConn(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		_ = conn.Close()
+		s.wg.Done()
+	}()
+	r := bufio.NewReader(conn)
+	w := &respWriter{bufio.NewWriter(conn)}
+	for {
+		args, err := readCommand(r)
+		if errors.Is(err, errProtocol) {
+			w.writeError("ERR " + err.Error())
+			_ = w.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		quit := s.run(w, args)
+		// Replies of pipelined commands are flushed together
+		if quit || r.Buffered() == 0 {
+			if w.Flush() != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+// readCommand reads one request, an array of bulk strings or an inline
+// command separated by spaces.
+func readCommand(r *bufio.Reader) ([][]byte, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		args := [][]byte{}
+		for _, f := range strings.Fields(string(line)) {
+			args = append(args, []byte(f))
+		}
+		return args, nil
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n < 0 || n > maxArgs {
+		return nil, fmt.Errorf("%w: bad array length %q", errProtocol, line[1:])
+	}
+	args := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		line, err = readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, fmt.Errorf("%w: expect bulk string, get %q", errProtocol, line)
+		}
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 || size > maxBulkSize {
+			return nil, fmt.Errorf("%w: bad bulk length %q", errProtocol, line[1:])
+		}
+		buf := make([]byte, size+2)
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.HasSuffix(buf, []byte("\r\n")) {
+			return nil, fmt.Errorf("%w: bulk string not ended by CRLF", errProtocol)
+		}
+		args = append(args, buf[:size])
+	}
+	return args, nil
+}
+
+// readLine reads a line without CRLF, a line longer than maxLineSize
+// is a protocol error.
+func readLine(r *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		frag, err := r.ReadSlice('\n')
+		if len(line)+len(frag) > maxLineSize {
+			return nil, fmt.Errorf("%w: line exceeds %d bytes", errProtocol, maxLineSize)
+		}
+		line = append(line, frag...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return bytes.TrimRight(line, "\r\n"), nil
+	}
+}
+
+// respWriter writes RESP replies.
+type respWriter struct {
+	*bufio.Writer
+}
+
+func (w *respWriter) writeSimple(s string) {
+	_, _ = w.WriteString("+" + s + "\r\n")
+}
+
+func (w *respWriter) writeError(s string) {
+	_, _ = w.WriteString("-" + s + "\r\n")
+}
+
+func (w *respWriter) writeInt(n int) {
+	_, _ = w.WriteString(":" + strconv.Itoa(n) + "\r\n")
+}
+
+// writeBulk writes b as bulk string, nil as null bulk string.
+func (w *respWriter) writeBulk(b []byte) {
+	if b == nil {
+		_, _ = w.WriteString("$-1\r\n")
+		return
+	}
+	_, _ = w.WriteString("$" + strconv.Itoa(len(b)) + "\r\n")
+	_, _ = w.Write(b)
+	_, _ = w.WriteString("\r\n")
+}
+
+func (w *respWriter) writeArray(n int) {
+	_, _ = w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+// respArity maps commands to minimal and maximal argument count,
+// maximal count is -1 for no limit.
+var respArity = map[string][2]int{
+	"get":  {1, 1},
+	"set":  {2, 4},
+	"del":  {1, -1},
+	"mget": {1, -1},
+	"scan": {1, 5},
+	"ping": {0, 1},
+	"echo": {1, 1},
+	"quit": {0, 0},
+}
+
+// run runs one command and writes its reply, returns whether
+// connection should be closed.
+func (s *RESPServer) run(w *respWriter, args [][]byte) bool {
+	name := strings.ToLower(string(args[0]))
+	arity, ok := respArity[name]
+	if !ok {
+		w.writeError(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return false
+	}
+	args = args[1:]
+	if len(args) < arity[0] || (arity[1] >= 0 && len(args) > arity[1]) {
+		w.writeError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", name))
+		return false
+	}
+	var err error
+	switch name {
+	case "ping":
+		if len(args) == 0 {
+			w.writeSimple("PONG")
+		} else {
+			w.writeBulk(args[0])
+		}
+	case "echo":
+		w.writeBulk(args[0])
+	case "quit":
+		w.writeSimple("OK")
+		return true
+	case "get":
+		err = s.mget(w, args, false)
+	case "mget":
+		err = s.mget(w, args, true)
+	case "set":
+		err = s.set(w, args)
+	case "del":
+		err = s.del(w, args)
+	case "scan":
+		err = s.scan(w, args)
+	}
+	if err != nil {
+		w.writeError("ERR " + err.Error())
+	}
+	return false
+}
+
+// mget replies values of keys, as array for MGET.
+func (s *RESPServer) mget(w *respWriter, args [][]byte, array bool) error {
+	keys := make([]kv.Key, len(args))
+	for i, arg := range args {
+		keys[i] = arg
+	}
+	var values []kv.Value
+	err := s.db.View(func(tx *db.Tx) error {
+		found, err := tx.GetMany(keys)
+		if err != nil {
+			return err
+		}
+		// Values are only valid in tx
+		values = make([]kv.Value, len(found))
+		for i, v := range found {
+			if v != nil {
+				values[i] = append(kv.Value{}, v...)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !array {
+		w.writeBulk(values[0])
+		return nil
+	}
+	w.writeArray(len(values))
+	for _, v := range values {
+		w.writeBulk(v)
+	}
+	return nil
+}
+
+// set handles SET key value [NX|XX].
+func (s *RESPServer) set(w *respWriter, args [][]byte) error {
+	nx, xx := false, false
+	for _, opt := range args[2:] {
+		switch strings.ToLower(string(opt)) {
+		case "nx":
+			nx = true
+		case "xx":
+			xx = true
+		default:
+			return fmt.Errorf("unsupported SET option '%s'", opt)
+		}
+	}
+	if nx && xx {
+		return errors.New("syntax error")
+	}
+	done := false
+	err := s.db.Update(func(tx *db.Tx) error {
+		exist := tx.Get(args[0]) != nil
+		if (nx && exist) || (xx && !exist) {
+			return nil
+		}
+		done = true
+		_, err := tx.Set(args[0], args[1])
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if done {
+		w.writeSimple("OK")
+	} else {
+		w.writeBulk(nil)
+	}
+	return nil
+}
+
+// del removes keys, replies number of keys removed.
+func (s *RESPServer) del(w *respWriter, keys [][]byte) error {
+	removed := 0
+	err := s.db.Update(func(tx *db.Tx) error {
+		removed = 0
+		for _, key := range keys {
+			old, err := tx.Remove(key)
+			if err != nil {
+				return err
+			}
+			if old != nil {
+				removed++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	w.writeInt(removed)
+	return nil
+}
+
+// scan handles SCAN cursor [MATCH pattern] [COUNT count]. Cursor
+// encodes the next key to visit, so keys removed or added during
+// iteration never make SCAN skip or repeat other keys.
+func (s *RESPServer) scan(w *respWriter, args [][]byte) error {
+	start, err := decodeCursor(string(args[0]))
+	if err != nil {
+		return err
+	}
+	var pattern []byte
+	count := defaultScanCount
+	for i := 1; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			return errors.New("syntax error")
+		}
+		switch strings.ToLower(string(args[i])) {
+		case "match":
+			pattern = args[i+1]
+		case "count":
+			count, err = strconv.Atoi(string(args[i+1]))
+			if err != nil || count <= 0 {
+				return errors.New("value is not an integer or out of range")
+			}
+		default:
+			return errors.New("syntax error")
+		}
+	}
+	keys := [][]byte{}
+	next := "0"
+	err = s.db.View(func(tx *db.Tx) error {
+		c := tx.Cursor()
+		k, _ := c.First()
+		if start != nil {
+			k, _ = c.Seek(start)
+		}
+		for visited := 0; visited < count && k != nil; visited++ {
+			if pattern == nil || globMatch(pattern, k) {
+				keys = append(keys, append([]byte{}, k...))
+			}
+			k, _ = c.Next()
+		}
+		if k != nil {
+			next = encodeCursor(k)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	w.writeArray(2)
+	w.writeBulk([]byte(next))
+	w.writeArray(len(keys))
+	for _, k := range keys {
+		w.writeBulk(k)
+	}
+	return nil
+}
+
+// encodeCursor returns SCAN cursor resuming at key, the decimal number
+// of key bytes after a leading 1. It stays an integer for clients which
+// parse cursors, and the leading 1 keeps leading zero bytes of key.
+func encodeCursor(key []byte) string {
+	return new(big.Int).SetBytes(append([]byte{1}, key...)).String()
+}
+
+// decodeCursor returns key SCAN resumes at, nil for cursor 0.
+func decodeCursor(cursor string) ([]byte, error) {
+	if cursor == "0" {
+		return nil, nil
+	}
+	invalid := errors.New("invalid cursor")
+	// Each key byte takes less than 3 digits
+	if len(cursor) > 3*(db.MaxKeySize+1) {
+		return nil, invalid
+	}
+	n, ok := new(big.Int).SetString(cursor, 10)
+	if !ok || n.Sign() <= 0 {
+		return nil, invalid
+	}
+	b := n.Bytes()
+	if b[0] != 1 {
+		return nil, invalid
+	}
+	return b[1:], nil
+}
+
+// globMatch returns whether key matches Redis glob pattern, where *
+// matches any bytes, ? one byte, [abc] and [^a-z] a byte class, and \
+// escapes. Unlike path.Match, / is an ordinary byte.
+func globMatch(pattern, key []byte) bool {
+	// After a mismatch, retry from the last * with it taking one more byte
+	star, starKey := -1, 0
+	p, k := 0, 0
+	for k < len(key) {
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '*':
+				star, starKey = p, k
+				p++
+				continue
+			case '?':
+				p++
+				k++
+				continue
+			}
+			if n, ok := matchElem(pattern[p:], key[k]); ok {
+				p += n
+				k++
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		starKey++
+		p, k = star+1, starKey
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchElem matches b with the literal, escaped byte or class at start
+// of pattern, returns length of the element and whether b matches.
+func matchElem(pattern []byte, b byte) (int, bool) {
+	switch pattern[0] {
+	case '\\':
+		if len(pattern) == 1 {
+			return 1, b == '\\'
+		}
+		return 2, pattern[1] == b
+	case '[':
+		i := 1
+		negate := i < len(pattern) && pattern[i] == '^'
+		if negate {
+			i++
+		}
+		matched := false
+		for ; i < len(pattern) && pattern[i] != ']'; i++ {
+			switch {
+			case pattern[i] == '\\' && i+1 < len(pattern):
+				i++
+				matched = matched || pattern[i] == b
+			case i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']':
+				lo, hi := pattern[i], pattern[i+2]
+				if lo > hi {
+					lo, hi = hi, lo
+				}
+				matched = matched || (lo <= b && b <= hi)
+				i += 2
+			default:
+				matched = matched || pattern[i] == b
+			}
+		}
+		// An unterminated class runs to the end of pattern, as in Redis
+		if i < len(pattern) {
+			i++
+		}
+		return i, matched != negate
+	}
+	return 1, pattern[0] == b
+}
@@ -0,0 +1,262 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// respClient sends commands to RESP server in tests.
+type respClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func startRESP(t *testing.T) (*RESPServer, *respClient) {
+	t.Helper()
+	s := NewRESPServer(openDB(t))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Serve(l)
+	}()
+	t.Cleanup(func() {
+		_ = s.Close()
+		if err := <-done; !errors.Is(err, ErrServerClosed) {
+			t.Errorf("Expect ErrServerClosed from Serve, get %v", err)
+		}
+	})
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return s, &respClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// send writes args as one command.
+func (c *respClient) send(args ...string) {
+	c.t.Helper()
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := c.conn.Write([]byte(b.String())); err != nil {
+		c.t.Fatalf("Failed to send: %v", err)
+	}
+}
+
+// reply reads one reply, rendered as "+OK", "-ERR ..", ":1", "value",
+// "(nil)" or "[a b]".
+func (c *respClient) reply() string {
+	c.t.Helper()
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("Failed to read reply: %v", err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return "(nil)"
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			c.t.Fatalf("Failed to read bulk: %v", err)
+		}
+		return string(buf[:n])
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		items := make([]string, n)
+		for i := range items {
+			items[i] = c.reply()
+		}
+		return "[" + strings.Join(items, " ") + "]"
+	}
+	return line
+}
+
+// do sends command and returns its reply.
+func (c *respClient) do(args ...string) string {
+	c.t.Helper()
+	c.send(args...)
+	return c.reply()
+}
+
+func TestRESPCommands(t *testing.T) {
+	_, c := startRESP(t)
+	tests := []struct {
+		args  []string
+		reply string
+	}{
+		{[]string{"PING"}, "+PONG"},
+		{[]string{"echo", "hi"}, "hi"},
+		{[]string{"GET", "a"}, "(nil)"},
+		{[]string{"SET", "a", "1"}, "+OK"},
+		{[]string{"SET", "b", ""}, "+OK"},
+		{[]string{"GET", "a"}, "1"},
+		{[]string{"GET", "b"}, ""},
+		{[]string{"SET", "a", "2", "NX"}, "(nil)"},
+		{[]string{"SET", "c", "3", "XX"}, "(nil)"},
+		{[]string{"SET", "a", "2", "XX"}, "+OK"},
+		{[]string{"MGET", "a", "c", "b"}, "[2 (nil) ]"},
+		{[]string{"DEL", "a", "c"}, ":1"},
+		{[]string{"GET", "a"}, "(nil)"},
+		{[]string{"SET", "a", "1", "EX", "10"}, "-ERR unsupported SET option 'EX'"},
+		{[]string{"GET"}, "-ERR wrong number of arguments for 'get' command"},
+		{[]string{"HGET", "a", "b"}, "-ERR unknown command 'HGET'"},
+	}
+	for _, tt := range tests {
+		if reply := c.do(tt.args...); reply != tt.reply {
+			t.Errorf("%v: expect %q, get %q", tt.args, tt.reply, reply)
+		}
+	}
+
+	// Inline command
+	if _, err := c.conn.Write([]byte("GET b\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if reply := c.reply(); reply != "" {
+		t.Errorf("Expect empty value of inline GET, get %q", reply)
+	}
+
+	// Pipelined commands
+	c.send("SET", "p", "1")
+	c.send("GET", "p")
+	if r1, r2 := c.reply(), c.reply(); r1 != "+OK" || r2 != "1" {
+		t.Errorf("Unexpected pipelined replies %q %q", r1, r2)
+	}
+
+	if reply := c.do("QUIT"); reply != "+OK" {
+		t.Errorf("Expect +OK for QUIT, get %q", reply)
+	}
+	if _, err := c.r.ReadByte(); err == nil {
+		t.Errorf("Expect connection closed after QUIT")
+	}
+}
+
+func TestRESPScan(t *testing.T) {
+	_, c := startRESP(t)
+	for i := 0; i < 25; i++ {
+		c.do("SET", fmt.Sprintf("key%02d", i), "v")
+	}
+	c.do("SET", "other", "v")
+
+	c.do("SET", "dir/a", "v")
+	c.do("SET", "dir/b", "v")
+
+	keys := []string{}
+	cursor := "0"
+	for {
+		reply := c.do("SCAN", cursor, "MATCH", "key*", "COUNT", "7")
+		fields := strings.Fields(strings.NewReplacer("[", "", "]", "").Replace(reply))
+		cursor = fields[0]
+		// Removing scanned keys doesn't make SCAN skip the others
+		for _, k := range fields[1:] {
+			c.do("DEL", k)
+		}
+		keys = append(keys, fields[1:]...)
+		if cursor == "0" {
+			break
+		}
+	}
+	if len(keys) != 25 || keys[0] != "key00" || keys[24] != "key24" {
+		t.Errorf("Unexpected scanned keys %v", keys)
+	}
+
+	// / is an ordinary byte for MATCH
+	if reply := c.do("SCAN", "0", "MATCH", "dir*"); reply != "[0 [dir/a dir/b]]" {
+		t.Errorf("Expect dir/a and dir/b, get %q", reply)
+	}
+
+	if reply := c.do("SCAN", "0", "COUNT", "0"); !strings.HasPrefix(reply, "-ERR") {
+		t.Errorf("Expect error for zero COUNT, get %q", reply)
+	}
+	if reply := c.do("SCAN", "x"); reply != "-ERR invalid cursor" {
+		t.Errorf("Expect invalid cursor error, get %q", reply)
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	for _, test := range []struct {
+		pattern, key string
+		match        bool
+	}{
+		{"", "", true},
+		{"", "a", false},
+		{"*", "", true},
+		{"*", "a/b", true},
+		{"a*", "a/b/c", true},
+		{"a?c", "a/c", true},
+		{"a?c", "ac", false},
+		{"*b*d", "abcabd", true},
+		{"*b*d", "abcabe", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[c-a]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{`a\*`, "a*", true},
+		{`a\*`, "ab", false},
+		{"a[", "a", false},
+	} {
+		if match := globMatch([]byte(test.pattern), []byte(test.key)); match != test.match {
+			t.Errorf("Match %q with %q: expect %v, get %v", test.pattern, test.key, test.match, match)
+		}
+	}
+}
+
+func TestScanCursor(t *testing.T) {
+	for _, key := range []string{"", "a", "\x00\x00b", strings.Repeat("\xff", 100)} {
+		cursor := encodeCursor([]byte(key))
+		if strings.Trim(cursor, "0123456789") != "" || cursor == "0" {
+			t.Errorf("Cursor of %q is not a positive integer: %q", key, cursor)
+		}
+		got, err := decodeCursor(cursor)
+		if err != nil || string(got) != key {
+			t.Errorf("Decode cursor of %q: get %q, %v", key, got, err)
+		}
+	}
+	for _, cursor := range []string{"-1", "00", "x", "255"} {
+		if _, err := decodeCursor(cursor); err == nil {
+			t.Errorf("Expect error for cursor %q", cursor)
+		}
+	}
+}
+
+func TestRESPProtocolError(t *testing.T) {
+	for name, req := range map[string]string{
+		"no bulk string":        "*1\r\n+GET\r\n",
+		"negative array length": "*-1\r\n",
+		"negative bulk length":  "*1\r\n$-1\r\n",
+		"long inline command":   strings.Repeat("x", maxLineSize+1) + "\r\n",
+		"long bulk header":      "*1\r\n$" + strings.Repeat("0", maxLineSize) + "\r\n",
+		"unterminated line":     strings.Repeat("x", 2*maxLineSize),
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, c := startRESP(t)
+			if _, err := c.conn.Write([]byte(req)); err != nil {
+				t.Fatal(err)
+			}
+			if reply := c.reply(); !strings.HasPrefix(reply, "-ERR protocol error") {
+				t.Errorf("Expect protocol error, get %q", reply)
+			}
+			if _, err := c.r.ReadByte(); err == nil {
+				t.Errorf("Expect connection closed after protocol error")
+			}
+		})
+	}
+}
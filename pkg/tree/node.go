@@ -1,10 +1,12 @@
 package tree
 
 import (
+	"bytes"
 	"fmt"
 	"sort"
 	"unsafe"
 
+	"github.com/daicang/mk/pkg/codec"
 	"github.com/daicang/mk/pkg/common"
 	"github.com/daicang/mk/pkg/kv"
 	"github.com/daicang/mk/pkg/page"
@@ -17,11 +19,21 @@ const (
 	maxKeys = 4
 )
 
+// minPrefix is the shortest shared prefix a leaf key is compressed by,
+// shorter ones save little and make reads copy the key.
+const minPrefix = 4
+
+const (
+	// DefaultFillPercent is how full split fills nodes by default.
+	DefaultFillPercent = 0.5
+	// MinFillPercent and MaxFillPercent bound fill percent of split.
+	MinFillPercent = 0.1
+	MaxFillPercent = 1.0
+)
+
 var (
-	splitPagePercent = 0.5
 	underfillPercent = 0.25
 
-	splitThreshold     = int(float64(page.PageSize) * splitPagePercent)
 	underfillThreshold = int(float64(page.PageSize) * underfillPercent)
 )
 
@@ -48,6 +60,19 @@ type Node struct {
 	Values []kv.Value
 	// cids holds children pgids.
 	Cids []common.Pgid
+	// Stored locates values already written to overflow pages, whose
+	// Values are nil, see SetStoredAt. It may be shorter than Keys,
+	// pairs past its end have values in Values.
+	Stored []Overflow
+	// Merged marks merge records, values holding a base value and
+	// operands which readers fold, see SetMergeAt. It may be shorter
+	// than Keys like Stored.
+	Merged []bool
+	// src is the page of node read by ReadPageLazy, values and
+	// children are read from it instead of Values and Cids.
+	src *page.Page
+	// get returns overflow pages of lazy node and stored values.
+	get func(common.Pgid) *page.Page
 }
 
 // String returns string representation of node.
@@ -62,7 +87,7 @@ func (n *Node) String() string {
 // Root returns root node from current node.
 func (n *Node) Root() *Node {
 	r := n
-	for !n.IsRoot() {
+	for !r.IsRoot() {
 		r = r.Parent
 	}
 	return r
@@ -73,15 +98,41 @@ func (n *Node) IsRoot() bool {
 	return n.Parent == nil
 }
 
+// Overflow locates a value stored in overflow pages.
+type Overflow struct {
+	// Head is the first page of chain, 0 for value in leaf page
+	Head common.Pgid
+	// Size is bytes in chain
+	Size int
+	// Compressed marks value encoded by codec.Encode
+	Compressed bool
+}
+
 // ReadPage initiate a node from page.
-func (n *Node) ReadPage(p *page.Page) {
-	n.Index = p.Index
+// get returns page by id, to read values in overflow pages.
+// Compressed values are decoded, error of a value failing to decode
+// wraps codec.ErrCorrupt, and the node is incomplete then.
+func (n *Node) ReadPage(p *page.Page, get func(common.Pgid) *page.Page) error {
+	n.Index = p.Index()
 	n.IsLeaf = p.IsLeaf()
+	n.get = get
 
-	for i := 0; i < p.Count; i++ {
+	for i := 0; i < p.Count(); i++ {
 		n.Keys = append(n.Keys, p.GetKeyAt(i))
 		if n.IsLeaf {
-			n.Values = append(n.Values, p.GetValueAt(i))
+			head := p.GetOverflowAt(i)
+			if head != 0 {
+				v, err := readOverflow(p, i, get)
+				if err != nil {
+					return err
+				}
+				n.Values = append(n.Values, v)
+			} else {
+				n.Values = append(n.Values, p.GetValueAt(i))
+			}
+			if p.IsMergeAt(i) {
+				n.SetMergeAt(i)
+			}
 		} else {
 			n.Cids = append(n.Cids, p.GetChildPgid(i))
 		}
@@ -90,25 +141,101 @@ func (n *Node) ReadPage(p *page.Page) {
 	if len(n.Keys) > 0 {
 		n.Key = n.Keys[0]
 	}
+	return nil
+}
+
+// ReadPageLazy initiates a read-only node from page, decoding only the
+// keys for search. Values, children and values in overflow pages are
+// read from page on demand, so a point read doesn't copy the rest of
+// node. Page and pages returned by get must stay valid while the node
+// is used, and the node must not be modified.
+func (n *Node) ReadPageLazy(p *page.Page, get func(common.Pgid) *page.Page) {
+	n.Index = p.Index()
+	n.IsLeaf = p.IsLeaf()
+	n.src = p
+	n.get = get
+	n.Keys = make([]kv.Key, p.Count())
+	for i := range n.Keys {
+		n.Keys[i] = p.GetKeyAt(i)
+	}
+	if len(n.Keys) > 0 {
+		n.Key = n.Keys[0]
+	}
 }
 
-// WritePage writes node to given page
-func (n *Node) WritePage(p *page.Page) {
+// Lazy returns whether node is read by ReadPageLazy.
+func (n *Node) Lazy() bool {
+	return n.src != nil
+}
+
+// readOverflow returns value i of leaf page p stored in overflow
+// pages, decoded when it's compressed.
+func readOverflow(p *page.Page, i int, get func(common.Pgid) *page.Page) (kv.Value, error) {
+	v, err := overflowAt(p, i).read(get)
+	if err != nil {
+		return nil, fmt.Errorf("decode value %d of page %d: %w", i, p.Index(), err)
+	}
+	return v, nil
+}
+
+// overflowAt returns location of value i of leaf page p, zero when
+// it's in the page.
+func overflowAt(p *page.Page, i int) Overflow {
+	head := p.GetOverflowAt(i)
+	if head == 0 {
+		return Overflow{}
+	}
+	return Overflow{Head: head, Size: p.GetValueSizeAt(i), Compressed: p.IsCompressedAt(i)}
+}
+
+// read returns copy of value in overflow chain, decoded when it's
+// compressed.
+func (ov Overflow) read(get func(common.Pgid) *page.Page) (kv.Value, error) {
+	v := page.ReadOverflow(get, ov.Head, ov.Size)
+	if !ov.Compressed {
+		return v, nil
+	}
+	return codec.Decode(v)
+}
+
+// WritePage writes node to given page.
+// For leaf node, overflows locates values larger than
+// page.MaxInlineValue, see OverflowPages.
+func (n *Node) WritePage(p *page.Page, overflows []Overflow) {
 	offset := uint32(len(n.Keys) * page.PairInfoSize)
 	buf := (*[common.MmapMaxSize]byte)(unsafe.Pointer(&p.Data))[offset:]
-	p.Count = len(n.Keys)
+	p.SetCount(len(n.Keys))
 
 	if n.IsLeaf {
 		p.SetFlag(page.FlagLeaf)
 		for i := 0; i < len(n.Keys); i++ {
-			keySize := uint32(len(n.Keys[i]))
+			// Prefix shared with key 0 is not stored
+			prefix := n.prefixAt(i)
+			key := n.Keys[i][prefix:]
+			keySize := uint32(len(key))
 			valueSize := uint32(len(n.Values[i]))
-			p.SetPairInfo(i, keySize, valueSize, 0, offset)
-
-			copy(buf, n.Keys[i])
+			if n.StoredAt(i).Head != 0 || page.IsOverflowValue(len(n.Values[i])) {
+				ov := overflows[i]
+				p.SetPairInfo(i, keySize, uint32(ov.Size), ov.Head, offset)
+				if ov.Compressed {
+					p.SetCompressedAt(i)
+				}
+				// Value is in overflow pages, only key is here
+				valueSize = 0
+			} else {
+				p.SetPairInfo(i, keySize, valueSize, 0, offset)
+			}
+			if prefix > 0 {
+				p.SetPrefixAt(i, prefix)
+			}
+			if n.MergeAt(i) {
+				p.SetMergeAt(i)
+			}
+
+			copy(buf, key)
 			buf = buf[keySize:]
 
-			copy(buf, n.Values[i])
+			copy(buf, n.Values[i][:valueSize])
 			buf = buf[valueSize:]
 
 			offset += keySize + valueSize
@@ -130,16 +257,36 @@ func (n *Node) WritePage(p *page.Page) {
 // Search searches key in index, returns (found, first equal-or-larger index)
 // when all indexes are smaller, returned index is len(index)
 func (n *Node) Search(key kv.Key) (bool, int) {
+	return n.SearchFunc(key, bytes.Compare)
+}
+
+// SearchFunc is Search in the order of cmp.
+func (n *Node) SearchFunc(key kv.Key, cmp kv.CompareFunc) (bool, int) {
 	i := sort.Search(len(n.Keys), func(i int) bool {
-		return n.Keys[i].GreaterEqual(key)
+		return cmp(n.Keys[i], key) >= 0
 	})
 	// Found
-	if i < len(n.Keys) && key.EqualTo(n.GetKeyAt(i)) {
+	if i < len(n.Keys) && cmp(key, n.Keys[i]) == 0 {
 		return true, i
 	}
 	return false, i
 }
 
+// ChildIndex returns index of the child which covers given key.
+// Keys smaller than the first key are routed to the first child.
+func (n *Node) ChildIndex(key kv.Key) int {
+	return n.ChildIndexFunc(key, bytes.Compare)
+}
+
+// ChildIndexFunc is ChildIndex in the order of cmp.
+func (n *Node) ChildIndexFunc(key kv.Key, cmp kv.CompareFunc) int {
+	found, i := n.SearchFunc(key, cmp)
+	if found || i == 0 {
+		return i
+	}
+	return i - 1
+}
+
 // InsertKeyValueAt inserts key/value pair into leaf node.
 func (n *Node) InsertKeyValueAt(i int, key kv.Key, value kv.Value) {
 	if !n.IsLeaf {
@@ -156,6 +303,17 @@ func (n *Node) InsertKeyValueAt(i int, key kv.Key, value kv.Value) {
 	n.Values = append(n.Values, kv.Value{})
 	copy(n.Values[i+1:], n.Values[i:])
 	n.Values[i] = value
+
+	if i < len(n.Stored) {
+		n.Stored = append(n.Stored, Overflow{})
+		copy(n.Stored[i+1:], n.Stored[i:])
+		n.Stored[i] = Overflow{}
+	}
+	if i < len(n.Merged) {
+		n.Merged = append(n.Merged, false)
+		copy(n.Merged[i+1:], n.Merged[i:])
+		n.Merged[i] = false
+	}
 }
 
 // InsertKeyChildAt inserts key/pgid into internal node.
@@ -180,11 +338,36 @@ func (n *Node) GetKeyAt(i int) kv.Key {
 	return n.Keys[i]
 }
 
+// GetValueAt returns value i, it panics on a value failing to decode,
+// see ValueAt.
 func (n *Node) GetValueAt(i int) kv.Value {
+	v, err := n.ValueAt(i)
+	if err != nil {
+		panic(err.Error())
+	}
+	return v
+}
+
+// ValueAt returns value i. Error of a value in overflow pages failing
+// to decode wraps codec.ErrCorrupt.
+func (n *Node) ValueAt(i int) (kv.Value, error) {
 	if !n.IsLeaf {
 		panic("get value in internal node")
 	}
-	return n.Values[i]
+	if n.src != nil {
+		if n.src.GetOverflowAt(i) != 0 {
+			return readOverflow(n.src, i, n.get)
+		}
+		return n.src.GetValueAt(i), nil
+	}
+	if ov := n.StoredAt(i); ov.Head != 0 {
+		v, err := ov.read(n.get)
+		if err != nil {
+			return nil, fmt.Errorf("decode stored value %d of %s: %w", i, n, err)
+		}
+		return v, nil
+	}
+	return n.Values[i], nil
 }
 
 func (n *Node) SetValueAt(i int, v kv.Value) {
@@ -192,12 +375,83 @@ func (n *Node) SetValueAt(i int, v kv.Value) {
 		panic("set value in internal node")
 	}
 	n.Values[i] = v
+	if i < len(n.Stored) {
+		n.Stored[i] = Overflow{}
+	}
+	if i < len(n.Merged) {
+		n.Merged[i] = false
+	}
+}
+
+// StoredAt returns location of value i written to overflow pages
+// before the node is written, zero for values in Values.
+func (n *Node) StoredAt(i int) Overflow {
+	if i < len(n.Stored) {
+		return n.Stored[i]
+	}
+	return Overflow{}
+}
+
+// SetStoredAt sets value i to the one in overflow pages located by ov,
+// so WritePage links the chain instead of writing value bytes. get of
+// ReadPage reads the value back.
+func (n *Node) SetStoredAt(i int, ov Overflow) {
+	if !n.IsLeaf {
+		panic("set stored value in internal node")
+	}
+	for len(n.Stored) < n.KeyCount() {
+		n.Stored = append(n.Stored, Overflow{})
+	}
+	n.Values[i] = nil
+	n.Stored[i] = ov
+	if i < len(n.Merged) {
+		n.Merged[i] = false
+	}
+}
+
+// MergeAt returns whether value i is a merge record, which holds an
+// optional base value and operands to fold with the merge function.
+func (n *Node) MergeAt(i int) bool {
+	if !n.IsLeaf {
+		panic("get merge record in internal node")
+	}
+	if n.src != nil {
+		return n.src.IsMergeAt(i)
+	}
+	return i < len(n.Merged) && n.Merged[i]
+}
+
+// SetMergeAt marks value i a merge record, setting value i clears it.
+func (n *Node) SetMergeAt(i int) {
+	if !n.IsLeaf {
+		panic("set merge record in internal node")
+	}
+	for len(n.Merged) <= i {
+		n.Merged = append(n.Merged, false)
+	}
+	n.Merged[i] = true
+}
+
+// OverflowAt returns location of value i when it's read from overflow
+// pages on demand, for stored values and values of lazy node. It's zero
+// for values in heap or leaf page.
+func (n *Node) OverflowAt(i int) Overflow {
+	if !n.IsLeaf {
+		panic("get overflow in internal node")
+	}
+	if n.src != nil {
+		return overflowAt(n.src, i)
+	}
+	return n.StoredAt(i)
 }
 
 func (n *Node) GetChildID(i int) common.Pgid {
 	if n.IsLeaf {
 		panic("get child at leaf node")
 	}
+	if n.src != nil {
+		return n.src.GetChildPgid(i)
+	}
 	return n.Cids[i]
 }
 
@@ -209,6 +463,7 @@ func (n *Node) SetChildID(i int, cid common.Pgid) {
 }
 
 // RemoveKeyValueAt removes key/value at given index.
+// Stored values are returned as nil, see StoredAt.
 func (n *Node) RemoveKeyValueAt(i int) (kv.Key, kv.Value) {
 	if !n.IsLeaf {
 		panic("Leaf-only operation")
@@ -226,6 +481,15 @@ func (n *Node) RemoveKeyValueAt(i int) (kv.Key, kv.Value) {
 	copy(n.Values[i:], n.Values[i+1:])
 	n.Values = n.Values[:len(n.Values)-1]
 
+	if i < len(n.Stored) {
+		copy(n.Stored[i:], n.Stored[i+1:])
+		n.Stored = n.Stored[:len(n.Stored)-1]
+	}
+	if i < len(n.Merged) {
+		copy(n.Merged[i:], n.Merged[i+1:])
+		n.Merged = n.Merged[:len(n.Merged)-1]
+	}
+
 	return removedKey, removedValue
 }
 
@@ -250,33 +514,137 @@ func (n *Node) RemoveKeyChildAt(i int) (kv.Key, common.Pgid) {
 	return removedKey, removedChild
 }
 
+// AppendPairs appends pairs of sibling from to n, for merging from
+// into n.
+func (n *Node) AppendPairs(from *Node) {
+	count := n.KeyCount()
+	n.Keys = append(n.Keys, from.Keys...)
+	n.Values = append(n.Values, from.Values...)
+	n.Cids = append(n.Cids, from.Cids...)
+	for i, ov := range from.Stored {
+		if ov.Head != 0 {
+			n.SetStoredAt(count+i, ov)
+		}
+	}
+	for i, merged := range from.Merged {
+		if merged {
+			n.SetMergeAt(count + i)
+		}
+	}
+}
+
+// prefixAt returns length of prefix key i shares with key 0, which
+// WritePage doesn't store. It's 0 for internal nodes and prefixes
+// shorter than minPrefix.
+func (n *Node) prefixAt(i int) int {
+	if !n.IsLeaf || i == 0 {
+		return 0
+	}
+	return sharedPrefix(n.Keys[0], n.Keys[i])
+}
+
+// sharedPrefix returns length of common prefix of a and b, 0 when it's
+// shorter than minPrefix.
+func sharedPrefix(a, b kv.Key) int {
+	limit := len(a)
+	if len(b) < limit {
+		limit = len(b)
+	}
+	if limit > page.MaxPrefix {
+		limit = page.MaxPrefix
+	}
+	i := 0
+	for i < limit && a[i] == b[i] {
+		i++
+	}
+	if i < minPrefix {
+		return 0
+	}
+	return i
+}
+
 // Size returns size when write to memory page.
+// Values in overflow pages and key prefixes shared with key 0 are not
+// counted.
 func (n *Node) Size() int {
 	size := page.HeaderSize + page.PairInfoSize*n.KeyCount()
 	for i := range n.Keys {
-		size += len(n.GetKeyAt(i))
+		size += len(n.GetKeyAt(i)) - n.prefixAt(i)
 		if n.IsLeaf {
-			size += len(n.GetValueAt(i))
+			size += n.inlineSizeAt(i)
 		}
 	}
 	return size
 }
 
+// OverflowPages returns number of overflow pages holding values of node.
+// Values of lazy node are counted by size in pages, which is smaller
+// for compressed values.
+func (n *Node) OverflowPages() int {
+	count := 0
+	if n.src != nil {
+		for i := 0; n.IsLeaf && i < n.src.Count(); i++ {
+			if n.src.GetOverflowAt(i) != 0 {
+				count += page.OverflowPages(n.src.GetValueSizeAt(i))
+			}
+		}
+		return count
+	}
+	for i, v := range n.Values {
+		if ov := n.StoredAt(i); ov.Head != 0 {
+			count += page.OverflowPages(ov.Size)
+		} else if page.IsOverflowValue(len(v)) {
+			count += page.OverflowPages(len(v))
+		}
+	}
+	return count
+}
+
+// inlineSizeAt returns bytes of value i in leaf page, without reading
+// values in overflow pages of lazy node.
+func (n *Node) inlineSizeAt(i int) int {
+	if n.src == nil {
+		return inlineSize(n.Values[i])
+	}
+	if n.src.GetOverflowAt(i) != 0 {
+		return 0
+	}
+	return n.src.GetValueSizeAt(i)
+}
+
+// inlineSize returns bytes of value in leaf page.
+func inlineSize(v kv.Value) int {
+	if page.IsOverflowValue(len(v)) {
+		return 0
+	}
+	return len(v)
+}
+
 func (n *Node) KeyCount() int {
 	return len(n.Keys)
 }
 
 // Split splits node into multiple siblings according to size and keys.
+// The first returned node is always n itself.
 // split sets Parent for new node, but will not update new nodes to Parent node.
 func (n *Node) Split() []*Node {
-	nodes := []*Node{}
+	return n.SplitFill(DefaultFillPercent)
+}
+
+// SplitFill is Split which fills each node but the last up to fill
+// percent of page, in [MinFillPercent, MaxFillPercent]. A high fill
+// packs keys appended in order, a low one leaves room for random
+// inserts.
+func (n *Node) SplitFill(fill float64) []*Node {
+	threshold := int(float64(page.PageSize) * fill)
+	nodes := []*Node{n}
 	node := n
 	for {
-		next := node.splitTwo()
+		next := node.splitTwo(threshold)
 		if next == nil {
 			break
 		}
-		nodes = append(nodes, node)
+		nodes = append(nodes, next)
 		node = next
 	}
 
@@ -293,13 +661,14 @@ func (n *Node) Overfill() bool {
 	return n.KeyCount() > maxKeys && n.Size() > page.PageSize
 }
 
-func isSplitPoint(i, size int) bool {
-	return i >= minKeys && size >= splitThreshold
+func isSplitPoint(i, size, threshold int) bool {
+	return i >= minKeys && size >= threshold
 }
 
-// splitTwo splits overfilled nodes.
+// splitTwo splits overfilled nodes, the first node keeps pairs below
+// threshold bytes.
 // splitTwo will not update new node to Parent node.
-func (n *Node) splitTwo() *Node {
+func (n *Node) splitTwo(threshold int) *Node {
 	if !n.Overfill() {
 		return nil
 	}
@@ -308,34 +677,42 @@ func (n *Node) splitTwo() *Node {
 	// Search split point
 	for i, key := range n.Keys {
 		size += page.PairInfoSize
-		size += len(key)
+		size += len(key) - n.prefixAt(i)
 		if n.IsLeaf {
-			size += len(n.Values[i])
+			size += inlineSize(n.Values[i])
 		}
-		if isSplitPoint(i, size) {
+		if isSplitPoint(i, size, threshold) {
 			splitIndex = i
 			break
 		}
 	}
-	// If it's root, prepare a new parent
+	// If it's root, prepare a new parent.
+	// Children are inserted to the new parent during spill.
 	if n.IsRoot() {
-		n.Parent = &Node{
-			Keys: []kv.Key{n.Key},
-			Cids: []common.Pgid{n.Index},
-		}
+		n.Parent = &Node{}
 	}
 	next := Node{
 		IsLeaf: n.IsLeaf,
 		Parent: n.Parent,
+		get:    n.get,
 	}
-	// Split key, value, children
-	next.Keys = n.Keys[splitIndex:]
+	// Split key, value, children.
+	// Copy the tail so appending to n never overwrites next.
+	next.Keys = append([]kv.Key{}, n.Keys[splitIndex:]...)
 	n.Keys = n.Keys[:splitIndex]
 	if n.IsLeaf {
-		next.Values = n.Values[splitIndex:]
+		next.Values = append([]kv.Value{}, n.Values[splitIndex:]...)
 		n.Values = n.Values[:splitIndex]
+		if len(n.Stored) > splitIndex {
+			next.Stored = append([]Overflow{}, n.Stored[splitIndex:]...)
+			n.Stored = n.Stored[:splitIndex]
+		}
+		if len(n.Merged) > splitIndex {
+			next.Merged = append([]bool{}, n.Merged[splitIndex:]...)
+			n.Merged = n.Merged[:splitIndex]
+		}
 	} else {
-		next.Cids = n.Cids[splitIndex:]
+		next.Cids = append([]common.Pgid{}, n.Cids[splitIndex:]...)
 		n.Cids = n.Cids[:splitIndex]
 	}
 
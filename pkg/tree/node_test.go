@@ -1,9 +1,15 @@
 package tree
 
 import (
+	"bytes"
+	"errors"
 	"math"
+	"strings"
 	"testing"
 
+	"github.com/daicang/mk/pkg/codec"
+	"github.com/daicang/mk/pkg/common"
+	"github.com/daicang/mk/pkg/kv"
 	"github.com/daicang/mk/pkg/page"
 	"github.com/daicang/mk/pkg/testutil"
 )
@@ -12,7 +18,7 @@ func allocPage(size int) *page.Page {
 	count := int(math.Ceil(float64(size) / float64(page.PageSize)))
 	buf := make([]byte, count*page.PageSize)
 	p := page.FromBuffer(buf, 0)
-	p.Overflow = count - 1
+	p.SetOverflow(count - 1)
 
 	return p
 }
@@ -57,17 +63,17 @@ func TestNodeWrite(t *testing.T) {
 	kvs, n := randomNode(size)
 	p := allocPage(n.Size())
 
-	n.WritePage(p)
+	n.WritePage(p, nil)
 
 	if !p.IsLeaf() {
 		t.Error("page should be leaf")
 	}
 
-	if p.Count != size {
-		t.Errorf("Incorrect page size: expect %d, get %d", size, p.Count)
+	if p.Count() != size {
+		t.Errorf("Incorrect page size: expect %d, get %d", size, p.Count())
 	}
 
-	for i := 0; i < p.Count; i++ {
+	for i := 0; i < p.Count(); i++ {
 		pk := string(p.GetKeyAt(i))
 		pv := string(p.GetValueAt(i))
 
@@ -81,9 +87,9 @@ func TestNodeRead(t *testing.T) {
 	size := 500
 	kvs, n1 := randomNode(size)
 	p := allocPage(n1.Size())
-	n1.WritePage(p)
+	n1.WritePage(p, nil)
 	n2 := &Node{}
-	n2.ReadPage(p)
+	n2.ReadPage(p, nil)
 
 	if !n2.IsLeaf {
 		t.Errorf("Node should be leaf")
@@ -124,10 +130,122 @@ func TestNodeSearch(t *testing.T) {
 	}
 }
 
+func TestNodeSearchFunc(t *testing.T) {
+	reverse := func(a, b []byte) int {
+		return bytes.Compare(b, a)
+	}
+	n := Node{IsLeaf: true}
+	for i, k := range []string{"c", "b", "a"} {
+		n.InsertKeyValueAt(i, kv.Key(k), kv.Value(k))
+	}
+	if found, i := n.SearchFunc(kv.Key("b"), reverse); !found || i != 1 {
+		t.Errorf("Expect b at 1, get %v %d", found, i)
+	}
+	if found, i := n.SearchFunc(kv.Key("bb"), reverse); found || i != 1 {
+		t.Errorf("Expect bb before 1, get %v %d", found, i)
+	}
+	if i := n.ChildIndexFunc(kv.Key("bb"), reverse); i != 0 {
+		t.Errorf("Expect bb routed to 0, get %d", i)
+	}
+}
+
+func TestNodePrefix(t *testing.T) {
+	n := Node{IsLeaf: true}
+	keys := []string{"/srv/data/a", "/srv/data/b", "/srv/x", "/sr", "zzz"}
+	plain := page.HeaderSize
+	for i, k := range keys {
+		n.InsertKeyValueAt(i, kv.Key(k), kv.Value(k))
+		plain += page.PairInfoSize + 2*len(k)
+	}
+	// "/srv/data/" and "/srv/" are not stored, "/sr" is below minPrefix
+	if saved := plain - n.Size(); saved != 10+5 {
+		t.Errorf("Expect 15 bytes saved by prefixes, get %d", saved)
+	}
+	p := allocPage(n.Size())
+	n.WritePage(p, nil)
+	for i, expect := range []int{0, 10, 5, 0, 0} {
+		if prefix := p.GetPrefixAt(i); prefix != expect {
+			t.Errorf("Expect prefix %d of key %d, get %d", expect, i, prefix)
+		}
+	}
+	n2 := Node{}
+	n2.ReadPage(p, nil)
+	for i, k := range keys {
+		if string(n2.Keys[i]) != k || string(n2.Values[i]) != k {
+			t.Errorf("Expect pair %s, get %s=%s", k, n2.Keys[i], n2.Values[i])
+		}
+	}
+}
+
+func TestNodeMergeRecord(t *testing.T) {
+	n := Node{IsLeaf: true}
+	keys := []string{"/srv/data/a", "/srv/data/b", "/srv/data/c"}
+	for i, k := range keys {
+		n.InsertKeyValueAt(i, kv.Key(k), kv.Value(k))
+	}
+	n.SetMergeAt(1)
+	// Inserting before shifts the flag, setting value clears it
+	n.InsertKeyValueAt(0, kv.Key("/srv/"), kv.Value("x"))
+	n.SetMergeAt(3)
+	n.SetValueAt(3, kv.Value("y"))
+	p := allocPage(n.Size())
+	n.WritePage(p, nil)
+	n2 := Node{}
+	n2.ReadPage(p, nil)
+	lazy := Node{}
+	lazy.ReadPageLazy(p, nil)
+	for i := range n.Keys {
+		if p.IsMergeAt(i) != (i == 2) || n2.MergeAt(i) != (i == 2) || lazy.MergeAt(i) != (i == 2) {
+			t.Errorf("Expect only pair 2 merge record, get %v at %d", n2.MergeAt(i), i)
+		}
+	}
+	if prefix := p.GetPrefixAt(2); prefix != 5 || string(n2.Keys[2]) != keys[1] {
+		t.Errorf("Expect prefix kept with merge flag, get %d %s", prefix, n2.Keys[2])
+	}
+	n2.RemoveKeyValueAt(0)
+	if !n2.MergeAt(1) || n2.MergeAt(0) {
+		t.Errorf("Expect removal shifting merge flag")
+	}
+}
+
+func TestNodeReadLazy(t *testing.T) {
+	size := 100
+	kvs, n1 := randomNode(size)
+	p := allocPage(n1.Size())
+	n1.WritePage(p, nil)
+	n2 := &Node{}
+	n2.ReadPageLazy(p, nil)
+	if !n2.Lazy() || n2.Values != nil || n2.KeyCount() != size {
+		t.Fatalf("Expect lazy node with %d keys and no values", size)
+	}
+	if n2.Size() != n1.Size() {
+		t.Errorf("Expect size %d, get %d", n1.Size(), n2.Size())
+	}
+	for i, key := range n2.Keys {
+		if string(n2.GetValueAt(i)) != kvs[string(key)] {
+			t.Errorf("Value mismatch of %s", key)
+		}
+	}
+
+	// Children are read from page
+	internal := Node{}
+	for i, k := range []string{"a", "b", "c"} {
+		internal.InsertKeyChildAt(i, kv.Key(k), common.Pgid(10+i))
+	}
+	p = allocPage(internal.Size())
+	internal.WritePage(p, nil)
+	lazy := Node{}
+	lazy.ReadPageLazy(p, nil)
+	if lazy.Cids != nil || lazy.GetChildID(2) != 12 || lazy.ChildIndex(kv.Key("bb")) != 1 {
+		t.Error("Expect children read from page")
+	}
+}
+
 func TestNodeSplitTwo(t *testing.T) {
 	_, n1 := randomNode(2)
+	threshold := int(float64(page.PageSize) * DefaultFillPercent)
 
-	if n1.splitTwo() != nil {
+	if n1.splitTwo(threshold) != nil {
 		t.Errorf("Should not split node")
 	}
 
@@ -142,13 +260,13 @@ func TestNodeSplitTwo(t *testing.T) {
 	t.Logf("nodeSize=%d, kvSize=%d", n2.Size(), kvSize)
 	t.Logf("keySize=%d, valueSize=%d", keySize, valueSize)
 
-	n3 := n2.splitTwo()
+	n3 := n2.splitTwo(threshold)
 
 	if n3 == nil {
 		t.Errorf("Should split two")
 	}
 
-	i := (splitThreshold - page.HeaderSize) / (page.PairInfoSize + kvSize)
+	i := (threshold - page.HeaderSize) / (page.PairInfoSize + keySize + valueSize)
 
 	if n2.KeyCount() != i {
 		t.Errorf("Incorrect split point: expect %d, get %d", i, n2.KeyCount())
@@ -158,3 +276,149 @@ func TestNodeSplitTwo(t *testing.T) {
 		t.Errorf("Incorrect new node: expect %d keys, get %d", keyCount-i, n3.KeyCount())
 	}
 }
+
+func TestNodeSplitFill(t *testing.T) {
+	counts := map[float64]int{}
+	for _, fill := range []float64{MinFillPercent, DefaultFillPercent, MaxFillPercent} {
+		nodes := GenNode(256, 16, 48).SplitFill(fill)
+		for i, n := range nodes[:len(nodes)-1] {
+			if n.Size() > int(float64(page.PageSize)*fill) {
+				t.Errorf("fill %v: node %d has %d bytes", fill, i, n.Size())
+			}
+		}
+		counts[fill] = len(nodes)
+	}
+	if counts[MinFillPercent] <= counts[DefaultFillPercent] || counts[DefaultFillPercent] <= counts[MaxFillPercent] {
+		t.Errorf("Expect fewer nodes with higher fill, get %v", counts)
+	}
+}
+
+func TestNodeOverflow(t *testing.T) {
+	n := Node{IsLeaf: true}
+	small := testutil.RandomByteArray(10)
+	large := testutil.RandomByteArray(3*page.PageSize + 100)
+	n.InsertKeyValueAt(0, []byte("a"), small)
+	n.InsertKeyValueAt(1, []byte("b"), large)
+	if n.Size() >= page.PageSize {
+		t.Errorf("Overflow value should not count in node size %d", n.Size())
+	}
+	count := n.OverflowPages()
+	if count != page.OverflowPages(len(large)) {
+		t.Errorf("Expect %d overflow pages, get %d", page.OverflowPages(len(large)), count)
+	}
+
+	// Leaf at page 0, overflow chain at the following pages
+	buf := make([]byte, (count+1)*page.PageSize)
+	get := func(id common.Pgid) *page.Page {
+		return page.FromBuffer(buf, id)
+	}
+	rest := kv.Value(large)
+	for i := 1; i <= count; i++ {
+		next := common.Pgid(i + 1)
+		if i == count {
+			next = 0
+		}
+		rest = get(common.Pgid(i)).WriteOverflow(rest, next)
+	}
+	if len(rest) != 0 {
+		t.Fatalf("%d bytes left after writing overflow pages", len(rest))
+	}
+	n.WritePage(get(0), []Overflow{{}, {Head: 1, Size: len(large)}})
+
+	n2 := Node{}
+	n2.ReadPage(get(0), get)
+	if string(n2.Values[0]) != string(small) || string(n2.Values[1]) != string(large) {
+		t.Error("Values mismatch after reading overflow pages")
+	}
+
+	// Compressed value is decoded on read
+	text := kv.Value(strings.Repeat("mk ", page.PageSize))
+	n.SetValueAt(1, text)
+	encoded := codec.Encode(codec.Flate, text)
+	if rest := get(1).WriteOverflow(encoded, 0); len(rest) != 0 {
+		t.Fatalf("Compressed value takes %d bytes", len(encoded))
+	}
+	n.WritePage(get(0), []Overflow{{}, {Head: 1, Size: len(encoded), Compressed: true}})
+	if !get(0).IsCompressedAt(1) || get(0).GetValueSizeAt(1) != len(encoded) {
+		t.Fatal("Expect compressed value in page")
+	}
+	n3 := Node{}
+	if err := n3.ReadPage(get(0), get); err != nil {
+		t.Fatalf("Failed to read compressed value: %v", err)
+	}
+	if string(n3.Values[1]) != string(text) {
+		t.Error("Values mismatch after reading compressed value")
+	}
+
+	// Lazy node reads overflow pages on demand
+	n4 := Node{}
+	n4.ReadPageLazy(get(0), get)
+	if string(n4.GetValueAt(1)) != string(text) || n4.OverflowPages() != 1 {
+		t.Error("Values mismatch after reading compressed value lazily")
+	}
+
+	// Corrupt compressed value fails to read
+	get(1).OverflowData()[0] = 0xff
+	if err := (&Node{}).ReadPage(get(0), get); !errors.Is(err, codec.ErrCorrupt) {
+		t.Errorf("Expect ErrCorrupt reading corrupt value, get %v", err)
+	}
+	if _, err := n4.ValueAt(1); !errors.Is(err, codec.ErrCorrupt) {
+		t.Errorf("Expect ErrCorrupt reading corrupt value lazily, get %v", err)
+	}
+}
+
+func TestNodeStored(t *testing.T) {
+	large := testutil.RandomByteArray(2*page.PageSize + 100)
+	count := page.OverflowPages(len(large))
+	buf := make([]byte, (count+1)*page.PageSize)
+	get := func(id common.Pgid) *page.Page {
+		return page.FromBuffer(buf, id)
+	}
+	rest := kv.Value(large)
+	for i := 1; i <= count; i++ {
+		next := common.Pgid(i + 1)
+		if i == count {
+			next = 0
+		}
+		rest = get(common.Pgid(i)).WriteOverflow(rest, next)
+	}
+	ov := Overflow{Head: 1, Size: len(large)}
+
+	n := Node{IsLeaf: true, get: get}
+	n.InsertKeyValueAt(0, []byte("a"), []byte("1"))
+	n.InsertKeyValueAt(1, []byte("c"), nil)
+	n.SetStoredAt(1, ov)
+	// Inserting before stored value shifts it
+	n.InsertKeyValueAt(1, []byte("b"), []byte("2"))
+	if n.StoredAt(2) != ov || n.OverflowAt(2) != ov || n.StoredAt(1).Head != 0 {
+		t.Fatalf("Expect value 2 stored, get %v", n.Stored)
+	}
+	if string(n.GetValueAt(2)) != string(large) || n.OverflowPages() != count {
+		t.Error("Stored value mismatch")
+	}
+
+	// Appended pairs keep stored values, pairs after them don't
+	m := Node{IsLeaf: true}
+	m.InsertKeyValueAt(0, []byte("0"), []byte("0"))
+	m.AppendPairs(&n)
+	m.InsertKeyValueAt(4, []byte("d"), []byte("4"))
+	if m.StoredAt(3) != ov || m.StoredAt(4).Head != 0 {
+		t.Errorf("Expect value 3 stored after append, get %v", m.Stored)
+	}
+	m.RemoveKeyValueAt(0)
+	if m.StoredAt(2) != ov {
+		t.Errorf("Expect value 2 stored after remove, get %v", m.Stored)
+	}
+
+	// Stored value links its chain when node is written
+	n.WritePage(get(0), []Overflow{{}, {}, ov})
+	n2 := Node{}
+	n2.ReadPage(get(0), get)
+	if string(n2.Values[2]) != string(large) || len(n2.Stored) != 0 {
+		t.Error("Values mismatch after writing stored value")
+	}
+	n.SetValueAt(2, []byte("3"))
+	if n.StoredAt(2).Head != 0 || string(n.GetValueAt(2)) != "3" {
+		t.Error("Expect stored value replaced")
+	}
+}
@@ -0,0 +1,194 @@
+// Package wal writes and replays the write-ahead log of page images.
+// Each commit appends one record per page, then a commit record holding
+// the checksum of its page records. A commit without a valid commit
+// record is torn, replay stops before it.
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/fnv"
+	"io"
+	"os"
+
+	"github.com/daicang/mk/pkg/common"
+)
+
+const (
+	// record kinds
+	kindPage   uint32 = 1
+	kindCommit uint32 = 2
+
+	// headerSize is size of record header:
+	// kind uint32 | length uint32 | id uint64
+	// id is page id of page record, txid of commit record, length is
+	// size of data following the header.
+	headerSize = 16
+	// sumSize is size of commit record data, the checksum
+	sumSize = 8
+)
+
+// Image is the content of one or more contiguous pages.
+type Image struct {
+	ID   common.Pgid
+	Data []byte
+}
+
+// Log appends commits to a log file.
+type Log struct {
+	f *os.File
+	// size is the end of the last commit
+	size int64
+	// pages is page records appended since the last truncate
+	pages int
+	// buf holds records of the last append, reused by the next one
+	// unless it's larger than maxKeptBuffer
+	buf []byte
+}
+
+// maxKeptBuffer is the largest append buffer kept for reuse.
+const maxKeptBuffer = 4 << 20
+
+// Open opens or creates log file at path. Appends start after
+// existing content, call Truncate after replay to start over.
+func Open(path string) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return &Log{f: f, size: info.Size()}, nil
+}
+
+// putHeader writes record header to buf.
+func putHeader(buf []byte, kind uint32, length int, id uint64) {
+	binary.LittleEndian.PutUint32(buf[0:], kind)
+	binary.LittleEndian.PutUint32(buf[4:], uint32(length))
+	binary.LittleEndian.PutUint64(buf[8:], id)
+}
+
+// Append appends images of one commit, syncs the log when sync is set.
+// A failed append leaves no valid record, the next append overwrites it.
+func (l *Log) Append(txid uint64, images []Image, sync bool) error {
+	size := headerSize + sumSize
+	for _, img := range images {
+		size += headerSize + len(img.Data)
+	}
+	buf := l.buffer(size)
+	off := 0
+	for _, img := range images {
+		putHeader(buf[off:], kindPage, len(img.Data), uint64(img.ID))
+		off += headerSize
+		off += copy(buf[off:], img.Data)
+	}
+	h := fnv.New64a()
+	_, _ = h.Write(buf[:off])
+	putHeader(buf[off:], kindCommit, sumSize, txid)
+	binary.LittleEndian.PutUint64(buf[off+headerSize:], h.Sum64())
+
+	_, err := l.f.WriteAt(buf, l.size)
+	if err != nil {
+		return err
+	}
+	l.size += int64(size)
+	l.pages += len(images)
+	if !sync {
+		return nil
+	}
+	return l.f.Sync()
+}
+
+// buffer returns buffer of size bytes, the kept one when it's large
+// enough. Every byte is written by Append, so it's not cleared.
+func (l *Log) buffer(size int) []byte {
+	if size <= cap(l.buf) {
+		return l.buf[:size]
+	}
+	buf := make([]byte, size)
+	if size <= maxKeptBuffer {
+		l.buf = buf
+	}
+	return buf
+}
+
+// Replay calls fn with images of every complete commit in append order,
+// stops at the first torn commit or error returned by fn.
+func (l *Log) Replay(fn func(txid uint64, images []Image) error) error {
+	r := bufio.NewReader(io.NewSectionReader(l.f, 0, l.size))
+	left := l.size
+	header := make([]byte, headerSize)
+	images := []Image{}
+	h := fnv.New64a()
+	for {
+		_, err := io.ReadFull(r, header)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		left -= headerSize
+		kind := binary.LittleEndian.Uint32(header[0:])
+		length := int64(binary.LittleEndian.Uint32(header[4:]))
+		id := binary.LittleEndian.Uint64(header[8:])
+		if length > left {
+			// Torn or garbage length
+			return nil
+		}
+		data := make([]byte, length)
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			return err
+		}
+		left -= length
+
+		switch kind {
+		case kindPage:
+			_, _ = h.Write(header)
+			_, _ = h.Write(data)
+			images = append(images, Image{ID: common.Pgid(id), Data: data})
+		case kindCommit:
+			if length != sumSize || binary.LittleEndian.Uint64(data) != h.Sum64() {
+				return nil
+			}
+			err = fn(id, images)
+			if err != nil {
+				return err
+			}
+			images = []Image{}
+			h.Reset()
+		default:
+			return nil
+		}
+	}
+}
+
+// Truncate empties the log.
+func (l *Log) Truncate() error {
+	err := l.f.Truncate(0)
+	if err != nil {
+		return err
+	}
+	l.size = 0
+	l.pages = 0
+	return nil
+}
+
+// Size returns log size in bytes.
+func (l *Log) Size() int64 {
+	return l.size
+}
+
+// Pages returns number of page records appended since the last truncate.
+func (l *Log) Pages() int {
+	return l.pages
+}
+
+// Close closes log file.
+func (l *Log) Close() error {
+	return l.f.Close()
+}
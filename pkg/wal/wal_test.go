@@ -0,0 +1,118 @@
+package wal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/daicang/mk/pkg/common"
+)
+
+// replay returns txids and images of complete commits in log.
+func replay(t *testing.T, l *Log) ([]uint64, [][]Image) {
+	t.Helper()
+	txids := []uint64{}
+	commits := [][]Image{}
+	err := l.Replay(func(txid uint64, images []Image) error {
+		txids = append(txids, txid)
+		commits = append(commits, images)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to replay: %v", err)
+	}
+	return txids, commits
+}
+
+func TestLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data-wal")
+	l, err := Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	first := []Image{
+		{ID: 3, Data: bytes.Repeat([]byte{1}, 100)},
+		{ID: 7, Data: bytes.Repeat([]byte{2}, 200)},
+	}
+	second := []Image{{ID: 3, Data: bytes.Repeat([]byte{3}, 100)}}
+	if err := l.Append(5, first, true); err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+	if err := l.Append(6, second, false); err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+	if l.Pages() != 3 {
+		t.Errorf("Expect 3 pages, get %d", l.Pages())
+	}
+	size := l.Size()
+	if err := l.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+
+	// Commits are replayed after reopen
+	l, err = Open(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen: %v", err)
+	}
+	txids, commits := replay(t, l)
+	if !reflect.DeepEqual(txids, []uint64{5, 6}) || !reflect.DeepEqual(commits, [][]Image{first, second}) {
+		t.Errorf("Replay returns %v", txids)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+
+	// Torn and corrupted commits are dropped
+	for name, damage := range map[string]func(f *os.File) error{
+		"torn": func(f *os.File) error {
+			return f.Truncate(size - 1)
+		},
+		"corrupted": func(f *os.File) error {
+			_, err := f.WriteAt([]byte{9}, size-headerSize-sumSize-1)
+			return err
+		},
+	} {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		damaged := filepath.Join(t.TempDir(), "damaged-wal")
+		if err := ioutil.WriteFile(damaged, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		l, err := Open(damaged)
+		if err != nil {
+			t.Fatalf("Failed to open: %v", err)
+		}
+		if err := damage(l.f); err != nil {
+			t.Fatal(err)
+		}
+		info, _ := l.f.Stat()
+		l.size = info.Size()
+		txids, _ := replay(t, l)
+		if !reflect.DeepEqual(txids, []uint64{5}) {
+			t.Errorf("%s: replay returns %v", name, txids)
+		}
+
+		// Appends after truncate start from an empty log
+		if err := l.Truncate(); err != nil {
+			t.Fatalf("Failed to truncate: %v", err)
+		}
+		if l.Size() != 0 || l.Pages() != 0 {
+			t.Errorf("Expect empty log, get size %d, %d pages", l.Size(), l.Pages())
+		}
+		if err := l.Append(7, []Image{{ID: common.Pgid(2), Data: []byte{1}}}, true); err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+		txids, _ = replay(t, l)
+		if !reflect.DeepEqual(txids, []uint64{7}) {
+			t.Errorf("%s: replay after truncate returns %v", name, txids)
+		}
+		if err := l.Close(); err != nil {
+			t.Fatalf("Failed to close: %v", err)
+		}
+	}
+}